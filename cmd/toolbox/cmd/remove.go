@@ -0,0 +1,44 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var cmdRemove = &cobra.Command{
+	Use:   "remove",
+	Run:   removeRun,
+	Short: "remove the provided files or directories and all their contents",
+}
+
+func init() {
+	CmdToolbox.AddCommand(cmdRemove)
+}
+
+func removeRun(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatalf("no path specified")
+	}
+
+	for _, p := range args {
+		if err := os.RemoveAll(p); err != nil {
+			log.Fatalf("failed to remove %q: %v", p, err)
+		}
+	}
+}
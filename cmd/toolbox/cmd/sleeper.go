@@ -50,10 +50,32 @@ func childsReaper() {
 	}
 }
 
+// terminate forwards the SIGTERM to all the other container processes, like
+// the ones executing the steps, so they can clean up before the grace period
+// expires and they're killed. It returns when no other process is left.
+func terminate() {
+	// as pid 1 of the container pid namespace, pid -1 selects all the other
+	// processes of the namespace
+	_ = syscall.Kill(-1, syscall.SIGTERM)
+	for {
+		if err := syscall.Kill(-1, 0); err == syscall.ESRCH {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
 func sleeperRun(cmd *cobra.Command, args []string) {
 	go childsReaper()
 
-	time.Sleep(100 * time.Hour)
-	//c := make(chan struct{})
-	//<-c
+	// as pid 1 the sleeper doesn't get the default signals handlers, the
+	// SIGTERM is ignored if not handled
+	var sigs = make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+
+	select {
+	case <-sigs:
+		terminate()
+	case <-time.After(100 * time.Hour):
+	}
 }
@@ -0,0 +1,124 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+// rlimitResources are the linux resource numbers of the ulimits. They aren't
+// all defined by the syscall package
+var rlimitResources = map[string]int{
+	"cpu":        0,
+	"fsize":      1,
+	"data":       2,
+	"stack":      3,
+	"core":       4,
+	"rss":        5,
+	"nproc":      6,
+	"nofile":     7,
+	"memlock":    8,
+	"as":         9,
+	"locks":      10,
+	"sigpending": 11,
+	"msgqueue":   12,
+	"nice":       13,
+	"rtprio":     14,
+	"rttime":     15,
+}
+
+const rlimInfinity = ^uint64(0)
+
+var cmdUlimit = &cobra.Command{
+	Use:   "ulimit",
+	Run:   ulimitRun,
+	Short: "sets the provided resource limits and then executes the provided command",
+}
+
+type ulimitOptions struct {
+	limits []string
+}
+
+var ulimitOpts ulimitOptions
+
+func init() {
+	flags := cmdUlimit.PersistentFlags()
+
+	flags.StringArrayVarP(&ulimitOpts.limits, "limit", "l", nil, "resource limit in the name=soft:hard format, -1 means unlimited")
+
+	CmdToolbox.AddCommand(cmdUlimit)
+}
+
+func parseRlimitValue(s string) (uint64, error) {
+	if s == "-1" {
+		return rlimInfinity, nil
+	}
+	return strconv.ParseUint(s, 10, 64)
+}
+
+func parseRlimit(s string) (int, *syscall.Rlimit, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return 0, nil, fmt.Errorf("invalid limit %q", s)
+	}
+	resource, ok := rlimitResources[parts[0]]
+	if !ok {
+		return 0, nil, fmt.Errorf("unknown limit %q", parts[0])
+	}
+	values := strings.SplitN(parts[1], ":", 2)
+	if len(values) != 2 {
+		return 0, nil, fmt.Errorf("invalid limit %q", s)
+	}
+	soft, err := parseRlimitValue(values[0])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid limit %q soft value: %v", s, err)
+	}
+	hard, err := parseRlimitValue(values[1])
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid limit %q hard value: %v", s, err)
+	}
+	return resource, &syscall.Rlimit{Cur: soft, Max: hard}, nil
+}
+
+func ulimitRun(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		log.Fatalf("no command provided")
+	}
+	for _, l := range ulimitOpts.limits {
+		resource, rlimit, err := parseRlimit(l)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		if err := syscall.Setrlimit(resource, rlimit); err != nil {
+			log.Fatalf("failed to set limit %q: %v", l, err)
+		}
+	}
+
+	p, err := exec.LookPath(args[0])
+	if err != nil {
+		log.Fatalf("failed to find executable %q: %v", args[0], err)
+	}
+	if err := syscall.Exec(p, args, os.Environ()); err != nil {
+		log.Fatalf("failed to exec: %v", err)
+	}
+}
@@ -313,6 +313,19 @@ func getRunConfigTaskByName(rcts map[string]*rstypes.RunConfigTask, name string)
 }
 
 func CheckRunConfigTasks(rcts map[string]*rstypes.RunConfigTask) error {
+	// check that the dependencies reference existing tasks
+	derrs := &util.Errors{}
+	for _, t := range rcts {
+		for depTaskID := range t.Depends {
+			if _, ok := rcts[depTaskID]; !ok {
+				derrs.Append(errors.Errorf("task %q depends on unknown task id %q", t.Name, depTaskID))
+			}
+		}
+	}
+	if derrs.IsErr() {
+		return derrs
+	}
+
 	// check circular dependencies
 	cerrs := &util.Errors{}
 	for _, t := range rcts {
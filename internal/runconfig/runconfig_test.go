@@ -648,6 +648,70 @@ func TestCheckRunConfig(t *testing.T) {
 			},
 			err: errors.Errorf("task %q and its parent %q have both a dependency on task %q", "task4", "task3", "task1"),
 		},
+		{
+			name: "Test task depending on itself: a -> a",
+			in: []task{
+				{
+					ID:    "1",
+					Level: -1,
+					Depends: map[string]*rstypes.RunConfigTaskDepend{
+						"1": &rstypes.RunConfigTaskDepend{TaskID: "1"},
+					},
+				},
+			},
+			err: &util.Errors{
+				Errs: []error{
+					errors.Errorf("circular dependency between task %q and tasks %q", "task1", "task1"),
+				},
+			},
+		},
+		{
+			name: "Test dependency on unknown task",
+			in: []task{
+				{
+					ID:    "1",
+					Level: -1,
+				},
+				{
+					ID:    "2",
+					Level: -1,
+					Depends: map[string]*rstypes.RunConfigTaskDepend{
+						"1": &rstypes.RunConfigTaskDepend{TaskID: "1"},
+						"3": &rstypes.RunConfigTaskDepend{TaskID: "3"},
+					},
+				},
+			},
+			err: &util.Errors{
+				Errs: []error{
+					errors.Errorf("task %q depends on unknown task id %q", "task2", "3"),
+				},
+			},
+		},
+		{
+			name: "Test dependency on unknown task in a circular dependency",
+			in: []task{
+				{
+					ID:    "1",
+					Level: -1,
+					Depends: map[string]*rstypes.RunConfigTaskDepend{
+						"2": &rstypes.RunConfigTaskDepend{TaskID: "2"},
+					},
+				},
+				{
+					ID:    "2",
+					Level: -1,
+					Depends: map[string]*rstypes.RunConfigTaskDepend{
+						"1": &rstypes.RunConfigTaskDepend{TaskID: "1"},
+						"4": &rstypes.RunConfigTaskDepend{TaskID: "4"},
+					},
+				},
+			},
+			err: &util.Errors{
+				Errs: []error{
+					errors.Errorf("task %q depends on unknown task id %q", "task2", "4"),
+				},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -16,6 +16,11 @@ package config
 
 import (
 	"io/ioutil"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"agola.io/agola/internal/util"
@@ -114,6 +119,405 @@ type Executor struct {
 	ActiveTasksLimit int `yaml:"active_tasks_limit"`
 
 	AllowPrivilegedContainers bool `yaml:"allowPrivilegedContainers"`
+
+	// AllowedNetworkModes are the task network modes (none, bridge, host or
+	// custom network names) allowed on this executor. If empty only the none
+	// and bridge modes are allowed
+	AllowedNetworkModes []string `yaml:"allowedNetworkModes"`
+
+	// AllowedImageRegistries are the registries the task containers images
+	// can be pulled from. An entry without a "/" matches the image registry
+	// and can contain "*" wildcards (i.e. "*.example.com"), an entry with a
+	// "/" also matches the repository prefix (i.e. "docker.io/library" or
+	// "registry.example.com/team-*"). If empty all the registries are allowed
+	AllowedImageRegistries []string `yaml:"allowedImageRegistries"`
+
+	// RequireImageTag rejects the submitted tasks with containers images
+	// without a tag or digest. When false the latest tag is used
+	RequireImageTag bool `yaml:"requireImageTag"`
+
+	// AdminToken is the token required to access the executor admin api. If
+	// empty the admin api is disabled
+	AdminToken string `yaml:"adminToken"`
+
+	// PprofListenAddress is the listen address of the admin http server
+	// exposing the pprof profiling endpoints. The endpoints require the admin
+	// token. If empty the pprof endpoints are disabled
+	PprofListenAddress string `yaml:"pprofListenAddress"`
+
+	// LogFollowMaxDuration is the max duration of a log follow request. When
+	// reached the client is told to reconnect from the current log offset. 0
+	// means no limit
+	LogFollowMaxDuration time.Duration `yaml:"logFollowMaxDuration"`
+
+	// StepStatsInterval is the sampling interval of the step container stats
+	// stream. Defaults to 2 seconds
+	StepStatsInterval time.Duration `yaml:"stepStatsInterval"`
+	// TaskResourcesInterval is the sampling interval of the step containers
+	// stats aggregated in the task resources usage summary. Defaults to 10
+	// seconds
+	TaskResourcesInterval time.Duration `yaml:"taskResourcesInterval"`
+
+	// HTTPTimeouts are the executor http api server timeouts
+	HTTPTimeouts ExecutorHTTPTimeouts `yaml:"httpTimeouts"`
+	// DisableHTTP2 disables serving the http api also with cleartext HTTP/2
+	// (h2c). With HTTP/2 the clients can multiplex the concurrent log streams
+	// of a task over a single connection
+	DisableHTTP2 bool `yaml:"disableHTTP2"`
+
+	// Proxy defines the proxy environment variables injected in the task steps
+	Proxy ExecutorProxy `yaml:"proxy"`
+
+	// MaxLogLineLength is the max length of a log line. Longer lines are split
+	// when captured and when sent as log events
+	MaxLogLineLength int `yaml:"maxLogLineLength"`
+	// MaxLogLinesPerSecond is the max number of lines per second captured in
+	// a log. Exceeding lines are dropped and a notice with the number of
+	// dropped lines is written in the log. 0 means no limit
+	MaxLogLinesPerSecond int `yaml:"maxLogLinesPerSecond"`
+
+	// FileMode is the mode, in octal notation (i.e. "0600"), of the created log
+	// and archive files. It's applied regardless of the process umask. Defaults
+	// to "0660"
+	FileMode string `yaml:"fileMode"`
+	// FileOwner is the optional owner, in the "uid:gid" format, of the created
+	// log and archive files
+	FileOwner string `yaml:"fileOwner"`
+
+	// TaskHistorySize is the max number of finished tasks kept in the executor
+	// task history
+	TaskHistorySize int `yaml:"taskHistorySize"`
+	// TaskHistoryPersist saves the task history in the data dir so it's kept
+	// across restarts
+	TaskHistoryPersist bool `yaml:"taskHistoryPersist"`
+
+	// MaxArchiveSize is the max size in bytes of a step archive (workspace or
+	// cache). A step producing a bigger archive fails. 0 means no limit
+	MaxArchiveSize int64 `yaml:"maxArchiveSize"`
+	// MaxTaskArchives is the max number of step archives stored for a task.
+	// The least recently used archives are removed. Only the archives of the
+	// tasks already fetched by the runservice and kept by the task data
+	// retention are removed. 0 means no limit
+	MaxTaskArchives int `yaml:"maxTaskArchives"`
+	// MaxArchives is the max number of step archives stored by the executor
+	// for all the tasks. Like for MaxTaskArchives, only the archives of the
+	// fetched tasks are removed. 0 means no limit
+	MaxArchives int `yaml:"maxArchives"`
+	// TaskDiskQuota is the max size in bytes of the logs and step archives
+	// (workspace and cache) written by a task, including the logs of its
+	// previous attempts. When exceeded the current step and the task fail. 0
+	// means no limit
+	TaskDiskQuota int64 `yaml:"taskDiskQuota"`
+
+	// MaxStreamFiles is the max number of log and archive files kept open by
+	// the log follow and archive download requests. When reached the new
+	// follow and download requests are rejected with a 503 while the current
+	// ones continue. It should be kept well below the process open files
+	// limit. 0 means no limit
+	MaxStreamFiles int `yaml:"maxStreamFiles"`
+	// MaxArchiveDownloads is the max number of concurrent archive downloads,
+	// new downloads are rejected with a 503 so bulk archive fetches won't
+	// starve the running tasks of disk and network bandwidth. 0 means no
+	// limit
+	MaxArchiveDownloads int `yaml:"maxArchiveDownloads"`
+	// MaxLogFollows is the max number of concurrent log follow requests, new
+	// follow requests are rejected with a 503. 0 means no limit
+	MaxLogFollows int `yaml:"maxLogFollows"`
+	// MaxLogFollowMemory is the max memory in bytes used by the buffers of the
+	// concurrent log follow requests. When reached the least recently active
+	// follow requests idle for a while are closed, telling the clients to
+	// reconnect, or the new follow requests are rejected with a 503. 0 means
+	// no limit
+	MaxLogFollowMemory int64 `yaml:"maxLogFollowMemory"`
+	// ArchiveReadBufferSize is the size in bytes of the buffer used to read
+	// the archives when serving them. Larger buffers use less syscalls on
+	// large archives. Defaults to 256KiB
+	ArchiveReadBufferSize int `yaml:"archiveReadBufferSize"`
+	// MaxConcurrentArchiveWrites is the max number of step archives written
+	// at the same time, the other archives wait. Defaults to 4
+	MaxConcurrentArchiveWrites int `yaml:"maxConcurrentArchiveWrites"`
+
+	// CABundle is the path of a PEM file with the CA certificates injected in
+	// the task containers. Since the tools honoring the related environment
+	// variables will trust only these CAs it should also contain the public
+	// CAs if needed
+	CABundle string `yaml:"caBundle"`
+
+	// StepScratch, when defined, provides every run step an empty scratch dir
+	// removed when the step finishes. Its path is in the AGOLA_SCRATCH_DIR
+	// environment variable. It can be "disk" (a dir in the main container
+	// filesystem) or "tmpfs" (a dir in a tmpfs mounted in the main container)
+	StepScratch string `yaml:"stepScratch"`
+	// StepScratchSize is the size in bytes of the steps scratch tmpfs. 0 means
+	// the driver default
+	StepScratchSize int64 `yaml:"stepScratchSize"`
+
+	// StepInterpolationUndefined defines how the references to undefined
+	// variables in the commands of the run steps enabling interpolation are
+	// handled: "empty" (the default) replaces them with an empty string,
+	// "error" fails the step
+	StepInterpolationUndefined string `yaml:"stepInterpolationUndefined"`
+
+	// PostTaskHook is the command, with its arguments, executed on the executor
+	// host after every task finished, also when stopped or timed out. The task
+	// result is provided as json on its stdin and in the AGOLA_TASK_*
+	// environment variables. Its failures don't change the task result
+	PostTaskHook []string `yaml:"postTaskHook"`
+	// PostTaskHookTimeout is the max duration of the post task hook. Defaults
+	// to 1 minute
+	PostTaskHookTimeout time.Duration `yaml:"postTaskHookTimeout"`
+
+	// StopGracePeriod is the time given to the task processes to exit, after
+	// the SIGTERM, when a task is stopped or timed out before they're killed.
+	// Tasks can override it. Defaults to 1 second
+	StopGracePeriod time.Duration `yaml:"stopGracePeriod"`
+
+	// PrewarmImages are the images pulled, in background, at executor startup
+	// so the first tasks using them won't wait for their pull. Only the docker
+	// driver supports prewarming images
+	PrewarmImages []string `yaml:"prewarmImages"`
+
+	// OrphanedPods defines how the pods left by a previous executor
+	// incarnation, or by executors not active anymore, are handled at
+	// startup. With "remove" (the default) they are removed before starting
+	// new tasks, with "background" new tasks are started while they're
+	// removed by the periodic pods cleaner. The tasks of these pods cannot be
+	// resumed and are marked as failed.
+	OrphanedPods string `yaml:"orphanedPods"`
+
+	// LogForward, when enabled, also sends the captured steps output lines to
+	// syslog. The lines are still saved in the local logs
+	LogForward ExecutorLogForward `yaml:"logForward"`
+
+	// AdmissionWebhook, when its url is defined, is called for every
+	// submitted task to accept or reject it
+	AdmissionWebhook ExecutorAdmissionWebhook `yaml:"admissionWebhook"`
+
+	// ContainerLogs defines how the output of the task service containers is
+	// handled. The run steps are executed in the main container and their
+	// output, not seen by the platform logging, is always captured
+	ContainerLogs ExecutorContainerLogs `yaml:"containerLogs"`
+
+	// LogDiff configures the diff of a step log between two task attempts
+	LogDiff ExecutorLogDiff `yaml:"logDiff"`
+
+	// PathLayout configures where the task logs and archives are saved inside
+	// the task directory
+	PathLayout ExecutorPathLayout `yaml:"pathLayout"`
+
+	// TaskDataRetention defines which finished tasks keep their logs and
+	// archives after the runservice fetched them and forgot the task. With
+	// "all" (the default) the data of every task is removed when the
+	// runservice forgets it, with "failed" the data of the not successful
+	// tasks is kept for FailedTaskDataTTL
+	TaskDataRetention string `yaml:"taskDataRetention"`
+	// FailedTaskDataTTL is, with the "failed" task data retention, how long
+	// the logs and archives of a not successful task are kept after the
+	// runservice forgot it. Defaults to 24 hours
+	FailedTaskDataTTL time.Duration `yaml:"failedTaskDataTTL"`
+
+	// MaxStepUlimits are the max values, by ulimit name (like "nofile" or
+	// "nproc"), of the run steps ulimits soft and hard limits. -1 means
+	// unlimited. Only the ulimits defined here can be set by the run steps,
+	// the tasks exceeding them are rejected
+	MaxStepUlimits map[string]int64 `yaml:"maxStepUlimits"`
+
+	// Gzip configures the compression level of the gzipped archives and task
+	// bundles and the compression of the JSON API responses
+	Gzip ExecutorGzip `yaml:"gzip"`
+
+	// LogSyncInterval is the max interval between the syncs to disk of a
+	// step log being written. After every sync the synced log offset is
+	// recorded as the log durable offset, so an executor host crash loses
+	// only the log content written after it. Shorter intervals lose less
+	// content but sync more often. Defaults to 1 second
+	LogSyncInterval time.Duration `yaml:"logSyncInterval"`
+	// DisableLogSync disables the periodic step logs syncs, the logs are
+	// synced to disk only by the operating system
+	DisableLogSync bool `yaml:"disableLogSync"`
+
+	// ArchiveVolume configures how the failures writing the step archives are
+	// handled
+	ArchiveVolume ExecutorArchiveVolume `yaml:"archiveVolume"`
+}
+
+// Executor step scratch types
+const (
+	StepScratchDisk  = "disk"
+	StepScratchTmpfs = "tmpfs"
+)
+
+// Executor step interpolation undefined variables policies
+const (
+	StepInterpolationUndefinedEmpty = "empty"
+	StepInterpolationUndefinedError = "error"
+)
+
+// Executor orphaned pods handling at startup
+const (
+	OrphanedPodsRemove     = "remove"
+	OrphanedPodsBackground = "background"
+)
+
+// Executor service containers logs modes
+const (
+	ContainerLogsCapture  = "capture"
+	ContainerLogsPlatform = "platform"
+)
+
+// Executor admission webhook failure policies
+const (
+	AdmissionWebhookFailClosed = "closed"
+	AdmissionWebhookFailOpen   = "open"
+)
+
+// Executor task data retention policies
+const (
+	TaskDataRetentionAll    = "all"
+	TaskDataRetentionFailed = "failed"
+)
+
+type ExecutorAdmissionWebhook struct {
+	// URL is the webhook url. The task, with its secrets redacted, is posted
+	// to it and the webhook replies if the task is allowed
+	URL string `yaml:"url"`
+	// Timeout is the max duration of a webhook call. Defaults to 10s
+	Timeout time.Duration `yaml:"timeout"`
+	// FailurePolicy defines what happens when the webhook fails or times
+	// out: "closed" (the default) rejects the task, "open" accepts it
+	FailurePolicy string `yaml:"failurePolicy"`
+}
+
+type ExecutorContainerLogs struct {
+	// Mode is "capture" (the default) to save the service containers output
+	// in the executor logs or "platform" to leave it to the platform logging.
+	// With "platform" the service logs are read back from the platform while
+	// the task pod exists
+	Mode string `yaml:"mode"`
+	// Driver is the docker log driver (i.e. "json-file", "journald" or
+	// "fluentd") of the task containers. If empty the docker daemon default is
+	// used. The platform mode requires a driver the docker daemon can read
+	// back. Only the docker driver supports it
+	Driver string `yaml:"driver"`
+	// DriverOptions are the docker log driver options
+	DriverOptions map[string]string `yaml:"driverOptions"`
+}
+
+type ExecutorGzip struct {
+	// Level is the gzip compression level, from 1 (best speed) to 9 (best
+	// compression). 0 means the gzip default level
+	Level int `yaml:"level"`
+	// Adaptive picks the level, between MinLevel and MaxLevel, from the
+	// executor host cpu utilization: the busier the host the lower the level.
+	// Level is ignored
+	Adaptive bool `yaml:"adaptive"`
+	// MinLevel is the adaptive level used when the host cpu is fully used.
+	// Defaults to 1
+	MinLevel int `yaml:"minLevel"`
+	// MaxLevel is the adaptive level used when the host cpu is idle. Defaults
+	// to 9
+	MaxLevel int `yaml:"maxLevel"`
+
+	// DisableJSONResponses disables the compression of the JSON API
+	// responses, like the status and the task history, requested with an
+	// Accept-Encoding header accepting gzip
+	DisableJSONResponses bool `yaml:"disableJSONResponses"`
+	// MinResponseSize is the min size in bytes of a compressed JSON API
+	// response, smaller responses aren't compressed. Defaults to 1024
+	MinResponseSize int `yaml:"minResponseSize"`
+}
+
+// ExecutorArchiveVolume configures the detection of a not writable archive
+// volume, like a volume remounted read-only because of a degraded storage. A
+// read-only volume is detected at the first failed write, the other write
+// failures are considered transient until they happen MaxTransientFailures
+// consecutive times.
+type ExecutorArchiveVolume struct {
+	// FailReadiness fails the executor readiness while the archive volume
+	// isn't writable so no tasks are scheduled on this executor
+	FailReadiness bool `yaml:"failReadiness"`
+	// MaxTransientFailures is the number of consecutive transient write
+	// failures after which the archive volume is considered not writable.
+	// Defaults to 3
+	MaxTransientFailures int `yaml:"maxTransientFailures"`
+	// CheckInterval is how often a not writable archive volume is checked to
+	// detect when it's writable again. Defaults to 30 seconds
+	CheckInterval time.Duration `yaml:"checkInterval"`
+}
+
+type ExecutorLogDiff struct {
+	// Rules are applied, in order, to every log line before comparing the
+	// lines, to replace their volatile parts. They're applied after the
+	// default rules replacing timestamps, durations, uuids and hex digests
+	Rules []ExecutorLogDiffRule `yaml:"rules"`
+	// DisableDefaultRules doesn't apply the default rules
+	DisableDefaultRules bool `yaml:"disableDefaultRules"`
+	// MaxLines is the max number of lines of a diffed log. Defaults to 100000
+	MaxLines int `yaml:"maxLines"`
+}
+
+// ExecutorPathLayout are the path templates, relative to the task directory
+// "<dataDir>/tasks/<taskid>", of the task logs and archives. They're validated
+// at startup: they must be clean relative paths and every log and archive must
+// get a distinct path.
+type ExecutorPathLayout struct {
+	// Log is the path template of the task logs. The placeholders are
+	// {taskid}, {attempt} and {stream}, the log stream: "setup",
+	// "steps/<step>", "steps/<step>/substeps/<substep>" or
+	// "services/<index>". It must contain {attempt} and {stream} and end with
+	// ".log". Defaults to "attempts/{attempt}/logs/{stream}.log"
+	Log string `yaml:"log"`
+	// Archive is the path template of the step archives. The placeholders are
+	// {taskid} and {step}. It must contain {step} and end with ".tar".
+	// Defaults to "archives/{step}.tar"
+	Archive string `yaml:"archive"`
+}
+
+type ExecutorLogDiffRule struct {
+	// Regex is the regular expression matching the volatile text
+	Regex string `yaml:"regex"`
+	// Replacement replaces the matched text, it can reference the regex
+	// groups like $1
+	Replacement string `yaml:"replacement"`
+}
+
+type ExecutorLogForward struct {
+	Enabled bool `yaml:"enabled"`
+	// Network is the syslog server network: "udp", "tcp", "unix" or
+	// "unixgram". If empty, together with the address, the local syslog
+	// daemon is used. On systemd hosts it's usually the journal
+	Network string `yaml:"network"`
+	// Address is the syslog server address
+	Address string `yaml:"address"`
+	// Tag is the syslog messages tag. Defaults to "agola-executor"
+	Tag string `yaml:"tag"`
+}
+
+type ExecutorHTTPTimeouts struct {
+	// ReadHeader is the max duration to read a request headers. Defaults to 10
+	// seconds
+	ReadHeader time.Duration `yaml:"readHeader"`
+	// Read is the max duration to read a whole request. 0 means no limit
+	Read time.Duration `yaml:"read"`
+	// Write is the max duration of the requests not streaming data. The logs,
+	// archives, events and status stream requests aren't limited since they
+	// can legitimately last long. 0 means no limit
+	Write time.Duration `yaml:"write"`
+	// Idle is the max duration a keep-alive connection waits for the next
+	// request. Defaults to 2 minutes
+	Idle time.Duration `yaml:"idle"`
+}
+
+type ExecutorProxy struct {
+	HTTPProxy  string `yaml:"httpProxy"`
+	HTTPSProxy string `yaml:"httpsProxy"`
+	// NoProxy is a comma separated list of hosts that shouldn't use the proxy.
+	// If empty it defaults to the local addresses and the runservice host
+	NoProxy string `yaml:"noProxy"`
+
+	// InheritEnv, when true, uses the executor own proxy environment variables
+	// for the values not defined in the config
+	InheritEnv bool `yaml:"inheritEnv"`
 }
 
 type Configstore struct {
@@ -229,6 +633,9 @@ var defaultConfig = Config{
 	},
 	Executor: Executor{
 		ActiveTasksLimit: 2,
+		MaxLogLineLength: 1024 * 1024,
+		FileMode:         "0660",
+		TaskHistorySize:  100,
 	},
 }
 
@@ -331,6 +738,181 @@ func Validate(c *Config, componentsNames []string) error {
 		default:
 			return errors.Errorf("executor driver type %q unknown", c.Executor.Driver.Type)
 		}
+		if c.Executor.PprofListenAddress != "" {
+			if c.Executor.AdminToken == "" {
+				return errors.Errorf("executor pprofListenAddress requires an adminToken")
+			}
+			if c.Executor.PprofListenAddress == c.Executor.Web.ListenAddress {
+				return errors.Errorf("executor pprofListenAddress must be different from the web listenAddress")
+			}
+		}
+		if c.Executor.HTTPTimeouts.ReadHeader < 0 || c.Executor.HTTPTimeouts.Read < 0 || c.Executor.HTTPTimeouts.Write < 0 || c.Executor.HTTPTimeouts.Idle < 0 {
+			return errors.Errorf("executor httpTimeouts must be positive")
+		}
+		if c.Executor.StepStatsInterval < 0 {
+			return errors.Errorf("executor stepStatsInterval must be positive")
+		}
+		if c.Executor.TaskResourcesInterval < 0 {
+			return errors.Errorf("executor taskResourcesInterval must be positive")
+		}
+		if c.Executor.LogFollowMaxDuration < 0 {
+			return errors.Errorf("executor logFollowMaxDuration must be positive")
+		}
+		if c.Executor.TaskHistorySize < 0 {
+			return errors.Errorf("executor taskHistorySize must be positive")
+		}
+		if c.Executor.MaxArchiveSize < 0 {
+			return errors.Errorf("executor maxArchiveSize must be positive")
+		}
+		switch c.Executor.StepScratch {
+		case "", StepScratchDisk, StepScratchTmpfs:
+		default:
+			return errors.Errorf("executor stepScratch must be %q or %q", StepScratchDisk, StepScratchTmpfs)
+		}
+		if c.Executor.StepScratchSize < 0 {
+			return errors.Errorf("executor stepScratchSize must be positive")
+		}
+		if c.Executor.PostTaskHookTimeout < 0 {
+			return errors.Errorf("executor postTaskHookTimeout must be positive")
+		}
+		if c.Executor.StopGracePeriod < 0 {
+			return errors.Errorf("executor stopGracePeriod must be positive")
+		}
+		switch c.Executor.StepInterpolationUndefined {
+		case "", StepInterpolationUndefinedEmpty, StepInterpolationUndefinedError:
+		default:
+			return errors.Errorf("executor stepInterpolationUndefined must be %q or %q", StepInterpolationUndefinedEmpty, StepInterpolationUndefinedError)
+		}
+		switch c.Executor.OrphanedPods {
+		case "", OrphanedPodsRemove, OrphanedPodsBackground:
+		default:
+			return errors.Errorf("executor orphanedPods must be %q or %q", OrphanedPodsRemove, OrphanedPodsBackground)
+		}
+		if aw := c.Executor.AdmissionWebhook; aw.URL != "" {
+			if u, err := url.Parse(aw.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return errors.Errorf("executor admissionWebhook url %q is invalid", aw.URL)
+			}
+			if aw.Timeout < 0 {
+				return errors.Errorf("executor admissionWebhook timeout must be positive")
+			}
+			switch aw.FailurePolicy {
+			case "", AdmissionWebhookFailClosed, AdmissionWebhookFailOpen:
+			default:
+				return errors.Errorf("executor admissionWebhook failurePolicy must be %q or %q", AdmissionWebhookFailClosed, AdmissionWebhookFailOpen)
+			}
+		}
+		switch c.Executor.ContainerLogs.Mode {
+		case "", ContainerLogsCapture, ContainerLogsPlatform:
+		default:
+			return errors.Errorf("executor containerLogs mode must be %q or %q", ContainerLogsCapture, ContainerLogsPlatform)
+		}
+		if c.Executor.ContainerLogs.Driver != "" && c.Executor.Driver.Type != DriverTypeDocker {
+			return errors.Errorf("executor containerLogs driver is supported only by the %q driver", DriverTypeDocker)
+		}
+		if c.Executor.ContainerLogs.Driver == "" && len(c.Executor.ContainerLogs.DriverOptions) > 0 {
+			return errors.Errorf("executor containerLogs driverOptions require a driver")
+		}
+		for i, r := range c.Executor.LogDiff.Rules {
+			re, err := regexp.Compile(r.Regex)
+			if err != nil {
+				return errors.Errorf("executor logDiff rule %d regex is not valid: %w", i, err)
+			}
+			if re.MatchString("") {
+				return errors.Errorf("executor logDiff rule %d regex %q matches the empty string", i, r.Regex)
+			}
+		}
+		if c.Executor.LogDiff.MaxLines < 0 {
+			return errors.Errorf("executor logDiff maxLines must be positive")
+		}
+		switch c.Executor.TaskDataRetention {
+		case "", TaskDataRetentionAll, TaskDataRetentionFailed:
+		default:
+			return errors.Errorf("executor taskDataRetention must be %q or %q", TaskDataRetentionAll, TaskDataRetentionFailed)
+		}
+		if c.Executor.FailedTaskDataTTL < 0 {
+			return errors.Errorf("executor failedTaskDataTTL must be positive")
+		}
+		for _, l := range []struct {
+			name  string
+			level int
+		}{{"level", c.Executor.Gzip.Level}, {"minLevel", c.Executor.Gzip.MinLevel}, {"maxLevel", c.Executor.Gzip.MaxLevel}} {
+			if l.level < 0 || l.level > 9 {
+				return errors.Errorf("executor gzip %s must be between 1 and 9", l.name)
+			}
+		}
+		if c.Executor.LogSyncInterval < 0 {
+			return errors.Errorf("executor logSyncInterval must be positive")
+		}
+		if c.Executor.ArchiveVolume.MaxTransientFailures < 0 {
+			return errors.Errorf("executor archiveVolume maxTransientFailures must be positive")
+		}
+		if c.Executor.ArchiveVolume.CheckInterval < 0 {
+			return errors.Errorf("executor archiveVolume checkInterval must be positive")
+		}
+		for name, max := range c.Executor.MaxStepUlimits {
+			if max < -1 {
+				return errors.Errorf("executor maxStepUlimits %q must be positive or -1", name)
+			}
+		}
+		if c.Executor.Gzip.MinResponseSize < 0 {
+			return errors.Errorf("executor gzip minResponseSize must be positive")
+		}
+		if g := c.Executor.Gzip; g.MinLevel != 0 && g.MaxLevel != 0 && g.MinLevel > g.MaxLevel {
+			return errors.Errorf("executor gzip minLevel must not be greater than maxLevel")
+		}
+		if c.Executor.MaxTaskArchives < 0 {
+			return errors.Errorf("executor maxTaskArchives must be positive")
+		}
+		if c.Executor.MaxArchives < 0 {
+			return errors.Errorf("executor maxArchives must be positive")
+		}
+		if c.Executor.TaskDiskQuota < 0 {
+			return errors.Errorf("executor taskDiskQuota must be positive")
+		}
+		if c.Executor.MaxStreamFiles < 0 {
+			return errors.Errorf("executor maxStreamFiles must be positive")
+		}
+		if c.Executor.MaxArchiveDownloads < 0 {
+			return errors.Errorf("executor maxArchiveDownloads must be positive")
+		}
+		if c.Executor.MaxLogFollows < 0 {
+			return errors.Errorf("executor maxLogFollows must be positive")
+		}
+		if c.Executor.MaxLogFollowMemory < 0 {
+			return errors.Errorf("executor maxLogFollowMemory must be positive")
+		}
+		if c.Executor.ArchiveReadBufferSize < 0 {
+			return errors.Errorf("executor archiveReadBufferSize must be positive")
+		}
+		if c.Executor.MaxConcurrentArchiveWrites < 0 {
+			return errors.Errorf("executor maxConcurrentArchiveWrites must be positive")
+		}
+		if c.Executor.MaxLogLinesPerSecond < 0 {
+			return errors.Errorf("executor maxLogLinesPerSecond must be positive")
+		}
+		if c.Executor.MaxLogLineLength <= 0 {
+			return errors.Errorf("executor maxLogLineLength must be greater than 0")
+		}
+		if _, err := ParseFileMode(c.Executor.FileMode); err != nil {
+			return errors.Errorf("executor fileMode: %w", err)
+		}
+		if _, _, err := ParseFileOwner(c.Executor.FileOwner); err != nil {
+			return errors.Errorf("executor fileOwner: %w", err)
+		}
+		if lf := c.Executor.LogForward; lf.Enabled {
+			switch lf.Network {
+			case "":
+				if lf.Address != "" {
+					return errors.Errorf("executor logForward network is empty")
+				}
+			case "udp", "tcp", "unix", "unixgram":
+				if lf.Address == "" {
+					return errors.Errorf("executor logForward address is empty")
+				}
+			default:
+				return errors.Errorf("executor logForward network %q is invalid", lf.Network)
+			}
+		}
 	}
 
 	// Scheduler
@@ -363,6 +945,39 @@ func Validate(c *Config, componentsNames []string) error {
 	return nil
 }
 
+// ParseFileMode parses a file permission mode in octal notation
+func ParseFileMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, errors.Errorf("invalid file mode %q", s)
+	}
+	if m > 0777 {
+		return 0, errors.Errorf("invalid file mode %q: only permission bits are allowed", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// ParseFileOwner parses a file owner in the "uid:gid" format. An empty owner
+// returns -1 for both uid and gid
+func ParseFileOwner(s string) (int, int, error) {
+	if s == "" {
+		return -1, -1, nil
+	}
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, 0, errors.Errorf("invalid file owner %q: must be in uid:gid format", s)
+	}
+	uid, err := strconv.Atoi(parts[0])
+	if err != nil || uid < 0 {
+		return 0, 0, errors.Errorf("invalid file owner %q: wrong uid", s)
+	}
+	gid, err := strconv.Atoi(parts[1])
+	if err != nil || gid < 0 {
+		return 0, 0, errors.Errorf("invalid file owner %q: wrong gid", s)
+	}
+	return uid, gid, nil
+}
+
 func isComponentEnabled(componentsNames []string, name string) bool {
 	if util.StringInSlice(componentsNames, "all-base") && name != "executor" {
 		return true
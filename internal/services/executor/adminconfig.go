@@ -0,0 +1,68 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"encoding/json"
+	"net/url"
+
+	"agola.io/agola/internal/services/config"
+
+	"github.com/ghodss/yaml"
+	errors "golang.org/x/xerrors"
+	yamlv2 "gopkg.in/yaml.v2"
+)
+
+const redactedValue = "REDACTED"
+
+// redactProxyURL hides the password of a proxy url with credentials. Values
+// that aren't valid urls are fully redacted since they could contain them
+func redactProxyURL(v string) string {
+	if v == "" {
+		return v
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return redactedValue
+	}
+	if u.User == nil {
+		return v
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+	}
+	return u.String()
+}
+
+// redactedConfig returns, as json, the executor config with the secrets
+// redacted. The keys are the config file ones.
+func redactedConfig(c *config.Executor) (json.RawMessage, error) {
+	rc := *c
+	if rc.AdminToken != "" {
+		rc.AdminToken = redactedValue
+	}
+	rc.Proxy.HTTPProxy = redactProxyURL(rc.Proxy.HTTPProxy)
+	rc.Proxy.HTTPSProxy = redactProxyURL(rc.Proxy.HTTPSProxy)
+
+	data, err := yamlv2.Marshal(&rc)
+	if err != nil {
+		return nil, errors.Errorf("failed to marshal config: %w", err)
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, errors.Errorf("failed to convert config to json: %w", err)
+	}
+	return json.RawMessage(data), nil
+}
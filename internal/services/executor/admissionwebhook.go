@@ -0,0 +1,169 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	defaultAdmissionWebhookTimeout = 10 * time.Second
+	// maxAdmissionWebhookResponseSize is the max size of a webhook response
+	// body
+	maxAdmissionWebhookResponseSize = 64 * 1024
+)
+
+// AdmissionRequest is the body posted to the admission webhook
+type AdmissionRequest struct {
+	ExecutorID string `json:"executor_id"`
+	// Task is the submitted task with the environment values, the registries
+	// credentials, the secret files contents and the proxy passwords redacted
+	Task *types.ExecutorTask `json:"task"`
+}
+
+// AdmissionResponse is the admission webhook reply. Reason is reported to the
+// submitter when the task isn't allowed
+type AdmissionResponse struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// admissionWebhook calls the configured admission webhook for the task. It
+// returns the webhook response, or an error if the call failed
+func (e *Executor) admissionWebhook(ctx context.Context, et *types.ExecutorTask) (*AdmissionResponse, error) {
+	timeout := e.c.AdmissionWebhook.Timeout
+	if timeout == 0 {
+		timeout = defaultAdmissionWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	data, err := json.Marshal(&AdmissionRequest{ExecutorID: e.id, Task: redactedTask(et)})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", e.c.AdmissionWebhook.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Errorf("admission webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAdmissionWebhookResponseSize))
+	if err != nil {
+		return nil, errors.Errorf("failed to read admission webhook response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("admission webhook returned status %d", resp.StatusCode)
+	}
+	var ar *AdmissionResponse
+	if err := json.Unmarshal(body, &ar); err != nil || ar == nil {
+		return nil, errors.Errorf("invalid admission webhook response")
+	}
+	return ar, nil
+}
+
+// admitTask asks the admission webhook, if configured, if a new task is
+// allowed. The tasks are submitted again to update them, the webhook is called
+// only for the tasks that would be queued for the first time. When the webhook
+// fails the task is allowed only with the open failure policy. The returned
+// reason explains a rejection.
+func (e *Executor) admitTask(ctx context.Context, et *types.ExecutorTask) (bool, string, error) {
+	if e.c.AdmissionWebhook.URL == "" || et == nil || et.Spec.ExecutorTaskSpecData == nil {
+		return true, "", nil
+	}
+	if et.Spec.ExecutorID != e.id || et.Spec.Stop || et.Status.Phase != types.ExecutorTaskPhaseNotStarted {
+		return true, "", nil
+	}
+	if _, ok := e.runningTasks.get(et.ID); ok || e.taskQueue.has(et.ID) {
+		return true, "", nil
+	}
+	ar, err := e.admissionWebhook(ctx, et)
+	if err != nil {
+		admissionWebhookCallsTotal.WithLabelValues("failed").Inc()
+		if e.c.AdmissionWebhook.FailurePolicy == config.AdmissionWebhookFailOpen {
+			log.Warnf("admitting task %s: %v", et.ID, err)
+			return true, "", nil
+		}
+		return false, "", err
+	}
+	if !ar.Allow {
+		admissionWebhookCallsTotal.WithLabelValues("denied").Inc()
+		reason := ar.Reason
+		if reason == "" {
+			reason = "task denied by the admission webhook"
+		}
+		return false, reason, nil
+	}
+	admissionWebhookCallsTotal.WithLabelValues("allowed").Inc()
+	return true, "", nil
+}
+
+// redactedTask returns a copy of the task with its secrets redacted
+func redactedTask(et *types.ExecutorTask) *types.ExecutorTask {
+	rt := et.DeepCopy()
+	redactEnv := func(env map[string]string) {
+		for k := range env {
+			env[k] = redactedValue
+		}
+	}
+
+	spec := rt.Spec.ExecutorTaskSpecData
+	redactEnv(spec.Environment)
+	for _, c := range spec.Containers {
+		redactEnv(c.Environment)
+	}
+	for _, step := range spec.Steps {
+		if s, ok := step.(*types.RunStep); ok {
+			redactEnv(s.Environment)
+			for _, ss := range s.Parallel {
+				redactEnv(ss.Environment)
+			}
+		}
+	}
+	for name, auth := range spec.DockerRegistriesAuth {
+		if auth.Password != "" {
+			auth.Password = redactedValue
+		}
+		if auth.Auth != "" {
+			auth.Auth = redactedValue
+		}
+		spec.DockerRegistriesAuth[name] = auth
+	}
+	for i := range spec.SecretFiles {
+		spec.SecretFiles[i].Content = redactedValue
+	}
+	if spec.Proxy != nil {
+		spec.Proxy.HTTPProxy = redactProxyURL(spec.Proxy.HTTPProxy)
+		spec.Proxy.HTTPSProxy = redactProxyURL(spec.Proxy.HTTPSProxy)
+	}
+	return rt
+}
@@ -15,237 +15,2982 @@
 package executor
 
 import (
+	"archive/tar"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"agola.io/agola/cmd"
+	"agola.io/agola/internal/services/executor/driver"
+	"agola.io/agola/internal/services/executor/registry"
+	"agola.io/agola/internal/util"
 	"agola.io/agola/services/runservice/types"
+	"github.com/gorilla/mux"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	errors "golang.org/x/xerrors"
 )
 
+const (
+	// logOffsetHeader and logReconnectHeader are sent as trailers when a raw log
+	// follow is interrupted since the max follow duration has been reached
+	logOffsetHeader    = "Agola-Log-Offset"
+	logReconnectHeader = "Agola-Log-Reconnect"
+	// logWindowWarningHeader reports why the whole log is returned instead of
+	// the lines in the requested time window
+	logWindowWarningHeader = "Agola-Log-Window-Warning"
+
+	// maxTaskSubmissionSize is the max size of a task submission request body.
+	// When the body is compressed it's applied to both the compressed and the
+	// decompressed size
+	maxTaskSubmissionSize = 16 * 1024 * 1024
+
+	// maxLogPollSize is the max log data returned by a single log poll
+	maxLogPollSize = 1024 * 1024
+)
+
 type taskSubmissionHandler struct {
-	c chan<- *types.ExecutorTask
+	log *zap.SugaredLogger
+	e   *Executor
+	c   chan<- *types.ExecutorTask
+}
+
+func NewTaskSubmissionHandler(logger *zap.Logger, e *Executor, c chan<- *types.ExecutorTask) *taskSubmissionHandler {
+	return &taskSubmissionHandler{
+		log: logger.Sugar(),
+		e:   e,
+		c:   c,
+	}
+}
+
+func (h *taskSubmissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// the submitted task can be received only when the execution loop is
+	// started, before it the submission would wait
+	if !h.e.isReady() {
+		w.Header().Set("Retry-After", "5")
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, "", "executor not ready")
+		return
+	}
+
+	et, ok := readTaskSubmission(w, r)
+	if !ok {
+		return
+	}
+
+	// with a not writable archive volume only the tasks not writing archives
+	// are accepted
+	if err := h.e.archiveVolumeReadinessErr(); err != nil && taskWritesArchives(et) {
+		w.Header().Set("Retry-After", "30")
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, et.ID, fmt.Sprintf("executor not ready: %v", err))
+		return
+	}
+
+	if violations := h.e.admissionViolations(et); len(violations) > 0 {
+		v := violations[0]
+		if v.Policy == TaskPolicyNetworkMode || v.Policy == TaskPolicyUlimits || v.Policy == TaskPolicyImageRegistry {
+			httpError(w, http.StatusForbidden, ErrorCodeForbidden, et.ID, v.Message)
+		} else {
+			httpError(w, http.StatusBadRequest, ErrorCodeInvalidTask, et.ID, v.Message)
+		}
+		return
+	}
+
+	allowed, reason, err := h.e.admitTask(r.Context(), et)
+	if err != nil {
+		h.log.Errorf("task %s admission failed: %+v", et.ID, err)
+		w.Header().Set("Retry-After", "5")
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, et.ID, "task admission failed, retry later")
+		return
+	}
+	if !allowed {
+		httpError(w, http.StatusForbidden, ErrorCodeForbidden, et.ID, reason)
+		return
+	}
+
+	// the task is received only when the execution loop isn't busy, if the
+	// client gives up before it the task isn't received
+	select {
+	case h.c <- et:
+	case <-r.Context().Done():
+		w.Header().Set("Retry-After", "5")
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, et.ID, "task not received, retry later")
+	}
+}
+
+// readTaskSubmission reads the submitted task from the, optionally compressed,
+// request body. It replies with an error and returns false if the task cannot
+// be read
+func readTaskSubmission(w http.ResponseWriter, r *http.Request) (*types.ExecutorTask, bool) {
+	body := http.MaxBytesReader(w, r.Body, maxTaskSubmissionSize)
+
+	var br io.Reader
+	switch strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))) {
+	case "", "identity":
+		br = body
+	case "gzip", "x-gzip":
+		gr, err := gzip.NewReader(body)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "invalid gzip request body")
+			return nil, false
+		}
+		defer gr.Close()
+		br = gr
+	case "deflate":
+		zr, err := zlib.NewReader(body)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "invalid deflate request body")
+			return nil, false
+		}
+		defer zr.Close()
+		br = zr
+	default:
+		httpError(w, http.StatusUnsupportedMediaType, ErrorCodeUnsupportedEncoding, "", "unsupported content encoding")
+		return nil, false
+	}
+
+	// limit the decompressed size to avoid decompression bombs
+	data, err := ioutil.ReadAll(io.LimitReader(br, maxTaskSubmissionSize+1))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "failed to read request body")
+		return nil, false
+	}
+	if len(data) > maxTaskSubmissionSize {
+		httpError(w, http.StatusRequestEntityTooLarge, ErrorCodeRequestTooLarge, "", "task exceeds the max submission size")
+		return nil, false
+	}
+
+	var et *types.ExecutorTask
+	if err := json.Unmarshal(data, &et); err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "invalid task")
+		return nil, false
+	}
+	return et, true
+}
+
+type taskValidationHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTaskValidationHandler(logger *zap.Logger, e *Executor) *taskValidationHandler {
+	return &taskValidationHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP reports the executor policies violated by the provided task. The
+// task is only checked, it isn't submitted
+func (h *taskValidationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	et, ok := readTaskSubmission(w, r)
+	if !ok {
+		return
+	}
+
+	var taskID string
+	if et != nil {
+		taskID = et.ID
+	}
+	res, err := h.e.validateTask(r.Context(), et)
+	if err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	if err := httpResponse(w, http.StatusOK, res); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+var hostnameRegexp = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+func validateExecutorTask(et *types.ExecutorTask) error {
+	if errs := taskDefinitionErrors(et); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// taskDefinitionErrors returns all the errors in the task definition
+func taskDefinitionErrors(et *types.ExecutorTask) []error {
+	if et == nil || et.Spec.ExecutorTaskSpecData == nil {
+		return nil
+	}
+	var errs []error
+	if et.Spec.CABundle != "" {
+		if err := validateCABundle([]byte(et.Spec.CABundle)); err != nil {
+			errs = append(errs, errors.Errorf("invalid ca bundle: %w", err))
+		}
+	}
+	if err := validateServiceNames(et); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateSecretFiles(et.Spec.SecretFiles); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := compileRedactionRules(et.Spec.RedactionRules); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateReadOnlyRootFS(et); err != nil {
+		errs = append(errs, err)
+	}
+	if et.Spec.ConcurrencyGroup != "" {
+		if err := validateConcurrencyGroup(et.Spec.ConcurrencyGroup); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if et.Spec.Shell != "" {
+		if err := validateShell(et.Spec.Shell); err != nil {
+			errs = append(errs, errors.Errorf("task %w", err))
+		}
+	}
+	for _, s := range et.Spec.DNSServers {
+		if net.ParseIP(s) == nil {
+			errs = append(errs, errors.Errorf("invalid dns server ip %q", s))
+		}
+	}
+	for i, step := range et.Spec.Steps {
+		bs := types.StepBase(step)
+		if bs == nil || bs.Retry == nil {
+			continue
+		}
+		if bs.Retry.MaxAttempts < 1 {
+			errs = append(errs, errors.Errorf("step %d retry max attempts must be at least 1", i))
+		}
+		if bs.Retry.Backoff < 0 {
+			errs = append(errs, errors.Errorf("step %d retry backoff must be positive", i))
+		}
+	}
+	for i, step := range et.Spec.Steps {
+		var metadata map[string]string
+		switch s := step.(type) {
+		case *types.SaveToWorkspaceStep:
+			metadata = s.Metadata
+		case *types.SaveCacheStep:
+			metadata = s.Metadata
+		}
+		if err := validateArchiveMetadata(metadata); err != nil {
+			errs = append(errs, errors.Errorf("step %d: %w", i, err))
+		}
+		if rs, ok := step.(*types.RunStep); ok {
+			if err := validateFailOnLogPatterns(rs.FailOnLogPatterns); err != nil {
+				errs = append(errs, errors.Errorf("step %d: %w", i, err))
+			}
+			if rs.Shell != "" {
+				if err := validateShell(rs.Shell); err != nil {
+					errs = append(errs, errors.Errorf("step %d: %w", i, err))
+				}
+			}
+			if rs.OutputEncoding != "" {
+				if _, err := lookupOutputEncoding(rs.OutputEncoding); err != nil {
+					errs = append(errs, errors.Errorf("step %d: %w", i, err))
+				}
+			}
+			if err := validateStepUlimits(rs.Ulimits); err != nil {
+				errs = append(errs, errors.Errorf("step %d: %w", i, err))
+			}
+			if rs.CaptureCommands && len(rs.Parallel) > 0 {
+				errs = append(errs, errors.Errorf("step %d: capture commands cannot be used with parallel sub steps", i))
+			}
+			for _, arg := range rs.ShellArgs {
+				if arg == "" || strings.ContainsAny(arg, "\n\x00") {
+					errs = append(errs, errors.Errorf("step %d: invalid shell arg %q", i, arg))
+				}
+			}
+		}
+		// only report syntax errors, the variables are known when the step
+		// is executed
+		if rs, ok := step.(*types.RunStep); ok && rs.Interpolate {
+			commands := []string{rs.Command}
+			for _, ss := range rs.Parallel {
+				commands = append(commands, ss.Command)
+			}
+			for _, command := range commands {
+				if _, err := interpolate(command, nil, false); err != nil {
+					errs = append(errs, errors.Errorf("step %d: %w", i, err))
+				}
+			}
+		}
+	}
+	for _, h := range et.Spec.ExtraHosts {
+		if len(h.Hostname) > 253 || !hostnameRegexp.MatchString(h.Hostname) {
+			errs = append(errs, errors.Errorf("invalid extra host hostname %q", h.Hostname))
+		}
+		if net.ParseIP(h.IP) == nil {
+			errs = append(errs, errors.Errorf("invalid extra host %q ip %q", h.Hostname, h.IP))
+		}
+	}
+	return errs
+}
+
+type logsHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewLogsHandler(logger *zap.Logger, e *Executor) *logsHandler {
+	return &logsHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// logSelector selects the log of a task attempt step, sub step, setup or
+// service container
+type logSelector struct {
+	setup   bool
+	step    int
+	substep int
+	// service is the service container name
+	service string
+	// serviceIndex is the service container index in the task containers,
+	// set by resolveLogSelector
+	serviceIndex int
+	// attempt is 0 when the latest attempt is requested
+	attempt int
+}
+
+func parseLogSelector(q url.Values) (*logSelector, error) {
+	sel := &logSelector{substep: -1}
+
+	_, sel.setup = q["setup"]
+	stepStr := q.Get("step")
+	sel.service = q.Get("service")
+	n := 0
+	for _, ok := range []bool{sel.setup, stepStr != "", sel.service != ""} {
+		if ok {
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, errors.Errorf("one of setup, step or service is required")
+	}
+	if n > 1 {
+		return nil, errors.Errorf("setup, step and service are mutually exclusive")
+	}
+
+	if stepStr != "" {
+		var err error
+		sel.step, err = strconv.Atoi(stepStr)
+		if err != nil {
+			return nil, errors.Errorf("invalid step")
+		}
+	}
+
+	// attempt selects the task attempt, defaults to the latest one
+	if attemptStr := q.Get("attempt"); attemptStr != "" {
+		var err error
+		sel.attempt, err = strconv.Atoi(attemptStr)
+		if err != nil || sel.attempt <= 0 {
+			return nil, errors.Errorf("invalid attempt")
+		}
+	}
+
+	// substep selects the log of a run step parallel sub step
+	if substepStr := q.Get("substep"); substepStr != "" {
+		if stepStr == "" {
+			return nil, errors.Errorf("substep can be used only with step")
+		}
+		var err error
+		sel.substep, err = strconv.Atoi(substepStr)
+		if err != nil || sel.substep < 0 {
+			return nil, errors.Errorf("invalid substep")
+		}
+	}
+
+	return sel, nil
+}
+
+// readLogsOptions defines how a log is read and sent to the client
+type readLogsOptions struct {
+	// follow keeps sending the log while the step is running
+	follow bool
+	// offset is the log byte offset from where to start reading
+	offset int64
+	// tailBytes, when positive, starts reading from the first line starting
+	// in the last tailBytes bytes of the log
+	tailBytes int64
+	// line, when positive, starts reading from the line with this number,
+	// starting from 1
+	line int64
+	// tailLines, when positive, starts reading from the last tailLines lines
+	tailLines int64
+	// sse sends the log lines as server sent events instead of raw data. The
+	// event id is the log offset after the line so clients can resume reading
+	// using the Last-Event-ID header. The log of a task or step not started yet
+	// is streamed after a queued event instead of not being found
+	sse bool
+	// rawMarkers keeps the step start/end marker lines in the returned log,
+	// and the escape of the output lines looking like a marker
+	rawMarkers bool
+	// merge returns the step log merged with its sub steps logs ordered by
+	// capture time
+	merge bool
+	// commands returns the finished step log grouped by the step commands
+	commands bool
+	// ifModifiedSince is the If-Modified-Since request header time. It's used
+	// only when not following the log of a finished step
+	ifModifiedSince *time.Time
+	// html returns the log of a finished step as an html page. It's used when
+	// a browser directly opens the log url
+	html bool
+	// since and until, when defined, return only the log lines captured in
+	// this time window
+	since *time.Time
+	until *time.Time
+	// replay, when defined, is the speed at which the lines of a finished log
+	// are sent respecting their original capture timing. A zero speed sends
+	// them without waiting
+	replay *float64
+	// tsFormat, when defined, formats the capture time prefixed to every log
+	// line
+	tsFormat func(time.Time) string
+	// follower is the accounted follow of a follow request
+	follower *logFollow
 }
 
-func NewTaskSubmissionHandler(c chan<- *types.ExecutorTask) *taskSubmissionHandler {
-	return &taskSubmissionHandler{c: c}
+func (h *logsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+
+	sel, err := parseLogSelector(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+		return
+	}
+	setup, step, substep, attempt := sel.setup, sel.step, sel.substep, sel.attempt
+
+	opts := &readLogsOptions{}
+
+	_, ok := q["follow"]
+	if ok {
+		opts.follow = true
+	}
+
+	opts.sse = strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	opts.html = !opts.follow && !opts.sse && prefersHTML(r.Header.Get("Accept"))
+
+	// step markers are stripped by default
+	if _, ok := q["raw_markers"]; ok {
+		rawMarkers, err := parseBoolParam(q.Get("raw_markers"))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid raw_markers")
+			return
+		}
+		opts.rawMarkers = rawMarkers
+	}
+
+	if _, ok := q["merge"]; ok {
+		merge, err := parseBoolParam(q.Get("merge"))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid merge")
+			return
+		}
+		if merge && (setup || sel.service != "" || substep >= 0 || opts.follow || opts.sse) {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "merge can be used only with a step and without follow")
+			return
+		}
+		opts.merge = merge
+	}
+
+	for _, p := range []struct {
+		name string
+		t    **time.Time
+	}{{"since", &opts.since}, {"until", &opts.until}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid "+p.name)
+			return
+		}
+		*p.t = &t
+	}
+	if opts.since != nil || opts.until != nil {
+		if opts.follow || opts.sse || opts.merge {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "since and until cannot be used with follow, sse or merge")
+			return
+		}
+		if opts.since != nil && opts.until != nil && opts.until.Before(*opts.since) {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "until is before since")
+			return
+		}
+	}
+
+	if _, ok := q["timestamps"]; ok {
+		timestamps, err := parseBoolParam(q.Get("timestamps"))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid timestamps")
+			return
+		}
+		if timestamps {
+			if opts.follow || opts.sse || opts.merge {
+				httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "timestamps cannot be used with follow, sse or merge")
+				return
+			}
+			opts.tsFormat, err = timestampFormat(q.Get("ts_format"), q.Get("ts_layout"))
+			if err != nil {
+				httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+				return
+			}
+			opts.html = false
+		}
+	}
+
+	if replayStr := q.Get("replay"); replayStr != "" {
+		speed, err := strconv.ParseFloat(replayStr, 64)
+		if err != nil || speed < 0 || math.IsInf(speed, 0) || math.IsNaN(speed) {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid replay")
+			return
+		}
+		if opts.follow || opts.sse || opts.merge {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "replay cannot be used with follow, sse or merge")
+			return
+		}
+		opts.replay = &speed
+		opts.html = false
+	}
+
+	// the offset query parameter takes precedence over the Last-Event-ID header
+	offsetStr := q.Get("offset")
+	if offsetStr == "" && opts.sse {
+		offsetStr = r.Header.Get("Last-Event-ID")
+	}
+	if offsetStr != "" {
+		offset, err := strconv.ParseInt(offsetStr, 10, 64)
+		if err != nil || offset < 0 {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid offset")
+			return
+		}
+		opts.offset = offset
+	}
+
+	if tailBytesStr := q.Get("tailbytes"); tailBytesStr != "" {
+		tailBytes, err := strconv.ParseInt(tailBytesStr, 10, 64)
+		if err != nil || tailBytes <= 0 {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid tailbytes")
+			return
+		}
+		if q.Get("offset") != "" || opts.merge || opts.since != nil || opts.until != nil || opts.tsFormat != nil || opts.replay != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "tailbytes cannot be used with offset, merge, since, until, timestamps or replay")
+			return
+		}
+		// a reconnecting sse client resumes from its Last-Event-ID
+		if offsetStr == "" {
+			opts.tailBytes = tailBytes
+		}
+	}
+
+	for _, p := range []struct {
+		name string
+		v    *int64
+	}{{"line", &opts.line}, {"taillines", &opts.tailLines}} {
+		v := q.Get(p.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid "+p.name)
+			return
+		}
+		if q.Get("offset") != "" || q.Get("tailbytes") != "" || opts.merge || opts.since != nil || opts.until != nil || opts.tsFormat != nil || opts.replay != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, p.name+" cannot be used with offset, tailbytes, merge, since, until, timestamps or replay")
+			return
+		}
+		// a reconnecting sse client resumes from its Last-Event-ID
+		if offsetStr == "" {
+			*p.v = n
+		}
+	}
+	if opts.line > 0 && opts.tailLines > 0 {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "line and taillines are mutually exclusive")
+		return
+	}
+
+	if _, ok := q["commands"]; ok {
+		commands, err := parseBoolParam(q.Get("commands"))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid commands")
+			return
+		}
+		if commands {
+			if setup || sel.service != "" || substep >= 0 {
+				httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "commands can be used only with a step")
+				return
+			}
+			if opts.follow || opts.sse || opts.merge || offsetStr != "" || opts.tailBytes > 0 || opts.line > 0 || opts.tailLines > 0 || opts.since != nil || opts.until != nil || opts.tsFormat != nil || opts.replay != nil {
+				httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "commands cannot be used with follow, sse, merge, offset, tailbytes, line, taillines, since, until, timestamps or replay")
+				return
+			}
+		}
+		opts.commands = commands
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		// ignore invalid dates like required by RFC 7232
+		if t, err := http.ParseTime(ims); err == nil {
+			opts.ifModifiedSince = &t
+		}
+	}
+
+	// the platform service logs are read as a whole stream from the platform
+	if sel.service != "" && h.e.platformServiceLogs() {
+		if opts.sse || offsetStr != "" || opts.tailBytes > 0 || opts.line > 0 || opts.tailLines > 0 || opts.since != nil || opts.until != nil || opts.tsFormat != nil || opts.replay != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "service logs read from the platform don't support sse, offset, tailbytes, line, taillines, since, until, timestamps or replay")
+			return
+		}
+	}
+
+	if err := h.e.resolveLogSelector(taskID, sel); err != nil {
+		if util.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+			return
+		}
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+	attempt = sel.attempt
+
+	// only the follow requests are limited since they keep the log open
+	if opts.follow {
+		follower, ok := h.e.acquireLogFollow(w, taskID)
+		if !ok {
+			return
+		}
+		defer follower.release()
+		opts.follower = follower
+	}
+
+	if sel.service != "" && h.e.platformServiceLogs() {
+		if err := h.readPlatformServiceLogs(r.Context(), taskID, sel, w, opts); err != nil {
+			h.log.Errorf("err: %+v", err)
+		}
+		return
+	}
+
+	if opts.commands {
+		if err := h.readCommandLogs(taskID, sel, w); err != nil {
+			h.log.Errorf("err: %+v", err)
+		}
+		return
+	}
+
+	if opts.merge {
+		if err := h.readMergedLogs(taskID, attempt, step, w, opts); err != nil {
+			h.log.Errorf("err: %+v", err)
+		}
+		return
+	}
+
+	if err := h.readTaskLogs(r.Context(), taskID, sel, w, opts); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+func (h *logsHandler) readTaskLogs(ctx context.Context, taskID string, sel *logSelector, w http.ResponseWriter, opts *readLogsOptions) error {
+	logPath := h.e.logPath(taskID, sel)
+	if offset, ok := h.e.logDurableOffset(taskID, logPath); ok {
+		w.Header().Set(logDurableOffsetHeader, strconv.FormatInt(offset, 10))
+	}
+	if opts.replay != nil {
+		return h.readReplayLogs(ctx, taskID, sel, logPath, w, opts)
+	}
+	if opts.since != nil || opts.until != nil || opts.tsFormat != nil {
+		return h.readWindowLogs(ctx, taskID, sel, logPath, w, opts)
+	}
+	return h.readLogs(ctx, taskID, sel, logPath, w, opts)
+}
+
+// readWindowLogs writes the log lines captured between opts.since and
+// opts.until, prefixed by their capture time in timestamps mode, using the log
+// timestamps index. When the lines capture time isn't available or reliable
+// the whole log is returned without timestamps and with a warning header.
+func (h *logsHandler) readWindowLogs(ctx context.Context, taskID string, sel *logSelector, logPath string, w http.ResponseWriter, opts *readLogsOptions) error {
+	fallback := func(warning string) error {
+		w.Header().Set(logWindowWarningHeader, warning)
+		return h.readLogs(ctx, taskID, sel, logPath, w, opts)
+	}
+
+	idx, err := openLogIndex(logPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			return err
+		}
+		return fallback("log timestamps not available")
+	}
+	defer idx.Close()
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		} else {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return err
+	}
+	if problem := logIndexProblem(idx, fi.Size()); problem != "" {
+		return fallback(problem)
+	}
+
+	src, err := newMergeSource("", logPath)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return err
+	}
+	defer src.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	return writeWindowLogs(w, src, opts)
+}
+
+// readReplayLogs replays a finished log at opts.replay speed using the log
+// timestamps index. Lines captured outside the opts.since and opts.until
+// window are skipped.
+func (h *logsHandler) readReplayLogs(ctx context.Context, taskID string, sel *logSelector, logPath string, w http.ResponseWriter, opts *readLogsOptions) error {
+	if !h.e.logFinished(taskID, sel) {
+		httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, "replay requires a finished log")
+		return nil
+	}
+
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		} else {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return err
+	}
+	idx, err := openLogIndex(logPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			return err
+		}
+		httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, "log timestamps not available")
+		return nil
+	}
+	defer idx.Close()
+	if problem := logIndexProblem(idx, fi.Size()); problem != "" {
+		httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, problem)
+		return nil
+	}
+
+	src, err := newMergeSource("", logPath)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return err
+	}
+	defer src.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	return writeReplayLogs(ctx, w, flusher, src, *opts.replay, opts)
+}
+
+// readMergedLogs writes the step log merged with its sub steps logs. The logs
+// of tasks that don't persist them have no capture time so they cannot be
+// merged
+func (h *logsHandler) readMergedLogs(taskID string, attempt, step int, w http.ResponseWriter, opts *readLogsOptions) error {
+	if rt, ok := h.e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		noLogPersist := rt.et.Spec.NoLogPersist
+		rt.Unlock()
+		if noLogPersist {
+			httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, "merged logs not available for tasks not persisting their logs")
+			return nil
+		}
+	}
+
+	sources, err := h.e.stepMergeSources(taskID, attempt, step)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		} else {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return err
+	}
+	defer func() {
+		for _, s := range sources {
+			s.Close()
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	return writeMergedLogs(w, sources, opts.rawMarkers)
+}
+
+// readCommandLogs returns the finished step log grouped by the commands of
+// the step
+func (h *logsHandler) readCommandLogs(taskID string, sel *logSelector, w http.ResponseWriter) error {
+	if rt, ok := h.e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		noLogPersist := rt.et.Spec.NoLogPersist
+		rt.Unlock()
+		if noLogPersist {
+			httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, "log commands not available for tasks not persisting their logs")
+			return nil
+		}
+	}
+	if !h.e.logFinished(taskID, sel) {
+		httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, "commands requires a finished log")
+		return nil
+	}
+
+	cmds, err := h.e.readLogCommands(taskID, h.e.logPath(taskID, sel))
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		} else {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return err
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	return httpResponse(w, http.StatusOK, cmds)
+}
+
+// logTitle returns the html log page title
+func logTitle(taskID string, sel *logSelector) string {
+	switch {
+	case sel.setup:
+		return fmt.Sprintf("task %s attempt %d setup", taskID, sel.attempt)
+	case sel.service != "":
+		return fmt.Sprintf("task %s attempt %d service %s", taskID, sel.attempt, sel.service)
+	case sel.substep >= 0:
+		return fmt.Sprintf("task %s attempt %d step %d substep %d", taskID, sel.attempt, sel.step, sel.substep)
+	default:
+		return fmt.Sprintf("task %s attempt %d step %d", taskID, sel.attempt, sel.step)
+	}
+}
+
+// writeLogPage writes the log read from r as an html page
+func writeLogPage(w http.ResponseWriter, title string, r io.Reader, rawMarkers bool) error {
+	if !rawMarkers {
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() {
+			sw := newMarkerStripWriter(pw)
+			_, err := io.Copy(sw, r)
+			if err == nil {
+				err = sw.Flush()
+			}
+			pw.CloseWithError(err)
+		}()
+		r = pr
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	return writeLogHTML(w, title, r)
+}
+
+func (h *logsHandler) readLogs(ctx context.Context, taskID string, sel *logSelector, logPath string, w http.ResponseWriter, opts *readLogsOptions) error {
+	// the max follow duration bounds the connection lifetime, when reached,
+	// or when the follow is shed, the client is told to reconnect from the
+	// current offset
+	var followDeadline <-chan time.Time
+	if opts.follow && h.e.c.LogFollowMaxDuration > 0 {
+		timer := time.NewTimer(h.e.c.LogFollowMaxDuration)
+		defer timer.Stop()
+		followDeadline = timer.C
+	}
+
+	f, err := h.e.openLog(taskID, logPath)
+	// the sse clients of a log not created yet since its task or step hasn't
+	// started get a stream beginning with a queued event
+	headerSent := false
+	if os.IsNotExist(err) && opts.sse {
+		if reason := h.e.logPending(taskID, sel); reason != "" {
+			if f, err = h.waitPendingLog(ctx, taskID, sel, logPath, w, opts, reason, followDeadline); f == nil {
+				return err
+			}
+			headerSent = true
+		}
+	}
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		case errors.Is(err, errLogGone):
+			httpError(w, http.StatusGone, ErrorCodeLogGone, taskID, "log not available anymore")
+		default:
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return err
+	}
+	defer f.Close()
+
+	logSize, err := f.Size()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return err
+	}
+	start := opts.offset
+	switch {
+	case opts.tailBytes > 0:
+		start, err = tailBytesOffset(f, logSize, opts.tailBytes)
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			return errors.Errorf("failed to seek in log file %q: %w", logPath, err)
+		}
+	case opts.line > 0 || opts.tailLines > 0:
+		start, err = h.linesOffset(taskID, sel, logPath, f, opts)
+		if err != nil {
+			if errors.Is(err, errLogGone) {
+				httpError(w, http.StatusGone, ErrorCodeLogGone, taskID, "log lines not available anymore")
+			} else {
+				httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			}
+			return err
+		}
+	}
+	// the effective offset could be greater than the requested one if the log
+	// is an in memory log and the requested data has been discarded
+	offset, err := f.Seek(start, io.SeekStart)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return errors.Errorf("failed to seek in log file %q: %w", logPath, err)
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Vary", "Accept")
+
+	// the log of a finished step won't change anymore so clients can avoid
+	// fetching it again if not modified
+	finished := !opts.follow && h.e.logFinished(taskID, sel)
+	if finished {
+		modTime, err := f.ModTime()
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			return err
+		}
+		if !modTime.IsZero() {
+			w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+			// the http date has a seconds resolution
+			if opts.ifModifiedSince != nil && !modTime.Truncate(time.Second).After(*opts.ifModifiedSince) {
+				w.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+		}
+	}
+
+	if opts.html && finished {
+		return writeLogPage(w, logTitle(taskID, sel), f, opts.rawMarkers)
+	}
+
+	if opts.follow && !opts.sse && (h.e.c.LogFollowMaxDuration > 0 || h.e.c.MaxLogFollowMemory > 0) {
+		w.Header().Set("Trailer", logOffsetHeader+", "+logReconnectHeader)
+	}
+
+	if opts.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else if !opts.follow && opts.rawMarkers {
+		// if not following and not stripping the markers return the
+		// Content-Length
+		size := logSize - offset
+		if size < 0 {
+			size = 0
+		}
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	// write and flush the headers so the client will receive the response
+	// header also if there're currently no lines to send
+	if !headerSent {
+		w.WriteHeader(http.StatusOK)
+	}
+	var flusher http.Flusher
+	if fl, ok := w.(http.Flusher); ok {
+		flusher = fl
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	reconnect := func(offset int64) error {
+		if opts.sse {
+			_, err := fmt.Fprintf(w, "event: reconnect\ndata: {\"offset\":%d}\n\n", offset)
+			return err
+		}
+		w.Header().Set(logOffsetHeader, strconv.FormatInt(offset, 10))
+		w.Header().Set(logReconnectHeader, "true")
+		return nil
+	}
+
+	// wait waits for new log data. It returns false if reading must stop
+	// since the client went away, the max follow duration was reached or the
+	// follow was shed. When reached or shed the client is told to reconnect
+	// from offset
+	wait := func(offset int64) (bool, error) {
+		select {
+		case <-ctx.Done():
+			return false, nil
+		case <-followDeadline:
+			return false, reconnect(offset)
+		case <-opts.follower.shedC():
+			return false, reconnect(offset)
+		// TODO(sgotti) use ionotify/fswatcher?
+		case <-time.After(500 * time.Millisecond):
+			return true, nil
+		}
+	}
+
+	if opts.sse {
+		return h.sendLogEvents(f, opts.follower.writer(w), flusher, offset, opts, func() bool { return h.e.logFinished(taskID, sel) }, wait)
+	}
+
+	out := opts.follower.writer(w)
+	var sw *markerStripWriter
+	if !opts.rawMarkers {
+		sw = newMarkerStripWriter(out)
+		out = sw
+	}
+
+	buf := make([]byte, 4096)
+	flushstop := false
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			offset += int64(n)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			if !opts.follow || flushstop {
+				if sw != nil {
+					return sw.Flush()
+				}
+				return nil
+			}
+			// check if the step is finished, if so flush until EOF and stop
+			if h.e.logFinished(taskID, sel) {
+				flushstop = true
+				continue
+			}
+			// the bytes held by the marker strip writer haven't been sent
+			curOffset := offset
+			if sw != nil {
+				curOffset -= int64(sw.pendingLen())
+			}
+			if ok, err := wait(curOffset); !ok {
+				return err
+			}
+		}
+	}
+}
+
+// linesOffset returns the offset of the line requested by opts.line or
+// opts.tailLines
+func (h *logsHandler) linesOffset(taskID string, sel *logSelector, logPath string, f logSource, opts *readLogsOptions) (int64, error) {
+	idx, err := h.e.logLineIndex(taskID, sel, logPath, f)
+	if err != nil {
+		return 0, err
+	}
+	line := opts.line - 1
+	if opts.tailLines > 0 {
+		stats, err := h.e.logStats(taskID, sel)
+		if err != nil {
+			return 0, err
+		}
+		line = stats.Lines - opts.tailLines
+		if line < 0 {
+			line = 0
+		}
+	}
+	return logLineOffset(f, idx, line)
+}
+
+// tailBytesOffset returns the offset of the first line starting in the last n
+// bytes of a log of the provided size. If no line starts there, it's the
+// offset of the last n bytes.
+func tailBytesOffset(f io.ReadSeeker, size, n int64) (int64, error) {
+	if n >= size {
+		return 0, nil
+	}
+	start := size - n
+	// a line starts at start if the previous byte is a newline. The returned
+	// offset is greater than the requested one if the log is an in memory log
+	// and the data at start has been discarded
+	pos, err := f.Seek(start-1, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	br := bufio.NewReader(io.LimitReader(f, size-pos))
+	for {
+		b, err := br.ReadByte()
+		if err == io.EOF {
+			return start, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		pos++
+		if b == '\n' {
+			return pos, nil
+		}
+	}
+}
+
+func parseBoolParam(s string) (bool, error) {
+	if s == "" {
+		return true, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+type logEvent struct {
+	Offset int64  `json:"offset"`
+	Line   string `json:"line"`
+	// Split is true when the line has been split since it exceeds the max log
+	// line length. The next event continues the line
+	Split bool `json:"split,omitempty"`
+}
+
+type logQueuedEvent struct {
+	Reason string `json:"reason"`
+}
+
+// waitPendingLog starts the server sent events stream of a log not created yet,
+// sending a queued event, and waits for the log creation. It returns the log
+// once created or nil when the stream is finished since the client went away,
+// the log won't be created or the request isn't a follow one. The queued
+// event is sent again when the reason changes, like when a queued task starts.
+func (h *logsHandler) waitPendingLog(ctx context.Context, taskID string, sel *logSelector, logPath string, w http.ResponseWriter, opts *readLogsOptions, reason string, followDeadline <-chan time.Time) (logSource, error) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	out := opts.follower.writer(w)
+
+	send := func(format string, a ...interface{}) error {
+		if _, err := fmt.Fprintf(out, format, a...); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+	sendQueued := func(reason string) error {
+		evj, err := json.Marshal(&logQueuedEvent{Reason: reason})
+		if err != nil {
+			return err
+		}
+		return send("event: queued\ndata: %s\n\n", evj)
+	}
+
+	if err := sendQueued(reason); err != nil {
+		return nil, err
+	}
+	if !opts.follow {
+		return nil, nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-followDeadline:
+			return nil, send("event: reconnect\ndata: {\"offset\":0}\n\n")
+		case <-opts.follower.shedC():
+			return nil, send("event: reconnect\ndata: {\"offset\":0}\n\n")
+		case <-time.After(500 * time.Millisecond):
+		}
+
+		f, err := h.e.openLog(taskID, logPath)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		newReason := h.e.logPending(taskID, sel)
+		if newReason == "" {
+			// the log could have been created after the open
+			f, err := h.e.openLog(taskID, logPath)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil, nil
+				}
+				return nil, err
+			}
+			return f, nil
+		}
+		if newReason != reason {
+			reason = newReason
+			if err := sendQueued(reason); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// sendLogEvents sends every log line as a server sent event. Partial lines are
+// sent only when the log is finished. Lines longer than the max log line
+// length are split to not buffer them in memory
+func (h *logsHandler) sendLogEvents(f io.ReadSeeker, w io.Writer, flusher http.Flusher, offset int64, opts *readLogsOptions, finished func() bool, wait func(int64) (bool, error)) error {
+	br := bufio.NewReaderSize(f, h.e.c.MaxLogLineLength)
+	flushstop := false
+	for {
+		line, err := br.ReadSlice('\n')
+		split := err == bufio.ErrBufferFull
+		if err != nil && err != io.EOF && !split {
+			return err
+		}
+		eof := err == io.EOF
+		if eof && opts.follow && !flushstop {
+			// rewind to the start of the partial line and wait for more data
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				return err
+			}
+			br.Reset(f)
+			if finished() {
+				flushstop = true
+				continue
+			}
+			if ok, err := wait(offset); !ok {
+				return err
+			}
+			continue
+		}
+		if len(line) > 0 && !opts.rawMarkers && isStepMarker(line) {
+			offset += int64(len(line))
+			line = nil
+		}
+		if len(line) > 0 {
+			offset += int64(len(line))
+			if !opts.rawMarkers {
+				line = unescapeMarkerLine(line)
+			}
+			evj, err := json.Marshal(&logEvent{Offset: offset, Line: string(line), Split: split})
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", offset, evj); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if eof {
+			return nil
+		}
+	}
+}
+
+// LogPollResponse is the log data appended after the requested cursor
+type LogPollResponse struct {
+	Data string `json:"data"`
+	// Cursor is the cursor to use to get the next log data
+	Cursor int64 `json:"cursor"`
+	// Finished is true when the log won't change anymore and all of its data
+	// has been returned
+	Finished bool `json:"finished"`
+}
+
+// logPollHandler returns the log data appended after a cursor, the log byte
+// offset, for the clients polling the log instead of following it. Only whole
+// lines are returned while the log is still written so the step markers can
+// be stripped.
+type logPollHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewLogPollHandler(logger *zap.Logger, e *Executor) *logPollHandler {
+	return &logPollHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+func (h *logPollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+
+	sel, err := parseLogSelector(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+		return
+	}
+
+	var cursor int64
+	if cursorStr := q.Get("cursor"); cursorStr != "" {
+		cursor, err = strconv.ParseInt(cursorStr, 10, 64)
+		if err != nil || cursor < 0 {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid cursor")
+			return
+		}
+	}
+
+	rawMarkers := false
+	if _, ok := q["raw_markers"]; ok {
+		rawMarkers, err = parseBoolParam(q.Get("raw_markers"))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid raw_markers")
+			return
+		}
+	}
+
+	if err := h.e.resolveLogSelector(taskID, sel); err != nil {
+		if util.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+			return
+		}
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	res, err := h.pollLog(taskID, sel, cursor, rawMarkers)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		case errors.Is(err, errLogGone):
+			httpError(w, http.StatusGone, ErrorCodeLogGone, taskID, "log not available anymore")
+		case util.IsBadRequest(err):
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+			return
+		default:
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		h.log.Errorf("err: %+v", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := httpResponse(w, http.StatusOK, res); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+func (h *logPollHandler) pollLog(taskID string, sel *logSelector, cursor int64, rawMarkers bool) (*LogPollResponse, error) {
+	logPath := h.e.logPath(taskID, sel)
+
+	// check if the log is finished before reading it so the data written
+	// before finishing isn't missed
+	finished := h.e.logFinished(taskID, sel)
+
+	f, err := h.e.openLog(taskID, logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	logSize, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+	if cursor > logSize {
+		return nil, util.NewErrBadRequest(errors.Errorf("cursor %d is after the log end", cursor))
+	}
+	// the effective offset could be greater than the requested one if the log
+	// is an in memory log and the requested data has been discarded
+	offset, err := f.Seek(cursor, io.SeekStart)
+	if err != nil {
+		return nil, errors.Errorf("failed to seek in log file %q: %w", logPath, err)
+	}
+
+	buf := make([]byte, maxLogPollSize)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	data := buf[:n]
+
+	eof := offset+int64(n) >= logSize
+	// a partial last line is returned only when it won't be completed, or when
+	// it alone exceeds the max poll size
+	if !(finished && eof) {
+		if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+			data = data[:i+1]
+		} else if n < len(buf) {
+			data = data[:0]
+		}
+	}
+	offset += int64(len(data))
+
+	if !rawMarkers {
+		var out bytes.Buffer
+		sw := newMarkerStripWriter(&out)
+		if _, err := sw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := sw.Flush(); err != nil {
+			return nil, err
+		}
+		data = out.Bytes()
+	}
+
+	return &LogPollResponse{
+		Data:     string(data),
+		Cursor:   offset,
+		Finished: finished && offset >= logSize,
+	}, nil
+}
+
+type logStatsHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewLogStatsHandler(logger *zap.Logger, e *Executor) *logStatsHandler {
+	return &logStatsHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns the lines count and the size of a log without reading it
+func (h *logStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+
+	sel, err := parseLogSelector(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+		return
+	}
+	if err := h.e.resolveLogSelector(taskID, sel); err != nil {
+		if util.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+			return
+		}
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	stats, err := h.e.logStats(taskID, sel)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		case errors.Is(err, errLogGone):
+			httpError(w, http.StatusGone, ErrorCodeLogGone, taskID, "log not available anymore")
+		default:
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := httpResponse(w, http.StatusOK, stats); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+type logPageHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewLogPageHandler(logger *zap.Logger, e *Executor) *logPageHandler {
+	return &logPageHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns a page of the lines of a log with the total lines and
+// pages
+func (h *logPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+
+	sel, err := parseLogSelector(q)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+		return
+	}
+
+	page := 1
+	if pageStr := q.Get("page"); pageStr != "" {
+		page, err = strconv.Atoi(pageStr)
+		if err != nil || page < 1 {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid page")
+			return
+		}
+	}
+	pageSize := defaultLogPageSize
+	if pageSizeStr := q.Get("pagesize"); pageSizeStr != "" {
+		pageSize, err = strconv.Atoi(pageSizeStr)
+		if err != nil || pageSize < 1 || pageSize > maxLogPageSize {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, fmt.Sprintf("invalid pagesize, must be between 1 and %d", maxLogPageSize))
+			return
+		}
+	}
+
+	// step markers are stripped by default
+	rawMarkers := false
+	if _, ok := q["raw_markers"]; ok {
+		rawMarkers, err = parseBoolParam(q.Get("raw_markers"))
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid raw_markers")
+			return
+		}
+	}
+
+	if err := h.e.resolveLogSelector(taskID, sel); err != nil {
+		if util.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+			return
+		}
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	p, err := h.e.logPage(taskID, sel, page, pageSize, rawMarkers)
+	if err != nil {
+		switch {
+		case os.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "log not found")
+		case errors.Is(err, errLogGone):
+			httpError(w, http.StatusGone, ErrorCodeLogGone, taskID, "log not available anymore")
+		default:
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := httpResponse(w, http.StatusOK, p); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+type taskJSONLogsHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTaskJSONLogsHandler(logger *zap.Logger, e *Executor) *taskJSONLogsHandler {
+	return &taskJSONLogsHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP streams the lines of all the task steps logs as json lines, every
+// one with the step that produced it
+func (h *taskJSONLogsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["taskid"]
+	q := r.URL.Query()
+
+	attempt := 0
+	if attemptStr := q.Get("attempt"); attemptStr != "" {
+		var err error
+		attempt, err = strconv.Atoi(attemptStr)
+		if err != nil || attempt <= 0 {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid attempt")
+			return
+		}
+	}
+	_, follow := q["follow"]
+
+	m, err := h.e.getTaskManifest(taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task not found")
+			return
+		}
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+	sel := &logSelector{substep: -1, attempt: attempt}
+	if err := h.e.resolveLogSelector(taskID, sel); err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	ctx := r.Context()
+	var out io.Writer = w
+	if follow {
+		follower, ok := h.e.acquireLogFollow(w, taskID)
+		if !ok {
+			return
+		}
+		defer follower.release()
+		out = follower.writer(w)
+
+		// a shed follow just ends, the client reconnects like after a
+		// connection drop
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-follower.shedC():
+				cancel()
+			}
+		}()
+	}
+
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := h.e.writeTaskJSONLogs(ctx, out, flusher, taskID, sel.attempt, m.Steps, follow); err != nil {
+		// the logs not persisted are removed when the task finishes
+		if !errors.Is(err, errLogGone) {
+			h.log.Errorf("err: %+v", err)
+		}
+	}
+}
+
+type archivesHandler struct {
+	e *Executor
+}
+
+func NewArchivesHandler(e *Executor) *archivesHandler {
+	return &archivesHandler{e: e}
+}
+
+func (h *archivesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+	s := q.Get("step")
+	if s == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "missing step")
+		return
+	}
+	step, err := strconv.Atoi(s)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid step")
+		return
+	}
+
+	release, ok := h.e.acquireStream(w, taskID, streamArchiveDownload)
+	if !ok {
+		return
+	}
+	defer release()
+
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if err := h.readArchive(taskID, step, w); err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "archive not found")
+		} else {
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+}
+
+func (h *archivesHandler) readArchive(taskID string, step int, w http.ResponseWriter) error {
+	archivePath := h.e.archivePath(taskID, step)
+	defer h.e.archives.acquire(archivePath)()
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+
+	_, err = h.e.archiveBuffers.copy(w, f)
+	return err
+}
+
+// ArchiveExistsResponse reports if a task step archive exists. Digest is the
+// archive sha256 digest, it's empty when not known
+type ArchiveExistsResponse struct {
+	Exists   bool              `json:"exists"`
+	Size     int64             `json:"size"`
+	Digest   string            `json:"digest"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type archiveExistsHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewArchiveExistsHandler(logger *zap.Logger, e *Executor) *archiveExistsHandler {
+	return &archiveExistsHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP reports if the archive of a task step exists and its size and
+// digest without sending the archive
+func (h *archiveExistsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+	s := q.Get("step")
+	if s == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "missing step")
+		return
+	}
+	step, err := strconv.Atoi(s)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid step")
+		return
+	}
+
+	res := &ArchiveExistsResponse{}
+	archivePath := h.e.archivePath(taskID, step)
+	fi, err := os.Stat(archivePath)
+	if err != nil && !os.IsNotExist(err) {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+	if err == nil {
+		res.Exists = true
+		res.Size = fi.Size()
+		res.Digest = archiveDigest(archivePath, fi)
+		res.Metadata, err = readArchiveMetadata(archivePath)
+		if err != nil {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			return
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := httpResponse(w, http.StatusOK, res); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+// ArchiveInfo describes a stored task step archive
+type ArchiveInfo struct {
+	Step     int               `json:"step"`
+	Size     int64             `json:"size"`
+	Digest   string            `json:"digest"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+type archivesListHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewArchivesListHandler(logger *zap.Logger, e *Executor) *archivesListHandler {
+	return &archivesListHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns the stored archives of a task, ordered by step, with their
+// metadata
+func (h *archivesListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := r.URL.Query().Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+
+	steps, err := h.e.taskArchiveSteps(taskID)
+	if err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	archives := []*ArchiveInfo{}
+	for _, step := range steps {
+		archivePath := h.e.archivePath(taskID, step)
+		fi, err := os.Stat(archivePath)
+		if err != nil {
+			// the archive could have been just evicted
+			if os.IsNotExist(err) {
+				continue
+			}
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			return
+		}
+		metadata, err := readArchiveMetadata(archivePath)
+		if err != nil {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			return
+		}
+		archives = append(archives, &ArchiveInfo{
+			Step:     step,
+			Size:     fi.Size(),
+			Digest:   archiveDigest(archivePath, fi),
+			Metadata: metadata,
+		})
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := httpResponse(w, http.StatusOK, archives); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+type allArchivesHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewAllArchivesHandler(logger *zap.Logger, e *Executor) *allArchivesHandler {
+	return &allArchivesHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP streams a tar containing the entries of all the task step archives.
+// Every step archive is placed under a directory named after the step. The tar
+// is gzipped if the gzip query parameter is provided
+func (h *allArchivesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+	_, compress := q["gzip"]
+
+	release, ok := h.e.acquireStream(w, taskID, streamArchiveDownload)
+	if !ok {
+		return
+	}
+	defer release()
+
+	steps, err := h.e.taskArchiveSteps(taskID)
+	if err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	// step names are only used for the directory names, if the manifest isn't
+	// available the step index is used
+	var stepNames []string
+	if m, err := h.e.getTaskManifest(taskID); err == nil {
+		for _, s := range m.Steps {
+			stepNames = append(stepNames, s.Name)
+		}
+	}
+
+	filename := taskID + "-archives.tar"
+	contentType := "application/x-tar"
+	if compress {
+		filename += ".gz"
+		contentType = "application/gzip"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	var out io.Writer = w
+	if compress {
+		gw := h.e.newGzipWriter(w)
+		defer gw.Close()
+		out = gw
+	}
+	tw := tar.NewWriter(out)
+	defer tw.Close()
+
+	for _, step := range steps {
+		var stepName string
+		if step < len(stepNames) {
+			stepName = stepNames[step]
+		}
+		if err := h.writeStepArchive(tw, taskID, step, archiveStepDir(step, stepName)); err != nil {
+			// the response has already started, just stop sending it
+			h.log.Errorf("err: %+v", err)
+			return
+		}
+	}
+}
+
+func archiveStepDir(step int, stepName string) string {
+	if stepName == "" {
+		return fmt.Sprintf("step-%d", step)
+	}
+	stepName = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, stepName)
+	return fmt.Sprintf("%d-%s", step, stepName)
+}
+
+func (h *allArchivesHandler) writeStepArchive(tw *tar.Writer, taskID string, step int, dir string) error {
+	archivePath := h.e.archivePath(taskID, step)
+	defer h.e.archives.acquire(archivePath)()
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(h.e.archiveBuffers.reader(f))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Errorf("failed to read step %d archive: %w", step, err)
+		}
+		hdr.Name = path.Join(dir, hdr.Name)
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(dir, hdr.Linkname)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := h.e.archiveBuffers.copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+type taskBundleHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTaskBundleHandler(logger *zap.Logger, e *Executor) *taskBundleHandler {
+	return &taskBundleHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP streams a gzipped tar containing the task manifest, timings, logs
+// and archives
+func (h *taskBundleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["taskid"]
+
+	m, err := h.e.getTaskManifest(taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task not found")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	release, ok := h.e.acquireStream(w, taskID, streamArchiveDownload)
+	if !ok {
+		return
+	}
+	defer release()
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", taskID+"-bundle.tar.gz"))
+	w.Header().Set("Cache-Control", "no-cache")
+
+	gw := h.e.newGzipWriter(w)
+	defer gw.Close()
+	tw := tar.NewWriter(gw)
+	defer tw.Close()
+
+	if err := h.e.writeTaskBundle(tw, taskID, m); err != nil {
+		// the response has already started, just stop sending it
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+type archiveByDigestHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewArchiveByDigestHandler(logger *zap.Logger, e *Executor) *archiveByDigestHandler {
+	return &archiveByDigestHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP streams the archive with the sha256 digest provided in the path.
+// The same content archived by different tasks or steps is served from a
+// single archive
+func (h *archiveByDigestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	digest := mux.Vars(r)["digest"]
+
+	release, ok := h.e.acquireStream(w, "", streamArchiveDownload)
+	if !ok {
+		return
+	}
+	defer release()
+
+	f, err := h.e.archiveByDigest(digest)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, "", "archive not found")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, "", "internal server error")
+		}
+		return
+	}
+	defer f.Close()
+	defer h.e.archives.acquire(f.Name())()
+	fi, err := f.Stat()
+	if err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, "", "internal server error")
+		return
+	}
+
+	// the content never changes for a digest
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"sha256:`+digest+`"`)
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+
+	if _, err := h.e.archiveBuffers.copy(w, f); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+type eventsHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewEventsHandler(logger *zap.Logger, e *Executor) *eventsHandler {
+	return &eventsHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP streams the executor events as server sent events. Events can be
+// filtered by task id using the taskid query parameter.
+// A slow client never blocks the execution loop: events that cannot be
+// buffered are dropped and reported with a dropped event, so clients must
+// handle gaps (i.e. refetching the task status)
+func (h *eventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	taskID := q.Get("taskid")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "streaming not supported")
+		return
+	}
+
+	sub := h.e.events.subscribe(taskID)
+	defer h.e.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-sub.c:
+			evj, err := json.Marshal(ev)
+			if err != nil {
+				h.log.Errorf("err: %+v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", evj); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// StepStats is a resource usage sample of the main container of a running step
+type StepStats struct {
+	TaskID string `json:"task_id"`
+	Step   int    `json:"step"`
+	*driver.ContainerStats
+}
+
+type stepStatsHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewStepStatsHandler(logger *zap.Logger, e *Executor) *stepStatsHandler {
+	return &stepStatsHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP streams, as server sent events, the resource usage of the task
+// main container sampled while the step is running. The stream waits for the
+// step to start and is closed when the step finishes. The interval query
+// parameter overrides the executor sampling interval.
+func (h *stepStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	taskID := vars["taskid"]
+	step, err := strconv.Atoi(vars["step"])
+	if err != nil || step < 0 {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid step")
+		return
+	}
+
+	interval := h.e.c.StepStatsInterval
+	if interval == 0 {
+		interval = defaultStepStatsInterval
+	}
+	if intervalStr := r.URL.Query().Get("interval"); intervalStr != "" {
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil || interval < minStepStatsInterval {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, fmt.Sprintf("invalid interval, must be at least %s", minStepStatsInterval))
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "streaming not supported")
+		return
+	}
+
+	ctx := r.Context()
+	pod, _, err := h.e.stepPod(taskID, step)
+	if err != nil {
+		switch {
+		case util.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+		case util.IsBadRequest(err):
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+		default:
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+	if _, err := pod.Stats(ctx); err != nil {
+		if errors.Is(err, driver.ErrNotSupported) {
+			httpError(w, http.StatusNotImplemented, ErrorCodeNotSupported, taskID, "the executor driver cannot report the container stats")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		pod, phase, err := h.e.stepPod(taskID, step)
+		if err != nil || phase.IsFinished() {
+			return
+		}
+		if phase == types.ExecutorTaskPhaseRunning {
+			stats, err := pod.Stats(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					h.log.Errorf("err: %+v", err)
+				}
+				return
+			}
+			statsj, err := json.Marshal(&StepStats{TaskID: taskID, Step: step, ContainerStats: stats})
+			if err != nil {
+				h.log.Errorf("err: %+v", err)
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", statsj); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// ErrorCode is the machine readable reason of an executor api error
+type ErrorCode string
+
+const (
+	ErrorCodeBadRequest          ErrorCode = "bad_request"
+	ErrorCodeInvalidTask         ErrorCode = "invalid_task"
+	ErrorCodeUnsupportedEncoding ErrorCode = "unsupported_encoding"
+	ErrorCodeRequestTooLarge     ErrorCode = "request_too_large"
+	ErrorCodeNotFound            ErrorCode = "not_found"
+	ErrorCodeLogGone             ErrorCode = "log_gone"
+	ErrorCodeLogDiffTooLarge     ErrorCode = "log_diff_too_large"
+	ErrorCodeUnauthorized        ErrorCode = "unauthorized"
+	ErrorCodeForbidden           ErrorCode = "forbidden"
+	ErrorCodeConflict            ErrorCode = "conflict"
+	ErrorCodeNotSupported        ErrorCode = "not_supported"
+	ErrorCodeUnavailable         ErrorCode = "unavailable"
+	ErrorCodeInternal            ErrorCode = "internal_error"
+)
+
+// ErrorResponse is the body of the executor api error responses
+type ErrorResponse struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	TaskID  string    `json:"taskid,omitempty"`
+}
+
+// httpError writes a json error response. The message is returned to the
+// client so it must not contain internal error details, they should only be
+// logged.
+func httpError(w http.ResponseWriter, status int, code ErrorCode, taskID, message string) {
+	_ = httpResponse(w, status, &ErrorResponse{
+		Code:    code,
+		Message: message,
+		TaskID:  taskID,
+	})
+}
+
+func httpResponse(w http.ResponseWriter, code int, res interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+
+	if res != nil {
+		resj, err := json.Marshal(res)
+		if err != nil {
+			http.Error(w, "", http.StatusInternalServerError)
+			return err
+		}
+		w.WriteHeader(code)
+		_, err = w.Write(resj)
+		return err
+	}
+
+	w.WriteHeader(code)
+	return nil
+}
+
+// adminAuthHandler allows requests only when they provide the executor admin
+// token in the Authorization header in format "token THETOKEN". If no admin
+// token is configured the admin endpoints are disabled
+type adminAuthHandler struct {
+	next       http.Handler
+	adminToken string
+}
+
+func NewAdminAuthHandler(adminToken string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return &adminAuthHandler{
+			next:       h,
+			adminToken: adminToken,
+		}
+	}
+}
+
+func (h *adminAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.adminToken == "" {
+		httpError(w, http.StatusForbidden, ErrorCodeForbidden, "", "admin endpoints are disabled")
+		return
+	}
+
+	auth := r.Header.Get("Authorization")
+	const prefix = "token "
+	if len(auth) <= len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		httpError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "", "missing admin token")
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(h.adminToken)) != 1 {
+		httpError(w, http.StatusUnauthorized, ErrorCodeUnauthorized, "", "invalid admin token")
+		return
+	}
+
+	h.next.ServeHTTP(w, r)
+}
+
+type taskTimingsHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTaskTimingsHandler(logger *zap.Logger, e *Executor) *taskTimingsHandler {
+	return &taskTimingsHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+func (h *taskTimingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["taskid"]
+
+	m, err := h.e.getTaskManifest(taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task not found")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	if err := httpResponse(w, http.StatusOK, m.timings(time.Now())); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+// maxPreloadSteps is the max number of steps whose first log page is
+// advertised as a preload resource of the task manifest
+const maxPreloadSteps = 20
+
+type taskManifestHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTaskManifestHandler(logger *zap.Logger, e *Executor) *taskManifestHandler {
+	return &taskManifestHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns the task manifest, the first resource fetched by a task
+// page. The resources a task page fetches next, the task timings and the
+// first log page of the steps, are advertised with preload Link headers and,
+// to the HTTP/2 clients accepting it, pushed.
+func (h *taskManifestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["taskid"]
+
+	m, err := h.e.getTaskManifest(taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task not found")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	escapedID := url.PathEscape(taskID)
+	resources := []string{fmt.Sprintf("/api/v1alpha/executor/tasks/%s/timings", escapedID)}
+	for i := range m.Steps {
+		if i >= maxPreloadSteps {
+			break
+		}
+		if i >= len(m.Status.Steps) || m.Status.Steps[i].Phase == types.ExecutorTaskPhaseNotStarted {
+			continue
+		}
+		q := url.Values{}
+		q.Set("taskid", taskID)
+		q.Set("step", strconv.Itoa(i))
+		resources = append(resources, "/api/v1alpha/executor/logs/page?"+q.Encode())
+	}
+
+	pusher, _ := w.(http.Pusher)
+	for _, res := range resources {
+		w.Header().Add("Link", fmt.Sprintf("<%s>; rel=preload; as=fetch; crossorigin", res))
+		if pusher != nil {
+			if err := pusher.Push(res, nil); err != nil {
+				// the client disabled the pushes
+				if err != http.ErrNotSupported {
+					h.log.Debugf("failed to push %q: %v", res, err)
+				}
+				pusher = nil
+			}
+		}
+	}
+
+	if err := httpResponse(w, http.StatusOK, m); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
 }
 
-func (h *taskSubmissionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var et *types.ExecutorTask
-	d := json.NewDecoder(r.Body)
+// TaskStatusSnapshot is the task status written by the task status stream
+type TaskStatusSnapshot struct {
+	TaskID string                          `json:"task_id"`
+	Phase  types.ExecutorTaskPhase         `json:"phase"`
+	Steps  []*types.ExecutorTaskStepStatus `json:"steps"`
+}
 
-	if err := d.Decode(&et); err != nil {
-		http.Error(w, "", http.StatusInternalServerError)
-		return
+// finished reports if the task and all its steps are finished
+func (s *TaskStatusSnapshot) finished() bool {
+	if s.Phase.IsFinished() {
+		return true
+	}
+	for _, step := range s.Steps {
+		if !step.Phase.IsFinished() {
+			return false
+		}
 	}
+	return len(s.Steps) > 0
+}
 
-	h.c <- et
+// stepPhasesEqual reports if the steps of the two snapshots have the same phases
+func (s *TaskStatusSnapshot) stepPhasesEqual(o *TaskStatusSnapshot) bool {
+	if s.Phase != o.Phase || len(s.Steps) != len(o.Steps) {
+		return false
+	}
+	for i, step := range s.Steps {
+		if step.Phase != o.Steps[i].Phase {
+			return false
+		}
+	}
+	return true
 }
 
-type logsHandler struct {
+type taskStatusStreamHandler struct {
 	log *zap.SugaredLogger
 	e   *Executor
 }
 
-func NewLogsHandler(logger *zap.Logger, e *Executor) *logsHandler {
-	return &logsHandler{
+func NewTaskStatusStreamHandler(logger *zap.Logger, e *Executor) *taskStatusStreamHandler {
+	return &taskStatusStreamHandler{
 		log: logger.Sugar(),
 		e:   e,
 	}
 }
 
-func (h *logsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
+// ServeHTTP writes a newline delimited json task status snapshot at the start
+// and every time a step phase changes. The response ends when all the steps
+// are finished.
+func (h *taskStatusStreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["taskid"]
 
-	taskID := q.Get("taskid")
-	if taskID == "" {
-		http.Error(w, "", http.StatusBadRequest)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "streaming not supported")
 		return
 	}
 
-	_, setup := q["setup"]
-	stepStr := q.Get("step")
-	if !setup && stepStr == "" {
-		http.Error(w, "", http.StatusBadRequest)
-		return
-	}
-	if setup && stepStr != "" {
-		http.Error(w, "", http.StatusBadRequest)
+	// subscribe before taking the first snapshot to not miss any change
+	sub := h.e.events.subscribe(taskID)
+	defer h.e.events.unsubscribe(sub)
+
+	snapshot, err := h.e.taskStatusSnapshot(taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task not found")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
 		return
 	}
 
-	var step int
-	if stepStr != "" {
-		var err error
-		step, err = strconv.Atoi(stepStr)
-		if err != nil {
-			http.Error(w, "", http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	enc := json.NewEncoder(w)
+	ctx := r.Context()
+	for {
+		if err := enc.Encode(snapshot); err != nil {
+			return
+		}
+		flusher.Flush()
+		if snapshot.finished() {
 			return
 		}
+
+		last := snapshot
+		for snapshot.stepPhasesEqual(last) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sub.c:
+			}
+			// every event could be related to a phase change (also the dropped
+			// events since the missed ones could be), so check a new snapshot
+			snapshot, err = h.e.taskStatusSnapshot(taskID)
+			if err != nil {
+				h.log.Errorf("err: %+v", err)
+				return
+			}
+		}
 	}
+}
 
-	follow := false
-	_, ok := q["follow"]
-	if ok {
-		follow = true
+// ExecutorStatus is the executor local status
+type ExecutorStatus struct {
+	ID               string `json:"id"`
+	ActiveTasksLimit int    `json:"active_tasks_limit"`
+	ActiveTasks      int    `json:"active_tasks"`
+	// Ready is true when the executor accepts the submitted tasks
+	Ready bool `json:"ready"`
+	// QueuedTasks are the tasks waiting to be started in start order
+	QueuedTasks []*QueuedTask `json:"queued_tasks"`
+	// ConcurrencyGroups are the concurrency groups with a running or queued
+	// task
+	ConcurrencyGroups []*ConcurrencyGroupStatus `json:"concurrency_groups"`
+	// ArchiveVolumeError is the error making the archive volume not
+	// writable, empty when it's writable
+	ArchiveVolumeError string `json:"archive_volume_error,omitempty"`
+}
+
+type executorStatusHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewExecutorStatusHandler(logger *zap.Logger, e *Executor) *executorStatusHandler {
+	return &executorStatusHandler{
+		log: logger.Sugar(),
+		e:   e,
 	}
+}
 
-	if err := h.readTaskLogs(taskID, setup, step, w, follow); err != nil {
+func (h *executorStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	queued := h.e.taskQueue.list()
+	status := &ExecutorStatus{
+		ID:                h.e.id,
+		ActiveTasksLimit:  h.e.c.ActiveTasksLimit,
+		ActiveTasks:       h.e.runningTasks.len(),
+		Ready:             h.e.isReady() && h.e.archiveVolumeReadinessErr() == nil,
+		QueuedTasks:       queued,
+		ConcurrencyGroups: h.e.concurrencyGroupsStatus(queued),
+	}
+	if err := h.e.archiveVolumeErr(); err != nil {
+		status.ArchiveVolumeError = err.Error()
+	}
+	if err := httpResponse(w, http.StatusOK, status); err != nil {
 		h.log.Errorf("err: %+v", err)
 	}
 }
 
-func (h *logsHandler) readTaskLogs(taskID string, setup bool, step int, w http.ResponseWriter, follow bool) error {
-	var logPath string
-	if setup {
-		logPath = h.e.setupLogPath(taskID)
-	} else {
-		logPath = h.e.stepLogPath(taskID, step)
+type executorReadyHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewExecutorReadyHandler(logger *zap.Logger, e *Executor) *executorReadyHandler {
+	return &executorReadyHandler{
+		log: logger.Sugar(),
+		e:   e,
 	}
-	return h.readLogs(taskID, setup, step, logPath, w, follow)
 }
 
-func (h *logsHandler) readLogs(taskID string, setup bool, step int, logPath string, w http.ResponseWriter, follow bool) error {
-	f, err := os.Open(logPath)
-	if err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "", http.StatusNotFound)
-		} else {
-			http.Error(w, "", http.StatusInternalServerError)
-		}
-		return err
+// ServeHTTP is the executor readiness probe. It returns 503 until the
+// executor accepts the submitted tasks and, when configured, while the
+// archive volume isn't writable
+func (h *executorReadyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.e.isReady() {
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, "", "executor not ready")
+		return
 	}
-	defer f.Close()
+	if err := h.e.archiveVolumeReadinessErr(); err != nil {
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, "", fmt.Sprintf("executor not ready: %v", err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Connection", "keep-alive")
+type selfTestHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
 
-	buf := make([]byte, 4096)
+func NewSelfTestHandler(logger *zap.Logger, e *Executor) *selfTestHandler {
+	return &selfTestHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
 
-	// if not following return the Content-Length
-	if !follow {
-		fi, err := f.Stat()
-		if err != nil {
-			return err
-		}
-		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+func (h *selfTestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report, err := h.e.selfTest(r.Context())
+	if err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusConflict, ErrorCodeConflict, "", "a self test is already running")
+		return
 	}
 
-	// write and flush the headers so the client will receive the response
-	// header also if there're currently no lines to send
-	w.WriteHeader(http.StatusOK)
-	var flusher http.Flusher
-	if fl, ok := w.(http.Flusher); ok {
-		flusher = fl
+	if err := httpResponse(w, http.StatusOK, report); err != nil {
+		h.log.Errorf("err: %+v", err)
 	}
-	if flusher != nil {
-		flusher.Flush()
+}
+
+type taskPauseHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+	// resume is true if the handler resumes the task instead of pausing it
+	resume bool
+}
+
+func NewTaskPauseHandler(logger *zap.Logger, e *Executor) *taskPauseHandler {
+	return &taskPauseHandler{
+		log: logger.Sugar(),
+		e:   e,
 	}
+}
 
-	stop := false
-	flushstop := false
-	for {
-		if stop {
-			return nil
+func NewTaskResumeHandler(logger *zap.Logger, e *Executor) *taskPauseHandler {
+	return &taskPauseHandler{
+		log:    logger.Sugar(),
+		e:      e,
+		resume: true,
+	}
+}
+
+func (h *taskPauseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["taskid"]
+
+	var err error
+	if h.resume {
+		err = h.e.resumeTask(r.Context(), taskID)
+	} else {
+		err = h.e.pauseTask(r.Context(), taskID)
+	}
+	if err != nil {
+		switch {
+		case util.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+		case util.IsBadRequest(err):
+			httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, err.Error())
+		case errors.Is(err, driver.ErrNotSupported):
+			httpError(w, http.StatusNotImplemented, ErrorCodeNotSupported, taskID, "the executor driver cannot pause tasks")
+		default:
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
 		}
-		n, err := f.Read(buf)
-		if err != nil {
-			if err != io.EOF {
-				return err
-			}
-			if !flushstop && follow {
-				if _, err := f.Seek(-int64(n), io.SeekCurrent); err != nil {
-					return errors.Errorf("failed to seek in log file %q: %w", logPath, err)
-				}
-				// check if the step is finished, if so flush until EOF and stop
-				rt, ok := h.e.runningTasks.get(taskID)
-				if !ok {
-					flushstop = true
-				} else {
-					rt.Lock()
-					if rt.et.Status.Steps[step].Phase.IsFinished() {
-						flushstop = true
-					}
-					rt.Unlock()
-				}
-				// TODO(sgotti) use ionotify/fswatcher?
-				time.Sleep(500 * time.Millisecond)
-				continue
-			} else {
-				stop = true
-			}
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// LogLevel is the executor log level request and response
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+type logLevelHandler struct {
+	log   *zap.SugaredLogger
+	level zap.AtomicLevel
+}
+
+func NewLogLevelHandler(logger *zap.Logger, level zap.AtomicLevel) *logLevelHandler {
+	return &logLevelHandler{
+		log:   logger.Sugar(),
+		level: level,
+	}
+}
+
+// ServeHTTP returns the current log level on GET and changes it on POST
+func (h *logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var req LogLevel
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "invalid request")
+			return
 		}
-		if _, err := w.Write(buf[:n]); err != nil {
-			return err
+		var l zapcore.Level
+		switch req.Level {
+		case "debug":
+			l = zapcore.DebugLevel
+		case "info":
+			l = zapcore.InfoLevel
+		case "warn":
+			l = zapcore.WarnLevel
+		case "error":
+			l = zapcore.ErrorLevel
+		default:
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", fmt.Sprintf("unsupported log level %q", req.Level))
+			return
 		}
-		if flusher != nil {
-			flusher.Flush()
+		if old := h.level.Level(); old != l {
+			h.level.SetLevel(l)
+			h.log.Infof("log level changed from %s to %s", old, l)
 		}
 	}
+
+	if err := httpResponse(w, http.StatusOK, &LogLevel{Level: h.level.Level().String()}); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
 }
 
-type archivesHandler struct {
-	e *Executor
+// PrewarmRequest are the images to pull in the executor host image cache
+type PrewarmRequest struct {
+	Images []string `json:"images"`
 }
 
-func NewArchivesHandler(e *Executor) *archivesHandler {
-	return &archivesHandler{e: e}
+type prewarmHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
 }
 
-func (h *archivesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
+func NewPrewarmHandler(logger *zap.Logger, e *Executor) *prewarmHandler {
+	return &prewarmHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
 
-	taskID := q.Get("taskid")
-	if taskID == "" {
-		http.Error(w, "", http.StatusBadRequest)
+// ServeHTTP queues, on POST, the images to pull in background and returns
+// their status. On GET it returns the status of all the prewarmed images
+func (h *prewarmHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		if err := httpResponse(w, http.StatusOK, h.e.prewarmer.list()); err != nil {
+			h.log.Errorf("err: %+v", err)
+		}
 		return
 	}
-	s := q.Get("step")
-	if s == "" {
-		http.Error(w, "", http.StatusBadRequest)
+
+	var req PrewarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "invalid request")
 		return
 	}
-	step, err := strconv.Atoi(s)
+	if len(req.Images) == 0 {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "no images provided")
+		return
+	}
+	images := make([]string, len(req.Images))
+	for i, image := range req.Images {
+		normalized, _, err := registry.NormalizeImage(image)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", fmt.Sprintf("invalid image %q", image))
+			return
+		}
+		images[i] = normalized
+	}
+
+	if err := httpResponse(w, http.StatusAccepted, h.e.prewarmer.add(images)); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+// ExecutorConfig is the executor effective configuration with the secrets
+// redacted
+type ExecutorConfig struct {
+	ID      string          `json:"id"`
+	Version string          `json:"version"`
+	Config  json.RawMessage `json:"config"`
+}
+
+type adminConfigHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewAdminConfigHandler(logger *zap.Logger, e *Executor) *adminConfigHandler {
+	return &adminConfigHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+func (h *adminConfigHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c, err := redactedConfig(h.e.c)
 	if err != nil {
-		http.Error(w, "", http.StatusBadRequest)
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, "", "failed to get executor config")
 		return
 	}
+	res := &ExecutorConfig{
+		ID:      h.e.id,
+		Version: cmd.Version,
+		Config:  c,
+	}
+	if err := httpResponse(w, http.StatusOK, res); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
 
-	w.Header().Set("Cache-Control", "no-cache")
+// Capabilities are the executor limits and features exposed to the clients
+type Capabilities struct {
+	// MaxArchiveSize is the max size in bytes of a step archive. 0 means no
+	// limit
+	MaxArchiveSize int64 `json:"max_archive_size"`
+	// TaskDiskQuota is the max size in bytes of the logs and archives written
+	// by a task. 0 means no limit
+	TaskDiskQuota int64 `json:"task_disk_quota"`
+	// MaxLogLineLength is the max length of a log line, longer lines are split
+	MaxLogLineLength int `json:"max_log_line_length"`
+	// NetworkModes are the task network modes allowed
+	NetworkModes []string `json:"network_modes"`
+	// MaxStepUlimits are the max run steps ulimits, only these ulimits can be
+	// set
+	MaxStepUlimits map[string]int64 `json:"max_step_ulimits,omitempty"`
+	// ImageRegistries are the registries the containers images can be pulled
+	// from. Empty means all the registries
+	ImageRegistries []string `json:"image_registries,omitempty"`
+}
 
-	if err := h.readArchive(taskID, step, w); err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "", http.StatusNotFound)
-		} else {
-			http.Error(w, "", http.StatusInternalServerError)
+type capabilitiesHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewCapabilitiesHandler(logger *zap.Logger, e *Executor) *capabilitiesHandler {
+	return &capabilitiesHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+func (h *capabilitiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := httpResponse(w, http.StatusOK, h.e.capabilities()); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
+
+type taskHistoryHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTaskHistoryHandler(logger *zap.Logger, e *Executor) *taskHistoryHandler {
+	return &taskHistoryHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns the recently finished tasks, from the newest. The limit
+// query parameter limits the number of returned tasks
+func (h *taskHistoryHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "invalid limit")
+			return
 		}
-		return
+	}
+
+	if err := httpResponse(w, http.StatusOK, h.e.taskHistory.recent(limit)); err != nil {
+		h.log.Errorf("err: %+v", err)
 	}
 }
 
-func (h *archivesHandler) readArchive(taskID string, step int, w http.ResponseWriter) error {
-	archivePath := h.e.archivePath(taskID, step)
+type closeStepLogHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
 
-	f, err := os.Open(archivePath)
-	if err != nil {
-		return err
+func NewCloseStepLogHandler(logger *zap.Logger, e *Executor) *closeStepLogHandler {
+	return &closeStepLogHandler{
+		log: logger.Sugar(),
+		e:   e,
 	}
-	defer f.Close()
-	fi, err := f.Stat()
+}
+
+func (h *closeStepLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	taskID := vars["taskid"]
+	step, err := strconv.Atoi(vars["step"])
 	if err != nil {
-		return err
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid step")
+		return
 	}
 
-	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
-
-	br := bufio.NewReader(f)
+	if err := h.e.closeStepLog(r.Context(), taskID, step); err != nil {
+		if util.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
 
-	_, err = io.Copy(w, br)
-	return err
+	w.WriteHeader(http.StatusNoContent)
 }
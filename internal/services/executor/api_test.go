@@ -0,0 +1,124 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+
+	"go.uber.org/zap"
+)
+
+func TestTaskSubmissionBeforeReady(t *testing.T) {
+	e := &Executor{
+		c:     &config.Executor{},
+		ready: make(chan struct{}),
+	}
+	// nothing receives the submitted tasks during the startup window
+	ch := make(chan *types.ExecutorTask)
+	h := NewTaskSubmissionHandler(zap.NewNop(), e, ch)
+
+	submit := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/v1alpha/executor", strings.NewReader(`{"id":"task01"}`))
+		done := make(chan struct{})
+		go func() {
+			h.ServeHTTP(w, r)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("task submission didn't return")
+		}
+		return w
+	}
+
+	w := submit()
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header")
+	}
+
+	rh := NewExecutorReadyHandler(zap.NewNop(), e)
+	rw := httptest.NewRecorder()
+	rh.ServeHTTP(rw, httptest.NewRequest("GET", "/api/v1alpha/executor/ready", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected readiness status %d, got %d", http.StatusServiceUnavailable, rw.Code)
+	}
+
+	// start receiving the submitted tasks like the execution loop does
+	received := make(chan *types.ExecutorTask, 1)
+	close(e.ready)
+	go func() {
+		received <- <-ch
+	}()
+
+	w = submit()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	if et := <-received; et.ID != "task01" {
+		t.Fatalf("expected task %q, got %q", "task01", et.ID)
+	}
+
+	rw = httptest.NewRecorder()
+	rh.ServeHTTP(rw, httptest.NewRequest("GET", "/api/v1alpha/executor/ready", nil))
+	if rw.Code != http.StatusOK {
+		t.Fatalf("expected readiness status %d, got %d", http.StatusOK, rw.Code)
+	}
+}
+
+func TestTaskSubmissionCanceled(t *testing.T) {
+	e := &Executor{
+		c:     &config.Executor{},
+		ready: make(chan struct{}),
+	}
+	close(e.ready)
+	// the execution loop is busy and doesn't receive the submitted task
+	ch := make(chan *types.ExecutorTask)
+	h := NewTaskSubmissionHandler(zap.NewNop(), e, ch)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/v1alpha/executor", strings.NewReader(`{"id":"task01"}`)).WithContext(ctx)
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(w, r)
+		close(done)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("task submission didn't return")
+	}
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status %d, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header")
+	}
+}
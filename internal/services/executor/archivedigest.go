@@ -0,0 +1,177 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	errors "golang.org/x/xerrors"
+)
+
+var archiveDigestRegexp = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// archiveDigestEntry is the digest index entry of an archive. The archive
+// size and modification time are used to detect archives rewritten after
+// being indexed
+type archiveDigestEntry struct {
+	Path    string `json:"path"`
+	Digest  string `json:"digest,omitempty"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+}
+
+func (e *Executor) archiveDigestsDir() string {
+	return filepath.Join(e.c.DataDir, "archivedigests")
+}
+
+// archiveDigestPath returns the path of the file, saved beside the archive,
+// recording the archive digest
+func archiveDigestPath(archivePath string) string {
+	return archivePath + ".digest"
+}
+
+// indexArchive records in the digest index the archive at archivePath with
+// the sha256 digest computed while writing it. When the same content is
+// produced by multiple steps the last written archive is used
+func (e *Executor) indexArchive(h hash.Hash, archivePath string) error {
+	fi, err := os.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	digest := hex.EncodeToString(h.Sum(nil))
+	entryj, err := json.Marshal(&archiveDigestEntry{
+		Path:    archivePath,
+		Digest:  digest,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime().UnixNano(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.writeDataFileAtomic(archiveDigestPath(archivePath), entryj); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(e.archiveDigestsDir(), 0770); err != nil {
+		return err
+	}
+	return e.writeDataFileAtomic(filepath.Join(e.archiveDigestsDir(), digest), entryj)
+}
+
+// archiveDigest returns the digest of the archive at archivePath, with file
+// info fi, or an empty string if the archive hasn't been indexed or has been
+// rewritten after being indexed
+func archiveDigest(archivePath string, fi os.FileInfo) string {
+	entryj, err := ioutil.ReadFile(archiveDigestPath(archivePath))
+	if err != nil {
+		return ""
+	}
+	var entry *archiveDigestEntry
+	if err := json.Unmarshal(entryj, &entry); err != nil {
+		return ""
+	}
+	if !entry.matches(fi) {
+		return ""
+	}
+	return entry.Digest
+}
+
+func (e *Executor) readArchiveDigestEntry(digest string) (*archiveDigestEntry, error) {
+	entryj, err := ioutil.ReadFile(filepath.Join(e.archiveDigestsDir(), digest))
+	if err != nil {
+		return nil, err
+	}
+	var entry *archiveDigestEntry
+	if err := json.Unmarshal(entryj, &entry); err != nil {
+		return nil, errors.Errorf("failed to unmarshal archive digest entry %q: %w", digest, err)
+	}
+	return entry, nil
+}
+
+// matches reports if the archive file is the one indexed by the entry
+func (entry *archiveDigestEntry) matches(fi os.FileInfo) bool {
+	return fi.Size() == entry.Size && fi.ModTime().UnixNano() == entry.ModTime
+}
+
+// archiveByDigest opens the archive with the provided sha256 digest. It returns
+// an os.ErrNotExist error if the digest is unknown or the indexed archive has
+// been removed or rewritten
+func (e *Executor) archiveByDigest(digest string) (*os.File, error) {
+	if !archiveDigestRegexp.MatchString(digest) {
+		return nil, os.ErrNotExist
+	}
+	entry, err := e.readArchiveDigestEntry(digest)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(entry.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			_ = os.Remove(filepath.Join(e.archiveDigestsDir(), digest))
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !entry.matches(fi) {
+		f.Close()
+		_ = os.Remove(filepath.Join(e.archiveDigestsDir(), digest))
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+// pruneArchiveDigests removes the digest index entries of the archives removed
+// or rewritten
+func (e *Executor) pruneArchiveDigests() error {
+	entries, err := ioutil.ReadDir(e.archiveDigestsDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, de := range entries {
+		digest := de.Name()
+		if !archiveDigestRegexp.MatchString(digest) {
+			continue
+		}
+		entry, err := e.readArchiveDigestEntry(digest)
+		if err != nil {
+			log.Warnf("removing archive digest entry %q: %v", digest, err)
+			_ = os.Remove(filepath.Join(e.archiveDigestsDir(), digest))
+			continue
+		}
+		fi, err := os.Stat(entry.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || !entry.matches(fi) {
+			if err := os.Remove(filepath.Join(e.archiveDigestsDir(), digest)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// archiveTracker keeps the archives being downloaded and the last time every
+// archive was used.
+type archiveTracker struct {
+	inUse    map[string]int
+	lastUsed map[string]time.Time
+	m        sync.Mutex
+}
+
+func newArchiveTracker() *archiveTracker {
+	return &archiveTracker{
+		inUse:    make(map[string]int),
+		lastUsed: make(map[string]time.Time),
+	}
+}
+
+// acquire marks the archive as being downloaded, the returned function must be
+// called when the download finished
+func (t *archiveTracker) acquire(archivePath string) func() {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.inUse[archivePath]++
+	t.lastUsed[archivePath] = time.Now()
+
+	return func() {
+		t.m.Lock()
+		defer t.m.Unlock()
+		t.inUse[archivePath]--
+		if t.inUse[archivePath] <= 0 {
+			delete(t.inUse, archivePath)
+		}
+	}
+}
+
+// written records the archive as just used
+func (t *archiveTracker) written(archivePath string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	t.lastUsed[archivePath] = time.Now()
+}
+
+type storedArchive struct {
+	path     string
+	lastUsed time.Time
+	removed  bool
+}
+
+// taskArchives returns the stored archives of a task
+func (e *Executor) taskArchives(taskID string) ([]*storedArchive, error) {
+	steps, err := e.taskArchiveSteps(taskID)
+	if err != nil {
+		return nil, err
+	}
+	var archives []*storedArchive
+	for _, step := range steps {
+		archivePath := e.archivePath(taskID, step)
+		fi, err := os.Stat(archivePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		archives = append(archives, &storedArchive{path: archivePath, lastUsed: fi.ModTime()})
+	}
+	return archives, nil
+}
+
+// evictArchives removes the least recently used archives exceeding the max
+// archives per task and per executor. Only the archives of the tasks already
+// fetched by the runservice, and kept by the task data retention, are
+// evicted: the archives of the task with id taskID, of the running tasks and
+// the ones being downloaded are never removed. The archives last use time is
+// the last download or, after an executor restart, the archive modification
+// time.
+func (e *Executor) evictArchives(taskID string) error {
+	if e.c.MaxTaskArchives == 0 && e.c.MaxArchives == 0 {
+		return nil
+	}
+
+	entries, err := ioutil.ReadDir(e.tasksDir())
+	if err != nil {
+		return err
+	}
+	var archives, evictable []*storedArchive
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		tID := entry.Name()
+		taskArchives, err := e.taskArchives(tID)
+		if err != nil {
+			return err
+		}
+		archives = append(archives, taskArchives...)
+		if !e.archivesEvictable(taskID, tID) {
+			continue
+		}
+		if e.c.MaxTaskArchives > 0 {
+			e.evictLRUArchives(taskArchives, taskArchives, e.c.MaxTaskArchives)
+		}
+		evictable = append(evictable, taskArchives...)
+	}
+
+	if e.c.MaxArchives > 0 {
+		e.evictLRUArchives(archives, evictable, e.c.MaxArchives)
+	}
+	return nil
+}
+
+// archivesEvictable reports if the archives of the task with id tID can be
+// evicted by the task with id taskID
+func (e *Executor) archivesEvictable(taskID, tID string) bool {
+	if tID == taskID {
+		return false
+	}
+	if _, ok := e.runningTasks.get(tID); ok {
+		return false
+	}
+	return e.taskFetched(tID)
+}
+
+// evictLRUArchives removes the least recently used evictable archives until
+// the stored archives don't exceed max. The removed archives are set as
+// removed.
+func (e *Executor) evictLRUArchives(archives, evictable []*storedArchive, max int) {
+	n := 0
+	for _, a := range archives {
+		if !a.removed {
+			n++
+		}
+	}
+	n -= max
+	if n <= 0 {
+		return
+	}
+
+	t := e.archives
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	for _, a := range evictable {
+		if lastUsed, ok := t.lastUsed[a.path]; ok && lastUsed.After(a.lastUsed) {
+			a.lastUsed = lastUsed
+		}
+	}
+	evictable = append([]*storedArchive{}, evictable...)
+	sort.Slice(evictable, func(i, j int) bool { return evictable[i].lastUsed.Before(evictable[j].lastUsed) })
+
+	for _, a := range evictable {
+		if n == 0 {
+			break
+		}
+		if a.removed || t.inUse[a.path] > 0 {
+			continue
+		}
+		log.Infof("evicting archive %q", a.path)
+		if err := os.Remove(a.path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("failed to remove archive %q: %+v", a.path, err)
+			continue
+		}
+		_ = os.Remove(archiveDigestPath(a.path))
+		_ = os.Remove(archiveMetadataPath(a.path))
+		delete(t.lastUsed, a.path)
+		a.removed = true
+		archiveEvictionsTotal.Inc()
+		n--
+	}
+}
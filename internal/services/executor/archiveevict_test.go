@@ -0,0 +1,132 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+)
+
+func TestEvictArchives(t *testing.T) {
+	tests := []struct {
+		name            string
+		maxTaskArchives int
+		maxArchives     int
+		// remaining are the remaining archives, as task/step, of the tasks
+		// below
+		remaining []string
+	}{
+		{
+			name:            "max task archives",
+			maxTaskArchives: 1,
+			remaining:       []string{"current/0", "current/1", "current/2", "fetched/2", "running/0", "running/1", "unfetched/0", "unfetched/1"},
+		},
+		{
+			name:        "max archives",
+			maxArchives: 8,
+			remaining:   []string{"current/0", "current/1", "current/2", "fetched/2", "running/0", "running/1", "unfetched/0", "unfetched/1"},
+		},
+		{
+			name:        "max archives lower than the not evictable archives",
+			maxArchives: 2,
+			remaining:   []string{"current/0", "current/1", "current/2", "running/0", "running/1", "unfetched/0", "unfetched/1"},
+		},
+		{
+			name:        "max archives not exceeded",
+			maxArchives: 10,
+			remaining:   []string{"current/0", "current/1", "current/2", "fetched/0", "fetched/1", "fetched/2", "running/0", "running/1", "unfetched/0", "unfetched/1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			logLayout, archiveLayout, err := newPathLayouts(config.ExecutorPathLayout{})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			e := &Executor{
+				c: &config.Executor{DataDir: dir, MaxTaskArchives: tt.maxTaskArchives, MaxArchives: tt.maxArchives},
+				runningTasks: &runningTasks{
+					tasks: make(map[string]*runningTask),
+				},
+				archives:      newArchiveTracker(),
+				logLayout:     logLayout,
+				archiveLayout: archiveLayout,
+			}
+			e.runningTasks.addIfNotExists("running", &runningTask{et: &types.ExecutorTask{ID: "running"}})
+
+			// the archives are created from the least recently used
+			lastUsed := time.Now().Add(-time.Hour)
+			for _, task := range []struct {
+				id      string
+				steps   int
+				fetched bool
+			}{{"fetched", 3, true}, {"unfetched", 2, false}, {"running", 2, true}, {"current", 3, false}} {
+				for step := 0; step < task.steps; step++ {
+					archivePath := e.archivePath(task.id, step)
+					if err := os.MkdirAll(filepath.Dir(archivePath), 0770); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+					if err := ioutil.WriteFile(archivePath, []byte("archive"), 0660); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+					if err := os.Chtimes(archivePath, lastUsed, lastUsed); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+					lastUsed = lastUsed.Add(time.Minute)
+				}
+				if task.fetched {
+					if err := ioutil.WriteFile(e.taskFetchedPath(task.id), nil, 0660); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+				}
+			}
+
+			if err := e.evictArchives("current"); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			remaining := []string{}
+			for _, taskID := range []string{"current", "fetched", "running", "unfetched"} {
+				steps, err := e.taskArchiveSteps(taskID)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				for _, step := range steps {
+					remaining = append(remaining, fmt.Sprintf("%s/%d", taskID, step))
+				}
+			}
+			sort.Strings(remaining)
+			if !reflect.DeepEqual(remaining, tt.remaining) {
+				t.Fatalf("expected remaining archives %v, got %v", tt.remaining, remaining)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"agola.io/agola/internal/util"
+
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+// archiveEntry is a regular file entry of an archive. Offset is the position
+// of the entry data in the archive file
+type archiveEntry struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+// cleanArchiveEntryPath returns the normalized path of an archive entry, the
+// toolbox archive writes the entries without a leading slash
+func cleanArchiveEntryPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// findArchiveEntry returns the entry of the archive f with the provided path.
+// The entries data isn't read since the tar reader seeks over it
+func findArchiveEntry(f *os.File, entryPath string) (*archiveEntry, error) {
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, util.NewErrNotExist(errors.Errorf("entry %q not found", entryPath))
+		}
+		if err != nil {
+			return nil, errors.Errorf("failed to read archive: %w", err)
+		}
+		if cleanArchiveEntryPath(hdr.Name) != entryPath {
+			continue
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			return nil, util.NewErrBadRequest(errors.Errorf("entry %q is not a regular file", entryPath))
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, errors.Errorf("failed to get entry offset: %w", err)
+		}
+		return &archiveEntry{hdr: hdr, offset: offset}, nil
+	}
+}
+
+type archiveFileHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewArchiveFileHandler(logger *zap.Logger, e *Executor) *archiveFileHandler {
+	return &archiveFileHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns the content of a file inside a task step archive. The
+// Range header is honored with the ranges scoped to the file content, so a
+// client can read a part of a large file without downloading the entire
+// archive or the entire file.
+func (h *archiveFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	taskID := q.Get("taskid")
+	if taskID == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "missing taskid")
+		return
+	}
+	s := q.Get("step")
+	if s == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "missing step")
+		return
+	}
+	step, err := strconv.Atoi(s)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid step")
+		return
+	}
+	entryPath := cleanArchiveEntryPath(q.Get("path"))
+	if entryPath == "" {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "missing path")
+		return
+	}
+
+	release, ok := h.e.acquireStream(w, taskID, streamArchiveDownload)
+	if !ok {
+		return
+	}
+	defer release()
+
+	archivePath := h.e.archivePath(taskID, step)
+	defer h.e.archives.acquire(archivePath)()
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "archive not found")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+
+	entry, err := findArchiveEntry(f, entryPath)
+	if err != nil {
+		switch {
+		case util.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+		case util.IsBadRequest(err):
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, err.Error())
+		default:
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	// the entry offset identifies the entry content inside an archive with a
+	// known digest, so the ETag can be used with If-Range to resume a download
+	if digest := archiveDigest(archivePath, fi); digest != "" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s-%d"`, digest, entry.offset))
+	}
+
+	// ServeContent handles the Range header replying with 206 and a
+	// Content-Range relative to the section, that is the entry content
+	http.ServeContent(w, r, path.Base(entryPath), entry.hdr.ModTime, io.NewSectionReader(f, entry.offset, entry.hdr.Size))
+}
@@ -0,0 +1,65 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	errors "golang.org/x/xerrors"
+)
+
+// archiveLimitWriter writes an archive until it reaches max bytes. Data after
+// the limit is discarded instead of returning an error since the archiving
+// command in the container would block writing to its stdout. A max <= 0 means
+// no limit.
+type archiveLimitWriter struct {
+	w   io.Writer
+	max int64
+	n   int64
+
+	exceeded bool
+}
+
+func newArchiveLimitWriter(w io.Writer, max int64) *archiveLimitWriter {
+	return &archiveLimitWriter{w: w, max: max}
+}
+
+func (w *archiveLimitWriter) Write(p []byte) (int, error) {
+	if w.exceeded {
+		return len(p), nil
+	}
+	if w.max > 0 && w.n+int64(len(p)) > w.max {
+		w.exceeded = true
+		return len(p), nil
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// checkArchiveSize removes the archive at archivePath and reports the failure
+// in the step log if it exceeded the max archive size
+func (e *Executor) checkArchiveSize(aw *archiveLimitWriter, archivePath string, logf io.Writer) error {
+	if !aw.exceeded {
+		return nil
+	}
+	if err := os.Remove(archivePath); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove archive %q: %+v", archivePath, err)
+	}
+	_, _ = io.WriteString(logf, fmt.Sprintf("archive exceeds the max archive size of %d bytes\n", aw.max))
+	return errors.Errorf("archive exceeds the max archive size of %d bytes", aw.max)
+}
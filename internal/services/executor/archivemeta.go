@@ -0,0 +1,80 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	errors "golang.org/x/xerrors"
+)
+
+// maxArchiveMetadataSize is the max total size of the keys and values of the
+// metadata of an archive
+const maxArchiveMetadataSize = 4096
+
+func validateArchiveMetadata(metadata map[string]string) error {
+	size := 0
+	for k, v := range metadata {
+		if k == "" {
+			return errors.Errorf("empty metadata key")
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxArchiveMetadataSize {
+		return errors.Errorf("metadata size %d bytes exceeds the max size of %d bytes", size, maxArchiveMetadataSize)
+	}
+	return nil
+}
+
+// archiveMetadataPath returns the path of the file, saved beside the archive,
+// containing the archive metadata
+func archiveMetadataPath(archivePath string) string {
+	return archivePath + ".meta"
+}
+
+// saveArchiveMetadata saves the metadata of the archive at archivePath.
+// Metadata left by a previous archive at the same path is removed
+func (e *Executor) saveArchiveMetadata(archivePath string, metadata map[string]string) error {
+	if len(metadata) == 0 {
+		if err := os.Remove(archiveMetadataPath(archivePath)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	metadataj, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return e.writeDataFileAtomic(archiveMetadataPath(archivePath), metadataj)
+}
+
+// readArchiveMetadata returns the metadata of the archive at archivePath. An
+// archive without metadata returns an empty map
+func readArchiveMetadata(archivePath string) (map[string]string, error) {
+	metadata := map[string]string{}
+	metadataj, err := ioutil.ReadFile(archiveMetadataPath(archivePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return metadata, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(metadataj, &metadata); err != nil {
+		return nil, errors.Errorf("failed to unmarshal archive %q metadata: %w", archivePath, err)
+	}
+	return metadata, nil
+}
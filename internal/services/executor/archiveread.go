@@ -0,0 +1,54 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+const defaultArchiveReadBufferSize = 256 * 1024
+
+// archiveBuffers is a pool of the buffers used to read the archives, shared by
+// all the archive downloads
+type archiveBuffers struct {
+	size int
+	pool sync.Pool
+}
+
+func newArchiveBuffers(size int) *archiveBuffers {
+	b := &archiveBuffers{size: size}
+	b.pool.New = func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return b
+}
+
+// copy copies from r to w reading r with a pooled buffer. They're wrapped so
+// io.CopyBuffer always uses it instead of the ReadFrom of w or the WriteTo of
+// r, with their smaller buffers
+func (b *archiveBuffers) copy(w io.Writer, r io.Reader) (int64, error) {
+	bufp := b.pool.Get().(*[]byte)
+	defer b.pool.Put(bufp)
+	return io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{r}, *bufp)
+}
+
+// reader returns a buffered reader of an archive read in small chunks, like
+// by a tar reader
+func (b *archiveBuffers) reader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, b.size)
+}
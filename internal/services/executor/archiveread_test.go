@@ -0,0 +1,82 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkArchiveRead reads an archive like the archives download. The
+// archive size defaults to 256MiB, set AGOLA_BENCH_ARCHIVE_SIZE to benchmark
+// multi GB archives
+func BenchmarkArchiveRead(b *testing.B) {
+	size := int64(256 * 1024 * 1024)
+	if v := os.Getenv("AGOLA_BENCH_ARCHIVE_SIZE"); v != "" {
+		var err error
+		size, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			b.Fatalf("invalid archive size: %v", err)
+		}
+	}
+
+	f, err := ioutil.TempFile("", "agola-archive")
+	if err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := io.CopyN(f, zeroReader{}, size); err != nil {
+		b.Fatalf("unexpected err: %v", err)
+	}
+
+	read := func(b *testing.B, copy func(w io.Writer, r io.Reader) (int64, error)) {
+		b.SetBytes(size)
+		for i := 0; i < b.N; i++ {
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				b.Fatalf("unexpected err: %v", err)
+			}
+			if _, err := copy(ioutil.Discard, f); err != nil {
+				b.Fatalf("unexpected err: %v", err)
+			}
+		}
+	}
+
+	b.Run("bufio-default", func(b *testing.B) {
+		read(b, func(w io.Writer, r io.Reader) (int64, error) {
+			return io.Copy(struct{ io.Writer }{w}, bufio.NewReader(r))
+		})
+	})
+	for _, bufSize := range []int{32 * 1024, defaultArchiveReadBufferSize, 1024 * 1024} {
+		ab := newArchiveBuffers(bufSize)
+		b.Run(fmt.Sprintf("pooled-%dKiB", bufSize/1024), func(b *testing.B) {
+			read(b, ab.copy)
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	defaultArchiveVolumeMaxTransientFailures = 3
+	defaultArchiveVolumeCheckInterval        = 30 * time.Second
+)
+
+// archiveVolumeError is a failure writing a step archive to the archive
+// volume
+type archiveVolumeError struct {
+	op  string
+	err error
+	// persistent is true when the archive volume isn't writable, like when
+	// it's read-only
+	persistent bool
+}
+
+func (e *archiveVolumeError) Error() string {
+	if isReadOnlyErr(e.err) {
+		return fmt.Sprintf("cannot %s, the archive volume is read-only: %v", e.op, e.err)
+	}
+	if e.persistent {
+		return fmt.Sprintf("cannot %s, the archive volume isn't writable: %v", e.op, e.err)
+	}
+	return fmt.Sprintf("cannot %s, transient archive volume error: %v", e.op, e.err)
+}
+
+func (e *archiveVolumeError) Unwrap() error {
+	return e.err
+}
+
+func isReadOnlyErr(err error) bool {
+	return errors.Is(err, syscall.EROFS)
+}
+
+// archiveVolume tracks if the archive volume is writable
+type archiveVolume struct {
+	m sync.Mutex
+	// failures are the consecutive transient write failures
+	failures int
+	// err is the error making the archive volume not writable, nil when it's
+	// writable
+	err error
+}
+
+// archiveVolumeFailed records the failure of the archive write operation op
+// and returns the error reported to the step. Read-only errors make the
+// archive volume immediately not writable, the other errors only after the
+// max transient failures.
+func (e *Executor) archiveVolumeFailed(op string, err error) error {
+	maxFailures := e.c.ArchiveVolume.MaxTransientFailures
+	if maxFailures == 0 {
+		maxFailures = defaultArchiveVolumeMaxTransientFailures
+	}
+
+	v := e.archiveVolume
+	v.m.Lock()
+	defer v.m.Unlock()
+	v.failures++
+	aerr := &archiveVolumeError{op: op, err: err}
+	if isReadOnlyErr(err) || v.failures >= maxFailures || v.err != nil {
+		aerr.persistent = true
+	}
+	if aerr.persistent {
+		if v.err == nil {
+			log.Errorf("archive volume not writable: %v", aerr)
+		}
+		v.err = aerr
+		archiveVolumeFailuresTotal.WithLabelValues("persistent").Inc()
+	} else {
+		log.Warnf("archive volume write failure %d of %d: %v", v.failures, maxFailures, aerr)
+		archiveVolumeFailuresTotal.WithLabelValues("transient").Inc()
+	}
+	return aerr
+}
+
+// archiveVolumeSucceeded records a successful archive write
+func (e *Executor) archiveVolumeSucceeded() {
+	v := e.archiveVolume
+	v.m.Lock()
+	defer v.m.Unlock()
+	if v.err != nil {
+		log.Infof("archive volume writable again")
+	}
+	v.failures = 0
+	v.err = nil
+}
+
+// archiveVolumeErr returns the error making the archive volume not writable
+// or nil if it's writable
+func (e *Executor) archiveVolumeErr() error {
+	v := e.archiveVolume
+	v.m.Lock()
+	defer v.m.Unlock()
+	return v.err
+}
+
+// checkArchiveVolume checks if the archive volume is writable creating, and
+// removing, a file in the tasks dir
+func (e *Executor) checkArchiveVolume() error {
+	f, err := ioutil.TempFile(e.tasksDir(), ".archive-volume-check")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write([]byte("check")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// archiveVolumeLoop periodically checks a not writable archive volume to
+// detect when it's writable again
+func (e *Executor) archiveVolumeLoop(ctx context.Context) {
+	interval := e.c.ArchiveVolume.CheckInterval
+	if interval == 0 {
+		interval = defaultArchiveVolumeCheckInterval
+	}
+	for {
+		if e.archiveVolumeErr() != nil {
+			if err := e.checkArchiveVolume(); err != nil {
+				log.Debugf("archive volume still not writable: %v", err)
+			} else {
+				e.archiveVolumeSucceeded()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// archiveVolumeReadinessErr returns, when the readiness must fail with a not
+// writable archive volume, the error making the archive volume not writable
+func (e *Executor) archiveVolumeReadinessErr() error {
+	if !e.c.ArchiveVolume.FailReadiness {
+		return nil
+	}
+	return e.archiveVolumeErr()
+}
+
+// taskWritesArchives reports if the task has steps writing an archive
+func taskWritesArchives(et *types.ExecutorTask) bool {
+	if et.Spec.ExecutorTaskSpecData == nil {
+		return false
+	}
+	for _, step := range et.Spec.Steps {
+		switch step.(type) {
+		case *types.SaveToWorkspaceStep, *types.SaveCacheStep:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const defaultMaxConcurrentArchiveWrites = 4
+
+// archiveFile is an archive being written to a temporary file in the archive
+// dir. Readers never see a partial archive since it's renamed to the archive
+// path only when complete. Every archive has its own temporary file so
+// archives with different paths can be written concurrently.
+type archiveFile struct {
+	*os.File
+	archivePath string
+
+	published bool
+	release   func()
+
+	// writeErr is the first error writing the archive content
+	writeErrM sync.Mutex
+	writeErr  error
+}
+
+// createArchiveFile creates the temporary file of the archive at archivePath.
+// It waits if the max concurrent archive writes has been reached. The
+// returned archive must be published or discarded.
+func (e *Executor) createArchiveFile(ctx context.Context, archivePath string) (*archiveFile, error) {
+	select {
+	case e.archiveWrites <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	var once sync.Once
+	release := func() { once.Do(func() { <-e.archiveWrites }) }
+
+	dir := filepath.Dir(archivePath)
+	if err := os.MkdirAll(dir, 0770); err != nil {
+		release()
+		return nil, e.archiveVolumeFailed("create the archive dir", err)
+	}
+	// the temporary file name doesn't end with the archive extension so it
+	// won't be considered a step archive
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(archivePath)+".tmp")
+	if err != nil {
+		release()
+		return nil, e.archiveVolumeFailed("create the archive", err)
+	}
+	if err := e.setDataFileMode(f); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		release()
+		return nil, e.archiveVolumeFailed("set the archive mode", err)
+	}
+	return &archiveFile{File: f, archivePath: archivePath, release: release}, nil
+}
+
+func (a *archiveFile) Write(p []byte) (int, error) {
+	n, err := a.File.Write(p)
+	if err != nil {
+		a.writeErrM.Lock()
+		if a.writeErr == nil {
+			a.writeErr = err
+		}
+		a.writeErrM.Unlock()
+	}
+	return n, err
+}
+
+// writeError returns the first error writing the archive content
+func (a *archiveFile) writeError() error {
+	a.writeErrM.Lock()
+	defer a.writeErrM.Unlock()
+	return a.writeErr
+}
+
+// publish atomically replaces the archive at archivePath with the written
+// archive
+func (a *archiveFile) publish() error {
+	defer a.release()
+	if err := a.Sync(); err != nil {
+		return err
+	}
+	if err := a.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(a.Name(), a.archivePath); err != nil {
+		return err
+	}
+	a.published = true
+	return nil
+}
+
+// discard removes the temporary file if the archive hasn't been published
+func (a *archiveFile) discard() {
+	defer a.release()
+	if a.published {
+		return
+	}
+	a.Close()
+	if err := os.Remove(a.Name()); err != nil && !os.IsNotExist(err) {
+		log.Errorf("failed to remove temporary archive %q: %+v", a.Name(), err)
+	}
+}
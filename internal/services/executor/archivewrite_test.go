@@ -0,0 +1,170 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConcurrentArchiveWrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const writers = 16
+	const maxWrites = 3
+
+	e := &Executor{
+		fileMode:      0660,
+		fileUID:       -1,
+		fileGID:       -1,
+		archiveWrites: make(chan struct{}, maxWrites),
+	}
+
+	var active, maxActive int32
+	errs := make([]error, writers)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			archivePath := filepath.Join(dir, "tasks", fmt.Sprintf("task%d", i%4), "archives", fmt.Sprintf("%d.tar", i))
+			a, err := e.createArchiveFile(context.Background(), archivePath)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer a.discard()
+
+			n := atomic.AddInt32(&active, 1)
+			for {
+				m := atomic.LoadInt32(&maxActive)
+				if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+					break
+				}
+			}
+			data := bytes.Repeat([]byte{byte(i)}, 64*1024)
+			for j := 0; j < 4; j++ {
+				if _, err := a.Write(data); err != nil {
+					errs[i] = err
+					return
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			atomic.AddInt32(&active, -1)
+
+			errs[i] = a.publish()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("writer %d: unexpected err: %v", i, err)
+		}
+	}
+	if maxActive > maxWrites {
+		t.Fatalf("expected at most %d concurrent writes, got %d", maxWrites, maxActive)
+	}
+
+	for i := 0; i < writers; i++ {
+		archiveDir := filepath.Join(dir, "tasks", fmt.Sprintf("task%d", i%4), "archives")
+		data, err := ioutil.ReadFile(filepath.Join(archiveDir, fmt.Sprintf("%d.tar", i)))
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte(i)}, 4*64*1024)) {
+			t.Fatalf("archive %d has wrong content", i)
+		}
+	}
+
+	// no temporary files must be left
+	for i := 0; i < 4; i++ {
+		archiveDir := filepath.Join(dir, "tasks", fmt.Sprintf("task%d", i), "archives")
+		entries, err := ioutil.ReadDir(archiveDir)
+		if err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		for _, entry := range entries {
+			if filepath.Ext(entry.Name()) != ".tar" {
+				t.Fatalf("unexpected file %q", entry.Name())
+			}
+		}
+	}
+}
+
+func TestDiscardedArchiveWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &Executor{
+		fileMode:      0660,
+		fileUID:       -1,
+		fileGID:       -1,
+		archiveWrites: make(chan struct{}, 1),
+	}
+
+	archivePath := filepath.Join(dir, "0.tar")
+	if err := ioutil.WriteFile(archivePath, []byte("previous"), 0660); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	a, err := e.createArchiveFile(context.Background(), archivePath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if _, err := a.Write([]byte("partial")); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	a.discard()
+
+	data, err := ioutil.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if string(data) != "previous" {
+		t.Fatalf("expected the previous archive to be kept, got %q", data)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the archive, got %d files", len(entries))
+	}
+
+	// the write slot must have been released
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	a, err = e.createArchiveFile(ctx, archivePath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	a.discard()
+}
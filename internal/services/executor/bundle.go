@@ -0,0 +1,137 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// writeTaskBundle writes to tw the task bundle with the task manifest, timings,
+// logs and archives. The bundle entries are placed under a directory named
+// after the task id:
+//
+//	manifest.json                                the task manifest
+//	timings.json                                 the task timings
+//	logs/<attempt>/setup.log                     the setup log of every attempt
+//	logs/<attempt>/steps/<step>.log              the step logs
+//	logs/<attempt>/steps/<step>/substeps/<n>.log the run step sub steps logs
+//	archives/<step>.tar                          the step archives
+//
+// The entries have this layout whatever the executor path layout. Only the
+// logs saved on disk are included, so the logs of tasks not persisting
+// them are missing. The files of a running task are included with the size
+// they have when added.
+func (e *Executor) writeTaskBundle(tw *tar.Writer, taskID string, m *TaskManifest) error {
+	now := time.Now()
+	for _, f := range []struct {
+		name string
+		v    interface{}
+	}{{"manifest.json", m}, {"timings.json", m.timings(now)}} {
+		data, err := json.MarshalIndent(f.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		hdr := &tar.Header{
+			Name:     path.Join(taskID, f.name),
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	logs, err := e.taskLogs(taskID)
+	if err != nil {
+		return err
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].attempt != logs[j].attempt {
+			return logs[i].attempt < logs[j].attempt
+		}
+		return logs[i].path < logs[j].path
+	})
+	for _, l := range logs {
+		name := path.Join(taskID, "logs", strconv.Itoa(l.attempt), l.stream+".log")
+		if err := e.writeBundleFile(tw, name, l.path); err != nil {
+			return err
+		}
+	}
+
+	steps, err := e.taskArchiveSteps(taskID)
+	if err != nil {
+		return err
+	}
+	for _, step := range steps {
+		archivePath := e.archivePath(taskID, step)
+		release := e.archives.acquire(archivePath)
+		err := e.writeBundleFile(tw, path.Join(taskID, "archives", fmt.Sprintf("%d.tar", step)), archivePath)
+		release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBundleFile writes the file at p in the tar with the provided name. A
+// file removed in the meantime is skipped
+func (e *Executor) writeBundleFile(tw *tar.Writer, name, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     fi.Size(),
+		ModTime:  fi.ModTime(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	// a log still being written could have grown after the stat
+	n, err := e.archiveBuffers.copy(tw, io.LimitReader(f, fi.Size()))
+	if err != nil {
+		return err
+	}
+	if n < fi.Size() {
+		return io.EOF
+	}
+	return nil
+}
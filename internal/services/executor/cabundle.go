@@ -0,0 +1,108 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"path"
+
+	"agola.io/agola/internal/services/executor/driver"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	caBundleContainerDir  = "/etc/ssl/agola"
+	caBundleContainerFile = "ca-bundle.crt"
+)
+
+var caBundleContainerPath = path.Join(caBundleContainerDir, caBundleContainerFile)
+
+// caBundleEnvVars are the environment variables, honored by the most common
+// tools and languages runtimes, set to the injected CA bundle path
+var caBundleEnvVars = []string{
+	"SSL_CERT_FILE",
+	"REQUESTS_CA_BUNDLE",
+	"CURL_CA_BUNDLE",
+	"GIT_SSL_CAINFO",
+	"NODE_EXTRA_CA_CERTS",
+}
+
+// validateCABundle checks that the bundle contains only valid PEM encoded
+// certificates
+func validateCABundle(data []byte) error {
+	n := 0
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return errors.Errorf("unexpected PEM block type %q", block.Type)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return errors.Errorf("failed to parse certificate: %w", err)
+		}
+		n++
+	}
+	if len(bytes.TrimSpace(data)) != 0 {
+		return errors.Errorf("unexpected data after the PEM certificates")
+	}
+	if n == 0 {
+		return errors.Errorf("no certificates found")
+	}
+	return nil
+}
+
+// taskCABundle returns the CA bundle to inject in the task containers: the
+// executor configured bundle followed by the task one
+func (e *Executor) taskCABundle(t *types.ExecutorTask) []byte {
+	if len(e.caBundle) == 0 && t.Spec.CABundle == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.Write(e.caBundle)
+	if t.Spec.CABundle != "" {
+		if buf.Len() > 0 && !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(t.Spec.CABundle)
+	}
+	return buf.Bytes()
+}
+
+// injectCABundle writes the task CA bundle inside the main container
+func (e *Executor) injectCABundle(ctx context.Context, t *types.ExecutorTask, pod driver.Pod, logf io.Writer, bundle []byte) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	if err := tw.WriteHeader(&tar.Header{Name: caBundleContainerFile, Mode: 0644, Size: int64(len(bundle))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(bundle); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return e.unarchive(ctx, t, &buf, pod, logf, caBundleContainerDir, true, false)
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"regexp"
+	"sort"
+
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const maxConcurrencyGroupLength = 128
+
+var concurrencyGroupRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._:/-]*$`)
+
+func validateConcurrencyGroup(group string) error {
+	if len(group) > maxConcurrencyGroupLength || !concurrencyGroupRegexp.MatchString(group) {
+		return errors.Errorf("invalid concurrency group %q", group)
+	}
+	return nil
+}
+
+// taskConcurrencyGroup returns the task concurrency group or an empty string
+// if the task isn't in a group
+func taskConcurrencyGroup(et *types.ExecutorTask) string {
+	if et.Spec.ExecutorTaskSpecData == nil {
+		return ""
+	}
+	return et.Spec.ConcurrencyGroup
+}
+
+// ConcurrencyGroupStatus is the occupancy of a concurrency group
+type ConcurrencyGroupStatus struct {
+	Name string `json:"name"`
+	// RunningTask is the task of the group currently running, empty if
+	// there's none
+	RunningTask string `json:"running_task,omitempty"`
+	// QueuedTasks is the number of tasks of the group waiting to be started
+	QueuedTasks int `json:"queued_tasks"`
+}
+
+// busyConcurrencyGroups returns the concurrency groups with a task not
+// finished and the task id
+func (e *Executor) busyConcurrencyGroups() map[string]string {
+	groups := map[string]string{}
+	for _, rtID := range e.runningTasks.ids() {
+		rt, ok := e.runningTasks.get(rtID)
+		if !ok {
+			continue
+		}
+		rt.Lock()
+		if group := taskConcurrencyGroup(rt.et); group != "" && !rt.et.Status.Phase.IsFinished() {
+			groups[group] = rt.et.ID
+		}
+		rt.Unlock()
+	}
+	return groups
+}
+
+// concurrencyGroupsStatus returns, sorted by name, the occupancy of the
+// concurrency groups with a running or queued task
+func (e *Executor) concurrencyGroupsStatus(queued []*QueuedTask) []*ConcurrencyGroupStatus {
+	statuses := map[string]*ConcurrencyGroupStatus{}
+	for group, taskID := range e.busyConcurrencyGroups() {
+		statuses[group] = &ConcurrencyGroupStatus{Name: group, RunningTask: taskID}
+	}
+	for _, qt := range queued {
+		if qt.ConcurrencyGroup == "" {
+			continue
+		}
+		s, ok := statuses[qt.ConcurrencyGroup]
+		if !ok {
+			s = &ConcurrencyGroupStatus{Name: qt.ConcurrencyGroup}
+			statuses[qt.ConcurrencyGroup] = s
+		}
+		s.QueuedTasks++
+	}
+
+	list := make([]*ConcurrencyGroupStatus, 0, len(statuses))
+	for _, s := range statuses {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	errors "golang.org/x/xerrors"
+)
+
+// taskDiskUsage accounts the bytes written by a running task in its logs, with
+// their companion files like the log indexes, and step archives, starting from the size of the task data already on disk,
+// like the logs of the previous attempts. When the task disk quota is
+// exceeded the task is cancelled. The data removed while the task runs, like
+// the evicted archives, isn't subtracted.
+// A nil taskDiskUsage, used when there's no quota, accounts nothing.
+type taskDiskUsage struct {
+	taskID string
+	max    int64
+	cancel func()
+
+	used     int64
+	exceeded int32
+}
+
+// newTaskDiskUsage returns the disk usage of the running task or nil if there's
+// no task disk quota. It must be called with the running task locked.
+func (e *Executor) newTaskDiskUsage(rt *runningTask) (*taskDiskUsage, error) {
+	if e.c.TaskDiskQuota <= 0 {
+		return nil, nil
+	}
+	used, err := dirSize(e.taskPath(rt.et.ID))
+	if err != nil {
+		return nil, errors.Errorf("failed to get task %q disk usage: %w", rt.et.ID, err)
+	}
+	return &taskDiskUsage{
+		taskID: rt.et.ID,
+		max:    e.c.TaskDiskQuota,
+		cancel: rt.cancel,
+		used:   used,
+	}, nil
+}
+
+func (u *taskDiskUsage) add(n int64) {
+	if u == nil {
+		return
+	}
+	if atomic.AddInt64(&u.used, n) > u.max && atomic.CompareAndSwapInt32(&u.exceeded, 0, 1) {
+		log.Warnf("task %s exceeded the task disk quota of %d bytes", u.taskID, u.max)
+		taskDiskQuotaExceededTotal.Inc()
+		u.cancel()
+	}
+}
+
+func (u *taskDiskUsage) isExceeded() bool {
+	return u != nil && atomic.LoadInt32(&u.exceeded) == 1
+}
+
+func (u *taskDiskUsage) err() error {
+	return errors.Errorf("task disk quota exceeded, the task logs and archives exceed %d bytes", u.max)
+}
+
+// writer returns a writer to the task data file w accounting the written bytes
+func (u *taskDiskUsage) writer(w io.WriteCloser) io.WriteCloser {
+	if u == nil {
+		return w
+	}
+	return &diskUsageWriter{WriteCloser: w, u: u}
+}
+
+// writeFile returns writeFile, writing a task data file, accounting the file
+// size increase
+func (u *taskDiskUsage) writeFile(writeFile func(p string, data []byte) error) func(p string, data []byte) error {
+	if u == nil {
+		return writeFile
+	}
+	return func(p string, data []byte) error {
+		var size int64
+		if fi, err := os.Stat(p); err == nil {
+			size = fi.Size()
+		}
+		if err := writeFile(p, data); err != nil {
+			return err
+		}
+		if n := int64(len(data)) - size; n > 0 {
+			u.add(n)
+		}
+		return nil
+	}
+}
+
+// limit returns a writer to w discarding the data once the quota has been
+// exceeded, instead of returning an error, since the container command would
+// block writing to its stdout
+func (u *taskDiskUsage) limit(w io.Writer) io.Writer {
+	if u == nil {
+		return w
+	}
+	return &diskQuotaWriter{w: w, u: u}
+}
+
+type diskUsageWriter struct {
+	io.WriteCloser
+	u *taskDiskUsage
+}
+
+func (w *diskUsageWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.u.add(int64(n))
+	return n, err
+}
+
+type diskQuotaWriter struct {
+	w io.Writer
+	u *taskDiskUsage
+}
+
+func (w *diskQuotaWriter) Write(p []byte) (int, error) {
+	if w.u.isExceeded() {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+// dirSize returns the size of the regular files inside dir. It's 0 if dir
+// doesn't exist
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
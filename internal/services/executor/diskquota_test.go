@@ -0,0 +1,74 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTaskDiskUsageLogFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, rs := newTestExecutor(t, dir, newFakePod())
+	defer rs.Close()
+	e.c.DisableLogSync = false
+	e.c.MaxLogLineLength = 1024
+
+	et := newTestTask(runStep("true"))
+	rt := &runningTask{et: et, attempt: 1, attempts: []int{1}}
+	rt.diskUsage = &taskDiskUsage{taskID: et.ID, max: 1 << 30, cancel: func() {}}
+	e.runningTasks.addIfNotExists(et.ID, rt)
+
+	logPath := e.stepLogPath(et.ID, rt.attempt, 0)
+	rt.Lock()
+	w, err := e.createLog(rt, logPath)
+	rt.Unlock()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := fmt.Fprintf(w, "line %d\n", i); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// the commands index is built when requested
+	if _, err := e.logCommands(et.ID, logPath); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	// the log and all its companion files are accounted
+	for _, p := range []string{logIndexPath(logPath), logLineIndexPath(logPath), logLinesPath(logPath), logCommandsPath(logPath), logDurablePath(logPath)} {
+		if _, err := os.Stat(p); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	size, err := dirSize(e.taskPath(et.ID))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if rt.diskUsage.used != size {
+		t.Fatalf("expected disk usage %d, got %d", size, rt.diskUsage.used)
+	}
+}
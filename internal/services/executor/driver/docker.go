@@ -27,6 +27,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"agola.io/agola/internal/services/executor/registry"
@@ -146,6 +147,11 @@ func (d *DockerDriver) Archs(ctx context.Context) ([]types.Arch, error) {
 	return []types.Arch{d.arch}, nil
 }
 
+func (d *DockerDriver) PullImage(ctx context.Context, image string, registryConfig *registry.DockerConfig, out io.Writer) error {
+	_, err := d.fetchImage(ctx, image, registryConfig, out)
+	return err
+}
+
 func (d *DockerDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Writer) (Pod, error) {
 	if len(podConfig.Containers) == 0 {
 		return nil, errors.Errorf("empty container config")
@@ -238,10 +244,13 @@ func (d *DockerDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.
 	return pod, nil
 }
 
-func (d *DockerDriver) fetchImage(ctx context.Context, image string, registryConfig *registry.DockerConfig, out io.Writer) error {
+// fetchImage pulls the image and returns the reference to use to create the
+// container. A digest pinned image with a tag is pulled by tag and the tag
+// must resolve to the pinned digest, the container is then created by digest.
+func (d *DockerDriver) fetchImage(ctx context.Context, image string, registryConfig *registry.DockerConfig, out io.Writer) (string, error) {
 	regName, err := registry.GetRegistry(image)
 	if err != nil {
-		return err
+		return "", err
 	}
 	var registryAuth registry.DockerConfigAuth
 	if registryConfig != nil {
@@ -251,25 +260,71 @@ func (d *DockerDriver) fetchImage(ctx context.Context, image string, registryCon
 	}
 	buf, err := json.Marshal(registryAuth)
 	if err != nil {
-		return err
+		return "", err
 	}
 	registryAuthEnc := base64.URLEncoding.EncodeToString(buf)
 
+	repo, tag, digest, err := registry.ImageDigest(image)
+	if err != nil {
+		return "", err
+	}
+	pullImage := image
+	if digest != "" {
+		pullImage = repo + "@" + digest
+		if tag != "" {
+			pullImage = repo + ":" + tag
+		}
+	}
+
 	// by default always try to pull the image so we are sure only authorized users can fetch them
 	// see https://kubernetes.io/docs/reference/access-authn-authz/admission-controllers/#alwayspullimages
-	reader, err := d.client.ImagePull(ctx, image, dockertypes.ImagePullOptions{RegistryAuth: registryAuthEnc})
+	reader, err := d.client.ImagePull(ctx, pullImage, dockertypes.ImagePullOptions{RegistryAuth: registryAuthEnc})
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer reader.Close()
 
-	_, err = io.Copy(out, reader)
-	return err
+	if err := writePullProgress(reader, out, pullImage); err != nil {
+		return "", err
+	}
+	if digest == "" {
+		return image, nil
+	}
+
+	if err := d.verifyImageDigest(ctx, pullImage, digest); err != nil {
+		fmt.Fprintf(out, "%v\n", err)
+		return "", err
+	}
+	fmt.Fprintf(out, "image %s verified with digest %s\n", pullImage, digest)
+	return repo + "@" + digest, nil
+}
+
+// verifyImageDigest checks that the pulled image has the expected repository
+// digest
+func (d *DockerDriver) verifyImageDigest(ctx context.Context, image, digest string) error {
+	info, _, err := d.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return err
+	}
+	var digests []string
+	for _, rd := range info.RepoDigests {
+		i := strings.LastIndex(rd, "@")
+		if i < 0 {
+			continue
+		}
+		if rd[i+1:] == digest {
+			return nil
+		}
+		digests = append(digests, rd[i+1:])
+	}
+	return errors.Errorf("image %s digest mismatch: expected %s, got %s", image, digest, strings.Join(digests, ", "))
 }
 
 func (d *DockerDriver) createContainer(ctx context.Context, index int, podConfig *PodConfig, maincontainerID string, toolboxVol *dockertypes.Volume, out io.Writer) (*container.ContainerCreateCreatedBody, error) {
 	containerConfig := podConfig.Containers[index]
 
-	if err := d.fetchImage(ctx, containerConfig.Image, podConfig.DockerConfig, out); err != nil {
+	image, err := d.fetchImage(ctx, containerConfig.Image, podConfig.DockerConfig, out)
+	if err != nil {
 		return nil, err
 	}
 
@@ -289,19 +344,35 @@ func (d *DockerDriver) createContainer(ctx context.Context, index int, podConfig
 		Entrypoint: containerConfig.Cmd,
 		Env:        makeEnvSlice(containerConfig.Env),
 		WorkingDir: containerConfig.WorkingDir,
-		Image:      containerConfig.Image,
+		Image:      image,
 		Tty:        true,
 		Labels:     containerLabels,
 	}
 
 	cliHostConfig := &container.HostConfig{
-		Privileged: containerConfig.Privileged,
+		Privileged:     containerConfig.Privileged,
+		ReadonlyRootfs: containerConfig.ReadOnlyRootFS,
+	}
+	if podConfig.LogDriver != nil {
+		cliHostConfig.LogConfig = container.LogConfig{
+			Type:   podConfig.LogDriver.Type,
+			Config: podConfig.LogDriver.Options,
+		}
 	}
 	if index == 0 {
 		// main container requires the initvolume containing the toolbox
 		// TODO(sgotti) migrate this to cliHostConfig.Mounts
 		cliHostConfig.Binds = []string{fmt.Sprintf("%s:%s", toolboxVol.Name, podConfig.InitVolumeDir)}
 		cliHostConfig.ReadonlyPaths = []string{fmt.Sprintf("%s:%s", toolboxVol.Name, podConfig.InitVolumeDir)}
+		// dns and hosts are shared by all the containers since they use the
+		// main container network namespace
+		cliHostConfig.DNS = podConfig.DNSServers
+		for _, h := range podConfig.ExtraHosts {
+			cliHostConfig.ExtraHosts = append(cliHostConfig.ExtraHosts, fmt.Sprintf("%s:%s", h.Hostname, h.IP))
+		}
+		if podConfig.NetworkMode != "" {
+			cliHostConfig.NetworkMode = container.NetworkMode(podConfig.NetworkMode)
+		}
 	} else {
 		// attach other containers to maincontainer network
 		cliHostConfig.NetworkMode = container.NetworkMode(fmt.Sprintf("container:%s", maincontainerID))
@@ -488,16 +559,141 @@ func (dp *DockerPod) TaskID() string {
 	return dp.labels[taskIDKey]
 }
 
-func (dp *DockerPod) Stop(ctx context.Context) error {
-	d := 1 * time.Second
+func (dp *DockerPod) Stop(ctx context.Context, gracePeriod time.Duration) error {
+	// the containers are stopped concurrently so the grace period applies once
+	// to the whole pod
+	var m sync.Mutex
+	var wg sync.WaitGroup
+	errs := []error{}
+	for _, container := range dp.containers {
+		container := container
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d := gracePeriod
+			if err := dp.client.ContainerStop(ctx, container.ID, &d); err != nil {
+				m.Lock()
+				errs = append(errs, err)
+				m.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(errs) != 0 {
+		return errors.Errorf("stop errors: %v", errs)
+	}
+	return nil
+}
+
+func (dp *DockerPod) Start(ctx context.Context) error {
+	for _, container := range dp.containers {
+		if err := dp.client.ContainerStart(ctx, container.ID, dockertypes.ContainerStartOptions{}); err != nil {
+			return errors.Errorf("failed to start container %s: %w", container.ID, err)
+		}
+	}
+	return nil
+}
+
+func (dp *DockerPod) Pause(ctx context.Context) error {
+	for i, container := range dp.containers {
+		if err := dp.client.ContainerPause(ctx, container.ID); err != nil {
+			// unpause the already paused containers
+			for _, c := range dp.containers[:i] {
+				_ = dp.client.ContainerUnpause(ctx, c.ID)
+			}
+			return errors.Errorf("failed to pause container %s: %w", container.ID, err)
+		}
+	}
+	return nil
+}
+
+func (dp *DockerPod) Stats(ctx context.Context) (*ContainerStats, error) {
+	var mainContainer *DockerContainer
+	for _, c := range dp.containers {
+		if c.Index == 0 {
+			mainContainer = c
+		}
+	}
+	if mainContainer == nil {
+		return nil, errors.Errorf("no main container in pod %s", dp.id)
+	}
+
+	// when not streaming the daemon returns the stats with the previous cpu
+	// usage so the cpu percentage can be computed
+	resp, err := dp.client.ContainerStats(ctx, mainContainer.ID, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var st dockertypes.StatsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		return nil, errors.Errorf("failed to decode container %s stats: %w", mainContainer.ID, err)
+	}
+
+	stats := &ContainerStats{
+		Time:        st.Read,
+		CPUTime:     time.Duration(st.CPUStats.CPUUsage.TotalUsage),
+		MemoryUsage: st.MemoryStats.Usage,
+		MemoryLimit: st.MemoryStats.Limit,
+	}
+	cpuDelta := float64(st.CPUStats.CPUUsage.TotalUsage) - float64(st.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(st.CPUStats.SystemUsage) - float64(st.PreCPUStats.SystemUsage)
+	onlineCPUs := float64(st.CPUStats.OnlineCPUs)
+	if onlineCPUs == 0 {
+		onlineCPUs = float64(len(st.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * onlineCPUs * 100
+	}
+	for _, n := range st.Networks {
+		stats.NetworkRxBytes += n.RxBytes
+		stats.NetworkTxBytes += n.TxBytes
+	}
+	for _, e := range st.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			stats.BlockReadBytes += e.Value
+		case "write":
+			stats.BlockWriteBytes += e.Value
+		}
+	}
+	return stats, nil
+}
+
+func (dp *DockerPod) ContainerLogs(ctx context.Context, index int, opts *ContainerLogsOptions, out io.Writer) error {
+	var container *DockerContainer
+	for _, c := range dp.containers {
+		if c.Index == index {
+			container = c
+		}
+	}
+	if container == nil {
+		return errors.Errorf("no container with index %d in pod %s", index, dp.id)
+	}
+
+	logsOptions := dockertypes.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: opts.Follow, Timestamps: opts.Timestamps}
+	if !opts.Since.IsZero() {
+		logsOptions.Since = fmt.Sprintf("%d.%09d", opts.Since.Unix(), opts.Since.Nanosecond())
+	}
+	rc, err := dp.client.ContainerLogs(ctx, container.ID, logsOptions)
+	if err != nil {
+		return errors.Errorf("failed to get container %s logs: %w", container.ID, err)
+	}
+	defer rc.Close()
+	// containers are created with a tty so the output isn't multiplexed
+	_, err = io.Copy(out, rc)
+	return err
+}
+
+func (dp *DockerPod) Unpause(ctx context.Context) error {
 	errs := []error{}
 	for _, container := range dp.containers {
-		if err := dp.client.ContainerStop(ctx, container.ID, &d); err != nil {
+		if err := dp.client.ContainerUnpause(ctx, container.ID); err != nil {
 			errs = append(errs, err)
 		}
 	}
 	if len(errs) != 0 {
-		return errors.Errorf("stop errors: %v", errs)
+		return errors.Errorf("unpause errors: %v", errs)
 	}
 	return nil
 }
@@ -20,11 +20,16 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"agola.io/agola/internal/services/executor/registry"
 	"agola.io/agola/services/types"
+
+	errors "golang.org/x/xerrors"
 )
 
+var ErrNotSupported = errors.New("operation not supported by the driver")
+
 const (
 	toolboxPrefix = "agola-toolbox"
 
@@ -54,6 +59,10 @@ type Driver interface {
 	ExecutorGroup(ctx context.Context) (string, error)
 	GetExecutors(ctx context.Context) ([]string, error)
 	Archs(ctx context.Context) ([]types.Arch, error)
+	// PullImage pulls the image in the executor host image cache so the pods
+	// using it will start faster. It returns ErrNotSupported if the driver
+	// doesn't pull the images on the executor host
+	PullImage(ctx context.Context, image string, registryConfig *registry.DockerConfig, out io.Writer) error
 }
 
 type Pod interface {
@@ -63,12 +72,55 @@ type Pod interface {
 	ExecutorID() string
 	// TaskID return the pod task id
 	TaskID() string
-	// Stop stops the pod
-	Stop(ctx context.Context) error
+	// Stop stops the pod. The containers processes receive a SIGTERM and are
+	// killed if still running after gracePeriod
+	Stop(ctx context.Context, gracePeriod time.Duration) error
+	// Start starts again the containers of a stopped pod, with their
+	// filesystem as left when stopped. It returns ErrNotSupported if the
+	// driver doesn't keep the stopped pods
+	Start(ctx context.Context) error
 	// Stop stops the pod
 	Remove(ctx context.Context) error
+	// Pause freezes all the pod processes. It returns ErrNotSupported if the
+	// driver cannot pause a pod
+	Pause(ctx context.Context) error
+	// Unpause resumes the processes of a paused pod
+	Unpause(ctx context.Context) error
 	// Exec executes a command inside the first container in the Pod
 	Exec(ctx context.Context, execConfig *ExecConfig) (ContainerExec, error)
+	// Stats returns the resource usage of the first container in the Pod. It
+	// returns ErrNotSupported if the driver cannot report it
+	Stats(ctx context.Context) (*ContainerStats, error)
+	// ContainerLogs writes to out the output of the container at index
+	ContainerLogs(ctx context.Context, index int, opts *ContainerLogsOptions, out io.Writer) error
+}
+
+// ContainerLogsOptions are the options of a container output request
+type ContainerLogsOptions struct {
+	// Follow follows the output until the container exits or ctx is done
+	Follow bool
+	// Since, when not zero, returns only the output captured since then. The
+	// platform could support only a seconds precision
+	Since time.Time
+	// Timestamps prefixes every line with its RFC3339Nano capture time and a
+	// space
+	Timestamps bool
+}
+
+// ContainerStats is the resource usage of a container. The network and block
+// I/O bytes are the totals since the container start
+type ContainerStats struct {
+	Time time.Time `json:"time"`
+	// CPUPercent is the cpu usage percentage where 100 is a whole cpu
+	CPUPercent float64 `json:"cpu_percent"`
+	// CPUTime is the cpu time used by the container since its start
+	CPUTime         time.Duration `json:"cpu_time"`
+	MemoryUsage     uint64        `json:"memory_usage"`
+	MemoryLimit     uint64        `json:"memory_limit"`
+	NetworkRxBytes  uint64        `json:"network_rx_bytes"`
+	NetworkTxBytes  uint64        `json:"network_tx_bytes"`
+	BlockReadBytes  uint64        `json:"block_read_bytes"`
+	BlockWriteBytes uint64        `json:"block_write_bytes"`
 }
 
 type ContainerExec interface {
@@ -84,6 +136,31 @@ type PodConfig struct {
 	// The container dir where the init volume will be mounted
 	InitVolumeDir string
 	DockerConfig  *registry.DockerConfig
+	DNSServers    []string
+	ExtraHosts    []ExtraHost
+	// NetworkMode is the pod network mode (none, bridge, host or a custom
+	// network name). If empty the driver default is used
+	NetworkMode string
+	// LogDriver, if defined, is the platform log driver of the pod
+	// containers. Only the docker driver supports it
+	LogDriver *LogDriver
+}
+
+type LogDriver struct {
+	Type    string
+	Options map[string]string
+}
+
+// Pod network modes. Any other network mode is the name of a custom network
+const (
+	NetworkModeNone   = "none"
+	NetworkModeBridge = "bridge"
+	NetworkModeHost   = "host"
+)
+
+type ExtraHost struct {
+	Hostname string
+	IP       string
 }
 
 type ContainerConfig struct {
@@ -94,6 +171,8 @@ type ContainerConfig struct {
 	User       string
 	Privileged bool
 	Volumes    []Volume
+	// ReadOnlyRootFS mounts the container root filesystem read-only
+	ReadOnlyRootFS bool
 }
 
 type Volume struct {
@@ -26,6 +26,7 @@ import (
 	"strings"
 	"time"
 
+	"agola.io/agola/internal/services/executor/registry"
 	"agola.io/agola/internal/util"
 	"agola.io/agola/services/types"
 
@@ -307,11 +308,24 @@ func (d *K8sDriver) getOrCreateExecutorsGroupID(ctx context.Context) (string, er
 	return executorsGroupID, nil
 }
 
+// PullImage isn't supported since the images are pulled by the nodes where
+// the pods are scheduled
+func (d *K8sDriver) PullImage(ctx context.Context, image string, registryConfig *registry.DockerConfig, out io.Writer) error {
+	return ErrNotSupported
+}
+
 func (d *K8sDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Writer) (Pod, error) {
 	if len(podConfig.Containers) == 0 {
 		return nil, errors.Errorf("empty container config")
 	}
 
+	// k8s pods can only use the cluster network or the host network
+	switch podConfig.NetworkMode {
+	case "", NetworkModeBridge, NetworkModeHost:
+	default:
+		return nil, errors.Errorf("network mode %q not supported by the k8s driver", podConfig.NetworkMode)
+	}
+
 	secretClient := d.client.CoreV1().Secrets(d.namespace)
 	podClient := d.client.CoreV1().Pods(d.namespace)
 
@@ -385,6 +399,24 @@ func (d *K8sDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Wri
 		},
 	}
 
+	if len(podConfig.DNSServers) > 0 {
+		// keep the default cluster dns policy and add the custom nameservers
+		pod.Spec.DNSConfig = &corev1.PodDNSConfig{
+			Nameservers: podConfig.DNSServers,
+		}
+	}
+	if podConfig.NetworkMode == NetworkModeHost {
+		pod.Spec.HostNetwork = true
+		// keep resolving the cluster services
+		pod.Spec.DNSPolicy = corev1.DNSClusterFirstWithHostNet
+	}
+	for _, h := range podConfig.ExtraHosts {
+		pod.Spec.HostAliases = append(pod.Spec.HostAliases, corev1.HostAlias{
+			IP:        h.IP,
+			Hostnames: []string{h.Hostname},
+		})
+	}
+
 	// define containers
 	for cIndex, containerConfig := range podConfig.Containers {
 		var containerName string
@@ -393,9 +425,19 @@ func (d *K8sDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Wri
 		} else {
 			containerName = fmt.Sprintf("service%d", cIndex)
 		}
+		// the kubelet verifies the content of images pulled by digest, the
+		// tag of a digest pinned image is ignored
+		image := containerConfig.Image
+		repo, _, digest, err := registry.ImageDigest(image)
+		if err != nil {
+			return nil, err
+		}
+		if digest != "" {
+			image = repo + "@" + digest
+		}
 		c := corev1.Container{
 			Name:       containerName,
-			Image:      containerConfig.Image,
+			Image:      image,
 			Command:    containerConfig.Cmd,
 			Env:        genEnvVars(containerConfig.Env),
 			Stdin:      true,
@@ -404,7 +446,8 @@ func (d *K8sDriver) NewPod(ctx context.Context, podConfig *PodConfig, out io.Wri
 			// see https://kubernetes.io/docs/reference/access-authn-authz/admission-controllers/#alwayspullimages
 			ImagePullPolicy: corev1.PullAlways,
 			SecurityContext: &corev1.SecurityContext{
-				Privileged: &containerConfig.Privileged,
+				Privileged:             &containerConfig.Privileged,
+				ReadOnlyRootFilesystem: &containerConfig.ReadOnlyRootFS,
 			},
 		}
 		if cIndex == 0 {
@@ -680,21 +723,61 @@ func (p *K8sPod) TaskID() string {
 	return p.labels[taskIDKey]
 }
 
-func (p *K8sPod) Stop(ctx context.Context) error {
+func (p *K8sPod) Stop(ctx context.Context, gracePeriod time.Duration) error {
 	d := int64(0)
 	secretClient := p.client.CoreV1().Secrets(p.namespace)
 	if err := secretClient.Delete(p.id, &metav1.DeleteOptions{GracePeriodSeconds: &d}); err != nil {
 		return err
 	}
+	// the grace period is rounded up to seconds, the k8s granularity
+	pd := int64((gracePeriod + time.Second - 1) / time.Second)
 	podClient := p.client.CoreV1().Pods(p.namespace)
-	if err := podClient.Delete(p.id, &metav1.DeleteOptions{GracePeriodSeconds: &d}); err != nil {
+	if err := podClient.Delete(p.id, &metav1.DeleteOptions{GracePeriodSeconds: &pd}); err != nil {
 		return err
 	}
 	return nil
 }
 
+// Start isn't supported since a stopped pod is deleted
+func (p *K8sPod) Start(ctx context.Context) error {
+	return ErrNotSupported
+}
+
+// Pause isn't supported since k8s doesn't provide a way to freeze a pod
+func (p *K8sPod) Pause(ctx context.Context) error {
+	return ErrNotSupported
+}
+
+func (p *K8sPod) Unpause(ctx context.Context) error {
+	return ErrNotSupported
+}
+
+// Stats isn't supported since the pods resource usage is available only with
+// the optional metrics api
+func (p *K8sPod) Stats(ctx context.Context) (*ContainerStats, error) {
+	return nil, ErrNotSupported
+}
+
+func (p *K8sPod) ContainerLogs(ctx context.Context, index int, opts *ContainerLogsOptions, out io.Writer) error {
+	containerName := mainContainerName
+	if index > 0 {
+		containerName = fmt.Sprintf("service%d", index)
+	}
+	logOptions := &corev1.PodLogOptions{Container: containerName, Follow: opts.Follow, Timestamps: opts.Timestamps}
+	if !opts.Since.IsZero() {
+		logOptions.SinceTime = &metav1.Time{Time: opts.Since}
+	}
+	rc, err := p.client.CoreV1().Pods(p.namespace).GetLogs(p.id, logOptions).Context(ctx).Stream()
+	if err != nil {
+		return errors.Errorf("failed to get pod %s container %s logs: %w", p.id, containerName, err)
+	}
+	defer rc.Close()
+	_, err = io.Copy(out, rc)
+	return err
+}
+
 func (p *K8sPod) Remove(ctx context.Context) error {
-	return p.Stop(ctx)
+	return p.Stop(ctx, 0)
 }
 
 type K8sContainerExec struct {
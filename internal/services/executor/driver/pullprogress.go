@@ -0,0 +1,169 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+// pullProgressInterval is the min interval between two pull progress lines
+const pullProgressInterval = 2 * time.Second
+
+// pullMessage is a message of the docker image pull json stream
+type pullMessage struct {
+	ID       string `json:"id,omitempty"`
+	Status   string `json:"status,omitempty"`
+	Progress *struct {
+		Current int64 `json:"current,omitempty"`
+		Total   int64 `json:"total,omitempty"`
+	} `json:"progressDetail,omitempty"`
+	Error *struct {
+		Message string `json:"message,omitempty"`
+	} `json:"errorDetail,omitempty"`
+}
+
+type pullLayer struct {
+	downloaded bool
+	current    int64
+	total      int64
+}
+
+// pullProgress summarizes the image pull json stream in human readable lines
+type pullProgress struct {
+	out   io.Writer
+	image string
+
+	layers map[string]*pullLayer
+	last   time.Time
+	// final is true when the summary of the completed download was written
+	final bool
+}
+
+func (p *pullProgress) layer(id string) *pullLayer {
+	l, ok := p.layers[id]
+	if !ok {
+		l = &pullLayer{}
+		p.layers[id] = l
+	}
+	return l
+}
+
+func (p *pullProgress) downloaded() bool {
+	for _, l := range p.layers {
+		if !l.downloaded {
+			return false
+		}
+	}
+	return len(p.layers) > 0
+}
+
+func (p *pullProgress) write() {
+	var downloaded int
+	var current, total int64
+	for _, l := range p.layers {
+		if l.downloaded {
+			downloaded++
+			current += l.total
+		} else {
+			current += l.current
+		}
+		total += l.total
+	}
+	line := fmt.Sprintf("pulling image %s: %d/%d layers downloaded, %s/%s", p.image, downloaded, len(p.layers), formatBytes(current), formatBytes(total))
+	if total > 0 {
+		line += fmt.Sprintf(" (%d%%)", current*100/total)
+	}
+	fmt.Fprintln(p.out, line)
+	p.last = time.Now()
+}
+
+// writePullProgress reads the image pull json stream from r and writes to out
+// the pull status messages and, at most every pullProgressInterval, a summary
+// of the layers download progress
+func writePullProgress(r io.Reader, out io.Writer, image string) error {
+	p := &pullProgress{out: out, image: image, layers: map[string]*pullLayer{}}
+
+	dec := json.NewDecoder(r)
+	for {
+		var m pullMessage
+		if err := dec.Decode(&m); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		if m.Error != nil {
+			return errors.Errorf("failed to pull image %s: %s", image, m.Error.Message)
+		}
+
+		switch m.Status {
+		case "Pulling fs layer", "Waiting":
+			p.layer(m.ID)
+		case "Downloading":
+			l := p.layer(m.ID)
+			if m.Progress != nil {
+				l.current = m.Progress.Current
+				l.total = m.Progress.Total
+			}
+			if time.Since(p.last) >= pullProgressInterval {
+				p.write()
+			}
+		case "Verifying Checksum", "Download complete", "Extracting", "Pull complete":
+			l := p.layer(m.ID)
+			if !l.downloaded {
+				l.downloaded = true
+				if l.total == 0 {
+					l.total = l.current
+				}
+			}
+		case "Already exists":
+			p.layer(m.ID).downloaded = true
+		default:
+			// general status messages (pulling from, digest, final status)
+			if !p.final && p.downloaded() {
+				p.write()
+				p.final = true
+			}
+			if m.ID != "" {
+				fmt.Fprintf(out, "%s: %s\n", m.ID, m.Status)
+			} else if m.Status != "" {
+				fmt.Fprintln(out, m.Status)
+			}
+		}
+	}
+
+	if len(p.layers) > 0 && !p.final {
+		p.write()
+	}
+	return nil
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"sync"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+)
+
+const (
+	eventSubscriberBufferSize = 128
+)
+
+type EventType string
+
+const (
+	EventTypeTaskReceived EventType = "task_received"
+	EventTypeTaskStarted  EventType = "task_started"
+	EventTypeStepPhase    EventType = "step_phase"
+	EventTypeTaskFinished EventType = "task_finished"
+	EventTypeError        EventType = "error"
+	// EventTypeDropped reports that Dropped events weren't delivered since the
+	// subscriber was too slow
+	EventTypeDropped EventType = "dropped"
+)
+
+// Event is an executor lifecycle event
+type Event struct {
+	Type   EventType `json:"type"`
+	Time   time.Time `json:"time"`
+	TaskID string    `json:"task_id,omitempty"`
+
+	// Setup is true when the event is related to the task setup step
+	Setup bool `json:"setup,omitempty"`
+	// Step is the step index for step events
+	Step *int `json:"step,omitempty"`
+
+	Phase types.ExecutorTaskPhase `json:"phase,omitempty"`
+	Error string                  `json:"error,omitempty"`
+
+	// Dropped is, for dropped events, the number of events not delivered
+	Dropped int `json:"dropped,omitempty"`
+}
+
+type eventSubscriber struct {
+	// taskID, when not empty, filters the events related to this task
+	taskID string
+	c      chan *Event
+	// dropped is the number of events dropped since the last delivered one
+	dropped int
+}
+
+// eventBus fans out the events published by the execution loop to all the
+// subscribers.
+// Delivery is at most once with gaps: every subscriber has a bounded buffer
+// and publishing never waits for a slow subscriber. When the buffer is full
+// the events are dropped and, as soon as there's space again, a dropped event
+// with the number of lost events is delivered before the next one.
+type eventBus struct {
+	subscribers map[*eventSubscriber]struct{}
+	m           sync.Mutex
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+func (b *eventBus) subscribe(taskID string) *eventSubscriber {
+	s := &eventSubscriber{
+		taskID: taskID,
+		c:      make(chan *Event, eventSubscriberBufferSize),
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.subscribers[s] = struct{}{}
+
+	return s
+}
+
+func (b *eventBus) unsubscribe(s *eventSubscriber) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	delete(b.subscribers, s)
+}
+
+// publish sends the event to all the subscribers. It never blocks: if a
+// subscriber buffer is full the event is dropped for that subscriber and
+// counted in the next dropped event
+func (b *eventBus) publish(ev *Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	b.m.Lock()
+	defer b.m.Unlock()
+	for s := range b.subscribers {
+		if s.taskID != "" && s.taskID != ev.TaskID {
+			continue
+		}
+		if s.dropped > 0 {
+			select {
+			case s.c <- &Event{Type: EventTypeDropped, Time: ev.Time, TaskID: s.taskID, Dropped: s.dropped}:
+				s.dropped = 0
+			default:
+				s.dropped++
+				continue
+			}
+		}
+		select {
+		case s.c <- ev:
+		default:
+			s.dropped++
+		}
+	}
+}
+
+func (b *eventBus) publishStepPhase(et *types.ExecutorTask, stepIndex int) {
+	step := stepIndex
+	b.publish(&Event{
+		Type:   EventTypeStepPhase,
+		TaskID: et.ID,
+		Step:   &step,
+		Phase:  et.Status.Steps[stepIndex].Phase,
+	})
+}
+
+func (b *eventBus) publishSetupPhase(et *types.ExecutorTask) {
+	b.publish(&Event{
+		Type:   EventTypeStepPhase,
+		TaskID: et.ID,
+		Setup:  true,
+		Phase:  et.Status.SetupStep.Phase,
+	})
+}
+
+func (b *eventBus) publishError(taskID string, err error) {
+	b.publish(&Event{
+		Type:   EventTypeError,
+		TaskID: taskID,
+		Error:  err.Error(),
+	})
+}
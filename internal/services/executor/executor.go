@@ -17,6 +17,7 @@ package executor
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -25,7 +26,9 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -42,6 +45,7 @@ import (
 
 	"github.com/gorilla/mux"
 	sockaddr "github.com/hashicorp/go-sockaddr"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	errors "golang.org/x/xerrors"
@@ -55,6 +59,17 @@ const (
 	defaultShell = "/bin/sh -e"
 
 	toolboxContainerDir = "/mnt/agola"
+
+	defaultHTTPReadHeaderTimeout = 10 * time.Second
+	defaultHTTPIdleTimeout       = 2 * time.Minute
+
+	defaultStepStatsInterval = 2 * time.Second
+	minStepStatsInterval     = 1 * time.Second
+
+	// stepScratchDir is the main container dir containing the run steps
+	// scratch dirs
+	stepScratchDir    = "/tmp/agola-scratch"
+	stepScratchDirEnv = "AGOLA_SCRATCH_DIR"
 )
 
 var (
@@ -109,59 +124,102 @@ func (e *Executor) createFile(ctx context.Context, pod driver.Pod, command, user
 	return buf.String(), nil
 }
 
-func (e *Executor) doRunStep(ctx context.Context, s *types.RunStep, t *types.ExecutorTask, pod driver.Pod, logPath string) (int, error) {
-	if err := os.MkdirAll(filepath.Dir(logPath), 0770); err != nil {
-		return -1, err
+func (e *Executor) doRunStep(ctx context.Context, s *types.RunStep, rt *runningTask, stepIndex int, pod driver.Pod, outf io.Writer) (int, error) {
+	t := rt.et
+
+	if rw := e.newStepRedactWriter(t, stepIndex, outf); rw != nil {
+		defer rw.Flush()
+		outf = rw
+	}
+
+	shell := stepShell(t, s)
+
+	// generate the environment using the task environment and then overriding with the runstep environment
+	environment := e.taskEnvironment(t)
+	for envName, envValue := range s.Environment {
+		environment[envName] = envValue
 	}
-	outf, err := os.Create(logPath)
+
+	workingDir, err := e.runStepWorkingDir(ctx, s, t, pod, outf)
 	if err != nil {
 		return -1, err
 	}
-	defer outf.Close()
 
-	// TODO(sgotti) this line is used only for old runconfig versions that don't
-	// set a task default shell in the runconfig
-	shell := defaultShell
-	if t.Spec.Shell != "" {
-		shell = t.Spec.Shell
+	rt.Lock()
+	t.Status.Steps[stepIndex].WorkingDir = workingDir
+	t.Status.Steps[stepIndex].Ulimits = s.Ulimits
+	rt.Unlock()
+
+	if e.c.StepScratch != "" {
+		scratchDir := path.Join(stepScratchDir, fmt.Sprintf("step-%d", stepIndex))
+		if err := e.mkdir(ctx, t, pod, outf, scratchDir); err != nil {
+			return -1, errors.Errorf("failed to create step scratch dir: %w", err)
+		}
+		defer func() {
+			if err := e.removeDir(ctx, t, pod, outf, scratchDir); err != nil {
+				log.Errorf("failed to remove step scratch dir: %+v", err)
+			}
+		}()
+		environment[stepScratchDirEnv] = scratchDir
 	}
-	if s.Shell != "" {
-		shell = s.Shell
+
+	if len(t.Spec.SecretFiles) > 0 {
+		paths, err := e.writeSecretFiles(ctx, t, pod, stepIndex)
+		if err != nil {
+			_, _ = io.WriteString(outf, fmt.Sprintf("failed to write secret files. Error: %s\n", err))
+			return -1, err
+		}
+		defer e.removeSecretFiles(ctx, t, pod, paths)
+	}
+
+	if len(s.Parallel) > 0 {
+		return e.doRunSubsteps(ctx, s, rt, stepIndex, pod, shell, environment, workingDir, outf)
 	}
 
 	var cmd []string
 	if s.Command != "" {
-		filename, err := e.createFile(ctx, pod, s.Command, stepUser(t), outf)
+		command, err := e.interpolateCommand(s, s.Command, e.stepInterpolationVars(rt, stepIndex, environment))
+		if err != nil {
+			_, _ = io.WriteString(outf, fmt.Sprintf("failed to interpolate command: %s\n", err))
+			return -1, err
+		}
+		if s.CaptureCommands {
+			command = wrapShellCommands(command)
+		}
+		filename, err := e.createFile(ctx, pod, command, stepUser(t), outf)
 		if err != nil {
 			return -1, errors.Errorf("create file err: %v", err)
 		}
 
-		args := strings.Split(shell, " ")
-		cmd = append(args, filename)
+		cmd = append(shell, filename)
 	} else {
-		cmd = strings.Split(shell, " ")
-	}
-
-	// override task working dir with runstep working dir if provided
-	workingDir := t.Spec.WorkingDir
-	if s.WorkingDir != "" {
-		workingDir = s.WorkingDir
-	}
-
-	// generate the environment using the task environment and then overriding with the runstep environment
-	environment := map[string]string{}
-	for envName, envValue := range t.Spec.Environment {
-		environment[envName] = envValue
-	}
-	for envName, envValue := range s.Environment {
-		environment[envName] = envValue
-	}
-
-	workingDir, err = e.expandDir(ctx, t, pod, outf, workingDir)
+		cmd = shell
+	}
+	cmd = ulimitCmd(s.Ulimits, cmd)
+
+	var out io.Writer = outf
+	var pw *logPatternWriter
+	if len(s.FailOnLogPatterns) > 0 {
+		pw = newLogPatternWriter(outf, s.FailOnLogPatterns, e.c.MaxLogLineLength)
+		out = pw
+	}
+	// the command output lines that look like a step marker are escaped.
+	// The command markers are converted before being matched with the
+	// patterns, they're skipped since they contain the command text
+	esc := newMarkerEscapeWriter(out)
+	out = esc
+	if s.CaptureCommands {
+		out = newCommandMarkerWriter(esc)
+	}
+	// the output is converted before being matched with the patterns
+	dw, err := newOutputDecoder(out, s.OutputEncoding)
 	if err != nil {
-		_, _ = outf.WriteString(fmt.Sprintf("failed to expand working dir %q. Error: %s\n", workingDir, err))
 		return -1, err
 	}
+	if dw != nil {
+		out = dw
+	}
+	out = rt.diskUsage.limit(out)
 
 	execConfig := &driver.ExecConfig{
 		Cmd:         cmd,
@@ -169,8 +227,8 @@ func (e *Executor) doRunStep(ctx context.Context, s *types.RunStep, t *types.Exe
 		WorkingDir:  workingDir,
 		User:        stepUser(t),
 		AttachStdin: true,
-		Stdout:      outf,
-		Stderr:      outf,
+		Stdout:      out,
+		Stderr:      out,
 		Tty:         *s.Tty,
 	}
 
@@ -179,48 +237,322 @@ func (e *Executor) doRunStep(ctx context.Context, s *types.RunStep, t *types.Exe
 		return -1, err
 	}
 
+	// unlike the service containers output, the step output stream cannot be
+	// reattached: the platform doesn't keep the output of an exec so when the
+	// stream breaks, like when the docker daemon restarts, the step fails and
+	// the rest of its output is lost
 	exitCode, err := ce.Wait(ctx)
+	if dw != nil {
+		_ = dw.Close()
+	}
+	_ = esc.Flush()
 	if err != nil {
+		if ctx.Err() == nil {
+			_, _ = io.WriteString(outf, fmt.Sprintf("lost the step exec, its output cannot be reattached. Error: %s\n", err))
+		}
 		return -1, err
 	}
 
+	if pw != nil && exitCode == 0 {
+		if pattern := pw.Matched(); pattern != "" {
+			_, _ = io.WriteString(outf, fmt.Sprintf("output matched fail on log pattern %q\n", pattern))
+			rt.Lock()
+			t.Status.Steps[stepIndex].ExitStatus = util.IntP(exitCode)
+			t.Status.Steps[stepIndex].FailedLogPattern = pattern
+			rt.Unlock()
+			return exitCode, errors.Errorf("output matched fail on log pattern %q", pattern)
+		}
+	}
+
 	return exitCode, nil
 }
 
-func (e *Executor) doSaveToWorkspaceStep(ctx context.Context, s *types.SaveToWorkspaceStep, t *types.ExecutorTask, pod driver.Pod, logPath string, archivePath string) (int, error) {
-	cmd := []string{toolboxContainerPath, "archive"}
+// stepShell returns the shell, with its arguments, executing the run step
+// commands. The step shell overrides the task shell. The step shell args, when
+// defined, replace the shell arguments.
+func stepShell(t *types.ExecutorTask, s *types.RunStep) []string {
+	// TODO(sgotti) this line is used only for old runconfig versions that don't
+	// set a task default shell in the runconfig
+	shell := defaultShell
+	if t.Spec.Shell != "" {
+		shell = t.Spec.Shell
+	}
+	if s.Shell != "" {
+		shell = s.Shell
+	}
+	cmd := strings.Split(shell, " ")
+	if s.ShellArgs != nil {
+		cmd = append(cmd[:1:1], s.ShellArgs...)
+	}
+	return cmd
+}
 
-	if err := os.MkdirAll(filepath.Dir(logPath), 0770); err != nil {
-		return -1, err
+// validateShell checks that a shell, with its arguments separated by spaces,
+// starts with the shell path
+func validateShell(shell string) error {
+	if strings.Split(shell, " ")[0] == "" {
+		return errors.Errorf("shell %q must start with the shell path", shell)
+	}
+	if strings.ContainsAny(shell, "\n\x00") {
+		return errors.Errorf("shell %q contains invalid characters", shell)
 	}
-	logf, err := os.Create(logPath)
+	return nil
+}
+
+// runStepWorkingDir returns the effective working dir of a run step. The task
+// working dir is overridden by the runstep working dir if provided. A relative
+// runstep working dir is resolved relative to the task working dir. If the
+// resulting dir is different from the task working dir it'll be created.
+func (e *Executor) runStepWorkingDir(ctx context.Context, s *types.RunStep, t *types.ExecutorTask, pod driver.Pod, logf io.Writer) (string, error) {
+	taskWorkingDir, err := e.expandDir(ctx, t, pod, logf, t.Spec.WorkingDir)
 	if err != nil {
-		return -1, err
+		_, _ = io.WriteString(logf, fmt.Sprintf("failed to expand working dir %q. Error: %s\n", t.Spec.WorkingDir, err))
+		return "", err
+	}
+	if s.WorkingDir == "" {
+		return taskWorkingDir, nil
 	}
-	defer logf.Close()
 
-	if err := os.MkdirAll(filepath.Dir(archivePath), 0770); err != nil {
-		return -1, err
+	workingDir, err := e.expandDir(ctx, t, pod, logf, s.WorkingDir)
+	if err != nil {
+		_, _ = io.WriteString(logf, fmt.Sprintf("failed to expand working dir %q. Error: %s\n", s.WorkingDir, err))
+		return "", err
+	}
+	// container paths are always unix paths
+	if !path.IsAbs(workingDir) {
+		if taskWorkingDir == "" {
+			_, _ = io.WriteString(logf, fmt.Sprintf("working dir %q must be absolute since the task doesn't define a working dir\n", s.WorkingDir))
+			return "", errors.Errorf("relative working dir %q without a task working dir", s.WorkingDir)
+		}
+		workingDir = path.Join(taskWorkingDir, workingDir)
+	}
+	workingDir = path.Clean(workingDir)
+
+	if workingDir != taskWorkingDir {
+		if err := e.mkdir(ctx, t, pod, logf, workingDir); err != nil {
+			_, _ = io.WriteString(logf, fmt.Sprintf("failed to create working dir %q. Error: %s\n", workingDir, err))
+			return "", err
+		}
+	}
+
+	return workingDir, nil
+}
+
+// doRunSubsteps concurrently executes the run step parallel sub steps. Every
+// sub step output is saved in its own log while the step log reports their
+// results. The returned exit code is the one of the first failed sub step.
+func (e *Executor) doRunSubsteps(ctx context.Context, s *types.RunStep, rt *runningTask, stepIndex int, pod driver.Pod, shell []string, environment map[string]string, workingDir string, outf io.Writer) (int, error) {
+	t := rt.et
+
+	cmds := make([][]string, len(s.Parallel))
+	subEnvironments := make([]map[string]string, len(s.Parallel))
+	for i, ss := range s.Parallel {
+		subEnvironment := map[string]string{}
+		for envName, envValue := range environment {
+			subEnvironment[envName] = envValue
+		}
+		for envName, envValue := range ss.Environment {
+			subEnvironment[envName] = envValue
+		}
+		subEnvironments[i] = subEnvironment
+
+		command, err := e.interpolateCommand(s, ss.Command, e.stepInterpolationVars(rt, stepIndex, subEnvironment))
+		if err != nil {
+			_, _ = io.WriteString(outf, fmt.Sprintf("failed to interpolate sub step %d command: %s\n", i, err))
+			return -1, err
+		}
+		filename, err := e.createFile(ctx, pod, command, stepUser(t), outf)
+		if err != nil {
+			return -1, errors.Errorf("create file err: %v", err)
+		}
+		cmds[i] = ulimitCmd(s.Ulimits, append(append([]string{}, shell...), filename))
+	}
+
+	logfs := make([]io.WriteCloser, len(s.Parallel))
+	rt.Lock()
+	t.Status.Steps[stepIndex].Substeps = make([]*types.ExecutorTaskSubstepStatus, len(s.Parallel))
+	for i, ss := range s.Parallel {
+		t.Status.Steps[stepIndex].Substeps[i] = &types.ExecutorTaskSubstepStatus{
+			Name:      ss.Name,
+			Phase:     types.ExecutorTaskPhaseRunning,
+			StartTime: util.TimeP(time.Now()),
+		}
+		logf, err := e.createLog(rt, e.substepLogPath(t.ID, rt.attempt, stepIndex, i))
+		if err != nil {
+			rt.Unlock()
+			for _, f := range logfs[:i] {
+				f.Close()
+			}
+			return -1, err
+		}
+		logfs[i] = e.forwardLog(t, stepIndex, i, logf)
+	}
+	rt.Unlock()
+
+	outs := make([]io.Writer, len(s.Parallel))
+	pws := make([]*logPatternWriter, len(s.Parallel))
+	rws := make([]*redactWriter, len(s.Parallel))
+	escs := make([]*markerEscapeWriter, len(s.Parallel))
+	dws := make([]io.WriteCloser, len(s.Parallel))
+	for i := range s.Parallel {
+		outs[i] = logfs[i]
+		if rws[i] = e.newStepRedactWriter(t, stepIndex, logfs[i]); rws[i] != nil {
+			outs[i] = rws[i]
+		}
+		if len(s.FailOnLogPatterns) > 0 {
+			pws[i] = newLogPatternWriter(outs[i], s.FailOnLogPatterns, e.c.MaxLogLineLength)
+			outs[i] = pws[i]
+		}
+		escs[i] = newMarkerEscapeWriter(outs[i])
+		outs[i] = escs[i]
+		dw, err := newOutputDecoder(outs[i], s.OutputEncoding)
+		if err != nil {
+			for _, f := range logfs {
+				f.Close()
+			}
+			return -1, err
+		}
+		if dw != nil {
+			dws[i] = dw
+			outs[i] = dw
+		}
+		outs[i] = rt.diskUsage.limit(outs[i])
+	}
+
+	exitCodes := make([]int, len(s.Parallel))
+	errs := make([]error, len(s.Parallel))
+	// matched fail on log patterns
+	patterns := make([]string, len(s.Parallel))
+
+	// with fail fast the first failed sub step cancels the others. Their
+	// commands aren't killed but they end when the pod is removed, since all
+	// the remaining steps are skipped and the task finishes
+	subctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// failFastSubstep is the index of the sub step that cancelled the others
+	failFastSubstep := -1
+	cancelled := make([]bool, len(s.Parallel))
+
+	var wg sync.WaitGroup
+	for i := range s.Parallel {
+		wg.Add(1)
+		go func(i int, execConfig *driver.ExecConfig) {
+			defer wg.Done()
+			defer logfs[i].Close()
+
+			ce, err := pod.Exec(subctx, execConfig)
+			if err != nil {
+				exitCodes[i], errs[i] = -1, err
+			} else {
+				exitCodes[i], errs[i] = ce.Wait(subctx)
+			}
+			if dws[i] != nil {
+				_ = dws[i].Close()
+			}
+			_ = escs[i].Flush()
+			if rws[i] != nil {
+				_ = rws[i].Flush()
+			}
+			if errs[i] == nil && exitCodes[i] == 0 && pws[i] != nil {
+				patterns[i] = pws[i].Matched()
+			}
+
+			rt.Lock()
+			ssStatus := t.Status.Steps[stepIndex].Substeps[i]
+			ssStatus.EndTime = util.TimeP(time.Now())
+			switch {
+			case errs[i] != nil:
+				ssStatus.Phase = types.ExecutorTaskPhaseFailed
+			case patterns[i] != "":
+				ssStatus.Phase = types.ExecutorTaskPhaseFailed
+				ssStatus.ExitStatus = util.IntP(exitCodes[i])
+				ssStatus.FailedLogPattern = patterns[i]
+				errs[i] = errors.Errorf("output matched fail on log pattern %q", patterns[i])
+			case exitCodes[i] != 0:
+				ssStatus.Phase = types.ExecutorTaskPhaseFailed
+				ssStatus.ExitStatus = util.IntP(exitCodes[i])
+			default:
+				ssStatus.Phase = types.ExecutorTaskPhaseSuccess
+				ssStatus.ExitStatus = util.IntP(exitCodes[i])
+			}
+			if ssStatus.Phase == types.ExecutorTaskPhaseFailed && t.Spec.FailFast && ctx.Err() == nil {
+				if failFastSubstep < 0 {
+					failFastSubstep = i
+					cancel()
+				} else {
+					ssStatus.Phase = types.ExecutorTaskPhaseCancelled
+					cancelled[i] = true
+				}
+			}
+			rt.Unlock()
+		}(i, &driver.ExecConfig{
+			Cmd:         cmds[i],
+			Env:         subEnvironments[i],
+			WorkingDir:  workingDir,
+			User:        stepUser(t),
+			AttachStdin: true,
+			Stdout:      outs[i],
+			Stderr:      outs[i],
+			Tty:         *s.Tty,
+		})
+	}
+	wg.Wait()
+
+	exitCode := 0
+	var ferr error
+	for i, ss := range s.Parallel {
+		if cancelled[i] {
+			_, _ = io.WriteString(outf, fmt.Sprintf("Substep %q cancelled since substep %q failed (fail fast)\n", ss.Name, s.Parallel[failFastSubstep].Name))
+			continue
+		}
+		if errs[i] != nil {
+			_, _ = io.WriteString(outf, fmt.Sprintf("Substep %q failed. Error: %s\n", ss.Name, errs[i]))
+			if ferr == nil {
+				ferr = errs[i]
+				if patterns[i] != "" {
+					rt.Lock()
+					t.Status.Steps[stepIndex].FailedLogPattern = patterns[i]
+					rt.Unlock()
+				}
+			}
+			continue
+		}
+		_, _ = io.WriteString(outf, fmt.Sprintf("Substep %q exited with code %d\n", ss.Name, exitCodes[i]))
+		if exitCodes[i] != 0 && exitCode == 0 {
+			exitCode = exitCodes[i]
+		}
+	}
+	if ferr != nil {
+		return -1, ferr
 	}
-	archivef, err := os.Create(archivePath)
+
+	return exitCode, nil
+}
+
+func (e *Executor) doSaveToWorkspaceStep(ctx context.Context, s *types.SaveToWorkspaceStep, t *types.ExecutorTask, pod driver.Pod, logf io.Writer, archivePath string, du *taskDiskUsage) (int, error) {
+	cmd := []string{toolboxContainerPath, "archive"}
+
+	archivef, err := e.createArchiveFile(ctx, archivePath)
 	if err != nil {
 		return -1, err
 	}
-	defer archivef.Close()
+	defer archivef.discard()
+	archiveh := sha256.New()
+	archivew := newArchiveLimitWriter(io.MultiWriter(du.writer(archivef), archiveh), e.c.MaxArchiveSize)
 
 	workingDir, err := e.expandDir(ctx, t, pod, logf, t.Spec.WorkingDir)
 	if err != nil {
-		_, _ = logf.WriteString(fmt.Sprintf("failed to expand working dir %q. Error: %s\n", t.Spec.WorkingDir, err))
+		_, _ = io.WriteString(logf, fmt.Sprintf("failed to expand working dir %q. Error: %s\n", t.Spec.WorkingDir, err))
 		return -1, err
 	}
 
 	execConfig := &driver.ExecConfig{
 		Cmd:         cmd,
-		Env:         t.Spec.Environment,
+		Env:         e.taskEnvironment(t),
 		WorkingDir:  workingDir,
 		User:        stepUser(t),
 		AttachStdin: true,
-		Stdout:      archivef,
+		Stdout:      du.limit(archivew),
 		Stderr:      logf,
 	}
 
@@ -262,9 +594,36 @@ func (e *Executor) doSaveToWorkspaceStep(ctx context.Context, s *types.SaveToWor
 	}()
 
 	exitCode, err := ce.Wait(ctx)
+	// a failed archive write also makes the archiving command fail
+	if werr := archivef.writeError(); werr != nil {
+		return -1, e.archiveVolumeFailed("write the archive", werr)
+	}
 	if err != nil {
 		return -1, err
 	}
+	if err := e.checkArchiveSize(archivew, archivef.Name(), logf); err != nil {
+		return -1, err
+	}
+	// the archive is incomplete, it's removed when discarded
+	if du.isExceeded() {
+		return -1, du.err()
+	}
+	if err := archivef.publish(); err != nil {
+		return -1, e.archiveVolumeFailed("publish the archive", err)
+	}
+	if exitCode == 0 {
+		if err := e.indexArchive(archiveh, archivePath); err != nil {
+			log.Errorf("failed to index archive %q: %+v", archivePath, err)
+		}
+	}
+	if err := e.saveArchiveMetadata(archivePath, s.Metadata); err != nil {
+		return -1, e.archiveVolumeFailed("save the archive metadata", err)
+	}
+	e.archiveVolumeSucceeded()
+	e.archives.written(archivePath)
+	if err := e.evictArchives(t.ID); err != nil {
+		log.Errorf("failed to evict archives: %+v", err)
+	}
 
 	return exitCode, nil
 }
@@ -278,7 +637,7 @@ func (e *Executor) expandDir(ctx context.Context, t *types.ExecutorTask, pod dri
 
 	execConfig := &driver.ExecConfig{
 		Cmd:         cmd,
-		Env:         t.Spec.Environment,
+		Env:         e.taskEnvironment(t),
 		User:        stepUser(t),
 		AttachStdin: true,
 		Stdout:      stdout,
@@ -307,7 +666,7 @@ func (e *Executor) mkdir(ctx context.Context, t *types.ExecutorTask, pod driver.
 
 	execConfig := &driver.ExecConfig{
 		Cmd:         cmd,
-		Env:         t.Spec.Environment,
+		Env:         e.taskEnvironment(t),
 		User:        stepUser(t),
 		AttachStdin: true,
 		Stdout:      logf,
@@ -330,6 +689,35 @@ func (e *Executor) mkdir(ctx context.Context, t *types.ExecutorTask, pod driver.
 	return nil
 }
 
+// removeDir removes the provided dirs or files and all their contents
+func (e *Executor) removeDir(ctx context.Context, t *types.ExecutorTask, pod driver.Pod, logf io.Writer, paths ...string) error {
+	cmd := append([]string{toolboxContainerPath, "remove"}, paths...)
+
+	execConfig := &driver.ExecConfig{
+		Cmd:         cmd,
+		Env:         e.taskEnvironment(t),
+		User:        stepUser(t),
+		AttachStdin: true,
+		Stdout:      logf,
+		Stderr:      logf,
+	}
+
+	ce, err := pod.Exec(ctx, execConfig)
+	if err != nil {
+		return err
+	}
+
+	exitCode, err := ce.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	if exitCode != 0 {
+		return errors.Errorf("remove ended with exit code %d", exitCode)
+	}
+
+	return nil
+}
+
 func (e *Executor) template(ctx context.Context, t *types.ExecutorTask, pod driver.Pod, logf io.Writer, key string) (string, error) {
 	cmd := []string{toolboxContainerPath, "template"}
 
@@ -344,7 +732,7 @@ func (e *Executor) template(ctx context.Context, t *types.ExecutorTask, pod driv
 
 	execConfig := &driver.ExecConfig{
 		Cmd:         cmd,
-		Env:         t.Spec.Environment,
+		Env:         e.taskEnvironment(t),
 		WorkingDir:  workingDir,
 		User:        stepUser(t),
 		AttachStdin: true,
@@ -392,7 +780,7 @@ func (e *Executor) unarchive(ctx context.Context, t *types.ExecutorTask, source
 
 	execConfig := &driver.ExecConfig{
 		Cmd:         cmd,
-		Env:         t.Spec.Environment,
+		Env:         e.taskEnvironment(t),
 		WorkingDir:  workingDir,
 		User:        stepUser(t),
 		AttachStdin: true,
@@ -422,16 +810,7 @@ func (e *Executor) unarchive(ctx context.Context, t *types.ExecutorTask, source
 	return nil
 }
 
-func (e *Executor) doRestoreWorkspaceStep(ctx context.Context, s *types.RestoreWorkspaceStep, t *types.ExecutorTask, pod driver.Pod, logPath string) (int, error) {
-	if err := os.MkdirAll(filepath.Dir(logPath), 0770); err != nil {
-		return -1, err
-	}
-	logf, err := os.Create(logPath)
-	if err != nil {
-		return -1, err
-	}
-	defer logf.Close()
-
+func (e *Executor) doRestoreWorkspaceStep(ctx context.Context, s *types.RestoreWorkspaceStep, t *types.ExecutorTask, pod driver.Pod, logf io.Writer) (int, error) {
 	for _, op := range t.Spec.WorkspaceOperations {
 		log.Debugf("unarchiving workspace for taskID: %s, step: %d", level, op.TaskID, op.Step)
 		resp, err := e.runserviceClient.GetArchive(ctx, op.TaskID, op.Step)
@@ -451,18 +830,9 @@ func (e *Executor) doRestoreWorkspaceStep(ctx context.Context, s *types.RestoreW
 	return 0, nil
 }
 
-func (e *Executor) doSaveCacheStep(ctx context.Context, s *types.SaveCacheStep, t *types.ExecutorTask, pod driver.Pod, logPath string, archivePath string) (int, error) {
+func (e *Executor) doSaveCacheStep(ctx context.Context, s *types.SaveCacheStep, t *types.ExecutorTask, pod driver.Pod, logf io.Writer, archivePath string, du *taskDiskUsage) (int, error) {
 	cmd := []string{toolboxContainerPath, "archive"}
 
-	if err := os.MkdirAll(filepath.Dir(logPath), 0770); err != nil {
-		return -1, err
-	}
-	logf, err := os.Create(logPath)
-	if err != nil {
-		return -1, err
-	}
-	defer logf.Close()
-
 	save := false
 
 	// calculate key from template
@@ -494,14 +864,13 @@ func (e *Executor) doSaveCacheStep(ctx context.Context, s *types.SaveCacheStep,
 	}
 
 	fmt.Fprintf(logf, "archiving cache with key %q\n", userKey)
-	if err := os.MkdirAll(filepath.Dir(archivePath), 0770); err != nil {
-		return -1, err
-	}
-	archivef, err := os.Create(archivePath)
+	archivef, err := e.createArchiveFile(ctx, archivePath)
 	if err != nil {
 		return -1, err
 	}
-	defer archivef.Close()
+	defer archivef.discard()
+	archiveh := sha256.New()
+	archivew := newArchiveLimitWriter(io.MultiWriter(du.writer(archivef), archiveh), e.c.MaxArchiveSize)
 
 	workingDir, err := e.expandDir(ctx, t, pod, logf, t.Spec.WorkingDir)
 	if err != nil {
@@ -511,11 +880,11 @@ func (e *Executor) doSaveCacheStep(ctx context.Context, s *types.SaveCacheStep,
 
 	execConfig := &driver.ExecConfig{
 		Cmd:         cmd,
-		Env:         t.Spec.Environment,
+		Env:         e.taskEnvironment(t),
 		WorkingDir:  workingDir,
 		User:        stepUser(t),
 		AttachStdin: true,
-		Stdout:      archivef,
+		Stdout:      du.limit(archivew),
 		Stderr:      logf,
 	}
 
@@ -557,6 +926,10 @@ func (e *Executor) doSaveCacheStep(ctx context.Context, s *types.SaveCacheStep,
 	}()
 
 	exitCode, err := ce.Wait(ctx)
+	// a failed archive write also makes the archiving command fail
+	if werr := archivef.writeError(); werr != nil {
+		return -1, e.archiveVolumeFailed("write the archive", werr)
+	}
 	if err != nil {
 		return -1, err
 	}
@@ -564,6 +937,27 @@ func (e *Executor) doSaveCacheStep(ctx context.Context, s *types.SaveCacheStep,
 	if exitCode != 0 {
 		return exitCode, errors.Errorf("save cache archiving command ended with exit code %d", exitCode)
 	}
+	if err := e.checkArchiveSize(archivew, archivef.Name(), logf); err != nil {
+		return -1, err
+	}
+	// the archive is incomplete, it's removed when discarded
+	if du.isExceeded() {
+		return -1, du.err()
+	}
+	if err := archivef.publish(); err != nil {
+		return -1, e.archiveVolumeFailed("publish the archive", err)
+	}
+	if err := e.indexArchive(archiveh, archivePath); err != nil {
+		log.Errorf("failed to index archive %q: %+v", archivePath, err)
+	}
+	if err := e.saveArchiveMetadata(archivePath, s.Metadata); err != nil {
+		return -1, e.archiveVolumeFailed("save the archive metadata", err)
+	}
+	e.archiveVolumeSucceeded()
+	e.archives.written(archivePath)
+	if err := e.evictArchives(t.ID); err != nil {
+		log.Errorf("failed to evict archives: %+v", err)
+	}
 
 	f, err := os.Open(archivePath)
 	if err != nil {
@@ -585,16 +979,7 @@ func (e *Executor) doSaveCacheStep(ctx context.Context, s *types.SaveCacheStep,
 	return exitCode, nil
 }
 
-func (e *Executor) doRestoreCacheStep(ctx context.Context, s *types.RestoreCacheStep, t *types.ExecutorTask, pod driver.Pod, logPath string) (int, error) {
-	if err := os.MkdirAll(filepath.Dir(logPath), 0770); err != nil {
-		return -1, err
-	}
-	logf, err := os.Create(logPath)
-	if err != nil {
-		return -1, err
-	}
-	defer logf.Close()
-
+func (e *Executor) doRestoreCacheStep(ctx context.Context, s *types.RestoreCacheStep, t *types.ExecutorTask, pod driver.Pod, logf io.Writer) (int, error) {
 	fmt.Fprintf(logf, "restoring cache: %s\n", util.Dump(s))
 	for _, key := range s.Keys {
 		// calculate key from template
@@ -641,24 +1026,518 @@ func (e *Executor) tasksDir() string {
 	return filepath.Join(e.c.DataDir, "tasks")
 }
 
+// taskEnvironment returns the task environment with the proxy and CA bundle
+// variables. The task environment has precedence over them.
+func (e *Executor) taskEnvironment(t *types.ExecutorTask) map[string]string {
+	environment := map[string]string{}
+	for envName, envValue := range e.proxyEnvironment(t) {
+		environment[envName] = envValue
+	}
+	if len(e.caBundle) > 0 || t.Spec.CABundle != "" {
+		for _, envName := range caBundleEnvVars {
+			environment[envName] = caBundleContainerPath
+		}
+	}
+	for envName, envValue := range t.Spec.Environment {
+		environment[envName] = envValue
+	}
+	return environment
+}
+
+func (e *Executor) proxyEnvironment(t *types.ExecutorTask) map[string]string {
+	c := e.c.Proxy
+	httpProxy, httpsProxy, noProxy := c.HTTPProxy, c.HTTPSProxy, c.NoProxy
+	if c.InheritEnv {
+		if httpProxy == "" {
+			httpProxy = getenvAny("HTTP_PROXY", "http_proxy")
+		}
+		if httpsProxy == "" {
+			httpsProxy = getenvAny("HTTPS_PROXY", "https_proxy")
+		}
+		if noProxy == "" {
+			noProxy = getenvAny("NO_PROXY", "no_proxy")
+		}
+	}
+	if p := t.Spec.Proxy; p != nil {
+		if p.HTTPProxy != "" {
+			httpProxy = p.HTTPProxy
+		}
+		if p.HTTPSProxy != "" {
+			httpsProxy = p.HTTPSProxy
+		}
+		if p.NoProxy != "" {
+			noProxy = p.NoProxy
+		}
+	}
+
+	if httpProxy == "" && httpsProxy == "" {
+		return nil
+	}
+	if noProxy == "" {
+		noProxy = e.defaultNoProxy()
+	}
+
+	environment := map[string]string{}
+	if httpProxy != "" {
+		environment["HTTP_PROXY"] = httpProxy
+		environment["http_proxy"] = httpProxy
+	}
+	if httpsProxy != "" {
+		environment["HTTPS_PROXY"] = httpsProxy
+		environment["https_proxy"] = httpsProxy
+	}
+	environment["NO_PROXY"] = noProxy
+	environment["no_proxy"] = noProxy
+	return environment
+}
+
+// defaultNoProxy returns the local addresses and the runservice host (used by
+// the toolbox to fetch workspaces and caches)
+func (e *Executor) defaultNoProxy() string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if u, err := url.Parse(e.c.RunserviceURL); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	return strings.Join(hosts, ",")
+}
+
+func getenvAny(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 func (e *Executor) taskPath(taskID string) string {
 	return filepath.Join(e.tasksDir(), taskID)
 }
 
-func (e *Executor) taskLogsPath(taskID string) string {
-	return filepath.Join(e.tasksDir(), taskID, "logs")
+// taskLogPath returns the path of the task attempt log stream generated by the
+// log path layout
+func (e *Executor) taskLogPath(taskID string, attempt int, stream string) string {
+	return filepath.Join(e.taskPath(taskID), filepath.FromSlash(e.logLayout.path(&pathVars{taskID: taskID, attempt: attempt, stream: stream})))
+}
+
+func (e *Executor) setupLogPath(taskID string, attempt int) string {
+	return e.taskLogPath(taskID, attempt, setupLogStream)
+}
+
+func (e *Executor) stepLogPath(taskID string, attempt, stepID int) string {
+	return e.taskLogPath(taskID, attempt, stepLogStream(stepID))
+}
+
+func (e *Executor) substepLogPath(taskID string, attempt, stepID, substepID int) string {
+	return e.taskLogPath(taskID, attempt, substepLogStream(stepID, substepID))
+}
+
+// createDataFile creates (or truncates) a log or archive file applying the
+// configured file mode and owner
+func (e *Executor) createDataFile(p string) (*os.File, error) {
+	f, err := os.OpenFile(p, os.O_RDWR|os.O_CREATE|os.O_TRUNC, e.fileMode)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.setDataFileMode(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// setDataFileMode sets the configured mode and owner of a created data file
+func (e *Executor) setDataFileMode(f *os.File) error {
+	// set the mode explicitly since the open mode is filtered by the umask
+	if err := f.Chmod(e.fileMode); err != nil {
+		return err
+	}
+	return e.setDataFileOwner(f)
+}
+
+// writeTaskDataFileAtomic is like writeDataFileAtomic for a data file of the
+// task, accounted in the task disk usage while the task is running
+func (e *Executor) writeTaskDataFileAtomic(taskID, p string, data []byte) error {
+	var u *taskDiskUsage
+	if rt, ok := e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		u = rt.diskUsage
+		rt.Unlock()
+	}
+	return u.writeFile(e.writeDataFileAtomic)(p, data)
+}
+
+// setDataFileOwner sets the configured owner of a created data file
+func (e *Executor) setDataFileOwner(f *os.File) error {
+	if e.fileUID != -1 || e.fileGID != -1 {
+		if err := f.Chown(e.fileUID, e.fileGID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDataFileAtomic atomically writes data to the data file at p with the
+// configured mode and owner
+func (e *Executor) writeDataFileAtomic(p string, data []byte) error {
+	return e.writeDataFileAtomicFunc(p, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// writeDataFileAtomicFunc is like writeDataFileAtomic but the file content is
+// written by writeFunc
+func (e *Executor) writeDataFileAtomicFunc(p string, writeFunc func(w io.Writer) error) error {
+	return common.WriteFileAtomicFunc(p, e.fileMode, func(w io.Writer) error {
+		if err := writeFunc(w); err != nil {
+			return err
+		}
+		// the temporary file is renamed to p only after it has been written,
+		// so set its owner before
+		return e.setDataFileOwner(w.(*os.File))
+	})
+}
+
+func (e *Executor) capabilities() *Capabilities {
+	return &Capabilities{
+		MaxArchiveSize:   e.c.MaxArchiveSize,
+		TaskDiskQuota:    e.c.TaskDiskQuota,
+		MaxLogLineLength: e.c.MaxLogLineLength,
+		NetworkModes:     e.allowedNetworkModes(),
+		MaxStepUlimits:   e.c.MaxStepUlimits,
+		ImageRegistries:  e.c.AllowedImageRegistries,
+	}
+}
+
+func (e *Executor) allowedNetworkModes() []string {
+	if len(e.c.AllowedNetworkModes) == 0 {
+		return []string{driver.NetworkModeNone, driver.NetworkModeBridge}
+	}
+	return e.c.AllowedNetworkModes
+}
+
+// networkModeAllowed reports if a task can use the network mode. The default
+// network mode is always allowed
+func (e *Executor) networkModeAllowed(mode string) bool {
+	if mode == "" {
+		return true
+	}
+	for _, m := range e.allowedNetworkModes() {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// taskArchiveSteps returns the sorted indexes of the steps with an archive
+func (e *Executor) taskArchiveSteps(taskID string) ([]int, error) {
+	archives, err := e.findTaskFiles(taskID, e.archiveLayout)
+	if err != nil {
+		return nil, err
+	}
+	steps := []int{}
+	for _, a := range archives {
+		steps = append(steps, a.step)
+	}
+	sort.Ints(steps)
+	return steps, nil
 }
 
-func (e *Executor) setupLogPath(taskID string) string {
-	return filepath.Join(e.taskLogsPath(taskID), "setup.log")
+// taskAttempts returns the sorted task attempts saved on disk: the attempts
+// with logs and the ones recorded in the task manifest, like the attempts of
+// a task not persisting its logs
+func (e *Executor) taskAttempts(taskID string) ([]int, error) {
+	logs, err := e.taskLogs(taskID)
+	if err != nil {
+		return nil, err
+	}
+	found := map[int]struct{}{}
+	for _, l := range logs {
+		found[l.attempt] = struct{}{}
+	}
+	if m, err := e.getTaskManifest(taskID); err == nil {
+		for _, attempt := range m.Attempts {
+			found[attempt] = struct{}{}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	attempts := []int{}
+	for attempt := range found {
+		attempts = append(attempts, attempt)
+	}
+	sort.Ints(attempts)
+	return attempts, nil
 }
 
-func (e *Executor) stepLogPath(taskID string, stepID int) string {
-	return filepath.Join(e.taskLogsPath(taskID), "steps", fmt.Sprintf("%d.log", stepID))
+// latestTaskAttempt returns the attempt of the running task or, if not
+// running, the last attempt saved on disk
+func (e *Executor) latestTaskAttempt(taskID string) (int, error) {
+	if rt, ok := e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		defer rt.Unlock()
+		return rt.attempt, nil
+	}
+	attempts, err := e.taskAttempts(taskID)
+	if err != nil {
+		return 0, err
+	}
+	if len(attempts) == 0 {
+		return 1, nil
+	}
+	return attempts[len(attempts)-1], nil
 }
 
 func (e *Executor) archivePath(taskID string, stepID int) string {
-	return filepath.Join(e.taskPath(taskID), "archives", fmt.Sprintf("%d.tar", stepID))
+	return filepath.Join(e.taskPath(taskID), filepath.FromSlash(e.archiveLayout.path(&pathVars{taskID: taskID, step: stepID})))
+}
+
+// removeTaskArchives removes all the task archives with their digests and
+// metadata
+func (e *Executor) removeTaskArchives(taskID string) error {
+	archives, err := e.findTaskFiles(taskID, e.archiveLayout)
+	if err != nil {
+		return err
+	}
+	for _, a := range archives {
+		for _, p := range []string{a.path, archiveDigestPath(a.path), archiveMetadataPath(a.path)} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		e.removeEmptyDirs(taskID, filepath.Dir(a.path))
+	}
+	return nil
+}
+
+// logPath returns the path of the log selected by sel
+func (e *Executor) logPath(taskID string, sel *logSelector) string {
+	switch {
+	case sel.setup:
+		return e.setupLogPath(taskID, sel.attempt)
+	case sel.service != "":
+		return e.serviceLogPath(taskID, sel.attempt, sel.serviceIndex)
+	case sel.substep >= 0:
+		return e.substepLogPath(taskID, sel.attempt, sel.step, sel.substep)
+	default:
+		return e.stepLogPath(taskID, sel.attempt, sel.step)
+	}
+}
+
+// resolveLogSelector sets the latest task attempt if not requested and the
+// index of the selected service container
+func (e *Executor) resolveLogSelector(taskID string, sel *logSelector) error {
+	if sel.attempt == 0 {
+		attempt, err := e.latestTaskAttempt(taskID)
+		if err != nil {
+			return err
+		}
+		sel.attempt = attempt
+	}
+	if sel.service != "" {
+		index, err := e.taskServiceIndex(taskID, sel.service)
+		if err != nil {
+			return err
+		}
+		sel.serviceIndex = index
+	}
+	return nil
+}
+
+// logFinished reports if the log selected by sel won't receive new data
+func (e *Executor) logFinished(taskID string, sel *logSelector) bool {
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return true
+	}
+	rt.Lock()
+	defer rt.Unlock()
+	if rt.attempt != sel.attempt {
+		return true
+	}
+	if sel.setup {
+		return rt.et.Status.SetupStep.Phase.IsFinished()
+	}
+	// the service containers run until the task finishes
+	if sel.service != "" {
+		return rt.et.Status.Phase.IsFinished()
+	}
+	step, substep := sel.step, sel.substep
+	if step < 0 || step >= len(rt.et.Status.Steps) {
+		return true
+	}
+	ss := rt.et.Status.Steps[step]
+	if substep >= 0 {
+		// the sub steps status is created when the step starts
+		if ss.Phase.IsFinished() || substep >= len(ss.Substeps) {
+			return ss.Phase.IsFinished()
+		}
+		return ss.Substeps[substep].Phase.IsFinished()
+	}
+	return ss.Phase.IsFinished()
+}
+
+const (
+	logPendingTaskQueued   = "task queued"
+	logPendingTaskStarting = "task starting"
+	logPendingStepQueued   = "step not started"
+)
+
+// logPending returns why the log selected by sel, not created yet, will be
+// created later: the task is queued or the task or the step hasn't started
+// yet. It returns an empty string when the log won't be created.
+func (e *Executor) logPending(taskID string, sel *logSelector) string {
+	if et, ok := e.taskQueue.get(taskID); ok {
+		// a queued task will start with a new attempt
+		attempts, err := e.taskAttempts(taskID)
+		if err != nil {
+			return ""
+		}
+		attempt := 1
+		if len(attempts) > 0 {
+			attempt = attempts[len(attempts)-1] + 1
+		}
+		if sel.attempt != attempt || sel.service != "" || !taskHasLog(et, sel) {
+			return ""
+		}
+		return logPendingTaskQueued
+	}
+
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return ""
+	}
+	rt.Lock()
+	defer rt.Unlock()
+	if rt.attempt != sel.attempt || !taskHasLog(rt.et, sel) {
+		return ""
+	}
+	switch {
+	case sel.setup:
+		if rt.et.Status.SetupStep.Phase.IsFinished() {
+			return ""
+		}
+		return logPendingTaskStarting
+	case sel.service != "":
+		if rt.et.Status.Phase.IsFinished() {
+			return ""
+		}
+		return logPendingTaskStarting
+	}
+	// the step log is created just after the step is set running
+	if sel.step >= len(rt.et.Status.Steps) || rt.et.Status.Steps[sel.step].Phase.IsFinished() {
+		return ""
+	}
+	return logPendingStepQueued
+}
+
+// taskHasLog reports if the task defines the step or substep selected by sel
+func taskHasLog(et *types.ExecutorTask, sel *logSelector) bool {
+	if et.Spec.ExecutorTaskSpecData == nil {
+		return false
+	}
+	if sel.setup || sel.service != "" {
+		return true
+	}
+	if sel.step < 0 || sel.step >= len(et.Spec.Steps) {
+		return false
+	}
+	if sel.substep >= 0 {
+		s, ok := et.Spec.Steps[sel.step].(*types.RunStep)
+		return ok && sel.substep < len(s.Parallel)
+	}
+	return true
+}
+
+// stepPod returns the pod of the running task and the phase of its step
+func (e *Executor) stepPod(taskID string, step int) (driver.Pod, types.ExecutorTaskPhase, error) {
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return nil, "", util.NewErrNotExist(errors.Errorf("task %q not running", taskID))
+	}
+	rt.Lock()
+	defer rt.Unlock()
+	if step >= len(rt.et.Status.Steps) {
+		return nil, "", util.NewErrBadRequest(errors.Errorf("task %q has no step %d", taskID, step))
+	}
+	if rt.pod == nil {
+		return nil, "", util.NewErrNotExist(errors.Errorf("task %q pod not started", taskID))
+	}
+	return rt.pod, rt.et.Status.Steps[step].Phase, nil
+}
+
+// taskStatusSnapshot returns a copy of the task phase and steps status. For a
+// running task it waits for the running task lock, so during the task setup it
+// waits until the setup finished.
+func (e *Executor) taskStatusSnapshot(taskID string) (*TaskStatusSnapshot, error) {
+	var status *types.ExecutorTaskStatus
+	if rt, ok := e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		defer rt.Unlock()
+		status = &rt.et.Status
+	} else {
+		m, err := e.getTaskManifest(taskID)
+		if err != nil {
+			return nil, err
+		}
+		status = &m.Status
+	}
+
+	snapshot := &TaskStatusSnapshot{
+		TaskID: taskID,
+		Phase:  status.Phase,
+		Steps:  make([]*types.ExecutorTaskStepStatus, len(status.Steps)),
+	}
+	for i, s := range status.Steps {
+		ss := *s
+		snapshot.Steps[i] = &ss
+	}
+	return snapshot, nil
+}
+
+// closeStepLog closes the log writer of a running task step and marks the step
+// as failed if not finished. It's a recovery tool for logs left open by a
+// driver fault that would keep the log followers waiting forever.
+func (e *Executor) closeStepLog(ctx context.Context, taskID string, step int) error {
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return util.NewErrNotExist(errors.Errorf("task %q not running", taskID))
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	et := rt.et
+	if step < 0 || step >= len(et.Status.Steps) {
+		return util.NewErrNotExist(errors.Errorf("task %q step %d doesn't exist", taskID, step))
+	}
+
+	if rt.stepLog != nil && rt.stepLogIndex == step {
+		if err := rt.stepLog.writeMarker("Log forcibly closed\n"); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+		if err := rt.stepLog.Close(); err != nil {
+			log.Errorf("failed to close task %s step %d log: %+v", taskID, step, err)
+		}
+		rt.stepLog = nil
+	}
+
+	ss := et.Status.Steps[step]
+	if ss.Phase.IsFinished() {
+		return nil
+	}
+	log.Infof("marking task %s step %d as failed since its log has been closed", taskID, step)
+	ss.Phase = types.ExecutorTaskPhaseFailed
+	if ss.StartTime != nil {
+		ss.EndTime = util.TimeP(time.Now())
+	}
+	if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
+		log.Errorf("err: %+v", err)
+	}
+	e.events.publishStepPhase(et, step)
+	return nil
 }
 
 func (e *Executor) sendExecutorStatus(ctx context.Context) error {
@@ -719,6 +1598,28 @@ func (e *Executor) sendExecutorStatus(ctx context.Context) error {
 }
 
 func (e *Executor) sendExecutorTaskStatus(ctx context.Context, et *types.ExecutorTask) error {
+	// all the callers of a running task hold its lock
+	if rt, ok := e.runningTasks.get(et.ID); ok && rt.et == et {
+		if err := e.saveTaskManifest(rt); err != nil {
+			log.Errorf("failed to save task manifest: %+v", err)
+		}
+	}
+
+	// the remaining time is set only in the sent status since the task status
+	// is shared with the running task
+	if et.Status.Deadline != nil {
+		remaining := time.Duration(0)
+		if !et.Status.Phase.IsFinished() {
+			remaining = time.Until(*et.Status.Deadline)
+			if remaining < 0 {
+				remaining = 0
+			}
+		}
+		set := *et
+		set.Status.RemainingTime = &remaining
+		et = &set
+	}
+
 	log.Debugf("send executor task: %s. status: %s", et.ID, et.Status.Phase)
 	_, err := e.runserviceClient.SendExecutorTaskStatus(ctx, e.id, et)
 	return err
@@ -732,46 +1633,137 @@ func (e *Executor) executeTask(rt *runningTask) {
 	// In this way we are sure that the pod cleaner will only remove pod that don't
 	// have an in progress running task
 
-	rt.Lock()
-	ctx := rt.ctx
+	rt.Lock()
+	ctx := rt.ctx
+	podStopped := make(chan struct{})
+	rt.podStopped = podStopped
+
+	// wait for context to be done and then stop the pod if running
+	go func() {
+		defer close(podStopped)
+		<-ctx.Done()
+		// a paused pod must be resumed before stopping it
+		rt.Lock()
+		if rt.paused {
+			if err := rt.pod.Unpause(context.Background()); err != nil {
+				log.Errorf("error unpausing the pod: %+v", err)
+			}
+			rt.paused = false
+			rt.et.Status.Paused = false
+		}
+		rt.Unlock()
+		e.stopPod(rt)
+	}()
+
+	// the post task hook is executed last, after the task context is cancelled
+	var result *TaskHistoryEntry
+	defer func() {
+		if result != nil {
+			e.runPostTaskHook(result)
+		}
+	}()
+
+	defer func() {
+		rt.Lock()
+		rt.cancel()
+		rt.Unlock()
+	}()
+
+	et := rt.et
+
+	// start the task timeout timer, when expired the running task will be
+	// cancelled like when stopping it
+	if et.Spec.Timeout > 0 {
+		e.startTaskTimeout(rt, et.Spec.Timeout)
+		defer func() {
+			rt.Lock()
+			rt.stopTaskTimeout()
+			rt.Unlock()
+		}()
+	}
+
+	et.Status.Phase = types.ExecutorTaskPhaseRunning
+	et.Status.StartTime = util.TimeP(time.Now())
+	// a step restart reuses the pod of the previous attempt, there's no setup
+	if rt.restart != nil {
+		if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+		e.events.publish(&Event{Type: EventTypeTaskStarted, TaskID: et.ID, Phase: et.Status.Phase})
+		rt.Unlock()
+	} else {
+		if !e.executeTaskSetup(ctx, rt) {
+			result = e.recordTaskHistory(rt)
+			rt.logBuffers = nil
+			rt.Unlock()
+			return
+		}
+		rt.Unlock()
+	}
+
+	_, err := e.executeTaskSteps(ctx, rt, rt.pod)
 
-	// wait for context to be done and then stop the pod if running
-	go func() {
-		<-ctx.Done()
-		if rt.pod != nil {
-			if err := rt.pod.Stop(context.Background()); err != nil {
-				log.Errorf("error stopping the pod: %+v", err)
-			}
+	rt.Lock()
+	if err != nil {
+		log.Errorf("err: %+v", err)
+		e.events.publishError(et.ID, err)
+		if rt.et.Spec.Stop {
+			et.Status.Phase = types.ExecutorTaskPhaseStopped
+		} else {
+			et.Status.Phase = types.ExecutorTaskPhaseFailed
 		}
-	}()
+		if rt.timedOut {
+			markTimedOut(et)
+		} else if rt.diskUsage.isExceeded() && !rt.et.Spec.Stop {
+			et.Status.FailError = rt.diskUsage.err().Error()
+		}
+	} else {
+		et.Status.Phase = types.ExecutorTaskPhaseSuccess
+	}
 
-	defer func() {
-		rt.Lock()
-		rt.cancel()
-		rt.Unlock()
-	}()
+	et.Status.EndTime = util.TimeP(time.Now())
 
-	et := rt.et
+	if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
+		log.Errorf("err: %+v", err)
+	}
+	e.events.publish(&Event{Type: EventTypeTaskFinished, TaskID: et.ID, Phase: et.Status.Phase})
+	result = e.recordTaskHistory(rt)
+	// discard the in memory logs of tasks that don't persist them
+	rt.logBuffers = nil
+	rt.Unlock()
+}
 
-	et.Status.Phase = types.ExecutorTaskPhaseRunning
-	et.Status.StartTime = util.TimeP(time.Now())
+// executeTaskSetup executes the task setup starting the task pod. It returns
+// false, with the task marked as failed, if the setup failed. It must be
+// called with the running task locked.
+func (e *Executor) executeTaskSetup(ctx context.Context, rt *runningTask) bool {
+	et := rt.et
 	et.Status.SetupStep.Phase = types.ExecutorTaskPhaseRunning
 	et.Status.SetupStep.StartTime = util.TimeP(time.Now())
 	if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
 		log.Errorf("err: %+v", err)
 	}
+	e.events.publish(&Event{Type: EventTypeTaskStarted, TaskID: et.ID, Phase: et.Status.Phase})
+	e.events.publishSetupPhase(et)
 
 	if err := e.setupTask(ctx, rt); err != nil {
 		log.Errorf("err: %+v", err)
+		e.events.publishError(et.ID, err)
 		et.Status.Phase = types.ExecutorTaskPhaseFailed
 		et.Status.EndTime = util.TimeP(time.Now())
 		et.Status.SetupStep.Phase = types.ExecutorTaskPhaseFailed
 		et.Status.SetupStep.EndTime = util.TimeP(time.Now())
+		if rt.timedOut {
+			markTimedOut(et)
+		} else if rt.diskUsage.isExceeded() {
+			et.Status.FailError = rt.diskUsage.err().Error()
+		}
 		if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
 			log.Errorf("err: %+v", err)
 		}
-		rt.Unlock()
-		return
+		e.events.publishSetupPhase(et)
+		e.events.publish(&Event{Type: EventTypeTaskFinished, TaskID: et.ID, Phase: et.Status.Phase})
+		return false
 	}
 
 	et.Status.SetupStep.Phase = types.ExecutorTaskPhaseSuccess
@@ -779,45 +1771,51 @@ func (e *Executor) executeTask(rt *runningTask) {
 	if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
 		log.Errorf("err: %+v", err)
 	}
+	e.events.publishSetupPhase(et)
+	return true
+}
 
-	rt.Unlock()
-
-	_, err := e.executeTaskSteps(ctx, rt, rt.pod)
-
-	rt.Lock()
-	if err != nil {
-		log.Errorf("err: %+v", err)
-		if rt.et.Spec.Stop {
-			et.Status.Phase = types.ExecutorTaskPhaseStopped
-		} else {
-			et.Status.Phase = types.ExecutorTaskPhaseFailed
+// markTimedOut marks all the not finished steps as timed out and sets the
+// task fail error
+func markTimedOut(et *types.ExecutorTask) {
+	et.Status.FailError = fmt.Sprintf("task timed out after %s", et.Spec.Timeout)
+	for _, s := range et.Status.Steps {
+		if s.Phase.IsFinished() {
+			continue
 		}
-	} else {
-		et.Status.Phase = types.ExecutorTaskPhaseSuccess
-	}
-
-	et.Status.EndTime = util.TimeP(time.Now())
-
-	if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
-		log.Errorf("err: %+v", err)
+		if s.Phase == types.ExecutorTaskPhaseRunning || s.Phase == types.ExecutorTaskPhasePaused {
+			s.EndTime = util.TimeP(time.Now())
+		}
+		s.Phase = types.ExecutorTaskPhaseTimedOut
 	}
-	rt.Unlock()
 }
 
 func (e *Executor) setupTask(ctx context.Context, rt *runningTask) error {
 	et := rt.et
-	if err := os.RemoveAll(e.taskPath(et.ID)); err != nil {
+	// keep the previous attempts logs but remove their archives since only the
+	// archives of the current attempt are fetched
+	if err := e.removeTaskArchives(et.ID); err != nil {
 		return err
 	}
-	if err := os.MkdirAll(e.taskPath(et.ID), 0770); err != nil {
+	logs, err := e.taskLogs(et.ID)
+	if err != nil {
 		return err
 	}
-
-	setupLogPath := e.setupLogPath(et.ID)
-	if err := os.MkdirAll(filepath.Dir(setupLogPath), 0770); err != nil {
+	for _, l := range logs {
+		if l.attempt != rt.attempt {
+			continue
+		}
+		if err := e.removeTaskLog(et.ID, l.path); err != nil {
+			return err
+		}
+	}
+	diskUsage, err := e.newTaskDiskUsage(rt)
+	if err != nil {
 		return err
 	}
-	outf, err := os.Create(setupLogPath)
+	rt.diskUsage = diskUsage
+
+	outf, err := e.createLog(rt, e.setupLogPath(et.ID, rt.attempt))
 	if err != nil {
 		return err
 	}
@@ -832,7 +1830,7 @@ func (e *Executor) setupTask(ctx context.Context, rt *runningTask) error {
 		}
 	}
 	if requiresPrivilegedContainers && !e.c.AllowPrivilegedContainers {
-		_, _ = outf.WriteString("Executor doesn't allow executing privileged containers.\n")
+		_, _ = io.WriteString(outf, "Executor doesn't allow executing privileged containers.\n")
 		return errors.Errorf("executor doesn't allow executing privileged containers")
 	}
 
@@ -851,8 +1849,14 @@ func (e *Executor) setupTask(ctx context.Context, rt *runningTask) error {
 		Arch:          et.Spec.Arch,
 		InitVolumeDir: toolboxContainerDir,
 		DockerConfig:  dockerConfig,
+		DNSServers:    et.Spec.DNSServers,
+		NetworkMode:   et.Spec.NetworkMode,
+		LogDriver:     e.podLogDriver(),
 		Containers:    make([]*driver.ContainerConfig, len(et.Spec.Containers)),
 	}
+	for _, h := range et.Spec.ExtraHosts {
+		podConfig.ExtraHosts = append(podConfig.ExtraHosts, driver.ExtraHost{Hostname: h.Hostname, IP: h.IP})
+	}
 	for i, c := range et.Spec.Containers {
 		var cmd []string
 		if i == 0 {
@@ -863,12 +1867,13 @@ func (e *Executor) setupTask(ctx context.Context, rt *runningTask) error {
 		}
 
 		containerConfig := &driver.ContainerConfig{
-			Image:      c.Image,
-			Cmd:        cmd,
-			Env:        c.Environment,
-			User:       c.User,
-			Privileged: c.Privileged,
-			Volumes:    make([]driver.Volume, len(c.Volumes)),
+			Image:          c.Image,
+			Cmd:            cmd,
+			Env:            c.Environment,
+			User:           c.User,
+			Privileged:     c.Privileged,
+			Volumes:        make([]driver.Volume, len(c.Volumes)),
+			ReadOnlyRootFS: c.ReadOnlyRootFS,
 		}
 
 		for vIndex, cVol := range c.Volumes {
@@ -884,19 +1889,76 @@ func (e *Executor) setupTask(ctx context.Context, rt *runningTask) error {
 
 		podConfig.Containers[i] = containerConfig
 	}
+	if mainContainerReadOnly(et) {
+		// mounted before the scratch and secret files tmpfs since they're
+		// inside it
+		podConfig.Containers[0].Volumes = append(podConfig.Containers[0].Volumes, driver.Volume{
+			Path:  readOnlyRootFSTmpDir,
+			TmpFS: &driver.VolumeTmpFS{},
+		})
+		if len(e.caBundle) > 0 || et.Spec.CABundle != "" {
+			podConfig.Containers[0].Volumes = append(podConfig.Containers[0].Volumes, driver.Volume{
+				Path:  caBundleContainerDir,
+				TmpFS: &driver.VolumeTmpFS{},
+			})
+		}
+	}
+	if e.c.StepScratch == config.StepScratchTmpfs && len(podConfig.Containers) > 0 {
+		// the steps are executed in the main container
+		podConfig.Containers[0].Volumes = append(podConfig.Containers[0].Volumes, driver.Volume{
+			Path:  stepScratchDir,
+			TmpFS: &driver.VolumeTmpFS{Size: e.c.StepScratchSize},
+		})
+	}
+	if len(et.Spec.SecretFiles) > 0 && len(podConfig.Containers) > 0 {
+		// the secret files must never be written to a disk backed volume
+		podConfig.Containers[0].Volumes = append(podConfig.Containers[0].Volumes, driver.Volume{
+			Path:  secretFilesDir,
+			TmpFS: &driver.VolumeTmpFS{Size: secretFilesTmpfsSize},
+		})
+	}
 
-	_, _ = outf.WriteString("Starting pod.\n")
+	_, _ = io.WriteString(outf, "Starting pod.\n")
+	podStart := time.Now()
 	pod, err := e.driver.NewPod(ctx, podConfig, outf)
+	rt.podStartDuration = time.Since(podStart)
 	if err != nil {
-		_, _ = outf.WriteString(fmt.Sprintf("Pod failed to start. Error: %s\n", err))
+		_, _ = io.WriteString(outf, fmt.Sprintf("Pod failed to start. Error: %s\n", err))
 		return err
 	}
-	_, _ = outf.WriteString("Pod started.\n")
+	_, _ = io.WriteString(outf, "Pod started.\n")
+	if mainContainerReadOnly(et) {
+		_, _ = io.WriteString(outf, fmt.Sprintf("The main container root filesystem is read-only, only %s are writable.\n", strings.Join(mainContainerWritableDirs(et), ", ")))
+	}
+
+	if err := e.captureServiceLogs(ctx, rt, pod); err != nil {
+		log.Errorf("failed to capture task %q service containers logs: %+v", et.ID, err)
+	}
+
+	// the running task is already locked by executeTask during the setup
+	et.Status.DNSServers = podConfig.DNSServers
+	et.Status.ExtraHosts = et.Spec.ExtraHosts
+	et.Status.NetworkMode = et.Spec.NetworkMode
+	if et.Status.NetworkMode == "" {
+		et.Status.NetworkMode = driver.NetworkModeBridge
+	}
+	et.Status.ContainerImages = nil
+	for _, c := range et.Spec.Containers {
+		et.Status.ContainerImages = append(et.Status.ContainerImages, c.Image)
+	}
 
 	if et.Spec.WorkingDir != "" {
-		_, _ = outf.WriteString(fmt.Sprintf("Creating working dir %q.\n", et.Spec.WorkingDir))
+		_, _ = io.WriteString(outf, fmt.Sprintf("Creating working dir %q.\n", et.Spec.WorkingDir))
 		if err := e.mkdir(ctx, et, pod, outf, et.Spec.WorkingDir); err != nil {
-			_, _ = outf.WriteString(fmt.Sprintf("Failed to create working dir %q. Error: %s\n", et.Spec.WorkingDir, err))
+			_, _ = io.WriteString(outf, fmt.Sprintf("Failed to create working dir %q. Error: %s\n", et.Spec.WorkingDir, err))
+			return err
+		}
+	}
+
+	if bundle := e.taskCABundle(et); bundle != nil {
+		_, _ = io.WriteString(outf, fmt.Sprintf("Injecting CA bundle in %q.\n", caBundleContainerPath))
+		if err := e.injectCABundle(ctx, et, pod, outf, bundle); err != nil {
+			_, _ = io.WriteString(outf, fmt.Sprintf("Failed to inject CA bundle. Error: %s\n", err))
 			return err
 		}
 	}
@@ -906,49 +1968,155 @@ func (e *Executor) setupTask(ctx context.Context, rt *runningTask) error {
 }
 
 func (e *Executor) executeTaskSteps(ctx context.Context, rt *runningTask, pod driver.Pod) (int, error) {
+	// first failed step index and error
+	failedStep := -1
+	var ferr error
+	// failFastReason is set, with fail fast, when a step failed
+	var failFastReason string
+
 	for i, step := range rt.et.Spec.Steps {
+		// a step restart keeps the status of the steps preceding the
+		// restarted one
+		if rt.restart != nil && i < rt.restart.step {
+			continue
+		}
+		// stop executing steps if the task has been stopped or timed out
+		if ctx.Err() != nil {
+			break
+		}
+
+		var when types.StepWhen
+		var name string
+		if bs := types.StepBase(step); bs != nil {
+			when = bs.When
+			name = bs.Name
+		}
+		if failFastReason != "" {
+			e.skipStep(ctx, rt, i, name, fmt.Sprintf("fail fast: %s", failFastReason))
+			continue
+		}
+		if rt.restart != nil && i > rt.restart.step && !rt.restart.downstream {
+			e.skipStep(ctx, rt, i, name, fmt.Sprintf("only step %d restarted", rt.restart.step))
+			continue
+		}
+		if !when.ShouldRun(ferr != nil) {
+			if when == "" {
+				when = types.StepWhenOnSuccess
+			}
+			e.skipStep(ctx, rt, i, name, fmt.Sprintf("when: %s", when))
+			continue
+		}
+
 		rt.Lock()
 		rt.et.Status.Steps[i].Phase = types.ExecutorTaskPhaseRunning
 		rt.et.Status.Steps[i].StartTime = util.TimeP(time.Now())
 		if err := e.sendExecutorTaskStatus(ctx, rt.et); err != nil {
 			log.Errorf("err: %+v", err)
 		}
+		e.events.publishStepPhase(rt.et, i)
 		rt.Unlock()
 
+		sampler := e.startStepResourcesSampler(rt, pod, i)
+
 		var err error
 		var exitCode int
 		var stepName string
 
-		switch s := step.(type) {
-		case *types.RunStep:
-			log.Debugf("run step: %s", util.Dump(s))
-			stepName = s.Name
-			exitCode, err = e.doRunStep(ctx, s, rt.et, pod, e.stepLogPath(rt.et.ID, i))
+		rt.Lock()
+		lf, err := e.createLog(rt, e.stepLogPath(rt.et.ID, rt.attempt, i))
+		if err != nil {
+			rt.Unlock()
+			return i, err
+		}
+		logf := newMarkedLogWriter(e.forwardLog(rt.et, i, -1, lf))
+		rt.stepLog = logf
+		rt.stepLogIndex = i
+		rt.Unlock()
+		if err := logf.writeStepStart(i, name); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+
+		var retry *types.StepRetry
+		if bs := types.StepBase(step); bs != nil {
+			retry = bs.Retry
+		}
+		for attempt := 1; ; attempt++ {
+			switch s := step.(type) {
+			case *types.RunStep:
+				log.Debugf("run step: %s", util.Dump(s))
+				stepName = s.Name
+				exitCode, err = e.doRunStep(ctx, s, rt, i, pod, logf)
+
+			case *types.SaveToWorkspaceStep:
+				log.Debugf("save to workspace step: %s", util.Dump(s))
+				stepName = s.Name
+				archivePath := e.archivePath(rt.et.ID, i)
+				exitCode, err = e.doSaveToWorkspaceStep(ctx, s, rt.et, pod, logf, archivePath, rt.diskUsage)
+
+			case *types.RestoreWorkspaceStep:
+				log.Debugf("restore workspace step: %s", util.Dump(s))
+				stepName = s.Name
+				exitCode, err = e.doRestoreWorkspaceStep(ctx, s, rt.et, pod, logf)
+
+			case *types.SaveCacheStep:
+				log.Debugf("save cache step: %s", util.Dump(s))
+				stepName = s.Name
+				archivePath := e.archivePath(rt.et.ID, i)
+				exitCode, err = e.doSaveCacheStep(ctx, s, rt.et, pod, logf, archivePath, rt.diskUsage)
+
+			case *types.RestoreCacheStep:
+				log.Debugf("restore cache step: %s", util.Dump(s))
+				stepName = s.Name
+				exitCode, err = e.doRestoreCacheStep(ctx, s, rt.et, pod, logf)
 
-		case *types.SaveToWorkspaceStep:
-			log.Debugf("save to workspace step: %s", util.Dump(s))
-			stepName = s.Name
-			archivePath := e.archivePath(rt.et.ID, i)
-			exitCode, err = e.doSaveToWorkspaceStep(ctx, s, rt.et, pod, e.stepLogPath(rt.et.ID, i), archivePath)
+			default:
+				sampler.stop()
+				rt.Lock()
+				rt.stepLog = nil
+				rt.Unlock()
+				logf.Close()
+				return i, errors.Errorf("unknown step type: %s", util.Dump(s))
+			}
 
-		case *types.RestoreWorkspaceStep:
-			log.Debugf("restore workspace step: %s", util.Dump(s))
-			stepName = s.Name
-			exitCode, err = e.doRestoreWorkspaceStep(ctx, s, rt.et, pod, e.stepLogPath(rt.et.ID, i))
+			if retry == nil {
+				break
+			}
+			rt.Lock()
+			rt.et.Status.Steps[i].Attempts = attempt
+			if err := e.sendExecutorTaskStatus(ctx, rt.et); err != nil {
+				log.Errorf("err: %+v", err)
+			}
+			rt.Unlock()
+			// only failures reported by the step exit code are retried
+			if err != nil || !retry.ShouldRetry(attempt, exitCode) || ctx.Err() != nil {
+				break
+			}
 
-		case *types.SaveCacheStep:
-			log.Debugf("save cache step: %s", util.Dump(s))
-			stepName = s.Name
-			archivePath := e.archivePath(rt.et.ID, i)
-			exitCode, err = e.doSaveCacheStep(ctx, s, rt.et, pod, e.stepLogPath(rt.et.ID, i), archivePath)
+			backoff := retry.RetryBackoff(attempt)
+			fmt.Fprintf(logf, "step failed with exit code %d, retrying in %s (attempt %d of %d)\n", exitCode, backoff, attempt+1, retry.MaxAttempts)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			if err := logf.writeStepAttempt(i, attempt+1, exitCode); err != nil {
+				log.Errorf("err: %+v", err)
+			}
+		}
 
-		case *types.RestoreCacheStep:
-			log.Debugf("restore cache step: %s", util.Dump(s))
-			stepName = s.Name
-			exitCode, err = e.doRestoreCacheStep(ctx, s, rt.et, pod, e.stepLogPath(rt.et.ID, i))
+		sampler.stop()
 
-		default:
-			return i, errors.Errorf("unknown step type: %s", util.Dump(s))
+		// the task is cancelled when it exceeds its disk quota, the step fails
+		// with the quota error
+		if (err != nil || exitCode != 0) && rt.diskUsage.isExceeded() {
+			err = rt.diskUsage.err()
+			_, _ = io.WriteString(logf, err.Error()+"\n")
+		}
+		var aerr *archiveVolumeError
+		if errors.As(err, &aerr) {
+			_, _ = io.WriteString(logf, err.Error()+"\n")
 		}
 
 		var serr error
@@ -961,6 +2129,8 @@ func (e *Executor) executeTaskSteps(ctx context.Context, rt *runningTask, pod dr
 		if err != nil {
 			if rt.et.Spec.Stop {
 				rt.et.Status.Steps[i].Phase = types.ExecutorTaskPhaseStopped
+			} else if rt.timedOut {
+				rt.et.Status.Steps[i].Phase = types.ExecutorTaskPhaseTimedOut
 			} else {
 				rt.et.Status.Steps[i].Phase = types.ExecutorTaskPhaseFailed
 			}
@@ -968,6 +2138,8 @@ func (e *Executor) executeTaskSteps(ctx context.Context, rt *runningTask, pod dr
 		} else if exitCode != 0 {
 			if rt.et.Spec.Stop {
 				rt.et.Status.Steps[i].Phase = types.ExecutorTaskPhaseStopped
+			} else if rt.timedOut {
+				rt.et.Status.Steps[i].Phase = types.ExecutorTaskPhaseTimedOut
 			} else {
 				rt.et.Status.Steps[i].Phase = types.ExecutorTaskPhaseFailed
 			}
@@ -976,20 +2148,95 @@ func (e *Executor) executeTaskSteps(ctx context.Context, rt *runningTask, pod dr
 		} else if exitCode == 0 {
 			rt.et.Status.Steps[i].ExitStatus = util.IntP(exitCode)
 		}
+		if rt.et.Spec.FailFast && rt.et.Status.Steps[i].Phase == types.ExecutorTaskPhaseFailed {
+			failFastReason = stepFailureReason(rt.et, i, stepName)
+			rt.et.Status.FailFastReason = failFastReason
+		}
+
+		// write the end marker before the step is reported as finished so log
+		// followers will receive it
+		if err := logf.writeStepEnd(i, rt.et.Status.Steps[i]); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+		rt.stepLog = nil
+		logf.Close()
 
 		if err := e.sendExecutorTaskStatus(ctx, rt.et); err != nil {
 			log.Errorf("err: %+v", err)
 		}
+		e.events.publishStepPhase(rt.et, i)
 		rt.Unlock()
 
-		if serr != nil {
-			return i, serr
+		if serr != nil && ferr == nil {
+			failedStep = i
+			ferr = serr
 		}
 	}
 
+	if ferr != nil {
+		return failedStep, ferr
+	}
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
 	return 0, nil
 }
 
+// stepFailureReason describes the failure of the step at stepIndex, reporting
+// the first failed parallel sub step
+func stepFailureReason(et *types.ExecutorTask, stepIndex int, name string) string {
+	reason := fmt.Sprintf("step %d", stepIndex)
+	if name != "" {
+		reason = fmt.Sprintf("step %d (%s)", stepIndex, name)
+	}
+	for _, ss := range et.Status.Steps[stepIndex].Substeps {
+		if ss.Phase == types.ExecutorTaskPhaseFailed {
+			return fmt.Sprintf("%s substep %q failed", reason, ss.Name)
+		}
+	}
+	return reason + " failed"
+}
+
+// skipStep marks the step as skipped and writes a notice, reporting why it has
+// been skipped, in the step log so log readers will receive it instead of a not
+// found error
+func (e *Executor) skipStep(ctx context.Context, rt *runningTask, stepIndex int, name string, reason string) {
+	rt.Lock()
+	defer rt.Unlock()
+
+	now := time.Now()
+	rt.et.Status.Steps[stepIndex].Phase = types.ExecutorTaskPhaseSkipped
+	rt.et.Status.Steps[stepIndex].StartTime = util.TimeP(now)
+	rt.et.Status.Steps[stepIndex].EndTime = util.TimeP(now)
+
+	// write the log before reporting the step as finished
+	if err := e.writeSkippedStepLog(rt, stepIndex, name, reason); err != nil {
+		log.Errorf("err: %+v", err)
+	}
+
+	if err := e.sendExecutorTaskStatus(ctx, rt.et); err != nil {
+		log.Errorf("err: %+v", err)
+	}
+	e.events.publishStepPhase(rt.et, stepIndex)
+}
+
+func (e *Executor) writeSkippedStepLog(rt *runningTask, stepIndex int, name string, reason string) error {
+	lf, err := e.createLog(rt, e.stepLogPath(rt.et.ID, rt.attempt, stepIndex))
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	logf := newMarkedLogWriter(lf)
+	if err := logf.writeStepStart(stepIndex, name); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(logf, "Step skipped (%s).\n", reason); err != nil {
+		return err
+	}
+	return logf.writeStepEnd(stepIndex, rt.et.Status.Steps[stepIndex])
+}
+
 func (e *Executor) podsCleanerLoop(ctx context.Context) {
 	for {
 		log.Debugf("podsCleaner")
@@ -1023,7 +2270,7 @@ func (e *Executor) podsCleaner(ctx context.Context) error {
 		taskID := pod.TaskID()
 		// clean our owned pods
 		if pod.ExecutorID() == e.id {
-			if _, ok := e.runningTasks.get(taskID); !ok {
+			if _, ok := e.runningTasks.get(taskID); !ok && !e.selfTests.isRunning(taskID) {
 				log.Infof("removing pod %s for not running task: %s", pod.ID(), taskID)
 				_ = pod.Remove(ctx)
 			}
@@ -1136,6 +2383,12 @@ func (e *Executor) tasksUpdater(ctx context.Context) error {
 		etIDsMap[et.ID] = struct{}{}
 	}
 
+	for _, qtID := range e.taskQueue.ids() {
+		if _, ok := etIDsMap[qtID]; !ok {
+			e.taskQueue.remove(qtID)
+		}
+	}
+
 	for _, rtID := range e.runningTasks.ids() {
 		if _, ok := etIDsMap[rtID]; ok {
 			continue
@@ -1175,6 +2428,7 @@ func (e *Executor) taskUpdater(ctx context.Context, et *types.ExecutorTask) {
 
 	// only send cancelled phase when the executor task isn't in running tasks and is not started
 	if et.Spec.Stop && et.Status.Phase == types.ExecutorTaskPhaseNotStarted {
+		e.taskQueue.remove(et.ID)
 		et.Status.Phase = types.ExecutorTaskPhaseCancelled
 		go func() {
 			if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
@@ -1202,26 +2456,49 @@ func (e *Executor) taskUpdater(ctx context.Context, et *types.ExecutorTask) {
 	}
 
 	if !et.Spec.Stop && et.Status.Phase == types.ExecutorTaskPhaseNotStarted {
-		activeTasks := e.runningTasks.len()
-		// don't start task if we have reached the active tasks limit (they will be retried
-		// on next taskUpdater calls)
-		if activeTasks > e.c.ActiveTasksLimit {
-			return
-		}
-		rtCtx, rtCancel := context.WithCancel(ctx)
-		rt := &runningTask{
-			et:     et,
-			ctx:    rtCtx,
-			cancel: rtCancel,
-		}
+		// the task is started by the task queue loop when there's room for
+		// new active tasks
+		e.taskQueue.push(et)
+	}
+}
 
-		if !e.runningTasks.addIfNotExists(et.ID, rt) {
-			log.Warnf("task %s already running, this shouldn't happen", et.ID)
-			return
-		}
+// startTask starts executing a queued task
+func (e *Executor) startTask(ctx context.Context, et *types.ExecutorTask) {
+	if _, ok := e.runningTasks.get(et.ID); ok {
+		return
+	}
+
+	attempts, err := e.taskAttempts(et.ID)
+	if err != nil {
+		log.Errorf("err: %+v", err)
+		return
+	}
+	attempt := 1
+	if len(attempts) > 0 {
+		attempt = attempts[len(attempts)-1] + 1
+	}
+	attempts = append(attempts, attempt)
+	et.Status.Attempt = attempt
+
+	rtCtx, rtCancel := context.WithCancel(ctx)
+	rt := &runningTask{
+		et:           et,
+		ctx:          rtCtx,
+		cancel:       rtCancel,
+		parentCtx:    ctx,
+		attempt:      attempt,
+		attempts:     attempts,
+		receivedTime: util.TimeP(time.Now()),
+		resources:    newTaskResources(len(et.Spec.Steps)),
+	}
 
-		go e.executeTask(rt)
+	if !e.runningTasks.addIfNotExists(et.ID, rt) {
+		log.Warnf("task %s already running, this shouldn't happen", et.ID)
+		return
 	}
+	e.events.publish(&Event{Type: EventTypeTaskReceived, TaskID: et.ID, Phase: et.Status.Phase})
+
+	go e.executeTask(rt)
 }
 
 func (e *Executor) tasksDataCleanerLoop(ctx context.Context) {
@@ -1263,6 +2540,15 @@ func (e *Executor) tasksDataCleaner(ctx context.Context) error {
 			}
 		}
 		if resp.StatusCode == http.StatusNotFound {
+			// the runservice forgets a task after it fetched its logs and
+			// archives
+			keep, err := e.keepForgottenTaskData(etID)
+			if err != nil {
+				return err
+			}
+			if keep {
+				continue
+			}
 			taskDir := e.taskPath(etID)
 			log.Infof("removing task dir %q", taskDir)
 			// remove task dir
@@ -1272,7 +2558,13 @@ func (e *Executor) tasksDataCleaner(ctx context.Context) error {
 		}
 	}
 
-	return nil
+	// the archives of the tasks just forgotten by the runservice could be
+	// evicted
+	if err := e.evictArchives(""); err != nil {
+		return err
+	}
+
+	return e.pruneArchiveDigests()
 }
 
 type runningTasks struct {
@@ -1285,9 +2577,56 @@ type runningTask struct {
 
 	ctx    context.Context
 	cancel context.CancelFunc
+	// parentCtx is the context the task context derives from, a new task
+	// context is derived from it when a step is restarted
+	parentCtx context.Context
+	// podStopped is closed when the task pod has been stopped after the task
+	// context is done
+	podStopped chan struct{}
 
 	et  *types.ExecutorTask
 	pod driver.Pod
+
+	// timedOut is true when the task has been cancelled since its timeout expired
+	timedOut bool
+	// timeoutTimer is the task timeout timer. It's stopped while the task is
+	// paused and timeoutRemaining keeps the time left
+	timeoutTimer     *time.Timer
+	timeoutRemaining time.Duration
+
+	// paused is true when the task pod is paused
+	paused bool
+	// stepLog is the log of the running step and stepLogIndex its index
+	stepLog      *markedLogWriter
+	stepLogIndex int
+
+	// attempt is the task execution attempt. Every time the same task is
+	// executed again by this executor a new attempt is created so the previous
+	// attempts logs are kept
+	attempt int
+	// attempts are all the task attempts including the current one
+	attempts []int
+
+	receivedTime *time.Time
+	// podStartDuration is the time spent starting the pod during the setup
+	podStartDuration time.Duration
+
+	// logBuffers are the in memory logs, by log path, of a task that doesn't
+	// persist its logs
+	logBuffers map[string]*logRingBuffer
+	// logLines are the lines counters, by log path, of the task logs
+	logLines map[string]*lineCountWriter
+	// logSyncs are the periodically synced task logs, by log path
+	logSyncs map[string]*syncLogWriter
+	// diskUsage is the task disk usage, nil when there's no task disk quota
+	diskUsage *taskDiskUsage
+	// resources is the task resource usage summary
+	resources *TaskResources
+	// manifest is the last saved task manifest
+	manifest []byte
+	// restart is the step restart being executed, nil when executing the
+	// whole task
+	restart *stepRestart
 }
 
 func (r *runningTasks) get(rtID string) (*runningTask, bool) {
@@ -1330,11 +2669,22 @@ func (r *runningTasks) ids() []string {
 }
 
 func (e *Executor) handleTasks(ctx context.Context, c <-chan *types.ExecutorTask) {
+	close(e.ready)
 	for et := range c {
 		e.taskUpdater(ctx, et)
 	}
 }
 
+// isReady reports if the executor accepts the submitted tasks
+func (e *Executor) isReady() bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
 func (e *Executor) getExecutorID() (string, error) {
 	id, err := ioutil.ReadFile(e.executorIDPath())
 	if err != nil && !os.IsNotExist(err) {
@@ -1359,6 +2709,46 @@ type Executor struct {
 	listenAddress    string
 	listenURL        string
 	dynamic          bool
+	events           *eventBus
+	selfTests        *selfTests
+	prewarmer        *imagePrewarmer
+	taskHistory      *taskHistory
+	archives         *archiveTracker
+	openFiles        *streamLimiter
+	logFollows       *streamLimiter
+	followMemory     *followMemory
+	archiveBuffers   *archiveBuffers
+	logDiffRules     []*logDiffRule
+	logLayout        *pathLayout
+	archiveLayout    *pathLayout
+	archiveDownloads *streamLimiter
+	// archiveWrites limits the concurrent archive writes
+	archiveWrites chan struct{}
+	taskQueue     *taskQueue
+	// ready is closed when the execution loop receives the submitted tasks
+	ready chan struct{}
+
+	// fileMode and fileUID, fileGID are the mode and owner of the created log
+	// and archive files. An uid or gid of -1 means unchanged
+	fileMode os.FileMode
+	fileUID  int
+	fileGID  int
+
+	// caBundle is the configured CA bundle injected in every task
+	caBundle []byte
+
+	// logForwarder, when log forwarding is enabled, sends the steps output to
+	// syslog
+	logForwarder *logForwarder
+
+	// hostCPU is the host cpu utilization used by the adaptive gzip level
+	hostCPU *hostCPU
+
+	// imageRegistries are the parsed allowed image registries
+	imageRegistries []*imageRegistryPattern
+
+	// archiveVolume tracks if the step archives can be written
+	archiveVolume *archiveVolume
 }
 
 func NewExecutor(ctx context.Context, l *zap.Logger, c *config.Executor) (*Executor, error) {
@@ -1376,18 +2766,100 @@ func NewExecutor(ctx context.Context, l *zap.Logger, c *config.Executor) (*Execu
 		return nil, errors.Errorf("cannot determine \"agola-toolbox\" absolute path: %w", err)
 	}
 
+	fileMode, err := config.ParseFileMode(c.FileMode)
+	if err != nil {
+		return nil, err
+	}
+	fileUID, fileGID, err := config.ParseFileOwner(c.FileOwner)
+	if err != nil {
+		return nil, err
+	}
+
+	var caBundle []byte
+	if c.CABundle != "" {
+		caBundle, err = ioutil.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, errors.Errorf("failed to read CA bundle: %w", err)
+		}
+		if err := validateCABundle(caBundle); err != nil {
+			return nil, errors.Errorf("invalid CA bundle %q: %w", c.CABundle, err)
+		}
+	}
+
+	maxConcurrentArchiveWrites := c.MaxConcurrentArchiveWrites
+	if maxConcurrentArchiveWrites == 0 {
+		maxConcurrentArchiveWrites = defaultMaxConcurrentArchiveWrites
+	}
+	archiveReadBufferSize := c.ArchiveReadBufferSize
+	if archiveReadBufferSize == 0 {
+		archiveReadBufferSize = defaultArchiveReadBufferSize
+	}
+	logDiffRules, err := compileLogDiffRules(c.LogDiff)
+	if err != nil {
+		return nil, err
+	}
+	logLayout, archiveLayout, err := newPathLayouts(c.PathLayout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateMaxStepUlimits(c.MaxStepUlimits); err != nil {
+		return nil, err
+	}
+	imageRegistries, err := parseImageRegistryPatterns(c.AllowedImageRegistries)
+	if err != nil {
+		return nil, err
+	}
+
 	e := &Executor{
 		c:                c,
+		caBundle:         caBundle,
+		fileMode:         fileMode,
+		fileUID:          fileUID,
+		fileGID:          fileGID,
 		runserviceClient: rsclient.NewClient(c.RunserviceURL),
 		runningTasks: &runningTasks{
 			tasks: make(map[string]*runningTask),
 		},
+		events:           newEventBus(),
+		selfTests:        &selfTests{},
+		prewarmer:        newImagePrewarmer(),
+		archives:         newArchiveTracker(),
+		openFiles:        newStreamLimiter(c.MaxStreamFiles, openStreamFiles),
+		logFollows:       newStreamLimiter(c.MaxLogFollows, nil),
+		followMemory:     newFollowMemory(c.MaxLogFollowMemory),
+		archiveDownloads: newStreamLimiter(c.MaxArchiveDownloads, archiveDownloadsInFlight),
+		archiveWrites:    make(chan struct{}, maxConcurrentArchiveWrites),
+		archiveBuffers:   newArchiveBuffers(archiveReadBufferSize),
+		logDiffRules:     logDiffRules,
+		logLayout:        logLayout,
+		archiveLayout:    archiveLayout,
+		taskQueue:        newTaskQueue(),
+		hostCPU:          &hostCPU{},
+		imageRegistries:  imageRegistries,
+		archiveVolume:    &archiveVolume{},
+		ready:            make(chan struct{}),
+	}
+	if c.LogForward.Enabled {
+		e.logForwarder = newLogForwarder(c.LogForward)
 	}
 
 	if err := os.MkdirAll(e.tasksDir(), 0770); err != nil {
 		return nil, err
 	}
 
+	taskHistorySize := c.TaskHistorySize
+	if taskHistorySize == 0 {
+		taskHistorySize = defaultTaskHistorySize
+	}
+	var taskHistoryPath string
+	if c.TaskHistoryPersist {
+		taskHistoryPath = e.taskHistoryPath()
+	}
+	e.taskHistory, err = newTaskHistory(taskHistorySize, taskHistoryPath)
+	if err != nil {
+		return nil, err
+	}
+
 	id, err := e.getExecutorID()
 	if err != nil {
 		return nil, err
@@ -1450,16 +2922,106 @@ func (e *Executor) Run(ctx context.Context) error {
 	}
 
 	ch := make(chan *types.ExecutorTask)
-	schedulerHandler := NewTaskSubmissionHandler(ch)
+	schedulerHandler := NewTaskSubmissionHandler(logger, e, ch)
 	logsHandler := NewLogsHandler(logger, e)
+	logPollHandler := NewLogPollHandler(logger, e)
+	logStatsHandler := NewLogStatsHandler(logger, e)
+	logPageHandler := NewLogPageHandler(logger, e)
+	taskJSONLogsHandler := NewTaskJSONLogsHandler(logger, e)
+	logDiffHandler := NewLogDiffHandler(logger, e)
 	archivesHandler := NewArchivesHandler(e)
+	allArchivesHandler := NewAllArchivesHandler(logger, e)
+	archiveByDigestHandler := NewArchiveByDigestHandler(logger, e)
+	archiveExistsHandler := NewArchiveExistsHandler(logger, e)
+	archivesListHandler := NewArchivesListHandler(logger, e)
+	archiveFileHandler := NewArchiveFileHandler(logger, e)
+	eventsHandler := NewEventsHandler(logger, e)
+	selfTestHandler := NewSelfTestHandler(logger, e)
+	taskTimingsHandler := NewTaskTimingsHandler(logger, e)
+	taskResourcesHandler := NewTaskResourcesHandler(logger, e)
+	taskManifestHandler := NewTaskManifestHandler(logger, e)
+	taskBundleHandler := NewTaskBundleHandler(logger, e)
+	stepStatsHandler := NewStepStatsHandler(logger, e)
+	taskStatusStreamHandler := NewTaskStatusStreamHandler(logger, e)
+	taskPauseHandler := NewTaskPauseHandler(logger, e)
+	taskResumeHandler := NewTaskResumeHandler(logger, e)
+	stepRestartHandler := NewStepRestartHandler(logger, e)
+	tasksCancelHandler := NewTasksCancelHandler(logger, e)
+	tasksListHandler := NewTasksListHandler(logger, e)
+	logLevelHandler := NewLogLevelHandler(logger, level)
+	prewarmHandler := NewPrewarmHandler(logger, e)
+	adminConfigHandler := NewAdminConfigHandler(logger, e)
+	closeStepLogHandler := NewCloseStepLogHandler(logger, e)
+	capabilitiesHandler := NewCapabilitiesHandler(logger, e)
+	executorStatusHandler := NewExecutorStatusHandler(logger, e)
+	executorReadyHandler := NewExecutorReadyHandler(logger, e)
+	taskHistoryHandler := NewTaskHistoryHandler(logger, e)
+	taskValidationHandler := NewTaskValidationHandler(logger, e)
+
+	adminAuthHandler := NewAdminAuthHandler(e.c.AdminToken)
 
 	router := mux.NewRouter()
 	apirouter := router.PathPrefix("/api/v1alpha").Subrouter()
 
-	apirouter.Handle("/executor", schedulerHandler).Methods("POST")
+	// the write timeout is applied only to the requests not streaming data.
+	// The logs, archives, events, status stream and self test requests could
+	// legitimately last long
+	writeTimeout := func(h http.Handler) http.Handler {
+		if e.c.HTTPTimeouts.Write <= 0 {
+			return h
+		}
+		return http.TimeoutHandler(h, e.c.HTTPTimeouts.Write, "request timeout")
+	}
+	// the responses of the JSON handlers are compressed when the client
+	// accepts it. The logs and archives handlers have their own encodings
+	gzipJSON := e.gzipJSONHandler
+
+	apirouter.Handle("/executor", writeTimeout(schedulerHandler)).Methods("POST")
+	apirouter.Handle("/executor/validate", writeTimeout(gzipJSON(taskValidationHandler))).Methods("POST")
 	apirouter.Handle("/executor/logs", logsHandler).Methods("GET")
+	apirouter.Handle("/executor/logs/poll", writeTimeout(logPollHandler)).Methods("GET")
+	apirouter.Handle("/executor/logs/stats", writeTimeout(gzipJSON(logStatsHandler))).Methods("GET")
+	apirouter.Handle("/executor/logs/page", writeTimeout(gzipJSON(logPageHandler))).Methods("GET")
 	apirouter.Handle("/executor/archives", archivesHandler).Methods("GET")
+	apirouter.Handle("/executor/archives/all", allArchivesHandler).Methods("GET")
+	apirouter.Handle("/executor/archives/by-digest/{digest}", archiveByDigestHandler).Methods("GET")
+	apirouter.Handle("/executor/archives/exists", writeTimeout(gzipJSON(archiveExistsHandler))).Methods("GET")
+	apirouter.Handle("/executor/archives/list", writeTimeout(gzipJSON(archivesListHandler))).Methods("GET")
+	apirouter.Handle("/executor/archives/file", archiveFileHandler).Methods("GET")
+	apirouter.Handle("/executor/events", eventsHandler).Methods("GET")
+	apirouter.Handle("/executor/tasks", writeTimeout(gzipJSON(tasksListHandler))).Methods("GET")
+	apirouter.Handle("/executor/tasks/history", writeTimeout(gzipJSON(taskHistoryHandler))).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/timings", writeTimeout(gzipJSON(taskTimingsHandler))).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/resources", writeTimeout(gzipJSON(taskResourcesHandler))).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/manifest", writeTimeout(gzipJSON(taskManifestHandler))).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/logs/jsonl", taskJSONLogsHandler).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/status/stream", taskStatusStreamHandler).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/bundle", taskBundleHandler).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/steps/{step}/stats", stepStatsHandler).Methods("GET")
+	apirouter.Handle("/executor/tasks/{taskid}/steps/{step}/logs/diff", writeTimeout(logDiffHandler)).Methods("GET")
+	apirouter.Handle("/executor/capabilities", writeTimeout(gzipJSON(capabilitiesHandler))).Methods("GET")
+	apirouter.Handle("/executor/status", writeTimeout(gzipJSON(executorStatusHandler))).Methods("GET")
+	apirouter.Handle("/executor/ready", writeTimeout(executorReadyHandler)).Methods("GET")
+	apirouter.Handle("/executor/metrics", writeTimeout(promhttp.Handler())).Methods("GET")
+
+	apirouter.Handle("/executor/selftest", adminAuthHandler(selfTestHandler)).Methods("POST")
+	apirouter.Handle("/executor/tasks/cancel", writeTimeout(adminAuthHandler(gzipJSON(tasksCancelHandler)))).Methods("POST")
+	apirouter.Handle("/executor/tasks/{taskid}/pause", writeTimeout(adminAuthHandler(taskPauseHandler))).Methods("POST")
+	apirouter.Handle("/executor/tasks/{taskid}/resume", writeTimeout(adminAuthHandler(taskResumeHandler))).Methods("POST")
+	apirouter.Handle("/executor/tasks/{taskid}/steps/{step}/restart", writeTimeout(adminAuthHandler(stepRestartHandler))).Methods("POST")
+	apirouter.Handle("/executor/tasks/{taskid}/steps/{step}/closelog", writeTimeout(adminAuthHandler(closeStepLogHandler))).Methods("POST")
+	apirouter.Handle("/executor/admin/loglevel", writeTimeout(adminAuthHandler(logLevelHandler))).Methods("GET", "POST")
+	apirouter.Handle("/executor/admin/prewarm", writeTimeout(adminAuthHandler(prewarmHandler))).Methods("GET", "POST")
+	apirouter.Handle("/executor/admin/config", writeTimeout(adminAuthHandler(gzipJSON(adminConfigHandler)))).Methods("GET")
+
+	// remove the pods left by a previous executor incarnation before starting
+	// new tasks. Since no task is running yet all the pods owned by the
+	// executor are orphaned
+	if e.c.OrphanedPods != config.OrphanedPodsBackground {
+		if err := e.podsCleaner(ctx); err != nil {
+			log.Errorf("failed to remove orphaned pods: %+v", err)
+		}
+	}
 
 	go e.executorStatusSenderLoop(ctx)
 	go e.executorTasksStatusSenderLoop(ctx)
@@ -1468,16 +3030,66 @@ func (e *Executor) Run(ctx context.Context) error {
 	go e.tasksDataCleanerLoop(ctx)
 
 	go e.handleTasks(ctx, ch)
+	go e.taskQueueLoop(ctx)
+
+	// the configured images are prewarmed on executor startup, so freshly
+	// started executors run their first tasks without waiting for the pulls
+	if len(e.c.PrewarmImages) > 0 {
+		var images []string
+		for _, image := range e.c.PrewarmImages {
+			normalized, _, err := registry.NormalizeImage(image)
+			if err != nil {
+				log.Errorf("invalid prewarm image %q: %v", image, err)
+				continue
+			}
+			images = append(images, normalized)
+		}
+		e.prewarmer.add(images)
+	}
+	go e.imagePrewarmLoop(ctx)
+	if e.logForwarder != nil {
+		go e.logForwarder.run(ctx)
+	}
+	if e.c.Gzip.Adaptive {
+		go e.hostCPULoop(ctx)
+	}
+	go e.archiveVolumeLoop(ctx)
 
+	readHeaderTimeout := e.c.HTTPTimeouts.ReadHeader
+	if readHeaderTimeout == 0 {
+		readHeaderTimeout = defaultHTTPReadHeaderTimeout
+	}
+	idleTimeout := e.c.HTTPTimeouts.Idle
+	if idleTimeout == 0 {
+		idleTimeout = defaultHTTPIdleTimeout
+	}
+	var handler http.Handler = apirouter
+	if !e.c.DisableHTTP2 {
+		handler = newH2CHandler(apirouter, idleTimeout)
+	}
 	httpServer := http.Server{
-		Addr:    e.listenAddress,
-		Handler: apirouter,
+		Addr:              e.listenAddress,
+		Handler:           handler,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       e.c.HTTPTimeouts.Read,
+		IdleTimeout:       idleTimeout,
 	}
 	lerrCh := make(chan error)
 	go func() {
 		lerrCh <- httpServer.ListenAndServe()
 	}()
 
+	if e.c.PprofListenAddress != "" {
+		pprofServer := newPprofServer(e.c.PprofListenAddress, adminAuthHandler)
+		defer pprofServer.Close()
+		go func() {
+			// a pprof server failure doesn't stop the executor
+			if err := pprofServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Errorf("pprof http server listen error: %v", err)
+			}
+		}()
+	}
+
 	select {
 	case <-ctx.Done():
 		log.Infof("runservice executor exiting")
@@ -0,0 +1,648 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/internal/services/executor/driver"
+	"agola.io/agola/internal/services/executor/registry"
+	"agola.io/agola/internal/util"
+	rsclient "agola.io/agola/services/runservice/client"
+	"agola.io/agola/services/runservice/types"
+	ctypes "agola.io/agola/services/types"
+)
+
+// fakeDriver creates fakePods
+type fakeDriver struct {
+	pod *fakePod
+}
+
+func (d *fakeDriver) Setup(ctx context.Context) error { return nil }
+
+func (d *fakeDriver) NewPod(ctx context.Context, podConfig *driver.PodConfig, out io.Writer) (driver.Pod, error) {
+	return d.pod, nil
+}
+
+func (d *fakeDriver) GetPods(ctx context.Context, all bool) ([]driver.Pod, error) {
+	return []driver.Pod{d.pod}, nil
+}
+
+func (d *fakeDriver) ExecutorGroup(ctx context.Context) (string, error) { return "", nil }
+
+func (d *fakeDriver) GetExecutors(ctx context.Context) ([]string, error) { return nil, nil }
+
+func (d *fakeDriver) Archs(ctx context.Context) ([]ctypes.Arch, error) { return nil, nil }
+
+func (d *fakeDriver) PullImage(ctx context.Context, image string, registryConfig *registry.DockerConfig, out io.Writer) error {
+	return driver.ErrNotSupported
+}
+
+// fakePod executes the run steps commands written by the toolbox createfile
+// command. A command is one of:
+// * "exit N": exits with code N
+// * "flaky N": exits with code 1 the first N times it's executed, then with 0
+// * "sleep": waits until the exec is cancelled
+// The other toolbox commands exit with code 0.
+type fakePod struct {
+	m        sync.Mutex
+	files    map[string]string
+	runs     map[string]int
+	started  int
+	execWait chan struct{}
+}
+
+func newFakePod() *fakePod {
+	return &fakePod{
+		files: make(map[string]string),
+		runs:  make(map[string]int),
+	}
+}
+
+func (p *fakePod) ID() string         { return "pod01" }
+func (p *fakePod) ExecutorID() string { return "executor01" }
+func (p *fakePod) TaskID() string     { return "task01" }
+
+func (p *fakePod) Stop(ctx context.Context, gracePeriod time.Duration) error { return nil }
+
+func (p *fakePod) Start(ctx context.Context) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.started++
+	return nil
+}
+
+func (p *fakePod) Remove(ctx context.Context) error  { return nil }
+func (p *fakePod) Pause(ctx context.Context) error   { return driver.ErrNotSupported }
+func (p *fakePod) Unpause(ctx context.Context) error { return driver.ErrNotSupported }
+
+func (p *fakePod) Stats(ctx context.Context) (*driver.ContainerStats, error) {
+	return nil, driver.ErrNotSupported
+}
+
+func (p *fakePod) ContainerLogs(ctx context.Context, index int, opts *driver.ContainerLogsOptions, out io.Writer) error {
+	return nil
+}
+
+func (p *fakePod) Exec(ctx context.Context, execConfig *driver.ExecConfig) (driver.ContainerExec, error) {
+	stdinr, stdinw := io.Pipe()
+	return &fakeExec{p: p, ctx: ctx, c: execConfig, stdinr: stdinr, stdinw: stdinw}, nil
+}
+
+// exec executes the command and returns its exit code
+func (p *fakePod) exec(ctx context.Context, c *driver.ExecConfig, stdin io.Reader) (int, error) {
+	if len(c.Cmd) > 1 && c.Cmd[0] == toolboxContainerPath {
+		if c.Cmd[1] != "createfile" {
+			return 0, nil
+		}
+		command, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return -1, err
+		}
+		p.m.Lock()
+		filename := fmt.Sprintf("/tmp/agola/%d", len(p.files))
+		p.files[filename] = strings.TrimSpace(string(command))
+		p.m.Unlock()
+		_, _ = io.WriteString(c.Stdout, filename)
+		return 0, nil
+	}
+
+	filename := c.Cmd[len(c.Cmd)-1]
+	p.m.Lock()
+	command := p.files[filename]
+	p.runs[command]++
+	runs := p.runs[command]
+	p.m.Unlock()
+
+	_, _ = io.WriteString(c.Stdout, command+"\n")
+	fields := strings.Fields(command)
+	switch fields[0] {
+	case "exit":
+		return strconv.Atoi(fields[1])
+	case "flaky":
+		n, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return -1, err
+		}
+		if runs <= n {
+			return 1, nil
+		}
+		return 0, nil
+	case "sleep":
+		<-ctx.Done()
+		return -1, ctx.Err()
+	}
+	return -1, fmt.Errorf("unknown command %q", command)
+}
+
+type fakeExec struct {
+	p      *fakePod
+	ctx    context.Context
+	c      *driver.ExecConfig
+	stdinr *io.PipeReader
+	stdinw *io.PipeWriter
+}
+
+func (e *fakeExec) Stdin() io.WriteCloser { return e.stdinw }
+
+func (e *fakeExec) Wait(ctx context.Context) (int, error) {
+	return e.p.exec(e.ctx, e.c, e.stdinr)
+}
+
+// fakeRunservice stores the tasks status sent by the executor and returns
+// them like the runservice executor task api
+type fakeRunservice struct {
+	*httptest.Server
+
+	m     sync.Mutex
+	tasks map[string]*types.ExecutorTask
+	// rejectFinished, when true, makes the tasks final status not accepted,
+	// like when they cannot be sent
+	rejectFinished bool
+}
+
+func newFakeRunservice() *fakeRunservice {
+	rs := &fakeRunservice{tasks: make(map[string]*types.ExecutorTask)}
+	rs.Server = httptest.NewServer(rs)
+	return rs
+}
+
+func (rs *fakeRunservice) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+
+	taskID := path.Base(r.URL.Path)
+	switch r.Method {
+	case "POST":
+		var et *types.ExecutorTask
+		if err := json.NewDecoder(r.Body).Decode(&et); err != nil {
+			http.Error(w, "", http.StatusBadRequest)
+			return
+		}
+		if rs.rejectFinished && et.Status.Phase.IsFinished() {
+			http.Error(w, "", http.StatusServiceUnavailable)
+			return
+		}
+		rs.tasks[taskID] = et
+	case "GET":
+		et, ok := rs.tasks[taskID]
+		if !ok {
+			http.Error(w, "", http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(et)
+	}
+}
+
+func (rs *fakeRunservice) setRejectFinished(reject bool) {
+	rs.m.Lock()
+	defer rs.m.Unlock()
+	rs.rejectFinished = reject
+}
+
+// newTestExecutor returns an executor using the fake driver with the pod and
+// the fake runservice, that must be closed
+func newTestExecutor(t *testing.T, dir string, pod *fakePod) (*Executor, *fakeRunservice) {
+	logLayout, archiveLayout, err := newPathLayouts(config.ExecutorPathLayout{})
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	taskHistory, err := newTaskHistory(10, "")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	rs := newFakeRunservice()
+	return &Executor{
+		c:                &config.Executor{DataDir: dir, DisableLogSync: true},
+		id:               "executor01",
+		runserviceClient: rsclient.NewClient(rs.URL),
+		driver:           &fakeDriver{pod: pod},
+		runningTasks: &runningTasks{
+			tasks: make(map[string]*runningTask),
+		},
+		events:        newEventBus(),
+		taskHistory:   taskHistory,
+		archives:      newArchiveTracker(),
+		logLayout:     logLayout,
+		archiveLayout: archiveLayout,
+		fileMode:      0660,
+		fileUID:       -1,
+		fileGID:       -1,
+	}, rs
+}
+
+// newTestTask returns a task with the provided steps
+func newTestTask(steps ...types.Step) *types.ExecutorTask {
+	et := &types.ExecutorTask{
+		ID: "task01",
+		Spec: types.ExecutorTaskSpec{
+			ExecutorID: "executor01",
+			ExecutorTaskSpecData: &types.ExecutorTaskSpecData{
+				Containers: []*types.Container{{Image: "image01"}},
+				Steps:      steps,
+			},
+		},
+		Status: types.ExecutorTaskStatus{
+			Phase: types.ExecutorTaskPhaseNotStarted,
+			Steps: make([]*types.ExecutorTaskStepStatus, len(steps)),
+		},
+	}
+	for i := range steps {
+		et.Status.Steps[i] = &types.ExecutorTaskStepStatus{Phase: types.ExecutorTaskPhaseNotStarted}
+	}
+	return et
+}
+
+// runStep returns a run step executing the fake pod command
+func runStep(command string, f ...func(s *types.RunStep)) *types.RunStep {
+	s := &types.RunStep{
+		BaseStep: types.BaseStep{Type: "run"},
+		Command:  command,
+		Tty:      util.BoolP(false),
+	}
+	for _, fn := range f {
+		fn(s)
+	}
+	return s
+}
+
+func withWhen(when types.StepWhen) func(s *types.RunStep) {
+	return func(s *types.RunStep) { s.When = when }
+}
+
+func withRetry(retry *types.StepRetry) func(s *types.RunStep) {
+	return func(s *types.RunStep) { s.Retry = retry }
+}
+
+// executeTestTask executes the task like when started by the task queue and
+// returns when it's finished
+func executeTestTask(e *Executor, et *types.ExecutorTask) *runningTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	rt := &runningTask{
+		et:           et,
+		ctx:          ctx,
+		cancel:       cancel,
+		parentCtx:    context.Background(),
+		attempt:      1,
+		attempts:     []int{1},
+		receivedTime: util.TimeP(time.Now()),
+		resources:    newTaskResources(len(et.Spec.Steps)),
+	}
+	e.runningTasks.addIfNotExists(et.ID, rt)
+	e.executeTask(rt)
+	return rt
+}
+
+// waitTaskFinished waits for the pod of the finished task to be stopped
+func waitTaskFinished(t *testing.T, rt *runningTask) {
+	rt.Lock()
+	podStopped := rt.podStopped
+	rt.Unlock()
+	select {
+	case <-podStopped:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout waiting for the task pod to be stopped")
+	}
+}
+
+func stepPhases(et *types.ExecutorTask) []types.ExecutorTaskPhase {
+	phases := []types.ExecutorTaskPhase{}
+	for _, s := range et.Status.Steps {
+		phases = append(phases, s.Phase)
+	}
+	return phases
+}
+
+func TestExecuteTaskSteps(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []types.Step
+		failFast bool
+		timeout  time.Duration
+
+		phase    types.ExecutorTaskPhase
+		phases   []types.ExecutorTaskPhase
+		attempts []int
+		// exitStatus are the steps exit status, -1 when not defined
+		exitStatus []int
+		failError  string
+		// failFastReason is the task fail fast reason
+		failFastReason string
+	}{
+		{
+			name:       "successful steps",
+			steps:      []types.Step{runStep("exit 0"), runStep("exit 0")},
+			phase:      types.ExecutorTaskPhaseSuccess,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSuccess},
+			exitStatus: []int{0, 0},
+		},
+		{
+			name: "when conditions after a failed step",
+			steps: []types.Step{
+				runStep("exit 2"),
+				runStep("exit 0"),
+				runStep("exit 0", withWhen(types.StepWhenOnSuccess)),
+				runStep("exit 0", withWhen(types.StepWhenOnFailure)),
+				runStep("exit 0", withWhen(types.StepWhenAlways)),
+			},
+			phase:      types.ExecutorTaskPhaseFailed,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseFailed, types.ExecutorTaskPhaseSkipped, types.ExecutorTaskPhaseSkipped, types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSuccess},
+			exitStatus: []int{2, -1, -1, 0, 0},
+		},
+		{
+			name: "when conditions after successful steps",
+			steps: []types.Step{
+				runStep("exit 0"),
+				runStep("exit 0", withWhen(types.StepWhenOnFailure)),
+				runStep("exit 0", withWhen(types.StepWhenAlways)),
+			},
+			phase:      types.ExecutorTaskPhaseSuccess,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSkipped, types.ExecutorTaskPhaseSuccess},
+			exitStatus: []int{0, -1, 0},
+		},
+		{
+			name: "fail fast skips also the steps that should always run",
+			steps: []types.Step{
+				runStep("exit 1"),
+				runStep("exit 0", withWhen(types.StepWhenOnFailure)),
+				runStep("exit 0", withWhen(types.StepWhenAlways)),
+			},
+			failFast:       true,
+			phase:          types.ExecutorTaskPhaseFailed,
+			phases:         []types.ExecutorTaskPhase{types.ExecutorTaskPhaseFailed, types.ExecutorTaskPhaseSkipped, types.ExecutorTaskPhaseSkipped},
+			exitStatus:     []int{1, -1, -1},
+			failFastReason: "step 0 failed",
+		},
+		{
+			name: "parallel sub steps with a failed sub step",
+			steps: []types.Step{
+				runStep("", func(s *types.RunStep) {
+					s.Parallel = []*types.RunSubstep{{Name: "sub01", Command: "exit 0"}, {Name: "sub02", Command: "exit 3"}}
+				}),
+				runStep("exit 0"),
+			},
+			failFast:       true,
+			phase:          types.ExecutorTaskPhaseFailed,
+			phases:         []types.ExecutorTaskPhase{types.ExecutorTaskPhaseFailed, types.ExecutorTaskPhaseSkipped},
+			exitStatus:     []int{3, -1},
+			failFastReason: `step 0 substep "sub02" failed`,
+		},
+		{
+			name: "parallel sub steps",
+			steps: []types.Step{
+				runStep("", func(s *types.RunStep) {
+					s.Parallel = []*types.RunSubstep{{Name: "sub01", Command: "exit 0"}, {Name: "sub02", Command: "exit 0"}}
+				}),
+			},
+			phase:      types.ExecutorTaskPhaseSuccess,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess},
+			exitStatus: []int{0},
+		},
+		{
+			name:       "retried step succeeding",
+			steps:      []types.Step{runStep("flaky 2", withRetry(&types.StepRetry{MaxAttempts: 3}))},
+			phase:      types.ExecutorTaskPhaseSuccess,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess},
+			attempts:   []int{3},
+			exitStatus: []int{0},
+		},
+		{
+			name:       "retried step exhausting its attempts",
+			steps:      []types.Step{runStep("exit 2", withRetry(&types.StepRetry{MaxAttempts: 2}))},
+			phase:      types.ExecutorTaskPhaseFailed,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseFailed},
+			attempts:   []int{2},
+			exitStatus: []int{2},
+		},
+		{
+			name:       "retried step with a not matching exit code",
+			steps:      []types.Step{runStep("exit 3", withRetry(&types.StepRetry{MaxAttempts: 3, ExitCodes: []int{2}}))},
+			phase:      types.ExecutorTaskPhaseFailed,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseFailed},
+			attempts:   []int{1},
+			exitStatus: []int{3},
+		},
+		{
+			name:       "timed out task",
+			steps:      []types.Step{runStep("exit 0"), runStep("sleep"), runStep("exit 0", withWhen(types.StepWhenAlways))},
+			timeout:    200 * time.Millisecond,
+			phase:      types.ExecutorTaskPhaseFailed,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseTimedOut, types.ExecutorTaskPhaseTimedOut},
+			exitStatus: []int{0, -1, -1},
+			failError:  "task timed out after 200ms",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			e, rs := newTestExecutor(t, dir, newFakePod())
+			defer rs.Close()
+			et := newTestTask(tt.steps...)
+			et.Spec.FailFast = tt.failFast
+			et.Spec.Timeout = tt.timeout
+
+			rt := executeTestTask(e, et)
+			waitTaskFinished(t, rt)
+
+			rt.Lock()
+			defer rt.Unlock()
+			checkTaskStatus(t, et, tt.phase, tt.phases, tt.exitStatus)
+			for i, attempts := range tt.attempts {
+				if et.Status.Steps[i].Attempts != attempts {
+					t.Fatalf("expected step %d attempts %d, got %d", i, attempts, et.Status.Steps[i].Attempts)
+				}
+			}
+			if et.Status.FailError != tt.failError {
+				t.Fatalf("expected fail error %q, got %q", tt.failError, et.Status.FailError)
+			}
+			if et.Status.FailFastReason != tt.failFastReason {
+				t.Fatalf("expected fail fast reason %q, got %q", tt.failFastReason, et.Status.FailFastReason)
+			}
+		})
+	}
+}
+
+func checkTaskStatus(t *testing.T, et *types.ExecutorTask, phase types.ExecutorTaskPhase, phases []types.ExecutorTaskPhase, exitStatus []int) {
+	t.Helper()
+	if et.Status.Phase != phase {
+		t.Fatalf("expected task phase %q, got %q", phase, et.Status.Phase)
+	}
+	if fmt.Sprint(stepPhases(et)) != fmt.Sprint(phases) {
+		t.Fatalf("expected steps phases %v, got %v", phases, stepPhases(et))
+	}
+	for i, s := range et.Status.Steps {
+		exitCode := -1
+		if s.ExitStatus != nil {
+			exitCode = *s.ExitStatus
+		}
+		if exitCode != exitStatus[i] {
+			t.Fatalf("expected step %d exit status %d, got %d", i, exitStatus[i], exitCode)
+		}
+	}
+}
+
+func TestRestartTaskStep(t *testing.T) {
+	tests := []struct {
+		name       string
+		downstream bool
+		// accepted is true when the runservice accepted the task failed
+		// status
+		accepted   bool
+		phases     []types.ExecutorTaskPhase
+		exitStatus []int
+	}{
+		{
+			name:     "failed status accepted by the runservice",
+			accepted: true,
+		},
+		{
+			name:       "restart only the failed step",
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSkipped},
+			exitStatus: []int{0, 0, -1},
+		},
+		{
+			name:       "restart the failed step and the following steps",
+			downstream: true,
+			phases:     []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSuccess},
+			exitStatus: []int{0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			pod := newFakePod()
+			e, rs := newTestExecutor(t, dir, pod)
+			defer rs.Close()
+			et := newTestTask(runStep("exit 0"), runStep("flaky 1"), runStep("exit 0"))
+
+			rs.setRejectFinished(!tt.accepted)
+			rt := executeTestTask(e, et)
+			waitTaskFinished(t, rt)
+			rt.Lock()
+			checkTaskStatus(t, et, types.ExecutorTaskPhaseFailed, []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseFailed, types.ExecutorTaskPhaseSkipped}, []int{0, 1, -1})
+			rt.Unlock()
+			rs.setRejectFinished(false)
+
+			attempt, err := e.restartTaskStep(context.Background(), et.ID, 1, tt.downstream)
+			if tt.accepted {
+				if !util.IsBadRequest(err) {
+					t.Fatalf("expected bad request error, got: %v", err)
+				}
+				if pod.started != 0 {
+					t.Fatalf("expected the task pod not started again")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if attempt != 2 {
+				t.Fatalf("expected attempt 2, got %d", attempt)
+			}
+			if pod.started != 1 {
+				t.Fatalf("expected the task pod started again")
+			}
+
+			// the restarted task is finished when its end time is set again
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				rt.Lock()
+				finished := et.Status.EndTime != nil
+				rt.Unlock()
+				if finished {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("timeout waiting for the restarted task to finish")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			waitTaskFinished(t, rt)
+
+			rt.Lock()
+			defer rt.Unlock()
+			checkTaskStatus(t, et, types.ExecutorTaskPhaseSuccess, tt.phases, tt.exitStatus)
+			if et.Status.Attempt != 2 {
+				t.Fatalf("expected task attempt 2, got %d", et.Status.Attempt)
+			}
+		})
+	}
+}
+
+func TestTaskFilesMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e, rs := newTestExecutor(t, dir, newFakePod())
+	defer rs.Close()
+	e.c.DisableLogSync = false
+	e.fileMode = 0604
+
+	et := newTestTask(runStep("exit 0"))
+	rt := executeTestTask(e, et)
+	waitTaskFinished(t, rt)
+
+	// the commands index of a log is built when requested
+	if _, err := e.logCommands(et.ID, e.stepLogPath(et.ID, rt.attempt, 0)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	files := 0
+	if err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		files++
+		if fi.Mode().Perm() != e.fileMode {
+			t.Errorf("file %q: expected mode %v, got %v", p, e.fileMode, fi.Mode().Perm())
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if files == 0 {
+		t.Fatalf("expected task files")
+	}
+}
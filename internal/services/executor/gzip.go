@@ -0,0 +1,303 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// gzipLevelHeader reports the compression level of a gzipped response
+	gzipLevelHeader = "Agola-Gzip-Level"
+
+	// defaultGzipLevel is the level used by compress/flate for
+	// gzip.DefaultCompression
+	defaultGzipLevel    = 6
+	defaultGzipMinLevel = gzip.BestSpeed
+	defaultGzipMaxLevel = gzip.BestCompression
+
+	defaultGzipMinResponseSize = 1024
+
+	hostCPUSampleInterval = 5 * time.Second
+)
+
+// hostCPU is the executor host cpu utilization, sampled from /proc/stat
+type hostCPU struct {
+	m sync.Mutex
+	// usage is the cpu utilization, from 0 to 1, in the last sample interval
+	usage float64
+	known bool
+
+	prevIdle  uint64
+	prevTotal uint64
+}
+
+// readProcStat returns the idle and total cpu time of the host
+func readProcStat() (uint64, uint64, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 5 || fields[0] != "cpu" {
+		return 0, 0, errors.Errorf("unexpected /proc/stat cpu line %q", line)
+	}
+	var idle, total uint64
+	// user nice system idle iowait irq softirq steal, guest time is already
+	// accounted in user and nice
+	for i, f := range fields[1:] {
+		if i >= 8 {
+			break
+		}
+		v, err := strconv.ParseUint(f, 10, 64)
+		if err != nil {
+			return 0, 0, errors.Errorf("unexpected /proc/stat cpu line %q", line)
+		}
+		total += v
+		if i == 3 || i == 4 {
+			idle += v
+		}
+	}
+	return idle, total, nil
+}
+
+func (c *hostCPU) sample() error {
+	idle, total, err := readProcStat()
+	if err != nil {
+		return err
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.prevTotal != 0 && total > c.prevTotal && idle >= c.prevIdle {
+		c.usage = 1 - float64(idle-c.prevIdle)/float64(total-c.prevTotal)
+		c.known = true
+	}
+	c.prevIdle, c.prevTotal = idle, total
+	return nil
+}
+
+// utilization returns the host cpu utilization, from 0 to 1, and false if
+// it's not known yet or cannot be sampled
+func (c *hostCPU) utilization() (float64, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.usage, c.known
+}
+
+// hostCPULoop samples the host cpu utilization used by the adaptive gzip
+// level
+func (e *Executor) hostCPULoop(ctx context.Context) {
+	for {
+		if err := e.hostCPU.sample(); err != nil {
+			log.Warnf("cannot sample the host cpu utilization, the adaptive gzip level will use the min level: %v", err)
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(hostCPUSampleInterval):
+		}
+	}
+}
+
+// gzipLevel returns the compression level of the gzipped responses. The
+// adaptive level decreases linearly from the max level, with an idle host
+// cpu, to the min level, with a fully used host cpu. The min level is used
+// when the cpu utilization isn't known.
+func (e *Executor) gzipLevel() int {
+	g := e.c.Gzip
+	if !g.Adaptive {
+		if g.Level == 0 {
+			return defaultGzipLevel
+		}
+		return g.Level
+	}
+
+	minLevel, maxLevel := g.MinLevel, g.MaxLevel
+	if minLevel == 0 {
+		minLevel = defaultGzipMinLevel
+	}
+	if maxLevel == 0 {
+		maxLevel = defaultGzipMaxLevel
+	}
+	if minLevel > maxLevel {
+		minLevel = maxLevel
+	}
+	usage, ok := e.hostCPU.utilization()
+	if !ok {
+		return minLevel
+	}
+	return maxLevel - int(math.Round(usage*float64(maxLevel-minLevel)))
+}
+
+// newGzipWriter returns a gzip writer of the response w compressing at the
+// executor gzip level, reported in the response gzip level header. It must be
+// called before writing the response header.
+func (e *Executor) newGzipWriter(w http.ResponseWriter) *gzip.Writer {
+	level := e.gzipLevel()
+	w.Header().Set(gzipLevelHeader, strconv.Itoa(level))
+	// the level, between 1 and 9, is always valid
+	gw, _ := gzip.NewWriterLevel(w, level)
+	return gw
+}
+
+// acceptsGzip reports if the request Accept-Encoding header accepts a gzipped
+// response
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header["Accept-Encoding"] {
+		for _, enc := range strings.Split(v, ",") {
+			parts := strings.Split(enc, ";")
+			name := strings.ToLower(strings.TrimSpace(parts[0]))
+			if name != "gzip" && name != "*" {
+				continue
+			}
+			rejected := false
+			for _, param := range parts[1:] {
+				param = strings.ReplaceAll(param, " ", "")
+				if q := strings.TrimPrefix(param, "q="); q != param {
+					if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+						rejected = true
+					}
+				}
+			}
+			if !rejected {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the response body until it reaches minSize, then
+// it compresses it. Smaller responses are sent uncompressed when finished.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	e       *Executor
+	minSize int
+
+	status int
+	buf    []byte
+	gw     *gzip.Writer
+	// direct is true when the response is sent without buffering
+	direct bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status != 0 || w.direct {
+		return
+	}
+	w.status = status
+	// responses without a body
+	if status == http.StatusNoContent || status == http.StatusNotModified || (status >= 100 && status < 200) {
+		w.sendHeader()
+	}
+}
+
+func (w *gzipResponseWriter) sendHeader() {
+	w.direct = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.gw != nil {
+		return w.gw.Write(p)
+	}
+	if w.direct {
+		return w.ResponseWriter.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) < w.minSize {
+		return len(p), nil
+	}
+
+	buf := w.buf
+	w.buf = nil
+	// the response is already encoded by the handler
+	if w.Header().Get("Content-Encoding") != "" {
+		w.sendHeader()
+	} else {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gw = w.e.newGzipWriter(w.ResponseWriter)
+		w.sendHeader()
+	}
+	if _, err := w.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// finish sends the small responses or completes the compressed response
+func (w *gzipResponseWriter) finish() error {
+	if w.gw != nil {
+		return w.gw.Close()
+	}
+	if w.direct {
+		return nil
+	}
+	w.sendHeader()
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(w.buf)
+	return err
+}
+
+// gzipJSONHandler compresses, when accepted by the client, the responses of
+// the not streaming JSON API handlers. The log and archive handlers do their
+// own content negotiation and they mustn't be wrapped.
+func (e *Executor) gzipJSONHandler(h http.Handler) http.Handler {
+	if e.c.Gzip.DisableJSONResponses {
+		return h
+	}
+	minSize := e.c.Gzip.MinResponseSize
+	if minSize == 0 {
+		minSize = defaultGzipMinResponseSize
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w, e: e, minSize: minSize}
+		h.ServeHTTP(gw, r)
+		if err := gw.finish(); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+	})
+}
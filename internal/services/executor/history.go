@@ -0,0 +1,138 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/common"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const defaultTaskHistorySize = 100
+
+// TaskHistoryEntry is a task executed by this executor
+type TaskHistoryEntry struct {
+	TaskID   string                  `json:"task_id"`
+	TaskName string                  `json:"task_name,omitempty"`
+	Attempt  int                     `json:"attempt,omitempty"`
+	Phase    types.ExecutorTaskPhase `json:"phase"`
+
+	StartTime *time.Time    `json:"start_time,omitempty"`
+	EndTime   *time.Time    `json:"end_time,omitempty"`
+	Duration  time.Duration `json:"duration"`
+}
+
+// taskHistory keeps the last size finished tasks. If path isn't empty the
+// history is also saved on disk so it survives executor restarts
+type taskHistory struct {
+	size int
+	path string
+
+	// entries are ordered from the oldest to the newest
+	entries []*TaskHistoryEntry
+	m       sync.Mutex
+}
+
+func newTaskHistory(size int, path string) (*taskHistory, error) {
+	h := &taskHistory{size: size, path: path}
+	if path == "" {
+		return h, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		return nil, errors.Errorf("failed to unmarshal task history %q: %w", path, err)
+	}
+	if len(h.entries) > size {
+		h.entries = h.entries[len(h.entries)-size:]
+	}
+	return h, nil
+}
+
+func (h *taskHistory) add(entry *TaskHistoryEntry) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if len(h.entries) >= h.size {
+		n := copy(h.entries, h.entries[len(h.entries)-h.size+1:])
+		h.entries = h.entries[:n]
+	}
+	h.entries = append(h.entries, entry)
+
+	if h.path == "" {
+		return
+	}
+	data, err := json.Marshal(h.entries)
+	if err != nil {
+		log.Errorf("failed to marshal task history: %+v", err)
+		return
+	}
+	if err := common.WriteFileAtomic(h.path, data, 0660); err != nil {
+		log.Errorf("failed to save task history: %+v", err)
+	}
+}
+
+// recent returns the last limit entries, from the newest. A limit <= 0
+// returns all the entries
+func (h *taskHistory) recent(limit int) []*TaskHistoryEntry {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if limit <= 0 || limit > len(h.entries) {
+		limit = len(h.entries)
+	}
+	entries := make([]*TaskHistoryEntry, 0, limit)
+	for i := len(h.entries) - 1; i >= len(h.entries)-limit; i-- {
+		entries = append(entries, h.entries[i])
+	}
+	return entries
+}
+
+func (e *Executor) taskHistoryPath() string {
+	return filepath.Join(e.c.DataDir, "taskhistory.json")
+}
+
+// recordTaskHistory adds the finished running task to the task history and
+// returns the added entry. It must be called with the running task locked.
+func (e *Executor) recordTaskHistory(rt *runningTask) *TaskHistoryEntry {
+	et := rt.et
+	entry := &TaskHistoryEntry{
+		TaskID:    et.ID,
+		TaskName:  et.Spec.TaskName,
+		Attempt:   rt.attempt,
+		Phase:     et.Status.Phase,
+		StartTime: et.Status.StartTime,
+		EndTime:   et.Status.EndTime,
+	}
+	if et.Status.StartTime != nil && et.Status.EndTime != nil {
+		entry.Duration = et.Status.EndTime.Sub(*et.Status.StartTime)
+	}
+	e.taskHistory.add(entry)
+	return entry
+}
@@ -0,0 +1,76 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newH2CHandler returns a handler serving h with cleartext HTTP/2, both with
+// prior knowledge and upgrading an HTTP/1.1 connection, and with HTTP/1.1 for
+// the other clients
+func newH2CHandler(h http.Handler, idleTimeout time.Duration) http.Handler {
+	h2h := h2c.NewHandler(h, &http2.Server{IdleTimeout: idleTimeout})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only the requests starting an HTTP/2 connection are wrapped, the
+		// HTTP/1.1 ones are directly served by h with the original response
+		// writer
+		if isH2CRequest(r) {
+			if hj, ok := w.(http.Hijacker); ok {
+				w = &h2cResponseWriter{ResponseWriter: w, hj: hj}
+			}
+		}
+		h2h.ServeHTTP(w, r)
+	})
+}
+
+func isH2CRequest(r *http.Request) bool {
+	if r.Method == "PRI" && r.Proto == "HTTP/2.0" {
+		return true
+	}
+	for _, u := range strings.Split(r.Header.Get("Upgrade"), ",") {
+		if strings.EqualFold(strings.TrimSpace(u), "h2c") {
+			return true
+		}
+	}
+	return false
+}
+
+// h2cResponseWriter clears the deadlines of the hijacked connection. They're
+// the ones set by the HTTP/1.1 server for the first request and would close
+// the HTTP/2 connection, with all its streams, when expired.
+type h2cResponseWriter struct {
+	http.ResponseWriter
+	hj http.Hijacker
+}
+
+func (w *h2cResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.hj.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"path"
+	"strings"
+
+	"agola.io/agola/internal/services/executor/registry"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// dockerHubRegistries are the names of the docker hub registry, the images
+// references are normalized to the first one
+var dockerHubRegistries = []string{"index.docker.io", "docker.io", "registry-1.docker.io"}
+
+// imageRegistryPattern is a parsed allowed image registry
+type imageRegistryPattern struct {
+	registry string
+	// repository is the optional repository prefix, when ending with "*" the
+	// repository must only start with it
+	repository string
+}
+
+func parseImageRegistryPattern(p string) (*imageRegistryPattern, error) {
+	parts := strings.SplitN(p, "/", 2)
+	rp := &imageRegistryPattern{registry: parts[0]}
+	if len(parts) == 2 {
+		rp.repository = strings.TrimSuffix(parts[1], "/")
+		if rp.repository == "" {
+			return nil, errors.Errorf("empty repository in allowed image registry %q", p)
+		}
+	}
+	if rp.registry == "" {
+		return nil, errors.Errorf("empty registry in allowed image registry %q", p)
+	}
+	if _, err := path.Match(rp.registry, ""); err != nil {
+		return nil, errors.Errorf("invalid allowed image registry %q: %w", p, err)
+	}
+	for _, name := range dockerHubRegistries[1:] {
+		if rp.registry == name {
+			rp.registry = dockerHubRegistries[0]
+		}
+	}
+	return rp, nil
+}
+
+// match reports if the image repository repo of the registry reg matches the
+// pattern
+func (rp *imageRegistryPattern) match(reg, repo string) bool {
+	if ok, _ := path.Match(rp.registry, reg); !ok {
+		return false
+	}
+	switch {
+	case rp.repository == "":
+		return true
+	case strings.HasSuffix(rp.repository, "*"):
+		return strings.HasPrefix(repo, strings.TrimSuffix(rp.repository, "*"))
+	default:
+		return repo == rp.repository || strings.HasPrefix(repo, rp.repository+"/")
+	}
+}
+
+func parseImageRegistryPatterns(patterns []string) ([]*imageRegistryPattern, error) {
+	var rps []*imageRegistryPattern
+	for _, p := range patterns {
+		rp, err := parseImageRegistryPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		rps = append(rps, rp)
+	}
+	return rps, nil
+}
+
+// imageRegistryViolations returns the task containers images not pulled from
+// an allowed image registry. It must be called after the images have been
+// normalized.
+func (e *Executor) imageRegistryViolations(et *types.ExecutorTask) []error {
+	if len(e.imageRegistries) == 0 || et == nil || et.Spec.ExecutorTaskSpecData == nil {
+		return nil
+	}
+	var errs []error
+	for i, c := range et.Spec.Containers {
+		reg, repo, err := registry.ImageRepository(c.Image)
+		if err != nil {
+			// already reported by the image normalization
+			continue
+		}
+		allowed := false
+		for _, rp := range e.imageRegistries {
+			if rp.match(reg, repo) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			errs = append(errs, errors.Errorf("container %d image %q registry %q not allowed", i, c.Image, reg))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,127 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"strconv"
+	"strings"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+func isVarNameStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isVarNameChar(c byte) bool {
+	return isVarNameStart(c) || (c >= '0' && c <= '9')
+}
+
+func isVarName(name string) bool {
+	if name == "" || !isVarNameStart(name[0]) {
+		return false
+	}
+	for i := 1; i < len(name); i++ {
+		if !isVarNameChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// interpolate replaces in s the $NAME and ${NAME} references with their value
+// in vars. $$ is replaced by $ and a $ not followed by a variable name (like in
+// $1, $? or $(cmd)) is kept as is. An undefined variable is replaced by an
+// empty string or, if strict, returns an error.
+func interpolate(s string, vars map[string]string, strict bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		var name string
+		next := s[i+1]
+		switch {
+		case next == '$':
+			b.WriteByte('$')
+			i++
+			continue
+		case next == '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", errors.Errorf("unterminated variable reference at offset %d", i)
+			}
+			name = s[i+2 : i+2+end]
+			if !isVarName(name) {
+				return "", errors.Errorf("invalid variable reference %q", "${"+name+"}")
+			}
+			i += 2 + end
+		case isVarNameStart(next):
+			j := i + 1
+			for j < len(s) && isVarNameChar(s[j]) {
+				j++
+			}
+			name = s[i+1 : j]
+			i = j - 1
+		default:
+			b.WriteByte('$')
+			continue
+		}
+
+		v, ok := vars[name]
+		if !ok && strict {
+			return "", errors.Errorf("undefined variable %q", name)
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+// stepInterpolationVars returns the variables available to the interpolation
+// of a run step command: the step environment and the executor provided
+// AGOLA_* variables. The executor provided ones take precedence.
+func (e *Executor) stepInterpolationVars(rt *runningTask, stepIndex int, environment map[string]string) map[string]string {
+	vars := make(map[string]string, len(environment))
+	for k, v := range environment {
+		vars[k] = v
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+	t := rt.et
+	vars["AGOLA_EXECUTOR_ID"] = e.id
+	vars["AGOLA_TASK_ID"] = t.ID
+	vars["AGOLA_TASK_NAME"] = t.Spec.TaskName
+	vars["AGOLA_TASK_ATTEMPT"] = strconv.Itoa(rt.attempt)
+	vars["AGOLA_STEP_INDEX"] = strconv.Itoa(stepIndex)
+	if bs := types.StepBase(t.Spec.Steps[stepIndex]); bs != nil {
+		vars["AGOLA_STEP_NAME"] = bs.Name
+	}
+	return vars
+}
+
+// interpolateCommand returns the command of a run step (or sub step) with the
+// variables references replaced if the step enables interpolation
+func (e *Executor) interpolateCommand(s *types.RunStep, command string, vars map[string]string) (string, error) {
+	if !s.Interpolate {
+		return command, nil
+	}
+	return interpolate(command, vars, e.c.StepInterpolationUndefined == config.StepInterpolationUndefinedError)
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"testing"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+)
+
+func TestInterpolate(t *testing.T) {
+	vars := map[string]string{
+		"FOO":     "foo",
+		"FOO_BAR": "foobar",
+		"_x1":     "x1",
+		"EMPTY":   "",
+	}
+
+	tests := []struct {
+		name   string
+		s      string
+		strict bool
+		out    string
+		err    bool
+	}{
+		{name: "no references", s: "echo hello", out: "echo hello"},
+		{name: "simple reference", s: "echo $FOO", out: "echo foo"},
+		{name: "braced reference", s: "echo ${FOO}bar", out: "echo foobar"},
+		{name: "longest name", s: "echo $FOO_BAR $FOO-bar", out: "echo foobar foo-bar"},
+		{name: "name with digits", s: "echo $_x1", out: "echo x1"},
+		{name: "empty value", s: "echo [$EMPTY]", out: "echo []"},
+		{name: "escaped dollar", s: "echo $$FOO $$$FOO", out: "echo $FOO $foo"},
+		{name: "shell special parameters kept", s: "echo $1 $? $# $@ $(date) $((1+2))", out: "echo $1 $? $# $@ $(date) $((1+2))"},
+		{name: "trailing dollar", s: "echo $", out: "echo $"},
+		{name: "undefined variable", s: "echo [$UNDEFINED] [${UNDEFINED}]", out: "echo [] []"},
+		{name: "undefined variable strict", s: "echo $UNDEFINED", strict: true, err: true},
+		{name: "defined variable strict", s: "echo ${FOO}", strict: true, out: "echo foo"},
+		{name: "unterminated braced reference", s: "echo ${FOO", err: true},
+		{name: "empty braced reference", s: "echo ${}", err: true},
+		{name: "invalid braced reference", s: "echo ${1FOO}", err: true},
+		{name: "shell parameter expansion", s: "echo ${FOO:-default}", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := interpolate(tt.s, vars, tt.strict)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if out != tt.out {
+				t.Fatalf("expected %q, got %q", tt.out, out)
+			}
+		})
+	}
+}
+
+func TestInterpolateCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		interpolate bool
+		undefined   string
+		command     string
+		out         string
+		err         bool
+	}{
+		{name: "interpolation disabled", command: "echo $AGOLA_TASK_ID ${", out: "echo $AGOLA_TASK_ID ${"},
+		{name: "executor variables", interpolate: true, command: "echo $AGOLA_EXECUTOR_ID $AGOLA_TASK_ID $AGOLA_TASK_NAME $AGOLA_TASK_ATTEMPT $AGOLA_STEP_INDEX $AGOLA_STEP_NAME", out: "echo executor01 task01 task name 2 1 step01"},
+		{name: "step environment", interpolate: true, command: "echo $ENV01", out: "echo env01"},
+		{name: "executor variables take precedence", interpolate: true, command: "echo $AGOLA_TASK_ID", out: "echo task01"},
+		{name: "undefined variable replaced", interpolate: true, undefined: config.StepInterpolationUndefinedEmpty, command: "echo [$UNDEFINED]", out: "echo []"},
+		{name: "undefined variable error", interpolate: true, undefined: config.StepInterpolationUndefinedError, command: "echo [$UNDEFINED]", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := runStep(tt.command, func(s *types.RunStep) {
+				s.Name = "step01"
+				s.Interpolate = tt.interpolate
+			})
+			et := newTestTask(runStep("true"), s)
+			et.Spec.TaskName = "task name"
+			rt := &runningTask{et: et, attempt: 2}
+
+			e := &Executor{id: "executor01", c: &config.Executor{StepInterpolationUndefined: tt.undefined}}
+			environment := map[string]string{"ENV01": "env01", "AGOLA_TASK_ID": "overridden"}
+			out, err := e.interpolateCommand(s, s.Command, e.stepInterpolationVars(rt, 1, environment))
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if out != tt.out {
+				t.Fatalf("expected %q, got %q", tt.out, out)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// logBufferSize is the size of the in memory log buffer of every step of a
+	// task that doesn't persist its logs. Older data is discarded
+	logBufferSize = 1024 * 1024
+)
+
+var errLogGone = errors.New("log not available anymore")
+
+// logRingBuffer keeps the last written bytes of a log. Offsets are absolute
+// (relative to the start of the log, including the discarded data)
+type logRingBuffer struct {
+	data []byte
+	// size is the total number of bytes written
+	size int64
+	m    sync.Mutex
+}
+
+func newLogRingBuffer(capacity int) *logRingBuffer {
+	return &logRingBuffer{data: make([]byte, capacity)}
+}
+
+func (b *logRingBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	n := len(p)
+	c := len(b.data)
+	if len(p) > c {
+		b.size += int64(len(p) - c)
+		p = p[len(p)-c:]
+	}
+	for len(p) > 0 {
+		pos := int(b.size % int64(c))
+		w := copy(b.data[pos:], p)
+		b.size += int64(w)
+		p = p[w:]
+	}
+	return n, nil
+}
+
+func (b *logRingBuffer) Close() error { return nil }
+
+// readAt reads into p the data starting at offset. If the data at offset has
+// already been discarded it starts from the oldest available offset. It
+// returns the number of bytes read and the effective start offset.
+func (b *logRingBuffer) readAt(p []byte, offset int64) (int, int64) {
+	b.m.Lock()
+	defer b.m.Unlock()
+
+	c := int64(len(b.data))
+	if first := b.first(); offset < first {
+		offset = first
+	}
+	if offset >= b.size {
+		return 0, offset
+	}
+	n := 0
+	for n < len(p) && offset+int64(n) < b.size {
+		pos := (offset + int64(n)) % c
+		end := c
+		if rem := b.size - (offset + int64(n)) + pos; rem < end {
+			end = rem
+		}
+		w := copy(p[n:], b.data[pos:end])
+		n += w
+	}
+	return n, offset
+}
+
+// first returns the oldest available offset
+func (b *logRingBuffer) first() int64 {
+	first := b.size - int64(len(b.data))
+	if first < 0 {
+		return 0
+	}
+	return first
+}
+
+func (b *logRingBuffer) Size() int64 {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.size
+}
+
+// logSource is a readable log, backed by a file or by an in memory buffer
+type logSource interface {
+	io.ReadSeeker
+	io.Closer
+	Size() (int64, error)
+	// ModTime returns the log last modification time. It's zero if not
+	// available
+	ModTime() (time.Time, error)
+}
+
+type fileLogSource struct {
+	*os.File
+}
+
+func (f *fileLogSource) Size() (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (f *fileLogSource) ModTime() (time.Time, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+type bufferLogSource struct {
+	b      *logRingBuffer
+	offset int64
+}
+
+func (s *bufferLogSource) Read(p []byte) (int, error) {
+	n, offset := s.b.readAt(p, s.offset)
+	s.offset = offset + int64(n)
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (s *bufferLogSource) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		offset += s.b.Size()
+	default:
+		return 0, errors.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errors.Errorf("negative offset")
+	}
+	// data before the oldest available offset has been discarded
+	s.b.m.Lock()
+	if first := s.b.first(); offset < first {
+		offset = first
+	}
+	s.b.m.Unlock()
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *bufferLogSource) Size() (int64, error) { return s.b.Size(), nil }
+
+func (s *bufferLogSource) ModTime() (time.Time, error) { return time.Time{}, nil }
+
+func (s *bufferLogSource) Close() error { return nil }
+
+// createLog creates the log at logPath for the running task. When the task
+// doesn't persist its logs they are kept in a size bounded memory buffer.
+// Lines longer than the max log line length are split and the lines exceeding
+// the max log lines per second are dropped. The capture time of the persisted
+// log lines is recorded in the log timestamps index, their offset in the log
+// line index, and the log lines are counted. The log and its companion files
+// are accounted in the task disk usage.
+// It must be called with the running task locked.
+func (e *Executor) createLog(rt *runningTask, logPath string) (io.WriteCloser, error) {
+	if rt.et.Spec.NoLogPersist {
+		b := newLogRingBuffer(logBufferSize)
+		if rt.logBuffers == nil {
+			rt.logBuffers = make(map[string]*logRingBuffer)
+		}
+		rt.logBuffers[logPath] = b
+		return newLineRateLimitWriter(newLineLimitWriter(e.countLogLines(rt, logPath, b, false), e.c.MaxLogLineLength), e.c.MaxLogLinesPerSecond), nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logPath), 0770); err != nil {
+		return nil, err
+	}
+	f, err := e.createDataFile(logPath)
+	if err != nil {
+		return nil, err
+	}
+	idxf, err := e.createDataFile(logIndexPath(logPath))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	lidxf, err := e.createDataFile(logLineIndexPath(logPath))
+	if err != nil {
+		f.Close()
+		idxf.Close()
+		return nil, err
+	}
+	return newLineRateLimitWriter(newLineLimitWriter(e.countLogLines(rt, logPath, newTimestampIndexWriter(newLineIndexWriter(rt.diskUsage.writer(e.syncLog(rt, logPath, f)), rt.diskUsage.writer(lidxf)), rt.diskUsage.writer(idxf)), true), e.c.MaxLogLineLength), e.c.MaxLogLinesPerSecond), nil
+}
+
+// countLogLines returns a writer counting the lines written to the log w. When
+// save is true the count is saved beside the log when closed. It must be
+// called with the running task locked.
+func (e *Executor) countLogLines(rt *runningTask, logPath string, w io.WriteCloser, save bool) io.WriteCloser {
+	savePath := ""
+	if save {
+		savePath = logLinesPath(logPath)
+	}
+	lw := newLineCountWriter(w, savePath, rt.diskUsage.writeFile(e.writeDataFileAtomic))
+	if rt.logLines == nil {
+		rt.logLines = make(map[string]*lineCountWriter)
+	}
+	rt.logLines[logPath] = lw
+	return lw
+}
+
+// openLog opens the log at logPath. It returns errLogGone if the task doesn't
+// persist its logs and it's finished, also when it isn't running anymore.
+func (e *Executor) openLog(taskID, logPath string) (logSource, error) {
+	rt, running := e.runningTasks.get(taskID)
+	if running {
+		rt.Lock()
+		defer rt.Unlock()
+		if rt.et.Spec.NoLogPersist {
+			if rt.et.Status.Phase.IsFinished() {
+				return nil, errLogGone
+			}
+			b, ok := rt.logBuffers[logPath]
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+			return &bufferLogSource{b: b}, nil
+		}
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		if os.IsNotExist(err) && !running && e.taskNoLogPersist(taskID) {
+			return nil, errLogGone
+		}
+		return nil, err
+	}
+	return &fileLogSource{File: f}, nil
+}
+
+// taskNoLogPersist reports if the task manifest saved on disk, kept as a
+// tombstone after the task finished, marks the task as not persisting its
+// logs
+func (e *Executor) taskNoLogPersist(taskID string) bool {
+	m, err := e.getTaskManifest(taskID)
+	if err != nil {
+		return false
+	}
+	return m.NoLogPersist
+}
@@ -0,0 +1,85 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+)
+
+func TestOpenLogNoLogPersistTombstone(t *testing.T) {
+	tests := []struct {
+		name         string
+		noLogPersist bool
+		running      bool
+		gone         bool
+	}{
+		{name: "finished task persisting its logs"},
+		{name: "finished task not persisting its logs", noLogPersist: true, gone: true},
+		{name: "running task persisting its logs", running: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			logLayout, archiveLayout, err := newPathLayouts(config.ExecutorPathLayout{})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			e := &Executor{
+				c: &config.Executor{DataDir: dir},
+				runningTasks: &runningTasks{
+					tasks: make(map[string]*runningTask),
+				},
+				logLayout:     logLayout,
+				archiveLayout: archiveLayout,
+			}
+			const taskID = "task01"
+			if tt.running {
+				e.runningTasks.addIfNotExists(taskID, &runningTask{et: &types.ExecutorTask{ID: taskID, Spec: types.ExecutorTaskSpec{ExecutorTaskSpecData: &types.ExecutorTaskSpecData{}}}})
+			}
+			if err := os.MkdirAll(e.taskPath(taskID), 0770); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			mj, err := json.Marshal(&TaskManifest{TaskID: taskID, NoLogPersist: tt.noLogPersist})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if err := ioutil.WriteFile(e.taskManifestPath(taskID), mj, 0660); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			_, err = e.openLog(taskID, e.stepLogPath(taskID, 0, 0))
+			if tt.gone {
+				if !errors.Is(err, errLogGone) {
+					t.Fatalf("expected log gone error, got %v", err)
+				}
+			} else if !os.IsNotExist(err) {
+				t.Fatalf("expected not exist error, got %v", err)
+			}
+		})
+	}
+}
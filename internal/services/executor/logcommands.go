@@ -0,0 +1,664 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// commandMarkerStart is the byte printed by the wrapped step script
+	// before a command marker. The command marker writer replaces it with the
+	// step marker prefix
+	commandMarkerStart = '\x1e'
+
+	// maxMarkerCommandLength is the max length of the command text reported
+	// in a command start marker, it keeps the marker shorter than a log line
+	maxMarkerCommandLength = 512
+
+	// maxLogCommandOutput is the max size of the output of a command returned
+	// grouping the log by command. The last part of a longer output is
+	// returned since it usually reports why the command failed
+	maxLogCommandOutput = 64 * 1024
+
+	commandStartMarker = "command-start"
+	commandEndMarker   = "command-end"
+)
+
+// logCommandsPath returns the path of the commands index of the log at
+// logPath
+func logCommandsPath(logPath string) string {
+	return logPath + ".cmds"
+}
+
+// splitShellCommands splits a POSIX shell script in its top level commands.
+// Every command is made of one or more lines: a command continues on the next
+// line when the line ends with a backslash or a pipeline or list operator,
+// inside quotes, here documents and compound commands. The blank and comment
+// lines outside a command are returned as separate entries with ok false
+// since they must not be reported as commands.
+// It returns nil if the script cannot be split, like when a quote or a
+// compound command isn't terminated.
+func splitShellCommands(script string) []shellCommand {
+	var cmds []shellCommand
+	var cur []string
+	var quote byte
+	var stack []string
+	var heredocs []shellHeredoc
+	var heredoc *shellHeredoc
+	// continued is true when the last command line continues on the next line
+	var continued bool
+
+	for _, line := range strings.Split(strings.TrimSuffix(script, "\n"), "\n") {
+		if heredoc != nil {
+			cur = append(cur, line)
+			l := line
+			if heredoc.stripTabs {
+				l = strings.TrimLeft(l, "\t")
+			}
+			if l == heredoc.delim {
+				heredoc = nil
+				if len(heredocs) > 0 {
+					heredoc, heredocs = &heredocs[0], heredocs[1:]
+				}
+				if heredoc == nil && !continued && len(stack) == 0 {
+					cmds = append(cmds, shellCommand{text: strings.Join(cur, "\n"), ok: true})
+					cur = nil
+				}
+			}
+			continue
+		}
+		if len(cur) == 0 {
+			if t := strings.TrimSpace(line); t == "" || strings.HasPrefix(t, "#") {
+				cmds = append(cmds, shellCommand{text: line})
+				continue
+			}
+		}
+		cur = append(cur, line)
+
+		s := &shellLineScanner{line: line, quote: quote, stack: stack, cmdPos: quote == 0}
+		s.scan()
+		quote, stack, continued = s.quote, s.stack, s.continued
+		if quote != 0 {
+			continue
+		}
+		heredocs = append(heredocs, s.heredocs...)
+		if len(heredocs) > 0 {
+			heredoc, heredocs = &heredocs[0], heredocs[1:]
+			continue
+		}
+		if !continued && len(stack) == 0 {
+			cmds = append(cmds, shellCommand{text: strings.Join(cur, "\n"), ok: true})
+			cur = nil
+		}
+	}
+	if len(cur) > 0 || heredoc != nil {
+		return nil
+	}
+	return cmds
+}
+
+// shellCommand is a top level command of a shell script. ok is false for the
+// blank and comment lines
+type shellCommand struct {
+	text string
+	ok   bool
+}
+
+type shellHeredoc struct {
+	delim     string
+	stripTabs bool
+}
+
+// shellLineScanner scans a shell script line keeping track of the quotes and
+// of the open compound commands
+type shellLineScanner struct {
+	line  string
+	quote byte
+	// stack are the open compound commands
+	stack []string
+	// cmdPos is true when the next word is at the start of a command, where
+	// the reserved words are recognized
+	cmdPos bool
+	// continued is true when the command continues on the next line
+	continued bool
+	heredocs  []shellHeredoc
+}
+
+func (s *shellLineScanner) scan() {
+	line := s.line
+	word := ""
+	// lastOp is the last operator, a continuation operator at the end of the
+	// line continues the command on the next line
+	lastOp := ""
+	endWord := func() {
+		if word == "" {
+			return
+		}
+		s.word(word)
+		word = ""
+		lastOp = ""
+	}
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch s.quote {
+		case '\'':
+			if c == '\'' {
+				s.quote = 0
+			}
+			word += string(c)
+			continue
+		case '"', '`':
+			if c == '\\' && i+1 < len(line) {
+				word += line[i : i+2]
+				i++
+				continue
+			}
+			if c == '\\' {
+				s.continued = true
+				return
+			}
+			if c == s.quote {
+				s.quote = 0
+			}
+			word += string(c)
+			continue
+		}
+
+		switch c {
+		case '\\':
+			if i+1 == len(line) {
+				endWord()
+				s.continued = true
+				return
+			}
+			word += line[i : i+2]
+			i++
+		case '\'', '"', '`':
+			s.quote = c
+			word += string(c)
+		case '#':
+			if word != "" {
+				word += string(c)
+				continue
+			}
+			endWord()
+			i = len(line)
+		case ' ', '\t':
+			endWord()
+		case ';', '&', '|':
+			endWord()
+			op := string(c)
+			if i+1 < len(line) && (line[i+1] == c || (c == ';' && line[i+1] == '&')) {
+				op += string(line[i+1])
+				i++
+			}
+			lastOp = op
+			s.cmdPos = true
+		case '(':
+			if strings.HasSuffix(word, "$") {
+				word += string(c)
+				s.stack = append(s.stack, "$(")
+				continue
+			}
+			endWord()
+			s.stack = append(s.stack, "(")
+			s.cmdPos = true
+		case ')':
+			n := len(s.stack)
+			if n > 0 && s.stack[n-1] == "$(" {
+				s.stack = s.stack[:n-1]
+				word += string(c)
+				continue
+			}
+			// an unmatched ) terminates a case pattern
+			if n > 0 && s.stack[n-1] == "(" {
+				s.stack = s.stack[:n-1]
+			}
+			endWord()
+			s.cmdPos = true
+		case '<':
+			if strings.HasPrefix(line[i:], "<<") && !strings.HasPrefix(line[i:], "<<<") {
+				endWord()
+				i += 2
+				stripTabs := false
+				if i < len(line) && line[i] == '-' {
+					stripTabs = true
+					i++
+				}
+				for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+					i++
+				}
+				start := i
+				for i < len(line) && !strings.ContainsRune(" \t;&|<>()", rune(line[i])) {
+					i++
+				}
+				delim := strings.NewReplacer("'", "", "\"", "", "\\", "").Replace(line[start:i])
+				i--
+				if delim != "" {
+					s.heredocs = append(s.heredocs, shellHeredoc{delim: delim, stripTabs: stripTabs})
+				}
+				continue
+			}
+			endWord()
+		default:
+			word += string(c)
+		}
+	}
+	if s.quote != 0 {
+		return
+	}
+	endWord()
+	if lastOp == "|" || lastOp == "&&" || lastOp == "||" {
+		s.continued = true
+	}
+}
+
+// word handles a complete word opening and closing the compound commands
+// when it's a reserved word at the start of a command
+func (s *shellLineScanner) word(w string) {
+	if !s.cmdPos {
+		return
+	}
+	top := ""
+	if n := len(s.stack); n > 0 {
+		top = s.stack[n-1]
+	}
+	pop := func(open string) {
+		if top == open {
+			s.stack = s.stack[:len(s.stack)-1]
+		}
+	}
+	s.cmdPos = false
+	switch w {
+	case "if", "case", "{":
+		s.stack = append(s.stack, w)
+	case "for", "while", "until", "select":
+		s.stack = append(s.stack, "loop")
+	case "fi":
+		pop("if")
+	case "esac":
+		pop("case")
+	case "done":
+		pop("loop")
+	case "}":
+		pop("{")
+	}
+	switch w {
+	case "if", "then", "else", "elif", "do", "while", "until", "{", "!", "time":
+		s.cmdPos = true
+	}
+}
+
+// wrapShellCommands returns the script executing the commands of the POSIX
+// shell script, split by splitShellCommands, printing before every command its
+// start marker and after it its end marker with the command exit code. A
+// failed command of a shell exiting on errors has no end marker: its exit
+// code is the step exit code. When the script cannot be split it's reported
+// as a single command.
+func wrapShellCommands(script string) string {
+	cmds := splitShellCommands(script)
+	if cmds == nil {
+		cmds = []shellCommand{{text: strings.TrimSuffix(script, "\n"), ok: true}}
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, cmd := range cmds {
+		if !cmd.ok {
+			b.WriteString(cmd.text + "\n")
+			continue
+		}
+		fmt.Fprintf(&b, "printf '\\036%s n=%d command=%%s\\n' %s\n", commandStartMarker, n, shellQuote(strconv.Quote(markerCommand(cmd.text))))
+		b.WriteString(cmd.text + "\n")
+		fmt.Fprintf(&b, "printf '\\036%s n=%d exit=%%d\\n' \"$?\"\n", commandEndMarker, n)
+		n++
+	}
+	return b.String()
+}
+
+// markerCommand returns the command text reported in the command start
+// marker, truncated to maxMarkerCommandLength
+func markerCommand(cmd string) string {
+	if len(cmd) <= maxMarkerCommandLength {
+		return cmd
+	}
+	cmd = cmd[:maxMarkerCommandLength]
+	for !utf8.ValidString(cmd) {
+		cmd = cmd[:len(cmd)-1]
+	}
+	return cmd + "..."
+}
+
+// shellQuote quotes s as a single shell word
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// commandMarkerWriter converts the command markers printed by a wrapped step
+// script in step markers, written on their own line, adding their capture
+// time. The command output is written escaped.
+type commandMarkerWriter struct {
+	w *markerEscapeWriter
+
+	// newline is true if the last written byte is a newline or if nothing has
+	// been written
+	newline  bool
+	inMarker bool
+}
+
+func newCommandMarkerWriter(w *markerEscapeWriter) *commandMarkerWriter {
+	return &commandMarkerWriter{w: w, newline: true}
+}
+
+func (cw *commandMarkerWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	// marker is true when out contains a marker part
+	marker := cw.inMarker
+	write := func() error {
+		if len(out) == 0 {
+			return nil
+		}
+		var err error
+		if marker {
+			err = cw.w.writeMarker(out)
+		} else {
+			_, err = cw.w.Write(out)
+		}
+		out = out[:0]
+		return err
+	}
+
+	for _, c := range p {
+		switch {
+		case cw.inMarker:
+			switch c {
+			case '\r':
+			case '\n':
+				out = append(out, fmt.Sprintf(" ts=%s\n", time.Now().UTC().Format(time.RFC3339Nano))...)
+				cw.inMarker = false
+				cw.newline = true
+			default:
+				out = append(out, c)
+			}
+		case c == commandMarkerStart:
+			if !cw.newline {
+				out = append(out, '\n')
+			}
+			if err := write(); err != nil {
+				return 0, err
+			}
+			marker = true
+			out = append(out, stepMarkerPrefix...)
+			cw.inMarker = true
+		default:
+			if marker {
+				if err := write(); err != nil {
+					return 0, err
+				}
+				marker = false
+			}
+			out = append(out, c)
+			cw.newline = c == '\n'
+		}
+	}
+	if err := write(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logCommand is a command entry of the log commands index. Start and End are
+// the log offsets of the command output
+type logCommand struct {
+	Index     int        `json:"index"`
+	Attempt   int        `json:"attempt"`
+	Command   string     `json:"command"`
+	Start     int64      `json:"start"`
+	End       int64      `json:"end"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+}
+
+// parseMarker returns the name and the fields of a step marker line
+func parseMarker(line string) (string, map[string]string, error) {
+	line = strings.TrimSuffix(strings.TrimPrefix(line, stepMarkerPrefix), "\n")
+	i := strings.IndexByte(line, ' ')
+	if i < 0 {
+		return line, nil, nil
+	}
+	name, rest := line[:i], line[i+1:]
+	fields := map[string]string{}
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", nil, errors.Errorf("invalid marker field %q", rest)
+		}
+		key := rest[:eq]
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return "", nil, errors.Errorf("unterminated marker field %q", key)
+			}
+			v, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return "", nil, errors.Errorf("invalid marker field %q: %w", key, err)
+			}
+			value, rest = v, rest[end+1:]
+		} else {
+			end := strings.IndexByte(rest, ' ')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		fields[key] = value
+		rest = strings.TrimPrefix(rest, " ")
+	}
+	return name, fields, nil
+}
+
+// buildLogCommands reads the log at logPath returning its commands. A command
+// without an end marker ends at the next step marker and its exit code is the
+// one reported by the step end or step attempt marker.
+func buildLogCommands(logPath string) ([]*logCommand, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cmds := []*logCommand{}
+	var cur *logCommand
+	var offset int64
+	attempt := 1
+	closeCur := func(fields map[string]string, exitKey string) {
+		if cur == nil {
+			return
+		}
+		cur.End = offset
+		if t, err := time.Parse(time.RFC3339Nano, fields["ts"]); err == nil {
+			cur.EndTime = &t
+		}
+		if exitCode, err := strconv.Atoi(fields[exitKey]); err == nil {
+			cur.ExitCode = &exitCode
+		}
+		cur = nil
+	}
+
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if isStepMarker([]byte(line)) && strings.HasSuffix(line, "\n") {
+			name, fields, perr := parseMarker(line)
+			if perr != nil {
+				log.Warnf("log %q: %v", logPath, perr)
+			}
+			switch name {
+			case commandStartMarker:
+				closeCur(nil, "")
+				n, err := strconv.Atoi(fields["n"])
+				if err != nil {
+					break
+				}
+				cur = &logCommand{Index: n, Attempt: attempt, Command: fields["command"], Start: offset + int64(len(line))}
+				if t, err := time.Parse(time.RFC3339Nano, fields["ts"]); err == nil {
+					cur.StartTime = &t
+				}
+				cmds = append(cmds, cur)
+			case commandEndMarker:
+				if cur != nil && fields["n"] == strconv.Itoa(cur.Index) {
+					closeCur(fields, "exit")
+				}
+			case "step-attempt":
+				closeCur(fields, "previous-exit")
+				if a, err := strconv.Atoi(fields["attempt"]); err == nil {
+					attempt = a
+				}
+			case "step-end":
+				closeCur(fields, "exit")
+			}
+		}
+		offset += int64(len(line))
+		if err == io.EOF {
+			break
+		}
+	}
+	if cur != nil {
+		cur.End = offset
+	}
+	return cmds, nil
+}
+
+// logCommands returns the commands of the finished log at logPath. The
+// commands index is built when first requested and saved beside the log.
+func (e *Executor) logCommands(taskID, logPath string) ([]*logCommand, error) {
+	idxPath := logCommandsPath(logPath)
+	data, err := ioutil.ReadFile(idxPath)
+	if err == nil {
+		var cmds []*logCommand
+		if err := json.Unmarshal(data, &cmds); err == nil {
+			return cmds, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	cmds, err := buildLogCommands(logPath)
+	if err != nil {
+		return nil, err
+	}
+	data, err = json.Marshal(cmds)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.writeTaskDataFileAtomic(taskID, idxPath, data); err != nil {
+		return nil, err
+	}
+	return cmds, nil
+}
+
+// LogCommands is a step log grouped by the commands of the step
+type LogCommands struct {
+	Commands []*LogCommand `json:"commands"`
+	// FailedCommand is the position in Commands of the first failed command
+	// of the last step attempt, -1 if no command failed
+	FailedCommand int `json:"failed_command"`
+}
+
+type LogCommand struct {
+	// Index is the index of the command in the step script, starting from 0
+	Index int `json:"index"`
+	// Attempt is the step attempt executing the command, starting from 1
+	Attempt   int        `json:"attempt"`
+	Command   string     `json:"command"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+	// ExitCode is nil when the command exit code isn't known, like when the
+	// step has been stopped
+	ExitCode *int `json:"exit_code,omitempty"`
+	// Output is the command output, without the step markers. Only its last
+	// part is returned when it's Truncated
+	Output    string `json:"output"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// readLogCommands returns the finished log at logPath grouped by command
+func (e *Executor) readLogCommands(taskID, logPath string) (*LogCommands, error) {
+	cmds, err := e.logCommands(taskID, logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	res := &LogCommands{Commands: []*LogCommand{}, FailedCommand: -1}
+	lastAttempt := 0
+	for _, c := range cmds {
+		lc := &LogCommand{Index: c.Index, Attempt: c.Attempt, Command: c.Command, StartTime: c.StartTime, EndTime: c.EndTime, ExitCode: c.ExitCode}
+		start := c.Start
+		if c.End-start > maxLogCommandOutput {
+			start = c.End - maxLogCommandOutput
+			lc.Truncated = true
+		}
+		var b strings.Builder
+		sw := newMarkerStripWriter(&b)
+		if _, err := io.Copy(sw, io.NewSectionReader(f, start, c.End-start)); err != nil {
+			return nil, err
+		}
+		if err := sw.Flush(); err != nil {
+			return nil, err
+		}
+		lc.Output = b.String()
+
+		if c.Attempt > lastAttempt {
+			lastAttempt = c.Attempt
+			res.FailedCommand = -1
+		}
+		if res.FailedCommand < 0 && c.ExitCode != nil && *c.ExitCode != 0 {
+			res.FailedCommand = len(res.Commands)
+		}
+		res.Commands = append(res.Commands, lc)
+	}
+	return res, nil
+}
@@ -0,0 +1,447 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"agola.io/agola/internal/services/config"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	defaultLogDiffMaxLines = 100000
+	defaultLogDiffContext  = 3
+	maxLogDiffContext      = 100
+	// maxLogDiffEdits is the max number of changed lines between the diffed
+	// logs. It bounds the memory used to compute the diff
+	maxLogDiffEdits = 2000
+)
+
+// defaultLogDiffRules replace the volatile parts of the log lines usually
+// changing between two attempts
+var defaultLogDiffRules = []config.ExecutorLogDiffRule{
+	{Regex: `\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?`, Replacement: "<timestamp>"},
+	{Regex: `\b\d{2}:\d{2}:\d{2}(?:[.,]\d+)?\b`, Replacement: "<time>"},
+	{Regex: `\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`, Replacement: "<uuid>"},
+	{Regex: `\b[0-9a-fA-F]{32,}\b`, Replacement: "<digest>"},
+	{Regex: `\b\d+(?:\.\d+)?(?:ns|us|µs|ms|s|m|h)\b`, Replacement: "<duration>"},
+}
+
+var errLogDiffTooLarge = errors.New("log diff too large")
+
+type logDiffRule struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+// compileLogDiffRules compiles the rules normalizing the log lines before
+// diffing them
+func compileLogDiffRules(c config.ExecutorLogDiff) ([]*logDiffRule, error) {
+	var rules []config.ExecutorLogDiffRule
+	if !c.DisableDefaultRules {
+		rules = append(rules, defaultLogDiffRules...)
+	}
+	rules = append(rules, c.Rules...)
+
+	crules := make([]*logDiffRule, len(rules))
+	for i, r := range rules {
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, errors.Errorf("log diff rule %d: invalid regex: %w", i, err)
+		}
+		crules[i] = &logDiffRule{re: re, replacement: r.Replacement}
+	}
+	return crules, nil
+}
+
+// logDiffInput are the lines of a diffed log. keys are the ids of the
+// normalized lines, equal for lines equal once normalized
+type logDiffInput struct {
+	lines []string
+	keys  []int
+}
+
+// readLogDiffInput reads the lines, without the step markers, of the log at
+// logPath
+func (e *Executor) readLogDiffInput(taskID, logPath string, keys map[string]int) (*logDiffInput, error) {
+	f, err := e.openLog(taskID, logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	maxLines := e.c.LogDiff.MaxLines
+	if maxLines == 0 {
+		maxLines = defaultLogDiffMaxLines
+	}
+
+	in := &logDiffInput{}
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line != "" && !isStepMarker([]byte(line)) {
+			if len(in.lines) >= maxLines {
+				return nil, errors.Errorf("log %q has more than %d lines: %w", logPath, maxLines, errLogDiffTooLarge)
+			}
+			line = strings.TrimSuffix(string(unescapeMarkerLine([]byte(line))), "\n")
+			norm := line
+			for _, r := range e.logDiffRules {
+				norm = r.re.ReplaceAllString(norm, r.replacement)
+			}
+			key, ok := keys[norm]
+			if !ok {
+				key = len(keys)
+				keys[norm] = key
+			}
+			in.lines = append(in.lines, line)
+			in.keys = append(in.keys, key)
+		}
+		if err == io.EOF {
+			return in, nil
+		}
+	}
+}
+
+type diffOp int
+
+const (
+	diffEqual diffOp = iota
+	diffDelete
+	diffInsert
+)
+
+// diffEdit is an edit of the script transforming a in b. a and b are the
+// positions in a and b where the edit applies
+type diffEdit struct {
+	op   diffOp
+	a, b int
+}
+
+// diffKeys returns the shortest edit script transforming a in b using the
+// Myers algorithm. It returns errLogDiffTooLarge if more than maxEdits edits
+// are needed.
+func diffKeys(a, b []int, maxEdits int) ([]diffEdit, error) {
+	// the common prefix and suffix are removed before computing the diff
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	edits := make([]diffEdit, 0, prefix)
+	for i := 0; i < prefix; i++ {
+		edits = append(edits, diffEdit{op: diffEqual, a: i, b: i})
+	}
+	medits, err := myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], maxEdits)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range medits {
+		edits = append(edits, diffEdit{op: e.op, a: e.a + prefix, b: e.b + prefix})
+	}
+	for i := 0; i < suffix; i++ {
+		edits = append(edits, diffEdit{op: diffEqual, a: len(a) - suffix + i, b: len(b) - suffix + i})
+	}
+	return edits, nil
+}
+
+func myersDiff(a, b []int, maxEdits int) ([]diffEdit, error) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, nil
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+	// trace keeps, for every d, the furthest x of the diagonals [-d, d]
+	// before the d step
+	var trace [][]int32
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > maxEdits {
+			return nil, errors.Errorf("logs differ by more than %d lines: %w", maxEdits, errLogDiffTooLarge)
+		}
+		snap := make([]int32, 2*d+1)
+		for i := range snap {
+			snap[i] = int32(v[off-d+i])
+		}
+		trace = append(trace, snap)
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	// walk back the trace from the end
+	var redits []diffEdit
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snap := trace[d]
+		at := func(k int) int { return int(snap[k+d]) }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := 0
+		if d > 0 {
+			prevX = at(prevK)
+		}
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			redits = append(redits, diffEdit{op: diffEqual, a: x, b: y})
+		}
+		if d > 0 {
+			if x == prevX {
+				redits = append(redits, diffEdit{op: diffInsert, a: x, b: prevY})
+			} else {
+				redits = append(redits, diffEdit{op: diffDelete, a: prevX, b: y})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]diffEdit, len(redits))
+	for i, e := range redits {
+		edits[len(redits)-1-i] = e
+	}
+	return edits, nil
+}
+
+// writeUnifiedDiff writes the edits as a unified diff with context lines
+// around the changes. The context lines are the ones of b.
+func writeUnifiedDiff(w io.Writer, fromName, toName string, a, b []string, edits []diffEdit, contextLines int) error {
+	bw := bufio.NewWriter(w)
+	headerWritten := false
+	for start := 0; start < len(edits); {
+		// find the next change
+		for start < len(edits) && edits[start].op == diffEqual {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		// extend the hunk until the equal lines between two changes exceed
+		// twice the context
+		end := start
+		for end < len(edits) {
+			if edits[end].op != diffEqual {
+				end++
+				continue
+			}
+			next := end
+			for next < len(edits) && edits[next].op == diffEqual {
+				next++
+			}
+			if next == len(edits) || next-end > 2*contextLines {
+				break
+			}
+			end = next
+		}
+		hstart := start - contextLines
+		if hstart < 0 {
+			hstart = 0
+		}
+		hend := end + contextLines
+		if hend > len(edits) {
+			hend = len(edits)
+		}
+
+		if !headerWritten {
+			fmt.Fprintf(bw, "--- %s\n+++ %s\n", fromName, toName)
+			headerWritten = true
+		}
+		var acount, bcount int
+		for _, e := range edits[hstart:hend] {
+			if e.op != diffInsert {
+				acount++
+			}
+			if e.op != diffDelete {
+				bcount++
+			}
+		}
+		fmt.Fprintf(bw, "@@ -%s +%s @@\n", hunkRange(edits[hstart].a, acount), hunkRange(edits[hstart].b, bcount))
+		for _, e := range edits[hstart:hend] {
+			switch e.op {
+			case diffEqual:
+				fmt.Fprintf(bw, " %s\n", b[e.b])
+			case diffDelete:
+				fmt.Fprintf(bw, "-%s\n", a[e.a])
+			case diffInsert:
+				fmt.Fprintf(bw, "+%s\n", b[e.b])
+			}
+		}
+		start = hend
+	}
+	return bw.Flush()
+}
+
+// hunkRange returns the unified diff range of a hunk starting at index start
+// with count lines. An empty range refers to the line before it
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+type logDiffHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewLogDiffHandler(logger *zap.Logger, e *Executor) *logDiffHandler {
+	return &logDiffHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP writes the unified diff between the step logs of two attempts of
+// the task, the from and to query parameters. to defaults to the latest
+// attempt and from to the attempt before to. The lines are compared once
+// normalized by the log diff rules, replacing their volatile parts, and the
+// step markers are ignored.
+func (h *logDiffHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	taskID := vars["taskid"]
+	step, err := strconv.Atoi(vars["step"])
+	if err != nil || step < 0 {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid step")
+		return
+	}
+	q := r.URL.Query()
+
+	contextLines := defaultLogDiffContext
+	if contextStr := q.Get("context"); contextStr != "" {
+		contextLines, err = strconv.Atoi(contextStr)
+		if err != nil || contextLines < 0 || contextLines > maxLogDiffContext {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, fmt.Sprintf("invalid context, must be between 0 and %d", maxLogDiffContext))
+			return
+		}
+	}
+
+	attempts, err := h.e.taskAttempts(taskID)
+	if err != nil {
+		h.log.Errorf("err: %+v", err)
+		httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		return
+	}
+	var from, to int
+	for _, p := range []struct {
+		name string
+		v    *int
+	}{{"from", &from}, {"to", &to}} {
+		if s := q.Get(p.name); s != "" {
+			*p.v, err = strconv.Atoi(s)
+			if err != nil || *p.v <= 0 {
+				httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid "+p.name)
+				return
+			}
+		}
+	}
+	if to == 0 && len(attempts) > 0 {
+		to = attempts[len(attempts)-1]
+	}
+	if from == 0 {
+		for _, attempt := range attempts {
+			if attempt < to {
+				from = attempt
+			}
+		}
+	}
+	if from == 0 || to == 0 {
+		httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task has no previous attempt")
+		return
+	}
+	if from == to {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "from and to must be different attempts")
+		return
+	}
+
+	keys := map[string]int{}
+	inputs := make([]*logDiffInput, 2)
+	for i, attempt := range []int{from, to} {
+		inputs[i], err = h.e.readLogDiffInput(taskID, h.e.stepLogPath(taskID, attempt, step), keys)
+		if err != nil {
+			switch {
+			case os.IsNotExist(err):
+				httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, fmt.Sprintf("attempt %d step %d log not found", attempt, step))
+			case errors.Is(err, errLogGone):
+				httpError(w, http.StatusGone, ErrorCodeLogGone, taskID, "log not available anymore")
+			case errors.Is(err, errLogDiffTooLarge):
+				httpError(w, http.StatusUnprocessableEntity, ErrorCodeLogDiffTooLarge, taskID, err.Error())
+			default:
+				h.log.Errorf("err: %+v", err)
+				httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+			}
+			return
+		}
+	}
+
+	edits, err := diffKeys(inputs[0].keys, inputs[1].keys, maxLogDiffEdits)
+	if err != nil {
+		httpError(w, http.StatusUnprocessableEntity, ErrorCodeLogDiffTooLarge, taskID, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fromName := fmt.Sprintf("task %s attempt %d step %d", taskID, from, step)
+	toName := fmt.Sprintf("task %s attempt %d step %d", taskID, to, step)
+	if err := writeUnifiedDiff(w, fromName, toName, inputs[0].lines, inputs[1].lines, edits, contextLines); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
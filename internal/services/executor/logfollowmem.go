@@ -0,0 +1,182 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// logFollowFixedBuffers is the size of the log read buffer and of the http
+	// response buffer of a log follow
+	logFollowFixedBuffers = 2 * 4096
+	// logFollowShedMinIdle is the min time without sent data before a log
+	// follow can be closed to make room for a new one
+	logFollowShedMinIdle = 30 * time.Second
+)
+
+// logFollow is an accounted log follow request
+type logFollow struct {
+	size int64
+	// lastActive is the unix nano time of the last sent data
+	lastActive int64
+	// shed is closed when the follow must stop telling the client to
+	// reconnect
+	shed chan struct{}
+
+	release func()
+}
+
+// writer returns a writer to w recording the follow activity
+func (f *logFollow) writer(w io.Writer) io.Writer {
+	if f == nil {
+		return w
+	}
+	return &logFollowWriter{w: w, f: f}
+}
+
+// shedC returns the channel closed when the follow is shed. It's nil, so it
+// never fires, for a nil follow
+func (f *logFollow) shedC() <-chan struct{} {
+	if f == nil {
+		return nil
+	}
+	return f.shed
+}
+
+type logFollowWriter struct {
+	w io.Writer
+	f *logFollow
+}
+
+func (w *logFollowWriter) Write(p []byte) (int, error) {
+	atomic.StoreInt64(&w.f.lastActive, time.Now().UnixNano())
+	return w.w.Write(p)
+}
+
+// followMemory accounts the memory used by the log follows buffers. When a new
+// follow exceeds the max the least recently active follows, idle for at least
+// logFollowShedMinIdle, are shed to make room for it. Their memory is
+// released when they notice it, at their next wait for new log data. A max <=
+// 0 means no limit.
+type followMemory struct {
+	max     int64
+	used    int64
+	follows map[*logFollow]struct{}
+	m       sync.Mutex
+}
+
+func newFollowMemory(max int64) *followMemory {
+	return &followMemory{max: max, follows: make(map[*logFollow]struct{})}
+}
+
+// acquire accounts a new follow with buffers of the provided size. It returns
+// false if there's no room for it.
+func (m *followMemory) acquire(size int64) (*logFollow, bool) {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	if m.max > 0 && m.used+size > m.max {
+		if !m.shed(m.used + size - m.max) {
+			return nil, false
+		}
+	}
+
+	f := &logFollow{
+		size:       size,
+		lastActive: time.Now().UnixNano(),
+		shed:       make(chan struct{}),
+	}
+	m.follows[f] = struct{}{}
+	m.used += size
+	logFollowBufferBytes.Set(float64(m.used))
+
+	f.release = func() {
+		m.m.Lock()
+		defer m.m.Unlock()
+		m.remove(f)
+	}
+	return f, true
+}
+
+// shed sheds the least recently active idle follows freeing at least n bytes.
+// If not enough follows are idle none is shed and it returns false
+func (m *followMemory) shed(n int64) bool {
+	idleBefore := time.Now().Add(-logFollowShedMinIdle).UnixNano()
+	var idle []*logFollow
+	var idleSize int64
+	for f := range m.follows {
+		if atomic.LoadInt64(&f.lastActive) < idleBefore {
+			idle = append(idle, f)
+			idleSize += f.size
+		}
+	}
+	if idleSize < n {
+		return false
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		return atomic.LoadInt64(&idle[i].lastActive) < atomic.LoadInt64(&idle[j].lastActive)
+	})
+	for _, f := range idle {
+		if n <= 0 {
+			break
+		}
+		close(f.shed)
+		m.remove(f)
+		n -= f.size
+		logFollowsShedTotal.Inc()
+	}
+	return true
+}
+
+func (m *followMemory) remove(f *logFollow) {
+	if _, ok := m.follows[f]; !ok {
+		return
+	}
+	delete(m.follows, f)
+	m.used -= f.size
+	logFollowBufferBytes.Set(float64(m.used))
+}
+
+// acquireLogFollow reserves the slots and the buffers memory of a log follow
+// request. When one of the limits has been reached it replies with a 503 and
+// returns false. The returned follow must be released when the request
+// finished.
+func (e *Executor) acquireLogFollow(w http.ResponseWriter, taskID string) (*logFollow, bool) {
+	releaseStream, ok := e.acquireStream(w, taskID, streamLogFollow)
+	if !ok {
+		return nil, false
+	}
+
+	f, ok := e.followMemory.acquire(int64(logFollowFixedBuffers + e.c.MaxLogLineLength))
+	if !ok {
+		releaseStream()
+		log.Warnf("rejecting request for task %q: reached the max log follows memory of %d bytes", taskID, e.followMemory.max)
+		w.Header().Set("Retry-After", "5")
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, taskID, "too much memory used by log follows, retry later")
+		return nil, false
+	}
+	releaseMemory := f.release
+	f.release = func() {
+		releaseMemory()
+		releaseStream()
+	}
+	return f, true
+}
@@ -0,0 +1,198 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/syslog"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+)
+
+const (
+	defaultLogForwardTag = "agola-executor"
+	// logForwardQueueSize is the max number of lines waiting to be sent. When
+	// full, like when the syslog server is down, the new lines are dropped
+	logForwardQueueSize = 8192
+	// logForwardRetryInterval is the wait before connecting again to the
+	// syslog server after a failure
+	logForwardRetryInterval = 5 * time.Second
+)
+
+// forwardedLine is a step output line sent, as json, to syslog
+type forwardedLine struct {
+	TaskID  string `json:"task_id"`
+	Step    int    `json:"step"`
+	Substep *int   `json:"substep,omitempty"`
+	Line    string `json:"line"`
+}
+
+// logForwarder sends the steps output lines to syslog. The lines are queued
+// and sent in background so a slow or unavailable syslog server never blocks
+// the steps execution.
+type logForwarder struct {
+	c     config.ExecutorLogForward
+	lines chan *forwardedLine
+}
+
+func newLogForwarder(c config.ExecutorLogForward) *logForwarder {
+	if c.Tag == "" {
+		c.Tag = defaultLogForwardTag
+	}
+	return &logForwarder{
+		c:     c,
+		lines: make(chan *forwardedLine, logForwardQueueSize),
+	}
+}
+
+// send queues the line or drops it if the queue is full
+func (f *logForwarder) send(l *forwardedLine) {
+	select {
+	case f.lines <- l:
+	default:
+		logForwardDroppedLines.Inc()
+	}
+}
+
+func (f *logForwarder) run(ctx context.Context) {
+	var w *syslog.Writer
+	defer func() {
+		if w != nil {
+			w.Close()
+		}
+	}()
+
+	for {
+		var l *forwardedLine
+		select {
+		case <-ctx.Done():
+			return
+		case l = <-f.lines:
+		}
+
+		if w == nil {
+			var err error
+			w, err = syslog.Dial(f.c.Network, f.c.Address, syslog.LOG_INFO|syslog.LOG_USER, f.c.Tag)
+			if err != nil {
+				log.Warnf("failed to connect to the log forward syslog server: %v", err)
+				logForwardDroppedLines.Inc()
+				// the lines remain queued, and then dropped, while waiting
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(logForwardRetryInterval):
+				}
+				continue
+			}
+		}
+
+		data, err := json.Marshal(l)
+		if err != nil {
+			log.Errorf("err: %+v", err)
+			continue
+		}
+		if err := w.Info(string(data)); err != nil {
+			log.Warnf("failed to forward log line to syslog: %v", err)
+			logForwardDroppedLines.Inc()
+			w.Close()
+			w = nil
+		}
+	}
+}
+
+// logForwardWriter writes to the log and forwards its complete lines, the
+// last partial line is forwarded when closed. Lines longer than maxLine are
+// forwarded in maxLine parts. The step marker lines aren't forwarded.
+type logForwardWriter struct {
+	io.WriteCloser
+	f       *logForwarder
+	base    forwardedLine
+	maxLine int
+
+	line []byte
+	m    sync.Mutex
+}
+
+// forwardLog returns a writer writing to the step log w and forwarding its
+// lines. substep is -1 for the step log. The logs of a task that doesn't
+// persist its logs aren't forwarded since they would be kept by syslog.
+func (e *Executor) forwardLog(et *types.ExecutorTask, step, substep int, w io.WriteCloser) io.WriteCloser {
+	if e.logForwarder == nil || et.Spec.NoLogPersist {
+		return w
+	}
+	fw := &logForwardWriter{
+		WriteCloser: w,
+		f:           e.logForwarder,
+		base:        forwardedLine{TaskID: et.ID, Step: step},
+		maxLine:     e.c.MaxLogLineLength,
+	}
+	if substep >= 0 {
+		fw.base.Substep = &substep
+	}
+	return fw
+}
+
+func (w *logForwardWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	n, err := w.WriteCloser.Write(p)
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		end := len(data)
+		if i >= 0 {
+			end = i
+		}
+		if room := w.maxLine - len(w.line); end > room {
+			w.line = append(w.line, data[:room]...)
+			data = data[room:]
+			w.forward()
+			continue
+		}
+		w.line = append(w.line, data[:end]...)
+		if i < 0 {
+			break
+		}
+		data = data[i+1:]
+		w.forward()
+	}
+	return n, err
+}
+
+// forward forwards the current line and resets it
+func (w *logForwardWriter) forward() {
+	if !isStepMarker(w.line) {
+		l := w.base
+		l.Line = string(unescapeMarkerLine(w.line))
+		w.f.send(&l)
+	}
+	w.line = w.line[:0]
+}
+
+func (w *logForwardWriter) Close() error {
+	w.m.Lock()
+	if len(w.line) > 0 {
+		w.forward()
+	}
+	w.m.Unlock()
+	return w.WriteCloser.Close()
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+)
+
+func TestForwardLogNoLogPersist(t *testing.T) {
+	tests := []struct {
+		name         string
+		noLogPersist bool
+		lines        []string
+	}{
+		{
+			name:  "persisted logs",
+			lines: []string{`Substep "sub01" exited with code 0`, `Substep "sub02" exited with code 0`, "exit 0", "exit 0", "exit 0"},
+		},
+		{
+			name:         "no log persist",
+			noLogPersist: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			e, rs := newTestExecutor(t, dir, newFakePod())
+			defer rs.Close()
+			e.c.MaxLogLineLength = 1024
+			// the forwarder isn't running so the forwarded lines stay queued
+			e.logForwarder = newLogForwarder(config.ExecutorLogForward{})
+
+			et := newTestTask(
+				runStep("exit 0"),
+				runStep("", func(s *types.RunStep) {
+					s.Parallel = []*types.RunSubstep{{Name: "sub01", Command: "exit 0"}, {Name: "sub02", Command: "exit 0"}}
+				}),
+			)
+			et.Spec.NoLogPersist = tt.noLogPersist
+
+			rt := executeTestTask(e, et)
+			waitTaskFinished(t, rt)
+			checkTaskStatus(t, et, types.ExecutorTaskPhaseSuccess, []types.ExecutorTaskPhase{types.ExecutorTaskPhaseSuccess, types.ExecutorTaskPhaseSuccess}, []int{0, 0})
+
+			lines := []string{}
+			for len(e.logForwarder.lines) > 0 {
+				l := <-e.logForwarder.lines
+				if l.TaskID != et.ID {
+					t.Fatalf("expected task %q, got %q", et.ID, l.TaskID)
+				}
+				lines = append(lines, l.Line)
+			}
+			sort.Strings(lines)
+			expectedLines := tt.lines
+			if expectedLines == nil {
+				expectedLines = []string{}
+			}
+			if len(lines) != len(expectedLines) {
+				t.Fatalf("expected forwarded lines %q, got %q", expectedLines, lines)
+			}
+			for i := range lines {
+				if lines[i] != expectedLines[i] {
+					t.Fatalf("expected forwarded lines %q, got %q", expectedLines, lines)
+				}
+			}
+		})
+	}
+}
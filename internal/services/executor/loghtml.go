@@ -0,0 +1,192 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// prefersHTML reports if the Accept header prefers an html response over a
+// plain text one, like the browsers do. Wildcards aren't considered so api
+// clients accepting anything keep receiving plain text.
+func prefersHTML(accept string) bool {
+	var htmlQ, plainQ float64
+	for _, mr := range strings.Split(accept, ",") {
+		parts := strings.Split(mr, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(parts[0]))
+		q := 1.0
+		for _, p := range parts[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		case "text/plain", "text/event-stream":
+			if q > plainQ {
+				plainQ = q
+			}
+		}
+	}
+	return htmlQ > 0 && htmlQ > plainQ
+}
+
+const logHTMLHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { margin: 0; background: #1e1e1e; color: #d4d4d4; }
+pre { margin: 0; padding: 1em; font: 13px/1.4 monospace; white-space: pre-wrap; word-wrap: break-word; }
+</style>
+</head>
+<body>
+<pre>`
+
+const logHTMLFooter = `</pre>
+</body>
+</html>
+`
+
+// ansiColors are the colors of the standard (30-37) and bright (90-97) ansi
+// color codes
+var ansiColors = [16]string{
+	"#000000", "#cd3131", "#0dbc79", "#e5e510", "#2472c8", "#bc3fbc", "#11a8cd", "#e5e5e5",
+	"#666666", "#f14c4c", "#23d18b", "#f5f543", "#3b8eea", "#d670d6", "#29b8db", "#ffffff",
+}
+
+// ansiStyle is the current ansi graphic rendition
+type ansiStyle struct {
+	bold bool
+	fg   string
+	bg   string
+}
+
+func (s *ansiStyle) css() string {
+	var css []string
+	if s.bold {
+		css = append(css, "font-weight:bold")
+	}
+	if s.fg != "" {
+		css = append(css, "color:"+s.fg)
+	}
+	if s.bg != "" {
+		css = append(css, "background-color:"+s.bg)
+	}
+	return strings.Join(css, ";")
+}
+
+// apply applies the parameters of an ansi SGR sequence
+func (s *ansiStyle) apply(params string) {
+	if params == "" {
+		params = "0"
+	}
+	for _, p := range strings.Split(params, ";") {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			continue
+		}
+		switch {
+		case n == 0:
+			*s = ansiStyle{}
+		case n == 1:
+			s.bold = true
+		case n == 22:
+			s.bold = false
+		case n >= 30 && n <= 37:
+			s.fg = ansiColors[n-30]
+		case n >= 90 && n <= 97:
+			s.fg = ansiColors[n-90+8]
+		case n == 39:
+			s.fg = ""
+		case n >= 40 && n <= 47:
+			s.bg = ansiColors[n-40]
+		case n >= 100 && n <= 107:
+			s.bg = ansiColors[n-100+8]
+		case n == 49:
+			s.bg = ""
+		}
+	}
+}
+
+// writeLogHTML writes a self contained html page rendering the log read from
+// r. The ansi colors are converted to html, the other escape sequences are
+// removed.
+func writeLogHTML(w io.Writer, title string, r io.Reader) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, logHTMLHeader, html.EscapeString(title))
+
+	var style ansiStyle
+	open := false
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		for len(line) > 0 {
+			i := strings.IndexByte(line, 0x1b)
+			if i < 0 {
+				bw.WriteString(html.EscapeString(line))
+				break
+			}
+			bw.WriteString(html.EscapeString(line[:i]))
+			line = line[i+1:]
+			if !strings.HasPrefix(line, "[") {
+				continue
+			}
+			// find the final byte of the control sequence
+			end := strings.IndexFunc(line[1:], func(c rune) bool { return c >= 0x40 && c <= 0x7e })
+			if end < 0 {
+				line = ""
+				break
+			}
+			seq, final := line[1:end+1], line[end+1]
+			line = line[end+2:]
+			if final != 'm' {
+				continue
+			}
+			style.apply(seq)
+			if open {
+				bw.WriteString("</span>")
+				open = false
+			}
+			if css := style.css(); css != "" {
+				fmt.Fprintf(bw, `<span style="%s">`, css)
+				open = true
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+	}
+	if open {
+		bw.WriteString("</span>")
+	}
+	bw.WriteString(logHTMLFooter)
+	return bw.Flush()
+}
@@ -0,0 +1,258 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+)
+
+// logLineIndexInterval is the number of lines between two line index entries
+const logLineIndexInterval = 1000
+
+// logLineIndexEntrySize is the size of a line index entry, a big endian
+// uint64 offset
+const logLineIndexEntrySize = 8
+
+// logLineIndexPath returns the path of the sparse line index of the log at
+// logPath. Its entry n is the offset of the line n*logLineIndexInterval
+// (numbered from 0) so the entry of a line is read without scanning the index.
+func logLineIndexPath(logPath string) string {
+	return logPath + ".lidx"
+}
+
+// lineIndexWriter writes the log and records in the line index the offset of
+// every logLineIndexInterval lines. An entry is written after the data of its
+// line start so readers never get an offset beyond the log data.
+type lineIndexWriter struct {
+	w   io.WriteCloser
+	idx io.WriteCloser
+
+	offset    int64
+	lines     int64
+	lineStart bool
+	m         sync.Mutex
+}
+
+func newLineIndexWriter(w, idx io.WriteCloser) *lineIndexWriter {
+	return &lineIndexWriter{w: w, idx: idx, lineStart: true}
+}
+
+func (w *lineIndexWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	n, err := w.w.Write(p)
+	var entries []byte
+	for i, c := range p[:n] {
+		if w.lineStart {
+			if w.lines%logLineIndexInterval == 0 {
+				entries = appendLineIndexEntry(entries, w.offset+int64(i))
+			}
+			w.lines++
+		}
+		w.lineStart = c == '\n'
+	}
+	w.offset += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if len(entries) > 0 {
+		if _, err := w.idx.Write(entries); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *lineIndexWriter) Close() error {
+	ierr := w.idx.Close()
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	return ierr
+}
+
+func appendLineIndexEntry(b []byte, offset int64) []byte {
+	var e [logLineIndexEntrySize]byte
+	binary.BigEndian.PutUint64(e[:], uint64(offset))
+	return append(b, e[:]...)
+}
+
+// lineIndex is the line index of a log
+type lineIndex struct {
+	path    string
+	entries int64
+}
+
+// lookup returns the nearest indexed line preceding line and its offset
+func (idx *lineIndex) lookup(line int64) (int64, int64, error) {
+	n := line / logLineIndexInterval
+	if n >= idx.entries {
+		n = idx.entries - 1
+	}
+	f, err := os.Open(idx.path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	var e [logLineIndexEntrySize]byte
+	if _, err := f.ReadAt(e[:], n*logLineIndexEntrySize); err != nil {
+		return 0, 0, errors.Errorf("failed to read line index %q: %w", idx.path, err)
+	}
+	return n * logLineIndexInterval, int64(binary.BigEndian.Uint64(e[:])), nil
+}
+
+// logLineIndex returns the line index of the log at logPath. The logs written
+// by previous executor versions have no index, it's built, together with the
+// lines count, when the log is finished. It returns nil when the log has no
+// index, like the in memory logs.
+func (e *Executor) logLineIndex(taskID string, sel *logSelector, logPath string, f logSource) (*lineIndex, error) {
+	if _, ok := f.(*fileLogSource); !ok {
+		return nil, nil
+	}
+	idxPath := logLineIndexPath(logPath)
+	fi, err := os.Stat(idxPath)
+	if err == nil {
+		if fi.Size() < logLineIndexEntrySize {
+			return nil, nil
+		}
+		return &lineIndex{path: idxPath, entries: fi.Size() / logLineIndexEntrySize}, nil
+	}
+	if !os.IsNotExist(err) || !e.logFinished(taskID, sel) {
+		return nil, nil
+	}
+
+	entries, lines, err := buildLogLineIndex(logPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := e.writeTaskDataFileAtomic(taskID, idxPath, entries); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(logLinesPath(logPath)); os.IsNotExist(err) {
+		if err := e.writeTaskDataFileAtomic(taskID, logLinesPath(logPath), []byte(strconv.FormatInt(lines, 10))); err != nil {
+			return nil, err
+		}
+	}
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	return &lineIndex{path: idxPath, entries: int64(len(entries) / logLineIndexEntrySize)}, nil
+}
+
+// buildLogLineIndex reads the log at logPath returning its line index entries
+// and its lines count
+func buildLogLineIndex(logPath string) ([]byte, int64, error) {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	var entries []byte
+	var offset, lines int64
+	lineStart := true
+	br := bufio.NewReaderSize(f, 64*1024)
+	for {
+		data, err := br.ReadSlice('\n')
+		for _, c := range data {
+			if lineStart {
+				if lines%logLineIndexInterval == 0 {
+					entries = appendLineIndexEntry(entries, offset)
+				}
+				lines++
+			}
+			lineStart = c == '\n'
+			offset++
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return entries, lines, nil
+		default:
+			return nil, 0, err
+		}
+	}
+}
+
+// logLineOffset returns the offset of the line (numbered from 0) of the log
+// read from f. It's the log size if the log has less lines. Only the lines
+// after the nearest indexed line are read.
+func logLineOffset(f logSource, idx *lineIndex, line int64) (int64, error) {
+	var start, skip int64 = 0, line
+	size, err := f.Size()
+	if err != nil {
+		return 0, err
+	}
+	if idx != nil && line > 0 {
+		indexedLine, offset, err := idx.lookup(line)
+		if err != nil {
+			return 0, err
+		}
+		// the index of a log truncated or rewritten isn't used
+		if offset <= size && isLineStart(f, offset) {
+			start, skip = offset, line-indexedLine
+		}
+	}
+
+	// the effective offset is greater than the requested one if the log is an
+	// in memory log and its start has been discarded, the lines numbers
+	// aren't known anymore
+	offset, err := f.Seek(start, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	if offset != start {
+		return 0, errors.Errorf("log start discarded: %w", errLogGone)
+	}
+
+	br := bufio.NewReader(f)
+	for skip > 0 {
+		data, err := br.ReadSlice('\n')
+		offset += int64(len(data))
+		switch err {
+		case nil:
+			skip--
+		case bufio.ErrBufferFull:
+		case io.EOF:
+			return offset, nil
+		default:
+			return 0, err
+		}
+	}
+	return offset, nil
+}
+
+// isLineStart reports if a line starts at offset
+func isLineStart(f logSource, offset int64) bool {
+	if offset == 0 {
+		return true
+	}
+	if _, err := f.Seek(offset-1, io.SeekStart); err != nil {
+		return false
+	}
+	var b [1]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		return false
+	}
+	return b[0] == '\n'
+}
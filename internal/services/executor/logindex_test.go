@@ -0,0 +1,302 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"agola.io/agola/services/runservice/types"
+)
+
+// testLog returns a log of lines lines, the last one without a trailing
+// newline when partial is true, and the offsets of its lines
+func testLog(lines int, partial bool) ([]byte, []int64) {
+	var b bytes.Buffer
+	var offsets []int64
+	for i := 0; i < lines; i++ {
+		offsets = append(offsets, int64(b.Len()))
+		// lines of variable length
+		fmt.Fprintf(&b, "line %d %s", i, bytes.Repeat([]byte("x"), i%7))
+		if !partial || i < lines-1 {
+			b.WriteByte('\n')
+		}
+	}
+	return b.Bytes(), offsets
+}
+
+func expectedLineIndex(offsets []int64) []byte {
+	var entries []byte
+	for i := 0; i < len(offsets); i += logLineIndexInterval {
+		entries = appendLineIndexEntry(entries, offsets[i])
+	}
+	return entries
+}
+
+func TestLineIndexWriter(t *testing.T) {
+	tests := []struct {
+		name      string
+		lines     int
+		partial   bool
+		chunkSize int
+	}{
+		{name: "empty log", lines: 0, chunkSize: 10},
+		{name: "single write", lines: 2500, chunkSize: 1 << 20},
+		{name: "one byte writes", lines: 2500, chunkSize: 1},
+		{name: "writes split across index intervals", lines: 3001, chunkSize: 37},
+		{name: "partial last line", lines: 2500, partial: true, chunkSize: 37},
+		{name: "partial last line starting an index interval", lines: 2001, partial: true, chunkSize: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			data, offsets := testLog(tt.lines, tt.partial)
+
+			logPath := filepath.Join(dir, "log")
+			lf, err := os.Create(logPath)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			idxf, err := os.Create(logLineIndexPath(logPath))
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			w := newLineIndexWriter(lf, idxf)
+			for p := data; len(p) > 0; {
+				n := tt.chunkSize
+				if n > len(p) {
+					n = len(p)
+				}
+				if _, err := w.Write(p[:n]); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				p = p[n:]
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			expectedEntries := expectedLineIndex(offsets)
+			entries, err := ioutil.ReadFile(logLineIndexPath(logPath))
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !bytes.Equal(entries, expectedEntries) {
+				t.Fatalf("expected %d index entries %v, got %d entries %v", len(expectedEntries)/logLineIndexEntrySize, expectedEntries, len(entries)/logLineIndexEntrySize, entries)
+			}
+
+			// the index built from the log must be the same
+			builtEntries, lines, err := buildLogLineIndex(logPath)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if !bytes.Equal(builtEntries, expectedEntries) {
+				t.Fatalf("expected built index entries %v, got %v", expectedEntries, builtEntries)
+			}
+			if lines != int64(tt.lines) {
+				t.Fatalf("expected %d lines, got %d", tt.lines, lines)
+			}
+
+			var idx *lineIndex
+			if len(entries) > 0 {
+				idx = &lineIndex{path: logLineIndexPath(logPath), entries: int64(len(entries) / logLineIndexEntrySize)}
+			}
+			f, err := os.Open(logPath)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer f.Close()
+			fs := &fileLogSource{File: f}
+
+			for _, line := range []int{0, 1, 999, 1000, 1001, 1999, 2000, 2500, tt.lines - 1, tt.lines, tt.lines + 1000} {
+				if line < 0 {
+					continue
+				}
+				expectedOffset := int64(len(data))
+				if line < len(offsets) {
+					expectedOffset = offsets[line]
+				}
+				offset, err := logLineOffset(fs, idx, int64(line))
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if offset != expectedOffset {
+					t.Fatalf("line %d: expected offset %d, got %d", line, expectedOffset, offset)
+				}
+			}
+		})
+	}
+}
+
+func TestLogLineOffsetRewrittenLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	data, offsets := testLog(2500, false)
+	logPath := filepath.Join(dir, "log")
+	if err := ioutil.WriteFile(logPath, data, 0660); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// a stale index whose entries don't point to a line start
+	var entries []byte
+	for i := 0; i < 3; i++ {
+		entries = appendLineIndexEntry(entries, offsets[i*logLineIndexInterval]+1)
+	}
+	if err := ioutil.WriteFile(logLineIndexPath(logPath), entries, 0660); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	idx := &lineIndex{path: logLineIndexPath(logPath), entries: 3}
+
+	f, err := os.Open(logPath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer f.Close()
+
+	offset, err := logLineOffset(&fileLogSource{File: f}, idx, 2001)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if offset != offsets[2001] {
+		t.Fatalf("expected offset %d, got %d", offsets[2001], offset)
+	}
+}
+
+func TestLogLineIndexLegacyLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   int
+		partial bool
+		// running is true when the task is running and its step isn't
+		// finished
+		running       bool
+		expectedIndex bool
+	}{
+		{name: "finished log", lines: 2500, expectedIndex: true},
+		{name: "finished log with a partial last line", lines: 1001, partial: true, expectedIndex: true},
+		{name: "finished empty log", lines: 0},
+		{name: "log of a running step", lines: 2500, running: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			e := &Executor{
+				runningTasks: &runningTasks{
+					tasks: make(map[string]*runningTask),
+				},
+				fileMode: 0660,
+				fileUID:  -1,
+				fileGID:  -1,
+			}
+			const taskID = "task01"
+			if tt.running {
+				e.runningTasks.addIfNotExists(taskID, &runningTask{
+					et: &types.ExecutorTask{
+						ID: taskID,
+						Status: types.ExecutorTaskStatus{
+							Phase: types.ExecutorTaskPhaseRunning,
+							Steps: []*types.ExecutorTaskStepStatus{{Phase: types.ExecutorTaskPhaseRunning}},
+						},
+					},
+				})
+			}
+
+			// a log written by a previous executor version, without index
+			data, offsets := testLog(tt.lines, tt.partial)
+			logPath := filepath.Join(dir, "log")
+			if err := ioutil.WriteFile(logPath, data, 0660); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			f, err := os.Open(logPath)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer f.Close()
+			fs := &fileLogSource{File: f}
+
+			sel := &logSelector{step: 0, substep: -1}
+			idx, err := e.logLineIndex(taskID, sel, logPath, fs)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if tt.running {
+				if idx != nil {
+					t.Fatalf("expected no index for a running step log")
+				}
+				if _, err := os.Stat(logLineIndexPath(logPath)); !os.IsNotExist(err) {
+					t.Fatalf("expected no index file, got err: %v", err)
+				}
+				return
+			}
+			if tt.expectedIndex != (idx != nil) {
+				t.Fatalf("expected index: %t, got index: %v", tt.expectedIndex, idx)
+			}
+
+			entries, err := ioutil.ReadFile(logLineIndexPath(logPath))
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if expectedEntries := expectedLineIndex(offsets); !bytes.Equal(entries, expectedEntries) {
+				t.Fatalf("expected index entries %v, got %v", expectedEntries, entries)
+			}
+			lines, err := ioutil.ReadFile(logLinesPath(logPath))
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if string(lines) != fmt.Sprintf("%d", tt.lines) {
+				t.Fatalf("expected lines count %d, got %q", tt.lines, lines)
+			}
+
+			// the built index is reused
+			idx2, err := e.logLineIndex(taskID, sel, logPath, fs)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if tt.expectedIndex && (idx2 == nil || *idx2 != *idx) {
+				t.Fatalf("expected index %v, got %v", idx, idx2)
+			}
+
+			if tt.lines > 0 {
+				line := int64(tt.lines - 1)
+				offset, err := logLineOffset(fs, idx, line)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if offset != offsets[line] {
+					t.Fatalf("expected offset %d, got %d", offsets[line], offset)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TaskLogLine is a line of the task steps logs with the step that produced it
+type TaskLogLine struct {
+	// Time is the line capture time, it's nil if not known
+	Time     *time.Time `json:"ts,omitempty"`
+	Step     int        `json:"step"`
+	StepName string     `json:"stepname"`
+	Line     string     `json:"line"`
+}
+
+// writeTaskJSONLogs writes, as json lines, the lines of all the task attempt
+// steps logs in the steps order. When following, the log of the running step
+// is followed and then the logs of the next steps. The step markers are
+// removed.
+func (e *Executor) writeTaskJSONLogs(ctx context.Context, w io.Writer, flusher http.Flusher, taskID string, attempt int, steps []*TaskManifestStep, follow bool) error {
+	enc := json.NewEncoder(w)
+	for step, ms := range steps {
+		sel := &logSelector{step: step, substep: -1, attempt: attempt}
+
+		// wait for the step to start
+		var f logSource
+		for {
+			var err error
+			f, err = e.openLog(taskID, e.logPath(taskID, sel))
+			if err == nil {
+				break
+			}
+			if !os.IsNotExist(err) {
+				return err
+			}
+			// the step won't be executed
+			if !follow || e.logFinished(taskID, sel) || e.taskFinished(taskID, attempt) {
+				break
+			}
+			if !waitLogData(ctx) {
+				return nil
+			}
+		}
+		if f == nil {
+			continue
+		}
+
+		err := e.writeStepJSONLogs(ctx, enc, flusher, f, taskID, sel, ms.Name, follow)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (e *Executor) writeStepJSONLogs(ctx context.Context, enc *json.Encoder, flusher http.Flusher, f logSource, taskID string, sel *logSelector, stepName string, follow bool) error {
+	// the logs kept in memory have no timestamps index
+	idx, err := openLogIndex(e.logPath(taskID, sel))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if idx != nil {
+		defer idx.Close()
+	}
+
+	br := bufio.NewReader(f)
+	var line []byte
+	var offset int64
+	stop := !follow
+	for {
+		data, err := br.ReadBytes('\n')
+		line = append(line, data...)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		// a partial line is sent only when the log won't change anymore
+		if len(line) > 0 && (err == nil || stop) {
+			if !isStepMarker(line) {
+				ll := &TaskLogLine{Step: sel.step, StepName: stepName, Line: string(bytes.TrimSuffix(unescapeMarkerLine(line), []byte("\n")))}
+				if idx != nil {
+					if ts := idx.tsAt(offset); ts != 0 {
+						t := time.Unix(0, ts).UTC()
+						ll.Time = &t
+					}
+				}
+				if err := enc.Encode(ll); err != nil {
+					return err
+				}
+			}
+			offset += int64(len(line))
+			line = line[:0]
+			continue
+		}
+		if err == nil {
+			continue
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if stop {
+			return nil
+		}
+		// when the step is finished read until EOF and stop
+		if e.logFinished(taskID, sel) {
+			stop = true
+			continue
+		}
+		if !waitLogData(ctx) {
+			return nil
+		}
+	}
+}
+
+// waitLogData waits before reading again a followed log. It returns false if
+// the context is done
+func waitLogData(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	// TODO(sgotti) use ionotify/fswatcher?
+	case <-time.After(500 * time.Millisecond):
+		return true
+	}
+}
+
+// taskFinished reports if the task attempt is finished. The steps after a
+// failed one are never started.
+func (e *Executor) taskFinished(taskID string, attempt int) bool {
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return true
+	}
+	rt.Lock()
+	defer rt.Unlock()
+	return rt.attempt != attempt || rt.et.Status.Phase.IsFinished()
+}
@@ -0,0 +1,324 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+)
+
+// stepMarkerPrefix is the prefix of the machine parseable lines written at the
+// start and at the end of every step log, and in the service logs where their
+// output has been reattached. Markers are always written on their own line.
+//
+// The output lines that look like a marker, starting with two or more '#'
+// followed by "agola:", are escaped adding a '#' at their start so a command
+// cannot write fake markers. The escape is removed when the markers are
+// removed from the log.
+const stepMarkerPrefix = "##agola:"
+
+// markerTag is the part of the marker prefix following the '#'
+const markerTag = "agola:"
+
+// markerLineState matches the start of a line with a marker or an escaped
+// marker ("#*##agola:")
+type markerLineState struct {
+	hashes int
+	// matched is the number of matched bytes of the marker tag
+	matched int
+}
+
+type markerMatch int
+
+const (
+	markerMatchPending markerMatch = iota
+	markerMatchNone
+	markerMatchFull
+)
+
+// feed matches the next byte of the line. When it returns markerMatchNone the
+// byte isn't part of the pending bytes.
+func (s *markerLineState) feed(c byte) markerMatch {
+	switch {
+	case s.matched == 0 && c == '#':
+		s.hashes++
+		return markerMatchPending
+	case s.hashes >= 2 && c == markerTag[s.matched]:
+		s.matched++
+		if s.matched == len(markerTag) {
+			return markerMatchFull
+		}
+		return markerMatchPending
+	default:
+		return markerMatchNone
+	}
+}
+
+// pending returns the matched bytes
+func (s *markerLineState) pending() []byte {
+	return append(bytes.Repeat([]byte{'#'}, s.hashes), markerTag[:s.matched]...)
+}
+
+func (s *markerLineState) len() int {
+	return s.hashes + s.matched
+}
+
+func (s *markerLineState) reset() {
+	s.hashes = 0
+	s.matched = 0
+}
+
+// isEscapedMarker reports if line is an output line escaped since it looked
+// like a marker
+func isEscapedMarker(line []byte) bool {
+	i := 0
+	for i < len(line) && line[i] == '#' {
+		i++
+	}
+	return i > 2 && bytes.HasPrefix(line[i:], []byte(markerTag))
+}
+
+// unescapeMarkerLine returns the line without the escape added when written
+func unescapeMarkerLine(line []byte) []byte {
+	if isEscapedMarker(line) {
+		return line[1:]
+	}
+	return line
+}
+
+// markerEscapeWriter escapes the written output lines that look like a marker.
+// The markers are written with writeMarker.
+type markerEscapeWriter struct {
+	w io.Writer
+
+	lineStart bool
+	state     markerLineState
+	m         sync.Mutex
+}
+
+func newMarkerEscapeWriter(w io.Writer) *markerEscapeWriter {
+	return &markerEscapeWriter{w: w, lineStart: true}
+}
+
+func (w *markerEscapeWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		if !w.lineStart {
+			out = append(out, c)
+			w.lineStart = c == '\n'
+			continue
+		}
+		switch w.state.feed(c) {
+		case markerMatchPending:
+		case markerMatchNone:
+			out = append(out, w.state.pending()...)
+			out = append(out, c)
+			w.state.reset()
+			w.lineStart = c == '\n'
+		case markerMatchFull:
+			out = append(out, '#')
+			out = append(out, w.state.pending()...)
+			w.state.reset()
+			w.lineStart = false
+		}
+	}
+	if len(out) > 0 {
+		if _, err := w.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// writeMarker writes the pending bytes and then data without escaping it
+func (w *markerEscapeWriter) writeMarker(data []byte) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if err := w.flush(); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.lineStart = data[len(data)-1] == '\n'
+	return nil
+}
+
+func (w *markerEscapeWriter) flush() error {
+	if w.state.len() == 0 {
+		return nil
+	}
+	pending := w.state.pending()
+	w.state.reset()
+	w.lineStart = false
+	_, err := w.w.Write(pending)
+	return err
+}
+
+// Flush writes the pending bytes of the last partial line. It must be called
+// after the command finished, before writing a marker to the underlying
+// writer.
+func (w *markerEscapeWriter) Flush() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.flush()
+}
+
+// markedLogWriter is a step log writer that keeps track of the line state so
+// the markers can be written at the start of a new line
+type markedLogWriter struct {
+	io.WriteCloser
+	// newline is true if the last written byte is a newline or if nothing has
+	// been written
+	newline bool
+	m       sync.Mutex
+}
+
+func newMarkedLogWriter(w io.WriteCloser) *markedLogWriter {
+	return &markedLogWriter{WriteCloser: w, newline: true}
+}
+
+func (w *markedLogWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+	n, err := w.WriteCloser.Write(p)
+	if n > 0 {
+		w.newline = p[n-1] == '\n'
+	}
+	return n, err
+}
+
+func (w *markedLogWriter) writeMarker(marker string) error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if !w.newline {
+		marker = "\n" + marker
+	}
+	_, err := io.WriteString(w.WriteCloser, marker)
+	w.newline = true
+	return err
+}
+
+func (w *markedLogWriter) writeStepStart(stepIndex int, name string) error {
+	return w.writeMarker(fmt.Sprintf("%sstep-start step=%d name=%s ts=%s\n", stepMarkerPrefix, stepIndex, strconv.Quote(name), time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+// writeStepAttempt marks the start of a step retry, attempt starts from 1
+func (w *markedLogWriter) writeStepAttempt(stepIndex, attempt, exitCode int) error {
+	return w.writeMarker(fmt.Sprintf("%sstep-attempt step=%d attempt=%d previous-exit=%d ts=%s\n", stepMarkerPrefix, stepIndex, attempt, exitCode, time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+func (w *markedLogWriter) writeStepEnd(stepIndex int, ss *types.ExecutorTaskStepStatus) error {
+	exit := ""
+	if ss.ExitStatus != nil {
+		exit = fmt.Sprintf(" exit=%d", *ss.ExitStatus)
+	}
+	return w.writeMarker(fmt.Sprintf("%sstep-end step=%d%s phase=%s ts=%s\n", stepMarkerPrefix, stepIndex, exit, ss.Phase, time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+// writeLogReattached marks where the container output has been reattached
+// after its stream broke
+func (w *markedLogWriter) writeLogReattached() error {
+	return w.writeMarker(fmt.Sprintf("%slog-reattached ts=%s\n", stepMarkerPrefix, time.Now().UTC().Format(time.RFC3339Nano)))
+}
+
+// markerStripWriter removes the step marker lines from the written data and
+// the escape of the output lines that looked like a marker
+type markerStripWriter struct {
+	w io.Writer
+
+	lineStart bool
+	discard   bool
+	// state holds the bytes at the start of a line that could be a marker
+	state markerLineState
+}
+
+func newMarkerStripWriter(w io.Writer) *markerStripWriter {
+	return &markerStripWriter{w: w, lineStart: true}
+}
+
+func (s *markerStripWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p))
+	for _, c := range p {
+		switch {
+		case s.discard:
+			if c == '\n' {
+				s.discard = false
+				s.lineStart = true
+			}
+		case s.lineStart:
+			switch s.state.feed(c) {
+			case markerMatchPending:
+			case markerMatchNone:
+				out = append(out, s.state.pending()...)
+				out = append(out, c)
+				s.state.reset()
+				s.lineStart = c == '\n'
+			case markerMatchFull:
+				if s.state.hashes == 2 {
+					s.discard = true
+				} else {
+					out = append(out, s.state.pending()[1:]...)
+				}
+				s.state.reset()
+				s.lineStart = false
+			}
+		default:
+			out = append(out, c)
+			if c == '\n' {
+				s.lineStart = true
+			}
+		}
+	}
+	if len(out) > 0 {
+		if _, err := s.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// pendingLen returns the number of bytes held waiting to know if they're part
+// of a marker
+func (s *markerStripWriter) pendingLen() int {
+	return s.state.len()
+}
+
+// Flush writes the pending bytes
+func (s *markerStripWriter) Flush() error {
+	if s.state.len() == 0 {
+		return nil
+	}
+	_, err := s.w.Write(s.state.pending())
+	s.state.reset()
+	return err
+}
+
+func isStepMarker(line []byte) bool {
+	return bytes.HasPrefix(line, []byte(stepMarkerPrefix))
+}
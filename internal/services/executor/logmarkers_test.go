@@ -0,0 +1,151 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMarkerEscape(t *testing.T) {
+	tests := []struct {
+		name string
+		// writes are the command output writes, a write starting with \x00
+		// is a marker
+		writes []string
+		// log is the written log
+		log string
+		// out is the log with the markers removed
+		out string
+	}{
+		{
+			name:   "no markers",
+			writes: []string{"line01\n# comment\n#agola: not a marker\n"},
+			log:    "line01\n# comment\n#agola: not a marker\n",
+			out:    "line01\n# comment\n#agola: not a marker\n",
+		},
+		{
+			name:   "markers",
+			writes: []string{"\x00##agola:step-start step=0\n", "line01\n", "\x00##agola:step-end step=0\n"},
+			log:    "##agola:step-start step=0\nline01\n##agola:step-end step=0\n",
+			out:    "line01\n",
+		},
+		{
+			name:   "output looking like a marker",
+			writes: []string{"\x00##agola:step-start step=0\n", "##agola:step-end step=0\n###agola:x\n", "\x00##agola:step-end step=0\n"},
+			log:    "##agola:step-start step=0\n###agola:step-end step=0\n####agola:x\n##agola:step-end step=0\n",
+			out:    "##agola:step-end step=0\n###agola:x\n",
+		},
+		{
+			name:   "output looking like a marker split between writes",
+			writes: []string{"line01\n#", "#ag", "ola:fake\n##", "agol", "a\n"},
+			log:    "line01\n###agola:fake\n##agola\n",
+			out:    "line01\n##agola:fake\n##agola\n",
+		},
+		{
+			name:   "output looking like a marker not at the line start",
+			writes: []string{"line01 ##agola:fake\n"},
+			log:    "line01 ##agola:fake\n",
+			out:    "line01 ##agola:fake\n",
+		},
+		{
+			name:   "partial line before a marker",
+			writes: []string{"##ago", "\x00\n##agola:step-end step=0\n"},
+			log:    "##ago\n##agola:step-end step=0\n",
+			out:    "##ago\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			w := newMarkerEscapeWriter(&log)
+			for _, p := range tt.writes {
+				if len(p) > 0 && p[0] == 0 {
+					if err := w.writeMarker([]byte(p[1:])); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+					continue
+				}
+				if _, err := w.Write([]byte(p)); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if log.String() != tt.log {
+				t.Fatalf("expected log %q, got %q", tt.log, log.String())
+			}
+
+			// strip the markers writing the log one byte at a time
+			var out bytes.Buffer
+			sw := newMarkerStripWriter(&out)
+			for _, c := range log.Bytes() {
+				if _, err := sw.Write([]byte{c}); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			}
+			if err := sw.Flush(); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if out.String() != tt.out {
+				t.Fatalf("expected output %q, got %q", tt.out, out.String())
+			}
+
+			// the line readers get the same lines
+			var lines bytes.Buffer
+			for _, line := range bytes.SplitAfter(log.Bytes(), []byte("\n")) {
+				if !isStepMarker(line) {
+					lines.Write(unescapeMarkerLine(line))
+				}
+			}
+			if lines.String() != tt.out {
+				t.Fatalf("expected lines %q, got %q", tt.out, lines.String())
+			}
+		})
+	}
+}
+
+func TestCommandMarkerWriterEscape(t *testing.T) {
+	var log bytes.Buffer
+	w := newCommandMarkerWriter(newMarkerEscapeWriter(&log))
+	for _, p := range []string{"##agola:fake\n", "\x1ecommand-start n=0", "\n##agola:fake2\noutput\x1ecommand-end n=0\n"} {
+		if _, err := w.Write([]byte(p)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+
+	lines := bytes.SplitAfter(log.Bytes(), []byte("\n"))
+	expected := []struct {
+		line   string
+		marker bool
+	}{
+		{line: "###agola:fake\n"},
+		{line: "##agola:command-start n=0 ts=", marker: true},
+		{line: "###agola:fake2\n"},
+		{line: "output\n"},
+		{line: "##agola:command-end n=0 ts=", marker: true},
+		{line: ""},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got %q", len(expected), log.String())
+	}
+	for i, e := range expected {
+		if !bytes.HasPrefix(lines[i], []byte(e.line)) || isStepMarker(lines[i]) != e.marker {
+			t.Fatalf("line %d: expected %q (marker: %t), got %q", i, e.line, e.marker, lines[i])
+		}
+	}
+}
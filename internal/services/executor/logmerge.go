@@ -0,0 +1,440 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	errors "golang.org/x/xerrors"
+)
+
+// maxTimestampLayoutLength is the max length of a custom timestamp layout
+const maxTimestampLayoutLength = 64
+
+// logIndexPath returns the path of the timestamps index of the log at logPath
+func logIndexPath(logPath string) string {
+	return logPath + ".idx"
+}
+
+// logIndexResolution is the max difference between the capture time of a log
+// line and the one recorded in the log timestamps index
+const logIndexResolution = 10 * time.Millisecond
+
+// timestampIndexWriter writes the log and records, in the index, the offset
+// and the capture time of the line starts. Every index entry is a text line
+// in the format "offset unixnano". To keep the index small an entry is
+// recorded only when the capture time advanced by at least
+// logIndexResolution since the last entry, the lines without an entry have
+// the capture time of the previous one.
+type timestampIndexWriter struct {
+	w   io.WriteCloser
+	idx io.WriteCloser
+
+	offset    int64
+	lineStart bool
+	// lastTS is the capture time of the last index entry, 0 if no entry has
+	// been recorded
+	lastTS int64
+	m      sync.Mutex
+}
+
+func newTimestampIndexWriter(w, idx io.WriteCloser) *timestampIndexWriter {
+	return &timestampIndexWriter{w: w, idx: idx, lineStart: true}
+}
+
+func (w *timestampIndexWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	now := time.Now().UnixNano()
+	var entries []byte
+	for i, c := range p {
+		if w.lineStart && (w.lastTS == 0 || now-w.lastTS >= int64(logIndexResolution)) {
+			entries = append(entries, fmt.Sprintf("%d %d\n", w.offset+int64(i), now)...)
+			w.lastTS = now
+		}
+		w.lineStart = c == '\n'
+	}
+
+	n, err := w.w.Write(p)
+	w.offset += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if len(entries) > 0 {
+		if _, err := w.idx.Write(entries); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (w *timestampIndexWriter) Close() error {
+	ierr := w.idx.Close()
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	return ierr
+}
+
+type logIndexEntry struct {
+	offset int64
+	ts     int64
+}
+
+// logIndexReader incrementally reads the timestamps index of a log, also while
+// it's written
+type logIndexReader struct {
+	f *os.File
+	r *bufio.Reader
+
+	// partial is a partially written index entry
+	partial string
+	// pending is an entry read but not yet reached by the log offset
+	pending *logIndexEntry
+	ts      int64
+}
+
+func openLogIndex(logPath string) (*logIndexReader, error) {
+	f, err := os.Open(logIndexPath(logPath))
+	if err != nil {
+		return nil, err
+	}
+	return &logIndexReader{f: f, r: bufio.NewReader(f)}, nil
+}
+
+// next returns the next index entry, nil when there are no more entries
+// written
+func (r *logIndexReader) next() *logIndexEntry {
+	for {
+		l, err := r.r.ReadString('\n')
+		if err != nil {
+			// the entry is still being written
+			r.partial += l
+			return nil
+		}
+		l, r.partial = r.partial+l, ""
+		fields := strings.Fields(l)
+		// ignore partially written entries
+		if len(fields) != 2 {
+			continue
+		}
+		offset, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		ts, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		return &logIndexEntry{offset: offset, ts: ts}
+	}
+}
+
+// tsAt returns the capture time of the line starting at offset. The offsets
+// must be increasing between calls. It's 0 if not known
+func (r *logIndexReader) tsAt(offset int64) int64 {
+	for {
+		if r.pending == nil {
+			r.pending = r.next()
+			if r.pending == nil {
+				return r.ts
+			}
+		}
+		if r.pending.offset > offset {
+			return r.ts
+		}
+		r.ts = r.pending.ts
+		r.pending = nil
+	}
+}
+
+func (r *logIndexReader) Close() error {
+	return r.f.Close()
+}
+
+// logIndexProblem reads the index entries and returns why they don't reliably
+// report the capture time of the lines of a log of the provided size or an
+// empty string if they do
+func logIndexProblem(idx *logIndexReader, logSize int64) string {
+	var prev *logIndexEntry
+	for entry := idx.next(); entry != nil; entry = idx.next() {
+		if prev == nil && entry.offset != 0 {
+			return "log timestamps missing"
+		}
+		if prev != nil && (entry.ts < prev.ts || entry.offset <= prev.offset) {
+			return "log timestamps out of order"
+		}
+		prev = entry
+	}
+	if logSize > 0 && prev == nil {
+		return "log timestamps missing"
+	}
+	return ""
+}
+
+// mergeSource reads the lines of a log with their capture time
+type mergeSource struct {
+	name string
+
+	f      *os.File
+	r      *bufio.Reader
+	idx    *logIndexReader
+	offset int64
+
+	// line is the current line and ts its capture time
+	line []byte
+	ts   int64
+	done bool
+}
+
+func newMergeSource(name, logPath string) (*mergeSource, error) {
+	idx, err := openLogIndex(logPath)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(logPath)
+	if err != nil {
+		idx.Close()
+		return nil, err
+	}
+	s := &mergeSource{name: name, f: f, r: bufio.NewReader(f), idx: idx}
+	if err := s.next(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// next reads the next line. A line without an index entry gets the capture
+// time of the previous one
+func (s *mergeSource) next() error {
+	line, err := s.r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if len(line) == 0 {
+		s.done = true
+		s.line = nil
+		return nil
+	}
+	s.ts = s.idx.tsAt(s.offset)
+	s.offset += int64(len(line))
+	s.line = line
+	return nil
+}
+
+func (s *mergeSource) Close() error {
+	ierr := s.idx.Close()
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	return ierr
+}
+
+// stepMergeSources returns the sources of the merged log of a step: the step
+// log and the logs of its sub steps
+func (e *Executor) stepMergeSources(taskID string, attempt, step int) ([]*mergeSource, error) {
+	paths := []string{e.stepLogPath(taskID, attempt, step)}
+	names := []string{"step"}
+
+	logs, err := e.taskLogs(taskID)
+	if err != nil {
+		return nil, err
+	}
+	var substeps []int
+	for _, l := range logs {
+		if l.attempt != attempt {
+			continue
+		}
+		if s, substep, ok := parseSubstepLogStream(l.stream); ok && s == step {
+			substeps = append(substeps, substep)
+		}
+	}
+	sort.Ints(substeps)
+	for _, substep := range substeps {
+		paths = append(paths, e.substepLogPath(taskID, attempt, step, substep))
+		names = append(names, fmt.Sprintf("substep/%d", substep))
+	}
+
+	var sources []*mergeSource
+	for i, p := range paths {
+		s, err := newMergeSource(names[i], p)
+		if err != nil {
+			for _, s := range sources {
+				s.Close()
+			}
+			return nil, err
+		}
+		sources = append(sources, s)
+	}
+	return sources, nil
+}
+
+// writeMergedLogs writes the lines of all the sources ordered by capture time.
+// Every line is prefixed with its source name. Lines with the same capture
+// time keep the sources order.
+func writeMergedLogs(w io.Writer, sources []*mergeSource, rawMarkers bool) error {
+	for {
+		var cur *mergeSource
+		for _, s := range sources {
+			if s.done {
+				continue
+			}
+			if cur == nil || s.ts < cur.ts {
+				cur = s
+			}
+		}
+		if cur == nil {
+			return nil
+		}
+
+		if rawMarkers || !isStepMarker(cur.line) {
+			line := cur.line
+			if !rawMarkers {
+				line = unescapeMarkerLine(line)
+			}
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if _, err := fmt.Fprintf(w, "[%s] %s", cur.name, line); err != nil {
+				return err
+			}
+		}
+		if err := cur.next(); err != nil {
+			return err
+		}
+	}
+}
+
+// timestampFormat returns the function formatting the line capture time
+// prefixed by the timestamps logs mode. format is one of "rfc3339" (the
+// default), "epoch", "epochmillis" or "custom" to use the provided go time
+// layout. Custom layouts are limited to a safe set of characters so they
+// cannot inject new lines or markup in the log.
+func timestampFormat(format, layout string) (func(time.Time) string, error) {
+	switch format {
+	case "", "rfc3339":
+		return func(t time.Time) string { return t.UTC().Format(time.RFC3339Nano) }, nil
+	case "epoch":
+		return func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }, nil
+	case "epochmillis":
+		return func(t time.Time) string { return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) }, nil
+	case "custom":
+		if layout == "" || len(layout) > maxTimestampLayoutLength {
+			return nil, errors.Errorf("custom timestamp layout must be between 1 and %d characters", maxTimestampLayoutLength)
+		}
+		for _, c := range layout {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(" -+:.,/_TZ", c)) {
+				return nil, errors.Errorf("invalid character %q in custom timestamp layout", c)
+			}
+		}
+		// a layout without time elements would print the same text on every line
+		if time.Unix(0, 0).UTC().Format(layout) == layout {
+			return nil, errors.Errorf("custom timestamp layout %q without time elements", layout)
+		}
+		return func(t time.Time) string { return t.UTC().Format(layout) }, nil
+	default:
+		return nil, errors.Errorf("unknown timestamp format %q", format)
+	}
+}
+
+// writeSourceLine writes the current source line, prefixed by its capture time
+// if opts.tsFormat is defined
+func writeSourceLine(w io.Writer, s *mergeSource, opts *readLogsOptions) error {
+	if opts.tsFormat != nil {
+		if _, err := io.WriteString(w, opts.tsFormat(time.Unix(0, s.ts))+" "); err != nil {
+			return err
+		}
+	}
+	line := s.line
+	if !opts.rawMarkers {
+		line = unescapeMarkerLine(line)
+	}
+	_, err := w.Write(line)
+	return err
+}
+
+// writeWindowLogs writes the lines of the source captured between opts.since
+// and opts.until (both inclusive). A nil since or until means no bound
+func writeWindowLogs(w io.Writer, s *mergeSource, opts *readLogsOptions) error {
+	since, until := opts.since, opts.until
+	for !s.done {
+		ts := time.Unix(0, s.ts)
+		if until != nil && ts.After(*until) {
+			// lines are ordered by capture time
+			return nil
+		}
+		if (since == nil || !ts.Before(*since)) && (opts.rawMarkers || !isStepMarker(s.line)) {
+			if err := writeSourceLine(w, s, opts); err != nil {
+				return err
+			}
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeReplayLogs writes the lines of the source captured between opts.since
+// and opts.until waiting, before every line, the time elapsed from the capture
+// of the previous one divided by speed. A zero speed writes the lines without
+// waiting. Every line is flushed when written.
+func writeReplayLogs(ctx context.Context, w io.Writer, flusher http.Flusher, s *mergeSource, speed float64, opts *readLogsOptions) error {
+	since, until := opts.since, opts.until
+	var prevTS int64
+	first := true
+	for !s.done {
+		ts := time.Unix(0, s.ts)
+		if until != nil && ts.After(*until) {
+			return nil
+		}
+		if (since == nil || !ts.Before(*since)) && (opts.rawMarkers || !isStepMarker(s.line)) {
+			if !first && speed > 0 && s.ts > prevTS {
+				timer := time.NewTimer(time.Duration(float64(s.ts-prevTS) / speed))
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return nil
+				case <-timer.C:
+				}
+			}
+			first = false
+			prevTS = s.ts
+
+			if err := writeSourceLine(w, s, opts); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err := s.next(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTimestampIndexWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "log")
+	lf, err := os.Create(logPath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	idxf, err := os.Create(logIndexPath(logPath))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	w := newTimestampIndexWriter(lf, idxf)
+
+	// a burst of lines, then a line split between writes after a pause
+	for i := 0; i < 1000; i++ {
+		if _, err := fmt.Fprintf(w, "line %d\n", i); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	time.Sleep(2 * logIndexResolution)
+	for _, p := range []string{"last ", "line\n"} {
+		if _, err := w.Write([]byte(p)); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	idx, err := openLogIndex(logPath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer idx.Close()
+	var entries []*logIndexEntry
+	for e := idx.next(); e != nil; e = idx.next() {
+		entries = append(entries, e)
+	}
+	// the burst lines share a few entries
+	if len(entries) < 2 || len(entries) > 100 {
+		t.Fatalf("expected a sparse index, got %d entries", len(entries))
+	}
+	last := entries[len(entries)-1]
+	if last.offset != fi.Size()-int64(len("last line\n")) {
+		t.Fatalf("expected last entry at the last line start %d, got %d", fi.Size()-int64(len("last line\n")), last.offset)
+	}
+	if last.ts-entries[len(entries)-2].ts < int64(logIndexResolution) {
+		t.Fatalf("expected last entry after the pause")
+	}
+
+	idx2, err := openLogIndex(logPath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer idx2.Close()
+	if problem := logIndexProblem(idx2, fi.Size()); problem != "" {
+		t.Fatalf("unexpected index problem: %s", problem)
+	}
+}
+
+func TestMergeSourceSparseIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, "log")
+	if err := ioutil.WriteFile(logPath, []byte("l0\nl1\nl2\nl3\nl4"), 0660); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	// the last entry is still being written
+	if err := ioutil.WriteFile(logIndexPath(logPath), []byte("0 100\n6 200\n12 3"), 0660); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+
+	s, err := newMergeSource("step", logPath)
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer s.Close()
+
+	expected := []struct {
+		line string
+		ts   int64
+	}{
+		{"l0\n", 100}, {"l1\n", 100}, {"l2\n", 200}, {"l3\n", 200}, {"l4", 200},
+	}
+	for _, e := range expected {
+		if s.done {
+			t.Fatalf("unexpected end of source")
+		}
+		if string(s.line) != e.line || s.ts != e.ts {
+			t.Fatalf("expected line %q with ts %d, got line %q with ts %d", e.line, e.ts, s.line, s.ts)
+		}
+		if err := s.next(); err != nil {
+			t.Fatalf("unexpected err: %v", err)
+		}
+	}
+	if !s.done {
+		t.Fatalf("expected end of source")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bufio"
+	"io"
+	"strings"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	defaultLogPageSize = 100
+	maxLogPageSize     = 1000
+)
+
+// LogPage is a page of the lines of a log. The lines are numbered from 1 and
+// the page is empty when out of range
+type LogPage struct {
+	Page     int `json:"page"`
+	PageSize int `json:"page_size"`
+	// FirstLine and LastLine are the numbers of the first and last line of the
+	// page, they're 0 for an empty page
+	FirstLine int64 `json:"first_line"`
+	LastLine  int64 `json:"last_line"`
+
+	TotalLines int64 `json:"total_lines"`
+	TotalPages int64 `json:"total_pages"`
+	// Partial is true when the lines have been counted only in the first part
+	// of the log
+	Partial bool `json:"partial,omitempty"`
+
+	// Lines are the page lines without the line end. The step marker lines,
+	// when not requested, are omitted keeping the numbering of the other lines
+	Lines []*LogPageLine `json:"lines"`
+}
+
+type LogPageLine struct {
+	Number int64  `json:"number"`
+	Line   string `json:"line"`
+}
+
+// logPage returns the page, numbered from 1, of the log selected by sel. The
+// lines count is the one maintained while writing the log and the page first
+// line is located using the log line index.
+func (e *Executor) logPage(taskID string, sel *logSelector, page, pageSize int, rawMarkers bool) (*LogPage, error) {
+	stats, err := e.logStats(taskID, sel)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &LogPage{
+		Page:       page,
+		PageSize:   pageSize,
+		TotalLines: stats.Lines,
+		TotalPages: (stats.Lines + int64(pageSize) - 1) / int64(pageSize),
+		Partial:    stats.Partial,
+		Lines:      []*LogPageLine{},
+	}
+	first := int64(page-1) * int64(pageSize)
+	if first >= stats.Lines {
+		return p, nil
+	}
+	last := first + int64(pageSize)
+	if last > stats.Lines {
+		last = stats.Lines
+	}
+
+	logPath := e.logPath(taskID, sel)
+	f, err := e.openLog(taskID, logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	idx, err := e.logLineIndex(taskID, sel, logPath, f)
+	if err != nil {
+		return nil, err
+	}
+	start, err := logLineOffset(f, idx, first)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return nil, errors.Errorf("failed to seek in log file %q: %w", logPath, err)
+	}
+
+	br := bufio.NewReader(f)
+	for n := first + 1; n <= last; n++ {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if line == "" {
+			break
+		}
+		if p.FirstLine == 0 {
+			p.FirstLine = n
+		}
+		p.LastLine = n
+		if rawMarkers {
+			p.Lines = append(p.Lines, &LogPageLine{Number: n, Line: strings.TrimSuffix(line, "\n")})
+		} else if !isStepMarker([]byte(line)) {
+			p.Lines = append(p.Lines, &LogPageLine{Number: n, Line: strings.TrimSuffix(string(unescapeMarkerLine([]byte(line))), "\n")})
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return p, nil
+}
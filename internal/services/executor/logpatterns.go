@@ -0,0 +1,136 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// maxFailOnLogPatterns is the max number of fail on log patterns of a run
+	// step
+	maxFailOnLogPatterns = 32
+	// maxFailOnLogPatternLength is the max length of a fail on log pattern
+	maxFailOnLogPatternLength = 256
+)
+
+func validateFailOnLogPatterns(patterns []string) error {
+	if len(patterns) > maxFailOnLogPatterns {
+		return errors.Errorf("too many fail on log patterns, max %d", maxFailOnLogPatterns)
+	}
+	for _, p := range patterns {
+		if p == "" {
+			return errors.Errorf("empty fail on log pattern")
+		}
+		if len(p) > maxFailOnLogPatternLength {
+			return errors.Errorf("fail on log pattern %q exceeds the max length of %d", p, maxFailOnLogPatternLength)
+		}
+		if _, err := regexp.Compile(p); err != nil {
+			return errors.Errorf("invalid fail on log pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+// logPatternWriter writes to w matching every written line with the fail on
+// log patterns. Since the command output is written in arbitrary chunks the
+// data is matched only when a line is complete. Lines longer than maxLine are
+// matched in maxLine parts like they're split in the step log.
+type logPatternWriter struct {
+	w        io.Writer
+	patterns []*regexp.Regexp
+	sources  []string
+	maxLine  int
+
+	line []byte
+	// matched is the first matched pattern
+	matched string
+	m       sync.Mutex
+}
+
+// newLogPatternWriter returns a logPatternWriter. The patterns must have
+// already been validated.
+func newLogPatternWriter(w io.Writer, patterns []string, maxLine int) *logPatternWriter {
+	pw := &logPatternWriter{w: w, sources: patterns, maxLine: maxLine}
+	for _, p := range patterns {
+		pw.patterns = append(pw.patterns, regexp.MustCompile(p))
+	}
+	return pw
+}
+
+func (w *logPatternWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	n, err := w.w.Write(p)
+	if w.matched != "" {
+		return n, err
+	}
+	data := p[:n]
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		end := len(data)
+		if i >= 0 {
+			end = i
+		}
+		if room := w.maxLine - len(w.line); end > room {
+			w.line = append(w.line, data[:room]...)
+			data = data[room:]
+			w.match()
+			continue
+		}
+		w.line = append(w.line, data[:end]...)
+		if i < 0 {
+			break
+		}
+		data = data[i+1:]
+		w.match()
+	}
+	return n, err
+}
+
+// match matches the current line and resets it. The command markers aren't
+// matched since they contain the command text.
+func (w *logPatternWriter) match() {
+	if isStepMarker(w.line) {
+		w.line = w.line[:0]
+		return
+	}
+	line := unescapeMarkerLine(w.line)
+	for i, re := range w.patterns {
+		if re.Match(line) {
+			w.matched = w.sources[i]
+			break
+		}
+	}
+	w.line = w.line[:0]
+}
+
+// Matched matches the last partial line and returns the first matched
+// pattern or an empty string if no pattern matched. It must be called after
+// the command finished.
+func (w *logPatternWriter) Matched() string {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if w.matched == "" && len(w.line) > 0 {
+		w.match()
+	}
+	return w.matched
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxLogStatsScanSize is the max log data read to count the lines of a log
+// without a line count
+const maxLogStatsScanSize = 64 * 1024 * 1024
+
+// LogStats are the lines and size of a log. Partial is true when the lines
+// have been counted only in the first part of the log
+type LogStats struct {
+	Lines   int64 `json:"lines"`
+	Size    int64 `json:"size"`
+	Partial bool  `json:"partial,omitempty"`
+}
+
+func logLinesPath(logPath string) string {
+	return logPath + ".lines"
+}
+
+// lineCountWriter counts the lines written to the log. When closed the count
+// is saved, if savePath is defined, so it's available also after the log has
+// been written. A partial last line is counted as a line.
+type lineCountWriter struct {
+	io.WriteCloser
+	savePath string
+	// writeFile atomically writes the saved count file
+	writeFile func(p string, data []byte) error
+
+	lines     int64
+	lineStart bool
+	m         sync.Mutex
+}
+
+func newLineCountWriter(w io.WriteCloser, savePath string, writeFile func(p string, data []byte) error) *lineCountWriter {
+	return &lineCountWriter{WriteCloser: w, savePath: savePath, writeFile: writeFile, lineStart: true}
+}
+
+func (w *lineCountWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	n, err := w.WriteCloser.Write(p)
+	for _, c := range p[:n] {
+		if w.lineStart {
+			w.lines++
+		}
+		w.lineStart = c == '\n'
+	}
+	return n, err
+}
+
+func (w *lineCountWriter) Lines() int64 {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.lines
+}
+
+func (w *lineCountWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if w.savePath != "" {
+		if serr := w.writeFile(w.savePath, []byte(strconv.FormatInt(w.Lines(), 10))); serr != nil && err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// savedLogLines returns the saved lines count of the log at logPath, -1 if not
+// available
+func savedLogLines(logPath string) int64 {
+	data, err := ioutil.ReadFile(logLinesPath(logPath))
+	if err != nil {
+		return -1
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// logStats returns the stats of the log selected by sel. The lines are the
+// ones counted while writing the log, if not available, like for the logs
+// written by previous executor versions, they're counted building the log line
+// index or, for the logs still written, reading the log.
+func (e *Executor) logStats(taskID string, sel *logSelector) (*LogStats, error) {
+	logPath := e.logPath(taskID, sel)
+
+	// open the log before getting the lines so the lines count won't be
+	// greater than the read size
+	f, err := e.openLog(taskID, logPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines int64 = -1
+	if rt, ok := e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		if lw, ok := rt.logLines[logPath]; ok {
+			lines = lw.Lines()
+		}
+		rt.Unlock()
+	}
+
+	size, err := f.Size()
+	if err != nil {
+		return nil, err
+	}
+
+	if lines < 0 {
+		lines = savedLogLines(logPath)
+	}
+	if lines < 0 {
+		// building the line index of a finished log also saves its lines count
+		if _, err := e.logLineIndex(taskID, sel, logPath, f); err != nil {
+			return nil, err
+		}
+		lines = savedLogLines(logPath)
+	}
+	if lines >= 0 {
+		return &LogStats{Lines: lines, Size: size}, nil
+	}
+
+	stats := &LogStats{Size: size}
+	lineStart := true
+	var read int64
+	buf := make([]byte, 32*1024)
+	for read < maxLogStatsScanSize {
+		n, err := f.Read(buf)
+		data := buf[:n]
+		if read+int64(n) > maxLogStatsScanSize {
+			data = data[:maxLogStatsScanSize-read]
+		}
+		read += int64(len(data))
+		if len(data) > 0 {
+			if lineStart {
+				stats.Lines++
+			}
+			// every newline not at the end starts a new line
+			stats.Lines += int64(bytes.Count(data[:len(data)-1], []byte("\n")))
+			lineStart = data[len(data)-1] == '\n'
+		}
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+	}
+	stats.Partial = read < size
+	return stats, nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// logDurableOffsetHeader reports the log offset up to which the log has
+	// been synced to disk. The log content before it survives an executor
+	// host crash
+	logDurableOffsetHeader = "Agola-Log-Durable-Offset"
+
+	defaultLogSyncInterval = 1 * time.Second
+)
+
+// logDurablePath returns the path of the file, saved beside the log, recording
+// the log durable offset
+func logDurablePath(logPath string) string {
+	return logPath + ".durable"
+}
+
+// syncLogWriter is a log file periodically synced to disk. The syncs are
+// throttled to at most one every interval and are started by the writes, so
+// an idle log isn't synced again. After every sync the synced offset is
+// recorded as the log durable offset.
+type syncLogWriter struct {
+	f        *os.File
+	logPath  string
+	interval time.Duration
+	// writeFile atomically writes the durable offset file
+	writeFile func(p string, data []byte) error
+
+	m sync.Mutex
+	// written is the number of bytes written to the log
+	written int64
+	// durable is the offset up to which the log has been synced
+	durable int64
+	// recorded is true when the durable offset has been recorded at least
+	// once, so also an empty log has a durable offset
+	recorded bool
+	// timer is the timer of the scheduled sync, nil when there's no
+	// scheduled sync
+	timer  *time.Timer
+	closed bool
+
+	// syncM serializes the syncs so the durable offset is always increasing
+	syncM sync.Mutex
+}
+
+func newSyncLogWriter(f *os.File, logPath string, interval time.Duration, writeFile func(p string, data []byte) error) *syncLogWriter {
+	return &syncLogWriter{f: f, logPath: logPath, interval: interval, writeFile: writeFile}
+}
+
+func (w *syncLogWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+
+	w.m.Lock()
+	w.written += int64(n)
+	if w.timer == nil && !w.closed {
+		w.timer = time.AfterFunc(w.interval, w.scheduledSync)
+	}
+	w.m.Unlock()
+
+	return n, err
+}
+
+func (w *syncLogWriter) scheduledSync() {
+	w.m.Lock()
+	w.timer = nil
+	closed := w.closed
+	w.m.Unlock()
+	if closed {
+		return
+	}
+	if err := w.sync(); err != nil {
+		log.Errorf("failed to sync log %q: %+v", w.logPath, err)
+	}
+}
+
+// sync syncs the log and records the synced offset. The offset is taken
+// before the sync so all the bytes before it are on disk when the sync
+// returns
+func (w *syncLogWriter) sync() error {
+	w.syncM.Lock()
+	defer w.syncM.Unlock()
+
+	w.m.Lock()
+	offset := w.written
+	synced := w.recorded && offset == w.durable
+	w.m.Unlock()
+	if synced {
+		return nil
+	}
+
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	if err := w.writeFile(logDurablePath(w.logPath), []byte(strconv.FormatInt(offset, 10))); err != nil {
+		return err
+	}
+
+	w.m.Lock()
+	w.durable = offset
+	w.recorded = true
+	w.m.Unlock()
+	return nil
+}
+
+// durableOffset returns the offset up to which the log has been synced
+func (w *syncLogWriter) durableOffset() int64 {
+	w.m.Lock()
+	defer w.m.Unlock()
+	return w.durable
+}
+
+// Close syncs all the log content, so a closed log is always fully durable,
+// and closes the log
+func (w *syncLogWriter) Close() error {
+	w.m.Lock()
+	w.closed = true
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.m.Unlock()
+
+	serr := w.sync()
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	return serr
+}
+
+// syncLog returns the log file f periodically synced to disk or f if the log
+// sync is disabled. It must be called with the running task locked.
+func (e *Executor) syncLog(rt *runningTask, logPath string, f *os.File) io.WriteCloser {
+	if e.c.DisableLogSync {
+		return f
+	}
+	interval := e.c.LogSyncInterval
+	if interval == 0 {
+		interval = defaultLogSyncInterval
+	}
+	w := newSyncLogWriter(f, logPath, interval, rt.diskUsage.writeFile(e.writeDataFileAtomic))
+	if rt.logSyncs == nil {
+		rt.logSyncs = make(map[string]*syncLogWriter)
+	}
+	rt.logSyncs[logPath] = w
+	return w
+}
+
+// readLogDurableOffset returns the recorded durable offset of the log at
+// logPath. After an executor host crash the log content before it can be
+// trusted.
+func readLogDurableOffset(logPath string) (int64, error) {
+	data, err := ioutil.ReadFile(logDurablePath(logPath))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// logDurableOffset returns the durable offset of the log of the task at
+// logPath and false if it isn't known, like when the log sync is disabled or
+// the task doesn't persist its logs
+func (e *Executor) logDurableOffset(taskID, logPath string) (int64, bool) {
+	if rt, ok := e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		w, ok := rt.logSyncs[logPath]
+		rt.Unlock()
+		if ok {
+			return w.durableOffset(), true
+		}
+	}
+	offset, err := readLogDurableOffset(logPath)
+	if err != nil {
+		return 0, false
+	}
+	return offset, true
+}
@@ -0,0 +1,164 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// logLineSplitSuffix is appended to a line split since it exceeds the max log
+// line length. The remaining data continues on the next line
+const logLineSplitSuffix = " [line split]\n"
+
+// lineLimitWriter splits the lines longer than max. A max <= 0 means no limit
+type lineLimitWriter struct {
+	io.WriteCloser
+	max int
+	// cur is the length of the current line
+	cur int
+	m   sync.Mutex
+}
+
+func newLineLimitWriter(w io.WriteCloser, max int) *lineLimitWriter {
+	return &lineLimitWriter{WriteCloser: w, max: max}
+}
+
+func (w *lineLimitWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.max <= 0 {
+		return w.WriteCloser.Write(p)
+	}
+
+	n := len(p)
+	out := make([]byte, 0, len(p))
+	for len(p) > 0 {
+		chunk := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+		}
+		p = p[len(chunk):]
+
+		for {
+			content := len(chunk)
+			newline := content > 0 && chunk[content-1] == '\n'
+			if newline {
+				content--
+			}
+			room := w.max - w.cur
+			if content <= room {
+				out = append(out, chunk...)
+				if newline {
+					w.cur = 0
+				} else {
+					w.cur += content
+				}
+				break
+			}
+			out = append(out, chunk[:room]...)
+			out = append(out, logLineSplitSuffix...)
+			w.cur = 0
+			chunk = chunk[room:]
+		}
+	}
+
+	if _, err := w.WriteCloser.Write(out); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// lineRateLimitWriter drops the lines exceeding max lines per second. Only
+// whole lines are dropped, the number of dropped lines is reported in a notice
+// line written before the next accepted line. Step markers are never dropped.
+// A max <= 0 means no limit.
+type lineRateLimitWriter struct {
+	io.WriteCloser
+	max int
+
+	windowStart time.Time
+	// lines is the number of lines started in the current window
+	lines     int
+	lineStart bool
+	dropping  bool
+	dropped   int
+	m         sync.Mutex
+}
+
+func newLineRateLimitWriter(w io.WriteCloser, max int) *lineRateLimitWriter {
+	return &lineRateLimitWriter{WriteCloser: w, max: max, lineStart: true}
+}
+
+func (w *lineRateLimitWriter) droppedNotice() []byte {
+	notice := fmt.Sprintf("[rate limited: %d lines dropped]\n", w.dropped)
+	w.dropped = 0
+	return []byte(notice)
+}
+
+func (w *lineRateLimitWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	if w.max <= 0 {
+		return w.WriteCloser.Write(p)
+	}
+
+	n := len(p)
+	out := make([]byte, 0, len(p))
+
+	now := time.Now()
+	for len(p) > 0 {
+		chunk := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			chunk = p[:i+1]
+		}
+		p = p[len(chunk):]
+
+		if w.lineStart {
+			marker := bytes.HasPrefix(chunk, []byte(stepMarkerPrefix))
+			if !marker && now.Sub(w.windowStart) >= time.Second {
+				w.windowStart = now
+				w.lines = 0
+			}
+			w.dropping = !marker && w.lines >= w.max
+			if w.dropping {
+				w.dropped++
+			} else {
+				if !marker {
+					w.lines++
+				}
+				if w.dropped > 0 {
+					out = append(out, w.droppedNotice()...)
+				}
+			}
+		}
+		if !w.dropping {
+			out = append(out, chunk...)
+		}
+		w.lineStart = chunk[len(chunk)-1] == '\n'
+	}
+
+	if len(out) > 0 {
+		if _, err := w.WriteCloser.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,275 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+)
+
+// TaskManifest is the task information saved on disk in the task dir. It
+// doesn't contain the task spec since it could contain secrets.
+type TaskManifest struct {
+	TaskID   string `json:"task_id,omitempty"`
+	TaskName string `json:"task_name,omitempty"`
+
+	// Attempts are the task attempts with logs available
+	Attempts []int `json:"attempts,omitempty"`
+
+	// ReceivedTime is the time when the executor received the task
+	ReceivedTime *time.Time `json:"received_time,omitempty"`
+	// PodStartDuration is the time spent starting the task pod. It includes
+	// pulling the containers images
+	PodStartDuration time.Duration `json:"pod_start_duration,omitempty"`
+
+	Steps []*TaskManifestStep `json:"steps,omitempty"`
+	// Services are the names of the task service containers
+	Services []string `json:"services,omitempty"`
+
+	Status types.ExecutorTaskStatus `json:"status"`
+
+	// NoLogPersist is true when the task doesn't persist its logs. It's kept
+	// as a tombstone so the logs are reported as gone also when the task
+	// isn't running anymore
+	NoLogPersist bool `json:"no_log_persist,omitempty"`
+
+	// Resources is the task resource usage summary
+	Resources *TaskResources `json:"resources,omitempty"`
+}
+
+type TaskManifestStep struct {
+	Type string `json:"type,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+func (e *Executor) taskManifestPath(taskID string) string {
+	return filepath.Join(e.taskPath(taskID), "manifest.json")
+}
+
+// taskManifest generates the manifest of the running task. It must be called
+// with the running task locked.
+func (e *Executor) taskManifest(rt *runningTask) *TaskManifest {
+	et := rt.et
+	m := &TaskManifest{
+		TaskID:           et.ID,
+		TaskName:         et.Spec.TaskName,
+		Attempts:         rt.attempts,
+		ReceivedTime:     rt.receivedTime,
+		PodStartDuration: rt.podStartDuration,
+		Services:         taskServiceNames(et),
+		Status:           et.Status,
+		NoLogPersist:     et.Spec.NoLogPersist,
+		Resources:        rt.resources,
+	}
+	for _, step := range et.Spec.Steps {
+		ms := &TaskManifestStep{}
+		if bs := types.StepBase(step); bs != nil {
+			ms.Type = bs.Type
+			ms.Name = bs.Name
+		}
+		m.Steps = append(m.Steps, ms)
+	}
+	return m
+}
+
+// saveTaskManifest atomically writes the running task manifest when it
+// changed since the last save, like at the phase transitions. It must be
+// called with the running task locked.
+func (e *Executor) saveTaskManifest(rt *runningTask) error {
+	m := e.taskManifest(rt)
+	mj, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(mj, rt.manifest) {
+		return nil
+	}
+	if err := os.MkdirAll(e.taskPath(m.TaskID), 0770); err != nil {
+		return err
+	}
+	if err := e.writeDataFileAtomicFunc(e.taskManifestPath(m.TaskID), func(f io.Writer) error {
+		_, err := f.Write(mj)
+		return err
+	}); err != nil {
+		return err
+	}
+	rt.manifest = mj
+	return nil
+}
+
+// getTaskManifest returns the manifest of the task from the running task when
+// available or from the one saved on disk
+func (e *Executor) getTaskManifest(taskID string) (*TaskManifest, error) {
+	var mj []byte
+	if rt, ok := e.runningTasks.get(taskID); ok {
+		// marshal it with the running task locked since the status is shared
+		// with the running task
+		rt.Lock()
+		var err error
+		mj, err = json.Marshal(e.taskManifest(rt))
+		rt.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		mj, err = ioutil.ReadFile(e.taskManifestPath(taskID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	var m *TaskManifest
+	if err := json.Unmarshal(mj, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type TaskTimings struct {
+	TaskID string `json:"task_id"`
+
+	ReceivedTime *time.Time `json:"received_time,omitempty"`
+	StartTime    *time.Time `json:"start_time,omitempty"`
+	EndTime      *time.Time `json:"end_time,omitempty"`
+	// Duration is the task wall clock duration. If the task isn't finished
+	// it's the duration until now
+	Duration time.Duration `json:"duration"`
+
+	Setup *StepTimings   `json:"setup"`
+	Steps []*StepTimings `json:"steps"`
+
+	// CriticalPath are the names of the executed steps (and of the longest sub
+	// step of steps with parallel sub steps) that determined the task duration
+	CriticalPath []string `json:"critical_path"`
+}
+
+type StepTimings struct {
+	Name  string                  `json:"name,omitempty"`
+	Type  string                  `json:"type,omitempty"`
+	Phase types.ExecutorTaskPhase `json:"phase,omitempty"`
+
+	// QueuedTime is the time when the step was ready to be executed
+	QueuedTime *time.Time `json:"queued_time,omitempty"`
+	StartTime  *time.Time `json:"start_time,omitempty"`
+	EndTime    *time.Time `json:"end_time,omitempty"`
+
+	QueuedDuration time.Duration `json:"queued_duration"`
+	// ImagePullDuration is the time spent starting the pod (including image
+	// pulls). It's only reported by the setup step since the steps are
+	// executed inside the already started pod
+	ImagePullDuration time.Duration `json:"image_pull_duration"`
+	// ExecutionDuration is the step duration excluding the image pulls
+	ExecutionDuration time.Duration `json:"execution_duration"`
+	Duration          time.Duration `json:"duration"`
+
+	Substeps []*StepTimings `json:"substeps,omitempty"`
+}
+
+func durationBetween(start, end *time.Time, now time.Time) time.Duration {
+	if start == nil {
+		return 0
+	}
+	if end == nil {
+		return now.Sub(*start)
+	}
+	return end.Sub(*start)
+}
+
+func (m *TaskManifest) timings(now time.Time) *TaskTimings {
+	st := m.Status
+	t := &TaskTimings{
+		TaskID:       m.TaskID,
+		ReceivedTime: m.ReceivedTime,
+		StartTime:    st.StartTime,
+		EndTime:      st.EndTime,
+		Duration:     durationBetween(st.StartTime, st.EndTime, now),
+		Steps:        []*StepTimings{},
+		CriticalPath: []string{},
+	}
+
+	t.Setup = &StepTimings{
+		Name:       "setup",
+		Phase:      st.SetupStep.Phase,
+		QueuedTime: m.ReceivedTime,
+		StartTime:  st.SetupStep.StartTime,
+		EndTime:    st.SetupStep.EndTime,
+	}
+	t.Setup.QueuedDuration = durationBetween(t.Setup.QueuedTime, t.Setup.StartTime, now)
+	t.Setup.Duration = durationBetween(t.Setup.StartTime, t.Setup.EndTime, now)
+	t.Setup.ImagePullDuration = m.PodStartDuration
+	if t.Setup.ImagePullDuration > t.Setup.Duration {
+		t.Setup.ImagePullDuration = t.Setup.Duration
+	}
+	t.Setup.ExecutionDuration = t.Setup.Duration - t.Setup.ImagePullDuration
+
+	// steps are executed sequentially so a step is queued when the previous
+	// one ends
+	queuedTime := st.SetupStep.EndTime
+	for i, ss := range st.Steps {
+		s := &StepTimings{
+			Phase:     ss.Phase,
+			StartTime: ss.StartTime,
+			EndTime:   ss.EndTime,
+		}
+		if i < len(m.Steps) {
+			s.Name = m.Steps[i].Name
+			s.Type = m.Steps[i].Type
+		}
+		if ss.StartTime != nil {
+			s.QueuedTime = queuedTime
+			s.QueuedDuration = durationBetween(queuedTime, ss.StartTime, now)
+		}
+		s.Duration = durationBetween(ss.StartTime, ss.EndTime, now)
+		s.ExecutionDuration = s.Duration
+
+		var longest *StepTimings
+		for _, sss := range ss.Substeps {
+			subs := &StepTimings{
+				Name:      sss.Name,
+				Phase:     sss.Phase,
+				StartTime: sss.StartTime,
+				EndTime:   sss.EndTime,
+			}
+			subs.Duration = durationBetween(sss.StartTime, sss.EndTime, now)
+			subs.ExecutionDuration = subs.Duration
+			s.Substeps = append(s.Substeps, subs)
+			if longest == nil || subs.Duration > longest.Duration {
+				longest = subs
+			}
+		}
+
+		if ss.StartTime != nil && ss.Phase != types.ExecutorTaskPhaseSkipped {
+			if longest != nil {
+				t.CriticalPath = append(t.CriticalPath, s.Name+"/"+longest.Name)
+			} else {
+				t.CriticalPath = append(t.CriticalPath, s.Name)
+			}
+		}
+		if ss.EndTime != nil {
+			queuedTime = ss.EndTime
+		}
+
+		t.Steps = append(t.Steps, s)
+	}
+
+	return t
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/runservice/types"
+)
+
+func TestSaveTaskManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agola")
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	e := &Executor{c: &config.Executor{DataDir: dir}, fileMode: 0660, fileUID: -1, fileGID: -1}
+	et := newTestTask(runStep("true"))
+	rt := &runningTask{et: et, attempt: 1, attempts: []int{1}}
+
+	saved := func() bool {
+		_, err := os.Stat(e.taskManifestPath(et.ID))
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("unexpected err: %v", err)
+		}
+		return err == nil
+	}
+
+	if err := e.saveTaskManifest(rt); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !saved() {
+		t.Fatalf("expected the manifest to be saved")
+	}
+
+	// the unchanged manifest isn't saved again
+	if err := os.Remove(e.taskManifestPath(et.ID)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if err := e.saveTaskManifest(rt); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if saved() {
+		t.Fatalf("expected the unchanged manifest to not be saved")
+	}
+
+	// a phase transition saves the manifest
+	et.Status.Phase = types.ExecutorTaskPhaseRunning
+	et.Status.StartTime = util.TimeP(time.Now())
+	if err := e.saveTaskManifest(rt); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if !saved() {
+		t.Fatalf("expected the changed manifest to be saved")
+	}
+	mj, err := ioutil.ReadFile(e.taskManifestPath(et.ID))
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	var m *TaskManifest
+	if err := json.Unmarshal(mj, &m); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if m.Status.Phase != types.ExecutorTaskPhaseRunning {
+		t.Fatalf("expected phase %q, got %q", types.ExecutorTaskPhaseRunning, m.Status.Phase)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	archiveEvictionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "archive_evictions_total",
+		Help:      "Number of step archives removed to respect the max stored archives.",
+	})
+	openStreamFiles = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "open_stream_files",
+		Help:      "Number of log and archive files held open by the log follow and archive download requests.",
+	})
+	archiveDownloadsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "archive_downloads_in_flight",
+		Help:      "Number of archive downloads being served.",
+	})
+	logForwardDroppedLines = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "log_forward_dropped_lines_total",
+		Help:      "Number of step output lines not forwarded to syslog.",
+	})
+	logFollowBufferBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "log_follow_buffer_bytes",
+		Help:      "Estimated memory used by the buffers of the active log follow requests.",
+	})
+	logFollowsShedTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "log_follows_shed_total",
+		Help:      "Number of idle log follow requests closed to respect the log follow memory limit.",
+	})
+	admissionWebhookCallsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "admission_webhook_calls_total",
+		Help:      "Number of admission webhook calls by result (allowed, denied or failed).",
+	}, []string{"result"})
+	taskDiskQuotaExceededTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "task_disk_quota_exceeded_total",
+		Help:      "Number of tasks failed since they exceeded the task disk quota.",
+	})
+	archiveVolumeFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "agola",
+		Subsystem: "executor",
+		Name:      "archive_volume_failures_total",
+		Help:      "Number of step archive write failures by kind (transient or persistent).",
+	}, []string{"kind"})
+)
+
+func init() {
+	prometheus.MustRegister(archiveEvictionsTotal)
+	prometheus.MustRegister(openStreamFiles)
+	prometheus.MustRegister(archiveDownloadsInFlight)
+	prometheus.MustRegister(logForwardDroppedLines)
+	prometheus.MustRegister(logFollowBufferBytes)
+	prometheus.MustRegister(logFollowsShedTotal)
+	prometheus.MustRegister(admissionWebhookCallsTotal)
+	prometheus.MustRegister(taskDiskQuotaExceededTotal)
+	prometheus.MustRegister(archiveVolumeFailuresTotal)
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// streamLimiter limits the number of concurrent streaming requests. When the
+// max is reached the new requests are rejected while the current ones
+// continue. A max <= 0 means no limit.
+type streamLimiter struct {
+	max int
+	n   int
+	// gauge, if defined, reports the current number of requests
+	gauge prometheus.Gauge
+	m     sync.Mutex
+}
+
+func newStreamLimiter(max int, gauge prometheus.Gauge) *streamLimiter {
+	return &streamLimiter{max: max, gauge: gauge}
+}
+
+// acquire reserves a request slot. It returns false if the max has been
+// reached, otherwise the returned function must be called when the request
+// finished
+func (l *streamLimiter) acquire() (func(), bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.max > 0 && l.n >= l.max {
+		return nil, false
+	}
+	l.n++
+	l.setGauge()
+
+	return func() {
+		l.m.Lock()
+		defer l.m.Unlock()
+		l.n--
+		l.setGauge()
+	}, true
+}
+
+func (l *streamLimiter) setGauge() {
+	if l.gauge != nil {
+		l.gauge.Set(float64(l.n))
+	}
+}
+
+type streamKind int
+
+const (
+	streamLogFollow streamKind = iota
+	streamArchiveDownload
+)
+
+// acquireStream reserves a log follow or archive download slot and an open
+// file for a streaming request. When one of their max has been reached it
+// replies with a 503 and returns false.
+func (e *Executor) acquireStream(w http.ResponseWriter, taskID string, kind streamKind) (func(), bool) {
+	limiter, what := e.logFollows, "log follows"
+	if kind == streamArchiveDownload {
+		limiter, what = e.archiveDownloads, "archive downloads"
+	}
+
+	release, ok := limiter.acquire()
+	if !ok {
+		log.Warnf("rejecting request for task %q: reached the max of %d concurrent %s", taskID, limiter.max, what)
+		w.Header().Set("Retry-After", "5")
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, taskID, "too many concurrent "+what+", retry later")
+		return nil, false
+	}
+
+	releaseFile, ok := e.openFiles.acquire()
+	if !ok {
+		release()
+		log.Warnf("rejecting request for task %q: reached the max of %d open stream files", taskID, e.openFiles.max)
+		w.Header().Set("Retry-After", "5")
+		httpError(w, http.StatusServiceUnavailable, ErrorCodeUnavailable, taskID, "too many open files, retry later")
+		return nil, false
+	}
+
+	return func() {
+		releaseFile()
+		release()
+	}, true
+}
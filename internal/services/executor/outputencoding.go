@@ -0,0 +1,88 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io"
+	"sort"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	errors "golang.org/x/xerrors"
+)
+
+// outputEncodings are the supported run steps output encodings. A nil
+// encoding means that the output is already UTF-8
+var outputEncodings = map[string]encoding.Encoding{
+	"utf-8":        nil,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"windows-1250": charmap.Windows1250,
+	"windows-1251": charmap.Windows1251,
+	"windows-1252": charmap.Windows1252,
+	"cp437":        charmap.CodePage437,
+	"cp850":        charmap.CodePage850,
+	"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+}
+
+// outputEncodingAliases are the common alternative names of the supported
+// encodings
+var outputEncodingAliases = map[string]string{
+	"utf8":   "utf-8",
+	"latin1": "iso-8859-1",
+	"latin9": "iso-8859-15",
+	"cp1250": "windows-1250",
+	"cp1251": "windows-1251",
+	"cp1252": "windows-1252",
+}
+
+func lookupOutputEncoding(name string) (encoding.Encoding, error) {
+	name = strings.ToLower(name)
+	if alias, ok := outputEncodingAliases[name]; ok {
+		name = alias
+	}
+	enc, ok := outputEncodings[name]
+	if !ok {
+		names := make([]string, 0, len(outputEncodings))
+		for n := range outputEncodings {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, errors.Errorf("unsupported output encoding %q, supported encodings: %s", name, strings.Join(names, ", "))
+	}
+	return enc, nil
+}
+
+// newOutputDecoder returns a writer converting the step output, encoded with
+// the named encoding, to UTF-8 and writing it to w. It must be closed, without
+// closing w, to write the last partially encoded characters. When the output
+// is already UTF-8 it returns nil.
+func newOutputDecoder(w io.Writer, name string) (io.WriteCloser, error) {
+	if name == "" {
+		return nil, nil
+	}
+	enc, err := lookupOutputEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return nil, nil
+	}
+	return transform.NewWriter(w, enc.NewDecoder()), nil
+}
@@ -0,0 +1,334 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/internal/util"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	defaultLogPathTemplate     = "attempts/{attempt}/logs/{stream}.log"
+	defaultArchivePathTemplate = "archives/{step}.tar"
+)
+
+const (
+	pathPlaceholderTaskID  = "taskid"
+	pathPlaceholderAttempt = "attempt"
+	pathPlaceholderStream  = "stream"
+	pathPlaceholderStep    = "step"
+)
+
+// pathPlaceholderRegexps are the regular expressions matching the placeholders
+// values when parsing a path
+var pathPlaceholderRegexps = map[string]string{
+	pathPlaceholderTaskID:  `[^/]+`,
+	pathPlaceholderAttempt: `[1-9][0-9]*`,
+	pathPlaceholderStream:  `setup|steps/(?:0|[1-9][0-9]*)(?:/substeps/(?:0|[1-9][0-9]*))?|services/(?:0|[1-9][0-9]*)`,
+	pathPlaceholderStep:    `0|[1-9][0-9]*`,
+}
+
+var pathPlaceholderRegexp = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// pathVars are the values of the path template placeholders
+type pathVars struct {
+	taskID  string
+	attempt int
+	stream  string
+	step    int
+}
+
+// pathLayout is a path template, relative to the task dir, used to generate
+// the paths of a kind of task files and to parse them back when listing the
+// task dir
+type pathLayout struct {
+	template string
+	re       *regexp.Regexp
+	// placeholders are the template placeholders in the order of the regexp
+	// groups
+	placeholders []string
+}
+
+func newPathLayout(template, ext string, allowed, required []string) (*pathLayout, error) {
+	if template == "" {
+		return nil, errors.Errorf("empty path template")
+	}
+	if path.IsAbs(template) || filepath.IsAbs(template) || strings.Contains(template, `\`) {
+		return nil, errors.Errorf("path template %q must be a relative slash separated path", template)
+	}
+	if path.Clean(template) != template {
+		return nil, errors.Errorf("path template %q isn't a clean path", template)
+	}
+	for _, elem := range strings.Split(template, "/") {
+		if elem == ".." || elem == "." {
+			return nil, errors.Errorf("path template %q must not contain %q elements", template, elem)
+		}
+	}
+	if !strings.HasSuffix(template, ext) || strings.HasSuffix(template, "/"+ext) || template == ext {
+		return nil, errors.Errorf("path template %q file name must end with %q", template, ext)
+	}
+
+	l := &pathLayout{template: template}
+	var re strings.Builder
+	re.WriteString("^")
+	prev := 0
+	for _, m := range pathPlaceholderRegexp.FindAllStringSubmatchIndex(template, -1) {
+		name := template[m[2]:m[3]]
+		if !util.StringInSlice(allowed, name) {
+			return nil, errors.Errorf("path template %q has unknown placeholder %q, allowed placeholders: %s", template, name, strings.Join(allowed, ", "))
+		}
+		if util.StringInSlice(l.placeholders, name) {
+			return nil, errors.Errorf("path template %q has duplicate placeholder %q", template, name)
+		}
+		if prev > 0 && m[0] == prev {
+			return nil, errors.Errorf("path template %q placeholders must be separated", template)
+		}
+		re.WriteString(regexp.QuoteMeta(template[prev:m[0]]))
+		re.WriteString("(" + pathPlaceholderRegexps[name] + ")")
+		l.placeholders = append(l.placeholders, name)
+		prev = m[1]
+	}
+	literal := template[prev:]
+	if strings.ContainsAny(pathPlaceholderRegexp.ReplaceAllString(template, ""), "{}") {
+		return nil, errors.Errorf("path template %q has unbalanced braces", template)
+	}
+	re.WriteString(regexp.QuoteMeta(literal))
+	re.WriteString("$")
+	for _, name := range required {
+		if !util.StringInSlice(l.placeholders, name) {
+			return nil, errors.Errorf("path template %q must contain the {%s} placeholder", template, name)
+		}
+	}
+
+	var err error
+	l.re, err = regexp.Compile(re.String())
+	if err != nil {
+		return nil, errors.Errorf("path template %q: %w", template, err)
+	}
+	return l, nil
+}
+
+// path returns the slash separated path, relative to the task dir, generated
+// from the template
+func (l *pathLayout) path(v *pathVars) string {
+	return strings.NewReplacer(
+		"{"+pathPlaceholderTaskID+"}", v.taskID,
+		"{"+pathPlaceholderAttempt+"}", strconv.Itoa(v.attempt),
+		"{"+pathPlaceholderStream+"}", v.stream,
+		"{"+pathPlaceholderStep+"}", strconv.Itoa(v.step),
+	).Replace(l.template)
+}
+
+// parse returns the placeholders values of the slash separated path p,
+// relative to the dir of the task taskID. It returns false if p hasn't been
+// generated by the template.
+func (l *pathLayout) parse(taskID, p string) (*pathVars, bool) {
+	m := l.re.FindStringSubmatch(p)
+	if m == nil {
+		return nil, false
+	}
+	v := &pathVars{taskID: taskID}
+	for i, name := range l.placeholders {
+		value := m[i+1]
+		switch name {
+		case pathPlaceholderTaskID:
+			if value != taskID {
+				return nil, false
+			}
+		case pathPlaceholderAttempt:
+			v.attempt, _ = strconv.Atoi(value)
+		case pathPlaceholderStream:
+			v.stream = value
+		case pathPlaceholderStep:
+			v.step, _ = strconv.Atoi(value)
+		}
+	}
+	return v, true
+}
+
+// newPathLayouts returns the logs and archives path layouts. Since the paths
+// are parsed to list the task logs and archives, the layouts are checked
+// generating the paths of a sample of logs and archives: every path must be
+// distinct, parsed back to the same values and not be the directory of
+// another path.
+func newPathLayouts(c config.ExecutorPathLayout) (*pathLayout, *pathLayout, error) {
+	logTemplate := c.Log
+	if logTemplate == "" {
+		logTemplate = defaultLogPathTemplate
+	}
+	archiveTemplate := c.Archive
+	if archiveTemplate == "" {
+		archiveTemplate = defaultArchivePathTemplate
+	}
+
+	logLayout, err := newPathLayout(logTemplate, ".log",
+		[]string{pathPlaceholderTaskID, pathPlaceholderAttempt, pathPlaceholderStream},
+		[]string{pathPlaceholderAttempt, pathPlaceholderStream})
+	if err != nil {
+		return nil, nil, errors.Errorf("invalid executor pathLayout log: %w", err)
+	}
+	archiveLayout, err := newPathLayout(archiveTemplate, ".tar",
+		[]string{pathPlaceholderTaskID, pathPlaceholderStep},
+		[]string{pathPlaceholderStep})
+	if err != nil {
+		return nil, nil, errors.Errorf("invalid executor pathLayout archive: %w", err)
+	}
+
+	const taskID = "d6e8c1b0-5b1a-4c1e-9a3e-2f0c7a9b4e21"
+	paths := map[string]string{}
+	add := func(l *pathLayout, v *pathVars, desc string) error {
+		p := l.path(v)
+		if other, ok := paths[p]; ok {
+			return errors.Errorf("%s and %s have the same path %q", other, desc, p)
+		}
+		paths[p] = desc
+		pv, ok := l.parse(taskID, p)
+		if !ok || *pv != *v {
+			return errors.Errorf("the path %q of %s is ambiguous", p, desc)
+		}
+		return nil
+	}
+	for _, attempt := range []int{1, 2, 10, 11} {
+		for _, stream := range []string{setupLogStream, stepLogStream(0), stepLogStream(1), stepLogStream(10), stepLogStream(11), substepLogStream(1, 0), substepLogStream(1, 1), substepLogStream(11, 1), serviceLogStream(1), serviceLogStream(11)} {
+			if err := add(logLayout, &pathVars{taskID: taskID, attempt: attempt, stream: stream}, fmt.Sprintf("attempt %d log %s", attempt, stream)); err != nil {
+				return nil, nil, errors.Errorf("invalid executor pathLayout: %w", err)
+			}
+		}
+	}
+	for _, step := range []int{0, 1, 10, 11} {
+		if err := add(archiveLayout, &pathVars{taskID: taskID, step: step}, fmt.Sprintf("step %d archive", step)); err != nil {
+			return nil, nil, errors.Errorf("invalid executor pathLayout: %w", err)
+		}
+	}
+	sorted := make([]string, 0, len(paths))
+	for p := range paths {
+		sorted = append(sorted, p)
+	}
+	sort.Strings(sorted)
+	for _, p := range sorted {
+		for _, dir := range sorted {
+			if strings.HasPrefix(p, dir+"/") {
+				return nil, nil, errors.Errorf("invalid executor pathLayout: the path %q of %s is a directory of %s", dir, paths[dir], paths[p])
+			}
+		}
+		if p == "manifest.json" {
+			return nil, nil, errors.Errorf("invalid executor pathLayout: the path of %s is reserved", paths[p])
+		}
+	}
+	return logLayout, archiveLayout, nil
+}
+
+const setupLogStream = "setup"
+
+func stepLogStream(step int) string {
+	return fmt.Sprintf("steps/%d", step)
+}
+
+func substepLogStream(step, substep int) string {
+	return fmt.Sprintf("steps/%d/substeps/%d", step, substep)
+}
+
+// parseSubstepLogStream returns the step and sub step of a sub step log stream
+func parseSubstepLogStream(stream string) (int, int, bool) {
+	parts := strings.Split(stream, "/")
+	if len(parts) != 4 || parts[0] != "steps" || parts[2] != "substeps" {
+		return 0, 0, false
+	}
+	step, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, false
+	}
+	substep, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return 0, 0, false
+	}
+	return step, substep, true
+}
+
+func serviceLogStream(index int) string {
+	return fmt.Sprintf("services/%d", index)
+}
+
+// taskFile is a task log or archive found in the task dir
+type taskFile struct {
+	path string
+	*pathVars
+}
+
+// findTaskFiles returns the files in the task dir generated by the path
+// layout l, sorted by path
+func (e *Executor) findTaskFiles(taskID string, l *pathLayout) ([]*taskFile, error) {
+	taskDir := e.taskPath(taskID)
+	var files []*taskFile
+	err := filepath.Walk(taskDir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(taskDir, p)
+		if err != nil {
+			return err
+		}
+		if v, ok := l.parse(taskID, filepath.ToSlash(rel)); ok {
+			files = append(files, &taskFile{path: p, pathVars: v})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// taskLogs returns the logs saved in the task dir
+func (e *Executor) taskLogs(taskID string) ([]*taskFile, error) {
+	return e.findTaskFiles(taskID, e.logLayout)
+}
+
+// removeTaskLog removes the log at logPath with its indexes.
+func (e *Executor) removeTaskLog(taskID, logPath string) error {
+	for _, p := range []string{logPath, logIndexPath(logPath), logLineIndexPath(logPath), logLinesPath(logPath), logCommandsPath(logPath), logDurablePath(logPath)} {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	e.removeEmptyDirs(taskID, filepath.Dir(logPath))
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents, up to the task dir excluded,
+// while they're empty
+func (e *Executor) removeEmptyDirs(taskID, dir string) {
+	taskDir := e.taskPath(taskID)
+	for dir != taskDir && strings.HasPrefix(dir, taskDir+string(filepath.Separator)) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
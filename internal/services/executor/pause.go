@@ -0,0 +1,171 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// startTaskTimeout starts the task timeout timer, when expired the running
+// task will be cancelled like when stopping it.
+// It must be called with the running task locked.
+func (e *Executor) startTaskTimeout(rt *runningTask, d time.Duration) {
+	et := rt.et
+	et.Status.Deadline = util.TimeP(time.Now().Add(d))
+	rt.timeoutTimer = time.AfterFunc(d, func() {
+		rt.Lock()
+		defer rt.Unlock()
+		log.Infof("task %s timed out after %s", et.ID, et.Spec.Timeout)
+		rt.timedOut = true
+		rt.cancel()
+	})
+}
+
+// stopTaskTimeout stops the task timeout timer and returns the time left
+// before its expiration.
+// It must be called with the running task locked.
+func (rt *runningTask) stopTaskTimeout() time.Duration {
+	if rt.timeoutTimer == nil {
+		return 0
+	}
+	rt.timeoutTimer.Stop()
+	rt.timeoutTimer = nil
+	if rt.et.Status.Deadline == nil {
+		return 0
+	}
+	remaining := time.Until(*rt.et.Status.Deadline)
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining
+}
+
+// runningStep returns the index of the step currently executing or -1
+func runningStep(et *types.ExecutorTask, phase types.ExecutorTaskPhase) int {
+	for i, s := range et.Status.Steps {
+		if s.Phase == phase {
+			return i
+		}
+	}
+	return -1
+}
+
+// pauseTask freezes the task pod. The task timeout is suspended until the task
+// is resumed. A task in the setup phase can be paused only after the setup
+// finished since the running task is locked during the whole setup.
+func (e *Executor) pauseTask(ctx context.Context, taskID string) error {
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return util.NewErrNotExist(errors.Errorf("task %q not running", taskID))
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	et := rt.et
+	if et.Status.Phase != types.ExecutorTaskPhaseRunning || rt.pod == nil || rt.ctx.Err() != nil {
+		return util.NewErrBadRequest(errors.Errorf("task %q not running", taskID))
+	}
+	if rt.paused {
+		return util.NewErrBadRequest(errors.Errorf("task %q already paused", taskID))
+	}
+
+	if err := rt.pod.Pause(ctx); err != nil {
+		return err
+	}
+	rt.paused = true
+	et.Status.Paused = true
+
+	if et.Spec.Timeout > 0 {
+		rt.timeoutRemaining = rt.stopTaskTimeout()
+		// the remaining time doesn't change while paused
+		et.Status.Deadline = nil
+		et.Status.RemainingTime = &rt.timeoutRemaining
+	}
+
+	now := time.Now()
+	stepIndex := runningStep(et, types.ExecutorTaskPhaseRunning)
+	if stepIndex >= 0 {
+		et.Status.Steps[stepIndex].Phase = types.ExecutorTaskPhasePaused
+	}
+	if rt.stepLog != nil {
+		if err := rt.stepLog.writeMarker(fmt.Sprintf("Task paused at %s\n", now.UTC().Format(time.RFC3339))); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+	}
+	log.Infof("task %s paused", taskID)
+
+	if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
+		log.Errorf("err: %+v", err)
+	}
+	if stepIndex >= 0 {
+		e.events.publishStepPhase(et, stepIndex)
+	}
+	return nil
+}
+
+// resumeTask unfreezes a paused task pod and restarts the task timeout with
+// the time left when the task was paused
+func (e *Executor) resumeTask(ctx context.Context, taskID string) error {
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return util.NewErrNotExist(errors.Errorf("task %q not running", taskID))
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	et := rt.et
+	if !rt.paused {
+		return util.NewErrBadRequest(errors.Errorf("task %q not paused", taskID))
+	}
+
+	if err := rt.pod.Unpause(ctx); err != nil {
+		return err
+	}
+	rt.paused = false
+	et.Status.Paused = false
+
+	if et.Spec.Timeout > 0 {
+		e.startTaskTimeout(rt, rt.timeoutRemaining)
+	}
+
+	now := time.Now()
+	stepIndex := runningStep(et, types.ExecutorTaskPhasePaused)
+	if stepIndex >= 0 {
+		et.Status.Steps[stepIndex].Phase = types.ExecutorTaskPhaseRunning
+	}
+	if rt.stepLog != nil {
+		if err := rt.stepLog.writeMarker(fmt.Sprintf("Task resumed at %s\n", now.UTC().Format(time.RFC3339))); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+	}
+	log.Infof("task %s resumed", taskID)
+
+	if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
+		log.Errorf("err: %+v", err)
+	}
+	if stepIndex >= 0 {
+		e.events.publishStepPhase(et, stepIndex)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/internal/services/executor/driver"
+)
+
+// platformServiceLogs reports if the service containers output is left to the
+// platform logging instead of being captured
+func (e *Executor) platformServiceLogs() bool {
+	return e.c.ContainerLogs.Mode == config.ContainerLogsPlatform
+}
+
+// podLogDriver returns the configured platform log driver of the task
+// containers, nil to use the platform default
+func (e *Executor) podLogDriver() *driver.LogDriver {
+	if e.c.ContainerLogs.Driver == "" {
+		return nil
+	}
+	return &driver.LogDriver{
+		Type:    e.c.ContainerLogs.Driver,
+		Options: e.c.ContainerLogs.DriverOptions,
+	}
+}
+
+// readPlatformServiceLogs writes the output of a service container read back
+// from the platform. It's available only while the task pod exists, and only
+// for its current attempt, since the platform logs are removed with it.
+func (h *logsHandler) readPlatformServiceLogs(ctx context.Context, taskID string, sel *logSelector, w http.ResponseWriter, opts *readLogsOptions) error {
+	var pod driver.Pod
+	if rt, ok := h.e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		if rt.attempt == sel.attempt {
+			pod = rt.pod
+		}
+		rt.Unlock()
+	}
+	if pod == nil {
+		httpError(w, http.StatusGone, ErrorCodeLogGone, taskID, "service log not available anymore")
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-opts.follower.shedC():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var out io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok && opts.follow {
+		flusher.Flush()
+		out = &flushWriter{w: w, f: flusher}
+	}
+	if err := pod.ContainerLogs(ctx, sel.serviceIndex, &driver.ContainerLogsOptions{Follow: opts.follow}, opts.follower.writer(out)); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// flushWriter flushes every write to the client
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.f.Flush()
+	return n, err
+}
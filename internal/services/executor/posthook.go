@@ -0,0 +1,66 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+const defaultPostTaskHookTimeout = 1 * time.Minute
+
+// runPostTaskHook executes the configured post task hook with the finished
+// task result. Errors are only logged.
+func (e *Executor) runPostTaskHook(result *TaskHistoryEntry) {
+	if len(e.c.PostTaskHook) == 0 {
+		return
+	}
+
+	timeout := e.c.PostTaskHookTimeout
+	if timeout == 0 {
+		timeout = defaultPostTaskHookTimeout
+	}
+	// the task context could be already cancelled (task stopped or timed out)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resultj, err := json.Marshal(result)
+	if err != nil {
+		log.Errorf("failed to marshal task %s result: %+v", result.TaskID, err)
+		return
+	}
+
+	cmd := exec.CommandContext(ctx, e.c.PostTaskHook[0], e.c.PostTaskHook[1:]...)
+	cmd.Env = append(os.Environ(),
+		"AGOLA_TASK_ID="+result.TaskID,
+		"AGOLA_TASK_NAME="+result.TaskName,
+		"AGOLA_TASK_ATTEMPT="+strconv.Itoa(result.Attempt),
+		"AGOLA_TASK_PHASE="+string(result.Phase),
+		fmt.Sprintf("AGOLA_TASK_DURATION=%d", int64(result.Duration.Seconds())),
+	)
+	cmd.Stdin = bytes.NewReader(resultj)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		log.Errorf("post task hook for task %s failed: %v, output: %s", result.TaskID, err, out)
+		return
+	}
+	log.Debugf("post task hook for task %s output: %s", result.TaskID, out)
+}
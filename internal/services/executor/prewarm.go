@@ -0,0 +1,156 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/services/executor/driver"
+	"agola.io/agola/internal/util"
+
+	errors "golang.org/x/xerrors"
+)
+
+type PrewarmPhase string
+
+const (
+	PrewarmPhasePending PrewarmPhase = "pending"
+	PrewarmPhasePulling PrewarmPhase = "pulling"
+	PrewarmPhaseSuccess PrewarmPhase = "success"
+	PrewarmPhaseFailed  PrewarmPhase = "failed"
+)
+
+// PrewarmImageStatus is the status of the pull of an image to prewarm
+type PrewarmImageStatus struct {
+	Image     string       `json:"image"`
+	Phase     PrewarmPhase `json:"phase"`
+	Error     string       `json:"error,omitempty"`
+	StartTime *time.Time   `json:"start_time,omitempty"`
+	EndTime   *time.Time   `json:"end_time,omitempty"`
+}
+
+// imagePrewarmer keeps the images to prewarm and their pull status. The
+// images are pulled one at a time to not slow down the running tasks.
+type imagePrewarmer struct {
+	images  map[string]*PrewarmImageStatus
+	pending []string
+	// notify is signaled when an image is queued
+	notify chan struct{}
+	m      sync.Mutex
+}
+
+func newImagePrewarmer() *imagePrewarmer {
+	return &imagePrewarmer{
+		images: make(map[string]*PrewarmImageStatus),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// add queues the images to pull. Images already queued or being pulled are
+// skipped, the other ones are pulled again to get their latest version.
+func (p *imagePrewarmer) add(images []string) []*PrewarmImageStatus {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	statuses := make([]*PrewarmImageStatus, 0, len(images))
+	for _, image := range images {
+		s, ok := p.images[image]
+		if !ok || (s.Phase != PrewarmPhasePending && s.Phase != PrewarmPhasePulling) {
+			s = &PrewarmImageStatus{Image: image, Phase: PrewarmPhasePending}
+			p.images[image] = s
+			p.pending = append(p.pending, image)
+		}
+		sc := *s
+		statuses = append(statuses, &sc)
+	}
+
+	select {
+	case p.notify <- struct{}{}:
+	default:
+	}
+	return statuses
+}
+
+// next marks the first queued image as being pulled and returns it. It
+// returns an empty string if there're no queued images
+func (p *imagePrewarmer) next() string {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if len(p.pending) == 0 {
+		return ""
+	}
+	image := p.pending[0]
+	p.pending = p.pending[1:]
+	s := p.images[image]
+	s.Phase = PrewarmPhasePulling
+	s.StartTime = util.TimeP(time.Now())
+	return image
+}
+
+func (p *imagePrewarmer) done(image string, err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	s := p.images[image]
+	s.EndTime = util.TimeP(time.Now())
+	if err != nil {
+		s.Phase = PrewarmPhaseFailed
+		s.Error = err.Error()
+		return
+	}
+	s.Phase = PrewarmPhaseSuccess
+}
+
+// list returns the status of all the prewarmed images sorted by image
+func (p *imagePrewarmer) list() []*PrewarmImageStatus {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	statuses := make([]*PrewarmImageStatus, 0, len(p.images))
+	for _, s := range p.images {
+		sc := *s
+		statuses = append(statuses, &sc)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Image < statuses[j].Image })
+	return statuses
+}
+
+// imagePrewarmLoop pulls the queued images to prewarm
+func (e *Executor) imagePrewarmLoop(ctx context.Context) {
+	for {
+		for image := e.prewarmer.next(); image != ""; image = e.prewarmer.next() {
+			log.Infof("prewarming image %q", image)
+			err := e.driver.PullImage(ctx, image, nil, ioutil.Discard)
+			if err != nil {
+				if errors.Is(err, driver.ErrNotSupported) {
+					err = errors.Errorf("the executor driver cannot prewarm images")
+				}
+				log.Errorf("failed to prewarm image %q: %+v", image, err)
+			}
+			e.prewarmer.done(image, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.prewarmer.notify:
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"path"
+	"strings"
+
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// readOnlyRootFSTmpDir is the dir of the tmpfs mounted in a main container
+// with a read-only root filesystem. The toolbox writes the steps commands
+// there and the scratch and secret files dirs are inside it
+const readOnlyRootFSTmpDir = "/tmp"
+
+func mainContainerReadOnly(et *types.ExecutorTask) bool {
+	return len(et.Spec.Containers) > 0 && et.Spec.Containers[0].ReadOnlyRootFS
+}
+
+// mainContainerWritableDirs returns the dirs writable in a main container with
+// a read-only root filesystem
+func mainContainerWritableDirs(et *types.ExecutorTask) []string {
+	dirs := []string{readOnlyRootFSTmpDir}
+	for _, v := range et.Spec.Containers[0].Volumes {
+		dirs = append(dirs, path.Clean(v.Path))
+	}
+	return dirs
+}
+
+// validateReadOnlyRootFS checks that, with a read-only main container root
+// filesystem, the paths written by the steps are inside its writable dirs.
+// The home dir isn't known before the task starts so the paths relative to it
+// are rejected. The writes done by the step commands cannot be checked, they
+// fail with a read-only file system error.
+func validateReadOnlyRootFS(et *types.ExecutorTask) error {
+	if !mainContainerReadOnly(et) {
+		return nil
+	}
+	dirs := mainContainerWritableDirs(et)
+
+	writable := func(p string) bool {
+		p = path.Clean(p)
+		for _, dir := range dirs {
+			if p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/") {
+				return true
+			}
+		}
+		return false
+	}
+	// check checks a path resolved, if relative, from the task working dir
+	check := func(what, p string) error {
+		resolved := p
+		if !path.IsAbs(p) && !strings.HasPrefix(p, "~") {
+			if et.Spec.WorkingDir == "" {
+				return errors.Errorf("%s %q must be absolute since the task doesn't define a working dir and the main container root filesystem is read-only", what, p)
+			}
+			resolved = path.Join(et.Spec.WorkingDir, p)
+		}
+		if !path.IsAbs(resolved) {
+			return errors.Errorf("%s %q must be an absolute path since the main container root filesystem is read-only", what, p)
+		}
+		if !writable(resolved) {
+			return errors.Errorf("%s %q is not in a writable dir, the main container root filesystem is read-only and only %s are writable", what, p, strings.Join(dirs, ", "))
+		}
+		return nil
+	}
+
+	if et.Spec.WorkingDir != "" {
+		if err := check("working dir", et.Spec.WorkingDir); err != nil {
+			return err
+		}
+	}
+	for _, f := range et.Spec.SecretFiles {
+		if err := check("secret file", f.Path); err != nil {
+			return err
+		}
+	}
+	for i, step := range et.Spec.Steps {
+		var err error
+		switch s := step.(type) {
+		case *types.RunStep:
+			if s.WorkingDir != "" {
+				err = check("working dir", s.WorkingDir)
+			}
+		case *types.RestoreWorkspaceStep:
+			err = check("destination dir", s.DestDir)
+		case *types.RestoreCacheStep:
+			err = check("destination dir", s.DestDir)
+		}
+		if err != nil {
+			return errors.Errorf("step %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"io"
+	"regexp"
+	"sync"
+
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	maxRedactionRules = 32
+	// maxRedactionRuleLength is the max length of a rule regex and of its
+	// replacement
+	maxRedactionRuleLength = 1024
+)
+
+type redactionRule struct {
+	re          *regexp.Regexp
+	replacement []byte
+}
+
+// compileRedactionRules compiles the task redaction rules. The rules are
+// rejected when too many or too long, when the regex is invalid or when it
+// matches the empty string, since it would insert the replacement everywhere.
+func compileRedactionRules(rules []types.RedactionRule) ([]*redactionRule, error) {
+	if len(rules) > maxRedactionRules {
+		return nil, errors.Errorf("too many redaction rules, max %d", maxRedactionRules)
+	}
+	crules := make([]*redactionRule, len(rules))
+	for i, r := range rules {
+		if len(r.Regex) > maxRedactionRuleLength || len(r.Replacement) > maxRedactionRuleLength {
+			return nil, errors.Errorf("redaction rule %d: regex and replacement max length is %d", i, maxRedactionRuleLength)
+		}
+		re, err := regexp.Compile(r.Regex)
+		if err != nil {
+			return nil, errors.Errorf("redaction rule %d: invalid regex: %w", i, err)
+		}
+		if re.MatchString("") {
+			return nil, errors.Errorf("redaction rule %d: regex %q matches the empty string", i, r.Regex)
+		}
+		crules[i] = &redactionRule{re: re, replacement: []byte(r.Replacement)}
+	}
+	return crules, nil
+}
+
+// newStepRedactWriter returns a writer redacting the step output written to w,
+// or nil if the task has no secret files or redaction rules
+func (e *Executor) newStepRedactWriter(t *types.ExecutorTask, stepIndex int, w io.Writer) *redactWriter {
+	if len(t.Spec.SecretFiles) == 0 && len(t.Spec.RedactionRules) == 0 {
+		return nil
+	}
+	var masks []string
+	if len(t.Spec.SecretFiles) > 0 {
+		masks = secretFileMasks(t, stepIndex)
+	}
+	// the rules have been validated at submission
+	rules, err := compileRedactionRules(t.Spec.RedactionRules)
+	if err != nil {
+		log.Errorf("err: %+v", err)
+	}
+	return newRedactWriter(w, masks, rules, e.c.MaxLogLineLength)
+}
+
+// redactWriter writes to w the data with the secret files paths and contents
+// replaced by a mask and then with the redaction rules applied line by line.
+// Masking before applying the rules ensures that a rule replacement cannot
+// reveal a secret. Since a secret or a rule match could be split between the
+// written chunks the data is written only when a line is complete, or it's
+// longer than maxLine, and the last partial line when flushed.
+type redactWriter struct {
+	w       io.Writer
+	masks   [][]byte
+	rules   []*redactionRule
+	maxLine int
+
+	line []byte
+	m    sync.Mutex
+}
+
+func newRedactWriter(w io.Writer, masks []string, rules []*redactionRule, maxLine int) *redactWriter {
+	rw := &redactWriter{w: w, rules: rules, maxLine: maxLine}
+	for _, m := range masks {
+		if m == "" {
+			continue
+		}
+		rw.masks = append(rw.masks, []byte(m))
+	}
+	return rw
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	w.line = append(w.line, p...)
+	// carriage returns are also handled as line ends to not delay the
+	// progress bars output
+	end := bytes.LastIndexAny(w.line, "\n\r") + 1
+	if len(w.line)-end >= w.maxLine {
+		end = len(w.line)
+	}
+	if end == 0 {
+		return len(p), nil
+	}
+	if err := w.write(end); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// write writes the redacted first n bytes of the buffered data
+func (w *redactWriter) write(n int) error {
+	data := w.line[:n]
+	for _, m := range w.masks {
+		data = bytes.Replace(data, m, []byte(secretMask), -1)
+	}
+	if len(w.rules) > 0 {
+		lines := bytes.SplitAfter(data, []byte("\n"))
+		for i, l := range lines {
+			// the line end is kept out of the rules reach
+			content := bytes.TrimRight(l, "\r\n")
+			end := l[len(content):]
+			for _, r := range w.rules {
+				content = r.re.ReplaceAll(content, r.replacement)
+			}
+			lines[i] = append(content, end...)
+		}
+		data = bytes.Join(lines, nil)
+	}
+	_, err := w.w.Write(data)
+	w.line = append(w.line[:0], w.line[n:]...)
+	return err
+}
+
+// Flush writes the last partial line. It must be called after the command
+// finished.
+func (w *redactWriter) Flush() error {
+	w.m.Lock()
+	defer w.m.Unlock()
+	if len(w.line) == 0 {
+		return nil
+	}
+	return w.write(len(w.line))
+}
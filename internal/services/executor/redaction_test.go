@@ -0,0 +1,157 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"agola.io/agola/services/runservice/types"
+)
+
+func TestCompileRedactionRules(t *testing.T) {
+	tooManyRules := make([]types.RedactionRule, maxRedactionRules+1)
+	for i := range tooManyRules {
+		tooManyRules[i] = types.RedactionRule{Regex: fmt.Sprintf("rule%d", i)}
+	}
+
+	tests := []struct {
+		name  string
+		rules []types.RedactionRule
+		err   bool
+	}{
+		{name: "no rules"},
+		{name: "valid rules", rules: []types.RedactionRule{{Regex: `[a-z]+@example\.com`, Replacement: "<email>"}, {Regex: `host-(\d+)`, Replacement: "host-$1"}}},
+		{name: "max rules", rules: tooManyRules[:maxRedactionRules]},
+		{name: "too many rules", rules: tooManyRules, err: true},
+		{name: "too long regex", rules: []types.RedactionRule{{Regex: strings.Repeat("a", maxRedactionRuleLength+1)}}, err: true},
+		{name: "too long replacement", rules: []types.RedactionRule{{Regex: "a", Replacement: strings.Repeat("a", maxRedactionRuleLength+1)}}, err: true},
+		{name: "invalid regex", rules: []types.RedactionRule{{Regex: "a(b"}}, err: true},
+		{name: "regex matching the empty string", rules: []types.RedactionRule{{Regex: "a*"}}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRedactionRules(tt.rules)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if len(rules) != len(tt.rules) {
+				t.Fatalf("expected %d rules, got %d", len(tt.rules), len(rules))
+			}
+		})
+	}
+}
+
+func TestRedactWriter(t *testing.T) {
+	tests := []struct {
+		name    string
+		masks   []string
+		rules   []types.RedactionRule
+		maxLine int
+		writes  []string
+		out     string
+	}{
+		{
+			name:   "rule replacement",
+			rules:  []types.RedactionRule{{Regex: `[a-z]+@example\.com`, Replacement: "<email>"}},
+			writes: []string{"mail from john@example.com to jane@example.com\n"},
+			out:    "mail from <email> to <email>\n",
+		},
+		{
+			name:   "rule replacement with submatches",
+			rules:  []types.RedactionRule{{Regex: `([a-z0-9]+)\.internal\.example\.com`, Replacement: "$1.<internal>"}},
+			writes: []string{"connecting to db01.internal.example.com\n"},
+			out:    "connecting to db01.<internal>\n",
+		},
+		{
+			name:   "rules applied in order",
+			rules:  []types.RedactionRule{{Regex: "foo", Replacement: "bar"}, {Regex: "bar", Replacement: "baz"}},
+			writes: []string{"foo\n"},
+			out:    "baz\n",
+		},
+		{
+			name:   "match split between writes",
+			rules:  []types.RedactionRule{{Regex: `[a-z]+@example\.com`, Replacement: "<email>"}},
+			writes: []string{"user: jo", "hn@exam", "ple.com\nother line\n"},
+			out:    "user: <email>\nother line\n",
+		},
+		{
+			name:   "line ends out of the rules reach",
+			rules:  []types.RedactionRule{{Regex: `\s+$`, Replacement: ""}, {Regex: `\s`, Replacement: "_"}},
+			writes: []string{"a b  \nc d\r\n"},
+			out:    "a_b\nc_d\r\n",
+		},
+		{
+			name:   "secrets masked before applying the rules",
+			masks:  []string{"s3cr3tvalue"},
+			rules:  []types.RedactionRule{{Regex: "s3cr3t", Replacement: "SECRET"}, {Regex: `\*+`, Replacement: "[masked]"}},
+			writes: []string{"the secret is s3cr3t", "value\n"},
+			out:    "the secret is [masked]\n",
+		},
+		{
+			name:   "partial last line written on flush",
+			rules:  []types.RedactionRule{{Regex: "foo", Replacement: "bar"}},
+			writes: []string{"foo\n", "last foo"},
+			out:    "bar\nlast bar",
+		},
+		{
+			name:    "line longer than max line",
+			rules:   []types.RedactionRule{{Regex: "foo", Replacement: "bar"}},
+			maxLine: 8,
+			writes:  []string{"foo foo fo", "o foo\n"},
+			out:     "bar bar foo bar\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRedactionRules(tt.rules)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			maxLine := tt.maxLine
+			if maxLine == 0 {
+				maxLine = 1024
+			}
+
+			var out bytes.Buffer
+			w := newRedactWriter(&out, tt.masks, rules, maxLine)
+			for _, p := range tt.writes {
+				n, err := w.Write([]byte(p))
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				if n != len(p) {
+					t.Fatalf("expected %d bytes written, got %d", len(p), n)
+				}
+			}
+			if err := w.Flush(); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if out.String() != tt.out {
+				t.Fatalf("expected output %q, got %q", tt.out, out.String())
+			}
+		})
+	}
+}
@@ -85,6 +85,78 @@ func GetRegistry(image string) (string, error) {
 	return regName, nil
 }
 
+// ImageRepository returns the registry (i.e. "index.docker.io") and the
+// repository inside it (i.e. "library/alpine") of image
+func ImageRepository(image string) (string, string, error) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", "", err
+	}
+	return ref.Context().RegistryStr(), ref.Context().RepositoryStr(), nil
+}
+
+// NormalizeImage returns the fully qualified reference of image (i.e.
+// "alpine" becomes "index.docker.io/library/alpine:latest"). defaultTag is
+// true when the image has no tag or digest and the latest tag has been used.
+// The tag of a digest pinned image with a tag ("name:tag@sha256:...") is kept
+// so it can be verified against the digest.
+func NormalizeImage(image string) (normalized string, defaultTag bool, err error) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", false, err
+	}
+	if _, ok := ref.(name.Digest); ok {
+		repo, tag, digest, err := ImageDigest(image)
+		if err != nil {
+			return "", false, err
+		}
+		if tag != "" {
+			return repo + ":" + tag + "@" + digest, false, nil
+		}
+		return repo + "@" + digest, false, nil
+	}
+	if _, ok := ref.(name.Tag); ok {
+		// the tag is the part after the last ":" when it isn't a registry
+		// port
+		parts := strings.Split(image, ":")
+		last := parts[len(parts)-1]
+		defaultTag = len(parts) == 1 || strings.Contains(last, "/")
+		if !defaultTag && last == "" {
+			return "", false, errors.Errorf("empty tag in image reference %q", image)
+		}
+	}
+	return ref.Name(), defaultTag, nil
+}
+
+// ImageDigest splits a digest pinned image ("name@sha256:..." or
+// "name:tag@sha256:...") in its fully qualified repository, its optional tag
+// and its digest. The digest is empty if the image isn't digest pinned.
+func ImageDigest(image string) (repo, tag, digest string, err error) {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return "", "", "", err
+	}
+	repo = ref.Context().Name()
+	d, ok := ref.(name.Digest)
+	if !ok {
+		return repo, "", "", nil
+	}
+	digest = d.DigestStr()
+	if !strings.HasPrefix(digest, "sha256:") {
+		return "", "", "", errors.Errorf("unsupported digest algorithm in image reference %q", image)
+	}
+
+	base := strings.TrimSuffix(image, "@"+digest)
+	// the tag is the part after the last ":" when it isn't a registry port
+	if i := strings.LastIndex(base, ":"); i >= 0 && !strings.Contains(base[i+1:], "/") {
+		tag = base[i+1:]
+		if tag == "" {
+			return "", "", "", errors.Errorf("empty tag in image reference %q", image)
+		}
+	}
+	return repo, tag, digest, nil
+}
+
 // ResolveAuth resolves the auth username and password for the provided registry name
 func ResolveAuth(auths map[string]types.DockerRegistryAuth, regname string) (string, string, error) {
 	if auths != nil {
@@ -0,0 +1,211 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"agola.io/agola/internal/services/executor/driver"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	defaultTaskResourcesInterval = 10 * time.Second
+	minTaskResourcesInterval     = 1 * time.Second
+)
+
+// TaskResources is the resource usage summary of the task main container,
+// aggregated from the stats sampled while the steps are running. The cpu time
+// and network counters are the ones of the container since its start, so they
+// also include the setup and the time between the steps, up to the last
+// sample.
+type TaskResources struct {
+	// Supported is false when the executor driver cannot report the
+	// container stats
+	Supported bool `json:"supported"`
+	// Samples is the number of stats samples
+	Samples int `json:"samples"`
+
+	PeakMemory     uint64        `json:"peak_memory"`
+	CPUTime        time.Duration `json:"cpu_time"`
+	CPUSeconds     float64       `json:"cpu_seconds"`
+	NetworkRxBytes uint64        `json:"network_rx_bytes"`
+	NetworkTxBytes uint64        `json:"network_tx_bytes"`
+
+	// Steps are the resource usage of the executed steps, by step index
+	Steps []*StepResources `json:"steps"`
+}
+
+// StepResources is the resource usage of the task main container while the
+// step was running. The usage after the step last sample isn't accounted, a
+// step shorter than the sampling interval only has its start sample.
+type StepResources struct {
+	Samples int `json:"samples"`
+
+	PeakMemory     uint64        `json:"peak_memory"`
+	CPUTime        time.Duration `json:"cpu_time"`
+	CPUSeconds     float64       `json:"cpu_seconds"`
+	NetworkRxBytes uint64        `json:"network_rx_bytes"`
+	NetworkTxBytes uint64        `json:"network_tx_bytes"`
+}
+
+func newTaskResources(steps int) *TaskResources {
+	return &TaskResources{
+		Supported: true,
+		Steps:     make([]*StepResources, steps),
+	}
+}
+
+// add adds a step sample to the resources. first is the step start sample
+func (r *TaskResources) add(step int, first, s *driver.ContainerStats) {
+	r.Samples++
+	if s.MemoryUsage > r.PeakMemory {
+		r.PeakMemory = s.MemoryUsage
+	}
+	// the counters are cumulative, the last sample has the task totals
+	r.CPUTime = s.CPUTime
+	r.CPUSeconds = s.CPUTime.Seconds()
+	r.NetworkRxBytes = s.NetworkRxBytes
+	r.NetworkTxBytes = s.NetworkTxBytes
+
+	sr := r.Steps[step]
+	if sr == nil {
+		sr = &StepResources{}
+		r.Steps[step] = sr
+	}
+	sr.Samples++
+	if s.MemoryUsage > sr.PeakMemory {
+		sr.PeakMemory = s.MemoryUsage
+	}
+	// a counter lower than the step start one has been reset, like when the
+	// container restarted, and isn't accounted
+	if s.CPUTime >= first.CPUTime {
+		sr.CPUTime = s.CPUTime - first.CPUTime
+		sr.CPUSeconds = sr.CPUTime.Seconds()
+	}
+	if s.NetworkRxBytes >= first.NetworkRxBytes {
+		sr.NetworkRxBytes = s.NetworkRxBytes - first.NetworkRxBytes
+	}
+	if s.NetworkTxBytes >= first.NetworkTxBytes {
+		sr.NetworkTxBytes = s.NetworkTxBytes - first.NetworkTxBytes
+	}
+}
+
+// stepResourcesSampler samples the stats of the task main container while a
+// step is running
+type stepResourcesSampler struct {
+	cancel context.CancelFunc
+	doneCh chan struct{}
+}
+
+// startStepResourcesSampler starts sampling the step resources usage. The
+// samples are added to the running task resources.
+func (e *Executor) startStepResourcesSampler(rt *runningTask, pod driver.Pod, step int) *stepResourcesSampler {
+	interval := e.c.TaskResourcesInterval
+	if interval == 0 {
+		interval = defaultTaskResourcesInterval
+	}
+	if interval < minTaskResourcesInterval {
+		interval = minTaskResourcesInterval
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &stepResourcesSampler{cancel: cancel, doneCh: make(chan struct{})}
+	go func() {
+		defer close(s.doneCh)
+
+		var first *driver.ContainerStats
+		for {
+			stats, err := pod.Stats(ctx)
+			if err != nil {
+				if errors.Is(err, driver.ErrNotSupported) {
+					rt.Lock()
+					rt.resources.Supported = false
+					rt.Unlock()
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				log.Warnf("failed to get task %s step %d stats: %v", rt.et.ID, step, err)
+			} else {
+				if first == nil {
+					first = stats
+				}
+				rt.Lock()
+				rt.resources.add(step, first, stats)
+				rt.Unlock()
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return s
+}
+
+// stop stops the sampler and waits for the sampling in progress. It must be
+// called with the running task unlocked.
+func (s *stepResourcesSampler) stop() {
+	s.cancel()
+	<-s.doneCh
+}
+
+type taskResourcesHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTaskResourcesHandler(logger *zap.Logger, e *Executor) *taskResourcesHandler {
+	return &taskResourcesHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns the task resources usage summary saved in the task
+// manifest. For a running task it's the usage sampled until now.
+func (h *taskResourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	taskID := mux.Vars(r)["taskid"]
+
+	m, err := h.e.getTaskManifest(taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task not found")
+		} else {
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+	// tasks executed by previous executor versions have no resources
+	if m.Resources == nil {
+		httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, "task resources not available")
+		return
+	}
+
+	if err := httpResponse(w, http.StatusOK, m.Resources); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
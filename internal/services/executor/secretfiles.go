@@ -0,0 +1,160 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+
+	"agola.io/agola/internal/services/executor/driver"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	// secretFilesDir is the main container tmpfs dir where the secret files
+	// are written. The secret files paths are symlinks to them
+	secretFilesDir = "/tmp/agola-secrets"
+
+	maxSecretFiles = 64
+	// maxSecretFilesSize is the max total size of the decoded secret files
+	maxSecretFilesSize = 1024 * 1024
+	// secretFilesTmpfsSize leaves room for the files blocks rounding
+	secretFilesTmpfsSize = 2 * maxSecretFilesSize
+
+	defaultSecretFileMode = 0400
+
+	// secretMaskMinLength is the min length of a secret file content line to
+	// be masked in the logs. Shorter lines, like the braces of a json file,
+	// would mask unrelated output.
+	secretMaskMinLength = 8
+	secretMask          = "***"
+)
+
+func validateSecretFiles(files []types.SecretFile) error {
+	if len(files) > maxSecretFiles {
+		return errors.Errorf("too many secret files, max %d", maxSecretFiles)
+	}
+	size := 0
+	paths := map[string]struct{}{}
+	for _, f := range files {
+		if !path.IsAbs(f.Path) || path.Clean(f.Path) != f.Path || f.Path == "/" {
+			return errors.Errorf("secret file path %q must be an absolute clean path", f.Path)
+		}
+		if f.Path == secretFilesDir || strings.HasPrefix(f.Path, secretFilesDir+"/") {
+			return errors.Errorf("secret file path %q cannot be inside %q", f.Path, secretFilesDir)
+		}
+		if _, ok := paths[f.Path]; ok {
+			return errors.Errorf("duplicate secret file path %q", f.Path)
+		}
+		paths[f.Path] = struct{}{}
+		if f.Mode&^0777 != 0 {
+			return errors.Errorf("secret file %q invalid mode %o", f.Path, f.Mode)
+		}
+		data, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return errors.Errorf("secret file %q content isn't valid base64: %w", f.Path, err)
+		}
+		size += len(data)
+	}
+	if size > maxSecretFilesSize {
+		return errors.Errorf("secret files total size exceeds %d bytes", maxSecretFilesSize)
+	}
+	return nil
+}
+
+// secretFileMasks returns the strings to mask in the step logs: the secret
+// files paths and contents lines
+func secretFileMasks(t *types.ExecutorTask, stepIndex int) []string {
+	masks := []string{stepSecretFilesDir(stepIndex)}
+	for _, f := range t.Spec.SecretFiles {
+		masks = append(masks, f.Path, f.Content)
+		// the content has been validated
+		data, _ := base64.StdEncoding.DecodeString(f.Content)
+		for _, l := range strings.Split(string(data), "\n") {
+			if l = strings.TrimSpace(l); len(l) >= secretMaskMinLength {
+				masks = append(masks, l)
+			}
+		}
+	}
+	// longer masks first since they could contain the shorter ones
+	sort.Slice(masks, func(i, j int) bool { return len(masks[i]) > len(masks[j]) })
+	return masks
+}
+
+func stepSecretFilesDir(stepIndex int) string {
+	return path.Join(secretFilesDir, fmt.Sprintf("step-%d", stepIndex))
+}
+
+// writeSecretFiles writes the secret files of a run step in the tmpfs secret
+// files dir and creates at the secret files paths a symlink to them, replacing
+// existing files. It returns the paths to remove when the step finishes.
+func (e *Executor) writeSecretFiles(ctx context.Context, t *types.ExecutorTask, pod driver.Pod, stepIndex int) ([]string, error) {
+	dir := stepSecretFilesDir(stepIndex)
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	// the archive is extracted in the container root dir
+	if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir[1:], Mode: 0700}); err != nil {
+		return nil, err
+	}
+	paths := []string{dir}
+	for i, f := range t.Spec.SecretFiles {
+		data, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return nil, err
+		}
+		mode := int64(f.Mode)
+		if mode == 0 {
+			mode = defaultSecretFileMode
+		}
+		filePath := path.Join(dir, fmt.Sprintf("%d", i))
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: filePath[1:], Mode: mode, Size: int64(len(data))}); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: f.Path[1:], Linkname: filePath}); err != nil {
+			return nil, err
+		}
+		paths = append(paths, f.Path)
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+
+	// don't report the files paths in the step log
+	if err := e.unarchive(ctx, t, &buf, pod, ioutil.Discard, "/", true, false); err != nil {
+		// remove the files written before the error
+		e.removeSecretFiles(ctx, t, pod, paths)
+		return nil, err
+	}
+	return paths, nil
+}
+
+func (e *Executor) removeSecretFiles(ctx context.Context, t *types.ExecutorTask, pod driver.Pod, paths []string) {
+	if err := e.removeDir(ctx, t, pod, ioutil.Discard, paths...); err != nil {
+		log.Errorf("failed to remove task %q secret files: %+v", t.ID, err)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"agola.io/agola/internal/services/executor/driver"
+
+	uuid "github.com/satori/go.uuid"
+	errors "golang.org/x/xerrors"
+)
+
+const (
+	selfTestImage         = "busybox"
+	selfTestTaskIDPrefix  = "selftest-"
+	selfTestOutput        = "agola executor selftest"
+	selfTestArchiveFile   = "selftest.txt"
+	selfTestStageDriver   = "driver"
+	selfTestStageExec     = "exec"
+	selfTestStageLog      = "log"
+	selfTestStageArchive  = "archive"
+	selfTestStageCleanup  = "cleanup"
+	selfTestArchiveLength = 1024
+)
+
+type SelfTestStage struct {
+	Name     string        `json:"name"`
+	Success  bool          `json:"success"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+}
+
+type SelfTestReport struct {
+	Success   bool             `json:"success"`
+	StartTime time.Time        `json:"start_time"`
+	Duration  time.Duration    `json:"duration"`
+	Stages    []*SelfTestStage `json:"stages"`
+}
+
+// selfTests tracks the running self test so the pods cleaner won't remove its
+// pod and only one self test is executed at a time
+type selfTests struct {
+	taskID string
+	m      sync.Mutex
+}
+
+func (s *selfTests) start(taskID string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.taskID != "" {
+		return false
+	}
+	s.taskID = taskID
+	return true
+}
+
+func (s *selfTests) end() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.taskID = ""
+}
+
+func (s *selfTests) isRunning(taskID string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.taskID != "" && s.taskID == taskID
+}
+
+func (e *Executor) selfTestDir() string {
+	return filepath.Join(e.c.DataDir, "selftest")
+}
+
+// selfTest executes a canary task end to end: it starts a pod using a trivial
+// image, executes a command inside it, writes and reads back a log and an
+// archive.
+func (e *Executor) selfTest(ctx context.Context) (*SelfTestReport, error) {
+	taskID := selfTestTaskIDPrefix + uuid.NewV4().String()
+	if !e.selfTests.start(taskID) {
+		return nil, errors.Errorf("a self test is already running")
+	}
+	defer e.selfTests.end()
+
+	report := &SelfTestReport{
+		StartTime: time.Now(),
+		Success:   true,
+	}
+	stage := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		s := &SelfTestStage{
+			Name:     name,
+			Success:  err == nil,
+			Duration: time.Since(start),
+		}
+		if err != nil {
+			s.Error = err.Error()
+			report.Success = false
+		}
+		report.Stages = append(report.Stages, s)
+		return err == nil
+	}
+	defer func() {
+		report.Duration = time.Since(report.StartTime)
+	}()
+
+	dir := filepath.Join(e.selfTestDir(), taskID)
+	defer os.RemoveAll(dir)
+
+	var pod driver.Pod
+	defer func() {
+		if pod == nil {
+			return
+		}
+		stage(selfTestStageCleanup, func() error {
+			return pod.Remove(context.Background())
+		})
+	}()
+
+	var podOut bytes.Buffer
+	if !stage(selfTestStageDriver, func() error {
+		podConfig := &driver.PodConfig{
+			ID:            uuid.NewV4().String(),
+			TaskID:        taskID,
+			InitVolumeDir: toolboxContainerDir,
+			Containers: []*driver.ContainerConfig{
+				{
+					Image: selfTestImage,
+					Cmd:   []string{toolboxContainerPath, "sleeper"},
+				},
+			},
+		}
+		var err error
+		pod, err = e.driver.NewPod(ctx, podConfig, &podOut)
+		if err != nil {
+			return errors.Errorf("failed to start pod: %w", err)
+		}
+		return nil
+	}) {
+		return report, nil
+	}
+
+	var execOut bytes.Buffer
+	if !stage(selfTestStageExec, func() error {
+		ce, err := pod.Exec(ctx, &driver.ExecConfig{
+			Cmd:    []string{"echo", selfTestOutput},
+			Stdout: &execOut,
+			Stderr: &execOut,
+		})
+		if err != nil {
+			return err
+		}
+		exitCode, err := ce.Wait(ctx)
+		if err != nil {
+			return err
+		}
+		if exitCode != 0 {
+			return errors.Errorf("command exited with code %d", exitCode)
+		}
+		if !strings.Contains(execOut.String(), selfTestOutput) {
+			return errors.Errorf("unexpected command output %q", execOut.String())
+		}
+		return nil
+	}) {
+		return report, nil
+	}
+
+	stage(selfTestStageLog, func() error {
+		logPath := filepath.Join(dir, "logs", "selftest.log")
+		if err := os.MkdirAll(filepath.Dir(logPath), 0770); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(logPath, execOut.Bytes(), 0660); err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(logPath)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, execOut.Bytes()) {
+			return errors.Errorf("log content mismatch")
+		}
+		return nil
+	})
+
+	stage(selfTestStageArchive, func() error {
+		archivePath := filepath.Join(dir, "archives", "selftest.tar")
+		if err := os.MkdirAll(filepath.Dir(archivePath), 0770); err != nil {
+			return err
+		}
+		content := bytes.Repeat([]byte("a"), selfTestArchiveLength)
+
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: selfTestArchiveFile, Mode: 0600, Size: int64(len(content))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(content); err != nil {
+			return err
+		}
+		if err := tw.Close(); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(archivePath, buf.Bytes(), 0660); err != nil {
+			return err
+		}
+
+		f, err := os.Open(archivePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		tr := tar.NewReader(f)
+		hdr, err := tr.Next()
+		if err != nil {
+			return err
+		}
+		if hdr.Name != selfTestArchiveFile {
+			return errors.Errorf("unexpected archive entry %q", hdr.Name)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, content) {
+			return errors.Errorf("archive content mismatch")
+		}
+		return nil
+	})
+
+	return report, nil
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"agola.io/agola/internal/services/executor/driver"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// serviceName returns the name of the service container at index (> 0) in the
+// task containers
+func serviceName(index int, c *types.Container) string {
+	if c.Name != "" {
+		return c.Name
+	}
+	return fmt.Sprintf("service%d", index)
+}
+
+// taskServiceNames returns the names of the task service containers
+func taskServiceNames(et *types.ExecutorTask) []string {
+	var names []string
+	for i, c := range et.Spec.Containers {
+		if i == 0 {
+			continue
+		}
+		names = append(names, serviceName(i, c))
+	}
+	return names
+}
+
+func validateServiceNames(et *types.ExecutorTask) error {
+	names := map[string]struct{}{}
+	for _, name := range taskServiceNames(et) {
+		if _, ok := names[name]; ok {
+			return errors.Errorf("duplicate service container name %q", name)
+		}
+		names[name] = struct{}{}
+	}
+	return nil
+}
+
+func (e *Executor) serviceLogPath(taskID string, attempt, index int) string {
+	return e.taskLogPath(taskID, attempt, serviceLogStream(index))
+}
+
+// taskServiceIndex returns the index in the task containers of the service
+// container with the provided name
+func (e *Executor) taskServiceIndex(taskID, name string) (int, error) {
+	var names []string
+	if rt, ok := e.runningTasks.get(taskID); ok {
+		rt.Lock()
+		names = taskServiceNames(rt.et)
+		rt.Unlock()
+	} else {
+		m, err := e.getTaskManifest(taskID)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return 0, util.NewErrNotExist(errors.Errorf("task not found"))
+			}
+			return 0, err
+		}
+		names = m.Services
+	}
+	for i, n := range names {
+		if n == name {
+			return i + 1, nil
+		}
+	}
+	return 0, util.NewErrNotExist(errors.Errorf("service %q not found", name))
+}
+
+// captureServiceLogs saves the output of the task service containers in their
+// logs until they exit or the pod is removed. Nothing is saved when the output
+// is left to the platform logging. It must be called with the running task
+// locked.
+func (e *Executor) captureServiceLogs(ctx context.Context, rt *runningTask, pod driver.Pod) error {
+	if e.platformServiceLogs() {
+		return nil
+	}
+	for i := range rt.et.Spec.Containers {
+		if i == 0 {
+			continue
+		}
+		logf, err := e.createLog(rt, e.serviceLogPath(rt.et.ID, rt.attempt, i))
+		if err != nil {
+			return err
+		}
+		go func(i int, logf *markedLogWriter) {
+			defer logf.Close()
+			e.followServiceLogs(ctx, rt.et.ID, pod, i, logf)
+		}(i, newMarkedLogWriter(logf))
+	}
+	return nil
+}
+
+const (
+	serviceLogsReattachMinDelay = 1 * time.Second
+	serviceLogsReattachMaxDelay = 30 * time.Second
+	// serviceLogsMaxReattaches is the max number of consecutive reattaches
+	// without receiving new output
+	serviceLogsMaxReattaches = 10
+)
+
+// followServiceLogs saves the output of the service container at index until
+// it exits or ctx is done. When the output stream breaks, like when the docker
+// daemon restarts, it's reattached from the capture time, provided by the
+// platform, of the last received line. A reattach marker is written before the
+// first line received after reattaching. The output lines that look like a
+// marker are escaped.
+func (e *Executor) followServiceLogs(ctx context.Context, taskID string, pod driver.Pod, index int, logf *markedLogWriter) {
+	esc := newMarkerEscapeWriter(logf)
+	defer esc.Flush()
+	tw := &timestampStripWriter{w: esc}
+	opts := &driver.ContainerLogsOptions{Follow: true, Timestamps: true}
+	delay := serviceLogsReattachMinDelay
+	reattaches := 0
+	for {
+		written := tw.lines
+		err := pod.ContainerLogs(ctx, index, opts, tw)
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		if tw.lines != written {
+			delay = serviceLogsReattachMinDelay
+			reattaches = 0
+		}
+		if reattaches >= serviceLogsMaxReattaches {
+			log.Errorf("failed to capture task %q service container %d logs: %+v", taskID, index, err)
+			return
+		}
+		log.Warnf("task %q service container %d logs stream broken, reattaching in %s: %+v", taskID, index, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		reattaches++
+		if delay *= 2; delay > serviceLogsReattachMaxDelay {
+			delay = serviceLogsReattachMaxDelay
+		}
+
+		tw.reattach(func() error {
+			if err := esc.Flush(); err != nil {
+				return err
+			}
+			return logf.writeLogReattached()
+		})
+		opts.Since = tw.last
+	}
+}
+
+// maxLogTimestampLength is longer than the RFC3339Nano timestamps
+const maxLogTimestampLength = 64
+
+// timestampStripWriter removes the capture time prefixed by the platform to
+// the container output lines, keeping the one of the last line. When a line
+// longer than the platform log message size is split its following parts
+// keep their capture time.
+type timestampStripWriter struct {
+	w io.Writer
+
+	// last is the capture time of the last received line, lastLines the
+	// number of received lines with that capture time and lines the number of
+	// received lines
+	last      time.Time
+	lastLines int
+	lines     int64
+	// after, when not zero, skips the lines captured before it and the first
+	// afterLines lines captured at it since they've been already received
+	// before reattaching the stream. Lines with the same capture time are
+	// received in the same order.
+	after      time.Time
+	afterLines int
+	// reattached, when defined, is called before writing the first line
+	// after reattaching the stream
+	reattached func() error
+
+	inLine    bool
+	skip      bool
+	timestamp []byte
+}
+
+// reattach prepares the writer for a stream reattached from the last line
+// capture time
+func (w *timestampStripWriter) reattach(reattached func() error) {
+	w.after = w.last
+	w.afterLines = w.lastLines
+	w.reattached = reattached
+	w.inLine = false
+	w.skip = false
+	w.timestamp = w.timestamp[:0]
+}
+
+func (w *timestampStripWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if !w.inLine {
+			i := bytes.IndexByte(p, ' ')
+			if i < 0 && len(w.timestamp)+len(p) <= maxLogTimestampLength {
+				w.timestamp = append(w.timestamp, p...)
+				return n, nil
+			}
+			w.inLine = true
+			w.skip = false
+			var prefix []byte
+			if i >= 0 {
+				w.timestamp = append(w.timestamp, p[:i]...)
+				p = p[i+1:]
+			}
+			ts, err := time.Parse(time.RFC3339Nano, string(w.timestamp))
+			switch {
+			case i < 0 || err != nil:
+				// not a timestamp, keep it
+				prefix = append([]byte{}, w.timestamp...)
+				if i >= 0 {
+					prefix = append(prefix, ' ')
+				}
+			case !w.after.IsZero() && ts.Before(w.after):
+				w.skip = true
+			case !w.after.IsZero() && ts.Equal(w.after) && w.afterLines > 0:
+				w.afterLines--
+				w.skip = true
+			default:
+				if ts.Equal(w.last) {
+					w.lastLines++
+				} else {
+					w.last = ts
+					w.lastLines = 1
+				}
+			}
+			w.timestamp = w.timestamp[:0]
+			if !w.skip {
+				w.lines++
+				if err := w.write(prefix); err != nil {
+					return 0, err
+				}
+			}
+		}
+
+		line := p
+		if i := bytes.IndexByte(p, '\n'); i >= 0 {
+			line = p[:i+1]
+			w.inLine = false
+		}
+		if !w.skip {
+			if err := w.write(line); err != nil {
+				return 0, err
+			}
+		}
+		p = p[len(line):]
+	}
+	return n, nil
+}
+
+func (w *timestampStripWriter) write(p []byte) error {
+	if w.reattached != nil {
+		if err := w.reattached(); err != nil {
+			return err
+		}
+		w.reattached = nil
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	_, err := w.w.Write(p)
+	return err
+}
@@ -0,0 +1,91 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTimestampStripWriter(t *testing.T) {
+	tests := []struct {
+		name string
+		// writes are written before reattaching, reattachWrites after
+		// reattaching the stream
+		writes         []string
+		reattachWrites []string
+		out            string
+	}{
+		{
+			name:   "lines",
+			writes: []string{"2020-01-01T00:00:00.1Z line01\n2020-01-01T00:00:00.2Z line02\n"},
+			out:    "line01\nline02\n",
+		},
+		{
+			name:   "timestamps split across writes",
+			writes: []string{"2020-01-01T00:0", "0:00.1Z line01\n2020-01-01T00:00:00.2Z", " line", "02\n"},
+			out:    "line01\nline02\n",
+		},
+		{
+			name:   "line without timestamp",
+			writes: []string{"notatimestamp line01\n"},
+			out:    "notatimestamp line01\n",
+		},
+		{
+			name:           "reattached lines already received are skipped",
+			writes:         []string{"2020-01-01T00:00:00.1Z line01\n2020-01-01T00:00:00.2Z line02\n"},
+			reattachWrites: []string{"2020-01-01T00:00:00.2Z line02\n2020-01-01T00:00:00.3Z line03\n"},
+			out:            "line01\nline02\n##agola:log-reattached\nline03\n",
+		},
+		{
+			name:           "reattached lines with identical timestamps",
+			writes:         []string{"2020-01-01T00:00:00.1Z line01\n2020-01-01T00:00:00.1Z line02\n"},
+			reattachWrites: []string{"2020-01-01T00:00:00.1Z line01\n2020-01-01T00:00:00.1Z line02\n2020-01-01T00:00:00.1Z line03\n2020-01-01T00:00:00.2Z line04\n"},
+			out:            "line01\nline02\n##agola:log-reattached\nline03\nline04\n",
+		},
+		{
+			name:           "reattached stream without new lines",
+			writes:         []string{"2020-01-01T00:00:00.1Z line01\n"},
+			reattachWrites: []string{"2020-01-01T00:00:00.1Z line01\n"},
+			out:            "line01\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := &timestampStripWriter{w: &buf}
+			for _, p := range tt.writes {
+				if _, err := w.Write([]byte(p)); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			}
+			if tt.reattachWrites != nil {
+				w.reattach(func() error {
+					_, err := buf.WriteString("##agola:log-reattached\n")
+					return err
+				})
+				for _, p := range tt.reattachWrites {
+					if _, err := w.Write([]byte(p)); err != nil {
+						t.Fatalf("unexpected err: %v", err)
+					}
+				}
+			}
+			if buf.String() != tt.out {
+				t.Fatalf("expected output %q, got %q", tt.out, buf.String())
+			}
+		})
+	}
+}
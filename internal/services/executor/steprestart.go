@@ -0,0 +1,283 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"agola.io/agola/internal/services/executor/driver"
+	"agola.io/agola/internal/util"
+	"agola.io/agola/services/runservice/types"
+
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+// stepRestart is the restart of a failed step of a finished task
+type stepRestart struct {
+	step int
+	// downstream is true when also the steps after the restarted one are
+	// executed
+	downstream bool
+}
+
+// StepRestart is the step restart response
+type StepRestart struct {
+	TaskID     string `json:"task_id"`
+	Step       int    `json:"step"`
+	Attempt    int    `json:"attempt"`
+	Downstream bool   `json:"downstream"`
+}
+
+// restartTaskStep executes again, in a new task attempt, the failed step of a
+// failed task and, if downstream is true, the steps after it. The steps run in
+// the stopped pod of the previous attempt, started again, so they find the
+// container filesystem left by the previous steps. The previous steps keep
+// their status and their logs are linked in the new attempt.
+// Only the tasks still known by the executor can be restarted, the driver
+// must keep their stopped pods. Since the runservice doesn't accept a new
+// status for a task after a final one, the task can be restarted only if the
+// runservice hasn't accepted its failed status, like when it couldn't be
+// sent.
+func (e *Executor) restartTaskStep(ctx context.Context, taskID string, step int, downstream bool) (int, error) {
+	rt, ok := e.runningTasks.get(taskID)
+	if !ok {
+		return 0, util.NewErrNotExist(errors.Errorf("task %q not found", taskID))
+	}
+
+	rt.Lock()
+	defer rt.Unlock()
+
+	et := rt.et
+	if et.Status.Phase != types.ExecutorTaskPhaseFailed || rt.ctx.Err() == nil {
+		return 0, util.NewErrBadRequest(errors.Errorf("task %q isn't failed", taskID))
+	}
+	select {
+	case <-rt.podStopped:
+	default:
+		return 0, util.NewErrBadRequest(errors.Errorf("task %q pod is stopping", taskID))
+	}
+	if step < 0 || step >= len(et.Status.Steps) {
+		return 0, util.NewErrBadRequest(errors.Errorf("task %q has no step %d", taskID, step))
+	}
+	if phase := et.Status.Steps[step].Phase; phase != types.ExecutorTaskPhaseFailed {
+		return 0, util.NewErrBadRequest(errors.Errorf("task %q step %d isn't failed, phase: %s", taskID, step, phase))
+	}
+	for i, s := range et.Status.Steps[:step] {
+		if s.Phase != types.ExecutorTaskPhaseSuccess && s.Phase != types.ExecutorTaskPhaseSkipped {
+			return 0, util.NewErrBadRequest(errors.Errorf("task %q step %d, preceding the restarted step, didn't succeed, phase: %s", taskID, i, s.Phase))
+		}
+	}
+	// the runservice ignores a task status change after it accepted a final
+	// status, the restarted attempt result would be lost
+	accepted, err := e.runserviceAcceptedFinalStatus(ctx, taskID)
+	if err != nil {
+		return 0, err
+	}
+	if accepted {
+		return 0, util.NewErrBadRequest(errors.Errorf("task %q final status already accepted by the runservice", taskID))
+	}
+	// the workspace is the container filesystem of the previous attempt
+	if rt.pod == nil {
+		return 0, util.NewErrBadRequest(errors.Errorf("task %q has no pod", taskID))
+	}
+	if err := rt.pod.Start(ctx); err != nil {
+		if errors.Is(err, driver.ErrNotSupported) {
+			return 0, err
+		}
+		return 0, util.NewErrBadRequest(errors.Errorf("task %q pod cannot be started, the workspace isn't available anymore: %w", taskID, err))
+	}
+
+	prevAttempt := rt.attempt
+	attempt := rt.attempts[len(rt.attempts)-1] + 1
+	if !et.Spec.NoLogPersist {
+		if err := e.linkRestartLogs(taskID, prevAttempt, attempt, step); err != nil {
+			return 0, err
+		}
+	}
+
+	rtCtx, rtCancel := context.WithCancel(rt.parentCtx)
+	rt.ctx = rtCtx
+	rt.cancel = rtCancel
+	rt.restart = &stepRestart{step: step, downstream: downstream}
+	rt.attempt = attempt
+	rt.attempts = append(rt.attempts, attempt)
+	rt.timedOut = false
+	rt.logLines = nil
+	diskUsage, err := e.newTaskDiskUsage(rt)
+	if err != nil {
+		rtCancel()
+		return 0, err
+	}
+	rt.diskUsage = diskUsage
+	resources := newTaskResources(len(et.Spec.Steps))
+	copy(resources.Steps[:step], rt.resources.Steps[:step])
+	rt.resources = resources
+
+	et.Status.Attempt = attempt
+	et.Status.EndTime = nil
+	et.Status.Deadline = nil
+	et.Status.FailError = ""
+	et.Status.FailFastReason = ""
+	for i := step; i < len(et.Status.Steps); i++ {
+		et.Status.Steps[i] = &types.ExecutorTaskStepStatus{Phase: types.ExecutorTaskPhaseNotStarted}
+	}
+
+	if err := e.captureServiceLogs(rtCtx, rt, rt.pod); err != nil {
+		log.Errorf("failed to capture task %q service containers logs: %+v", taskID, err)
+	}
+
+	log.Infof("restarting task %s step %d in attempt %d", taskID, step, attempt)
+	go e.executeTask(rt)
+
+	return attempt, nil
+}
+
+// runserviceAcceptedFinalStatus reports if the runservice accepted a final
+// status of the task, also when it already forgot the task
+func (e *Executor) runserviceAcceptedFinalStatus(ctx context.Context, taskID string) (bool, error) {
+	et, resp, err := e.runserviceClient.GetExecutorTask(ctx, e.id, taskID)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return true, nil
+		}
+		return false, err
+	}
+	return et.Status.Phase.IsFinished(), nil
+}
+
+// linkRestartLogs links in the new attempt the setup log and the logs of the
+// steps preceding the restarted step
+func (e *Executor) linkRestartLogs(taskID string, prevAttempt, attempt, step int) error {
+	logs, err := e.taskLogs(taskID)
+	if err != nil {
+		return err
+	}
+	for _, l := range logs {
+		if l.attempt != prevAttempt {
+			continue
+		}
+		s, ok := logStreamStep(l.stream)
+		if l.stream != setupLogStream && (!ok || s >= step) {
+			continue
+		}
+		dst := e.taskLogPath(taskID, attempt, l.stream)
+		if err := os.MkdirAll(filepath.Dir(dst), 0770); err != nil {
+			return err
+		}
+		for _, pathFn := range []func(string) string{func(p string) string { return p }, logIndexPath, logLineIndexPath, logLinesPath, logCommandsPath, logDurablePath} {
+			if err := e.linkTaskFile(pathFn(l.path), pathFn(dst)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logStreamStep returns the step of a step or sub step log stream
+func logStreamStep(stream string) (int, bool) {
+	if s, _, ok := parseSubstepLogStream(stream); ok {
+		return s, true
+	}
+	var step int
+	if _, err := fmt.Sscanf(stream, "steps/%d", &step); err != nil || stepLogStream(step) != stream {
+		return 0, false
+	}
+	return step, true
+}
+
+// linkTaskFile hard links src to dst, copying it with the configured mode and
+// owner if it cannot be linked. A missing src is ignored.
+func (e *Executor) linkTaskFile(src, dst string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := e.createDataFile(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+type stepRestartHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewStepRestartHandler(logger *zap.Logger, e *Executor) *stepRestartHandler {
+	return &stepRestartHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP restarts a failed step of a failed task. With the downstream query
+// parameter set to true also the steps after it are executed.
+func (h *stepRestartHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	taskID := vars["taskid"]
+	step, err := strconv.Atoi(vars["step"])
+	if err != nil || step < 0 {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid step")
+		return
+	}
+	var downstream bool
+	if downstreamStr := r.URL.Query().Get("downstream"); downstreamStr != "" {
+		downstream, err = strconv.ParseBool(downstreamStr)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, taskID, "invalid downstream")
+			return
+		}
+	}
+
+	attempt, err := h.e.restartTaskStep(r.Context(), taskID, step, downstream)
+	if err != nil {
+		switch {
+		case util.IsNotExist(err):
+			httpError(w, http.StatusNotFound, ErrorCodeNotFound, taskID, err.Error())
+		case util.IsBadRequest(err):
+			httpError(w, http.StatusConflict, ErrorCodeConflict, taskID, err.Error())
+		case errors.Is(err, driver.ErrNotSupported):
+			httpError(w, http.StatusNotImplemented, ErrorCodeNotSupported, taskID, "the executor driver doesn't keep the stopped pods")
+		default:
+			h.log.Errorf("err: %+v", err)
+			httpError(w, http.StatusInternalServerError, ErrorCodeInternal, taskID, "internal server error")
+		}
+		return
+	}
+
+	if err := httpResponse(w, http.StatusAccepted, &StepRestart{TaskID: taskID, Step: step, Attempt: attempt, Downstream: downstream}); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
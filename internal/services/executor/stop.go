@@ -0,0 +1,80 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+)
+
+const defaultStopGracePeriod = 1 * time.Second
+
+// stopGracePeriod returns the time the task processes have to exit, after the
+// SIGTERM, before being killed
+func (e *Executor) stopGracePeriod(et *types.ExecutorTask) time.Duration {
+	if et.Spec.StopGracePeriod != nil {
+		if *et.Spec.StopGracePeriod < 0 {
+			return 0
+		}
+		return *et.Spec.StopGracePeriod
+	}
+	if e.c.StopGracePeriod > 0 {
+		return e.c.StopGracePeriod
+	}
+	return defaultStopGracePeriod
+}
+
+// stopPod stops the running task pod once the task context is done. The
+// running step, if any, logs the SIGTERM and, when the step is still running
+// after the grace period, the escalation to SIGKILL.
+func (e *Executor) stopPod(rt *runningTask) {
+	rt.Lock()
+	pod := rt.pod
+	gracePeriod := e.stopGracePeriod(rt.et)
+	step := -1
+	if rt.stepLog != nil {
+		step = rt.stepLogIndex
+		if err := rt.stepLog.writeMarker(fmt.Sprintf("Task stopping at %s, sent SIGTERM, the processes will be killed after %s\n", time.Now().UTC().Format(time.RFC3339), gracePeriod)); err != nil {
+			log.Errorf("err: %+v", err)
+		}
+	}
+	rt.Unlock()
+	if pod == nil {
+		return
+	}
+
+	// the timer isn't stopped when Stop returns since some drivers, like k8s,
+	// don't wait for the pod termination
+	if step >= 0 {
+		time.AfterFunc(gracePeriod, func() {
+			rt.Lock()
+			defer rt.Unlock()
+			if rt.stepLog == nil || rt.stepLogIndex != step {
+				return
+			}
+			log.Infof("task %s step %d still running after the stop grace period of %s, killing it", rt.et.ID, step, gracePeriod)
+			if err := rt.stepLog.writeMarker(fmt.Sprintf("Stop grace period of %s expired at %s, sent SIGKILL\n", gracePeriod, time.Now().UTC().Format(time.RFC3339))); err != nil {
+				log.Errorf("err: %+v", err)
+			}
+		})
+	}
+
+	if err := pod.Stop(context.Background(), gracePeriod); err != nil {
+		log.Errorf("error stopping the pod: %+v", err)
+	}
+}
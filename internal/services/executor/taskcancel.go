@@ -0,0 +1,180 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+// TasksCancelRequest is the filter of the tasks to cancel. A task is
+// cancelled when it matches all the defined filters
+type TasksCancelRequest struct {
+	// All cancels all the tasks, it's required when no other filter is
+	// defined so an empty request won't cancel everything
+	All bool `json:"all,omitempty"`
+	// Labels selects the tasks having all these labels
+	Labels map[string]string `json:"labels,omitempty"`
+	// OlderThan, like "30m", selects the tasks received by the executor more
+	// than this duration ago
+	OlderThan string `json:"older_than,omitempty"`
+}
+
+// TasksCancelReport reports the cancelled tasks. The running tasks are
+// stopped, like when stopped by the scheduler, while the queued tasks are
+// removed from the queue and marked as cancelled
+type TasksCancelReport struct {
+	Cancelled []*CancelledTask `json:"cancelled"`
+}
+
+type CancelledTask struct {
+	TaskID   string `json:"task_id"`
+	TaskName string `json:"task_name,omitempty"`
+	// Queued is true when the task was waiting to be started
+	Queued bool `json:"queued,omitempty"`
+}
+
+// taskCancelFilter is a parsed TasksCancelRequest
+type taskCancelFilter struct {
+	labels    map[string]string
+	olderThan time.Duration
+}
+
+func parseTasksCancelRequest(req *TasksCancelRequest) (*taskCancelFilter, error) {
+	f := &taskCancelFilter{labels: req.Labels}
+	if req.OlderThan != "" {
+		d, err := time.ParseDuration(req.OlderThan)
+		if err != nil || d <= 0 {
+			return nil, errors.Errorf("invalid older_than %q", req.OlderThan)
+		}
+		f.olderThan = d
+	}
+	if !req.All && len(f.labels) == 0 && f.olderThan == 0 {
+		return nil, errors.Errorf("no filter provided, all must be true to cancel all the tasks")
+	}
+	return f, nil
+}
+
+// match reports if the task, received at receivedTime, matches the filter
+func (f *taskCancelFilter) match(et *types.ExecutorTask, receivedTime time.Time, now time.Time) bool {
+	if f.olderThan > 0 && now.Sub(receivedTime) < f.olderThan {
+		return false
+	}
+	labels := taskLabels(et)
+	for k, v := range f.labels {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// cancelTasks stops the running tasks and removes from the queue the queued
+// tasks matching the filter
+func (e *Executor) cancelTasks(ctx context.Context, f *taskCancelFilter) *TasksCancelReport {
+	now := time.Now()
+	report := &TasksCancelReport{Cancelled: []*CancelledTask{}}
+
+	ids := e.runningTasks.ids()
+	sort.Strings(ids)
+	for _, id := range ids {
+		rt, ok := e.runningTasks.get(id)
+		if !ok {
+			continue
+		}
+		rt.Lock()
+		et := rt.et
+		if !et.Status.Phase.IsFinished() && !et.Spec.Stop && rt.receivedTime != nil && f.match(et, *rt.receivedTime, now) {
+			log.Infof("cancelling running task %s", et.ID)
+			et.Spec.Stop = true
+			rt.cancel()
+			report.Cancelled = append(report.Cancelled, &CancelledTask{TaskID: et.ID, TaskName: taskName(et)})
+		}
+		rt.Unlock()
+	}
+
+	queued := e.taskQueue.removeMatching(func(et *types.ExecutorTask, queuedTime time.Time) bool {
+		return f.match(et, queuedTime, now)
+	})
+	for _, et := range queued {
+		log.Infof("cancelling queued task %s", et.ID)
+		et.Status.Phase = types.ExecutorTaskPhaseCancelled
+		report.Cancelled = append(report.Cancelled, &CancelledTask{TaskID: et.ID, TaskName: taskName(et), Queued: true})
+		go func(et *types.ExecutorTask) {
+			if err := e.sendExecutorTaskStatus(ctx, et); err != nil {
+				log.Errorf("err: %+v", err)
+			}
+		}(et)
+	}
+
+	return report
+}
+
+func taskName(et *types.ExecutorTask) string {
+	if et.Spec.ExecutorTaskSpecData == nil {
+		return ""
+	}
+	return et.Spec.TaskName
+}
+
+func taskLabels(et *types.ExecutorTask) map[string]string {
+	if et.Spec.ExecutorTaskSpecData == nil {
+		return nil
+	}
+	return et.Spec.Labels
+}
+
+type tasksCancelHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTasksCancelHandler(logger *zap.Logger, e *Executor) *tasksCancelHandler {
+	return &tasksCancelHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP cancels all the running and queued tasks matching the request
+// filter and returns the cancelled tasks
+func (h *tasksCancelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req TasksCancelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", "invalid request")
+		return
+	}
+	f, err := parseTasksCancelRequest(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", err.Error())
+		return
+	}
+
+	// the status of the cancelled queued tasks is sent after the request is
+	// done
+	report := h.e.cancelTasks(context.Background(), f)
+
+	if err := httpResponse(w, http.StatusOK, report); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+
+	"go.uber.org/zap"
+	errors "golang.org/x/xerrors"
+)
+
+// TaskInfo is a task known by the executor, running or queued
+type TaskInfo struct {
+	TaskID   string                  `json:"task_id"`
+	TaskName string                  `json:"task_name,omitempty"`
+	Phase    types.ExecutorTaskPhase `json:"phase"`
+	Labels   map[string]string       `json:"labels,omitempty"`
+	// Queued is true when the task is waiting to be started
+	Queued bool `json:"queued,omitempty"`
+	// ReceivedTime is when the task has been received by the executor
+	ReceivedTime *time.Time `json:"received_time,omitempty"`
+}
+
+// labelSelector selects the tasks by a label. The selector "key=value"
+// requires the label with the value, "key!=value" requires the label missing
+// or with another value and "key" only requires the label
+type labelSelector struct {
+	key   string
+	value string
+	// op is "=", "!=" or empty when only the label key is required
+	op string
+}
+
+func parseLabelSelector(s string) (*labelSelector, error) {
+	sel := &labelSelector{key: s}
+	if i := strings.Index(s, "!="); i >= 0 {
+		sel = &labelSelector{key: s[:i], value: s[i+2:], op: "!="}
+	} else if i := strings.Index(s, "="); i >= 0 {
+		sel = &labelSelector{key: s[:i], value: s[i+1:], op: "="}
+	}
+	sel.key = strings.TrimSpace(sel.key)
+	if sel.key == "" {
+		return nil, errors.Errorf("invalid label selector %q", s)
+	}
+	return sel, nil
+}
+
+func (sel *labelSelector) match(labels map[string]string) bool {
+	v, ok := labels[sel.key]
+	switch sel.op {
+	case "=":
+		return ok && v == sel.value
+	case "!=":
+		return !ok || v != sel.value
+	default:
+		return ok
+	}
+}
+
+// matchLabelSelectors reports if the labels match all the selectors
+func matchLabelSelectors(sels []*labelSelector, labels map[string]string) bool {
+	for _, sel := range sels {
+		if !sel.match(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// listTasks returns the running tasks, ordered by received time, followed by
+// the queued tasks, in start order, matching all the label selectors
+func (e *Executor) listTasks(sels []*labelSelector) []*TaskInfo {
+	running := []*TaskInfo{}
+	for _, id := range e.runningTasks.ids() {
+		rt, ok := e.runningTasks.get(id)
+		if !ok {
+			continue
+		}
+		rt.Lock()
+		et := rt.et
+		if matchLabelSelectors(sels, taskLabels(et)) {
+			running = append(running, &TaskInfo{
+				TaskID:       et.ID,
+				TaskName:     taskName(et),
+				Phase:        et.Status.Phase,
+				Labels:       taskLabels(et),
+				ReceivedTime: rt.receivedTime,
+			})
+		}
+		rt.Unlock()
+	}
+	receivedTime := func(t *TaskInfo) time.Time {
+		if t.ReceivedTime == nil {
+			return time.Time{}
+		}
+		return *t.ReceivedTime
+	}
+	sort.Slice(running, func(i, j int) bool {
+		ti, tj := receivedTime(running[i]), receivedTime(running[j])
+		if ti.Equal(tj) {
+			return running[i].TaskID < running[j].TaskID
+		}
+		return ti.Before(tj)
+	})
+
+	tasks := running
+	e.taskQueue.each(func(et *types.ExecutorTask, queuedTime time.Time) {
+		if !matchLabelSelectors(sels, taskLabels(et)) {
+			return
+		}
+		tasks = append(tasks, &TaskInfo{
+			TaskID:       et.ID,
+			TaskName:     taskName(et),
+			Phase:        et.Status.Phase,
+			Labels:       taskLabels(et),
+			Queued:       true,
+			ReceivedTime: &queuedTime,
+		})
+	})
+	return tasks
+}
+
+type tasksListHandler struct {
+	log *zap.SugaredLogger
+	e   *Executor
+}
+
+func NewTasksListHandler(logger *zap.Logger, e *Executor) *tasksListHandler {
+	return &tasksListHandler{
+		log: logger.Sugar(),
+		e:   e,
+	}
+}
+
+// ServeHTTP returns the running and queued tasks. The tasks can be filtered
+// by their labels with one or more label query parameters (i.e.
+// "?label=project=x&label=env!=test"), a task must match all of them.
+func (h *tasksListHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var sels []*labelSelector
+	for _, s := range r.URL.Query()["label"] {
+		sel, err := parseLabelSelector(s)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, ErrorCodeBadRequest, "", err.Error())
+			return
+		}
+		sels = append(sels, sel)
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := httpResponse(w, http.StatusOK, h.e.listTasks(sels)); err != nil {
+		h.log.Errorf("err: %+v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"testing"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		s   string
+		sel *labelSelector
+		err bool
+	}{
+		{s: "project=x", sel: &labelSelector{key: "project", value: "x", op: "="}},
+		{s: "env!=test", sel: &labelSelector{key: "env", value: "test", op: "!="}},
+		{s: "project", sel: &labelSelector{key: "project"}},
+		{s: " project =x", sel: &labelSelector{key: "project", value: "x", op: "="}},
+		{s: "project=", sel: &labelSelector{key: "project", value: "", op: "="}},
+		{s: "url=a=b", sel: &labelSelector{key: "url", value: "a=b", op: "="}},
+		{s: "", err: true},
+		{s: " ", err: true},
+		{s: "=x", err: true},
+		{s: "!=x", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			sel, err := parseLabelSelector(tt.s)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if *sel != *tt.sel {
+				t.Fatalf("expected selector %+v, got %+v", tt.sel, sel)
+			}
+		})
+	}
+}
+
+func TestMatchLabelSelectors(t *testing.T) {
+	labels := map[string]string{
+		"project": "x",
+		"env":     "prod",
+		"empty":   "",
+	}
+
+	tests := []struct {
+		name      string
+		selectors []string
+		labels    map[string]string
+		match     bool
+	}{
+		{name: "no selectors", labels: labels, match: true},
+		{name: "no selectors and no labels", match: true},
+		{name: "equal", selectors: []string{"project=x"}, labels: labels, match: true},
+		{name: "equal with another value", selectors: []string{"project=y"}, labels: labels},
+		{name: "equal missing label", selectors: []string{"team=a"}, labels: labels},
+		{name: "equal empty value", selectors: []string{"empty="}, labels: labels, match: true},
+		{name: "equal empty value missing label", selectors: []string{"team="}, labels: labels},
+		{name: "not equal", selectors: []string{"env!=test"}, labels: labels, match: true},
+		{name: "not equal with the same value", selectors: []string{"env!=prod"}, labels: labels},
+		{name: "not equal missing label", selectors: []string{"team!=a"}, labels: labels, match: true},
+		{name: "key only", selectors: []string{"project"}, labels: labels, match: true},
+		{name: "key only empty value", selectors: []string{"empty"}, labels: labels, match: true},
+		{name: "key only missing label", selectors: []string{"team"}, labels: labels},
+		{name: "key only no labels", selectors: []string{"project"}},
+		{name: "several selectors all matching", selectors: []string{"project=x", "env!=test", "empty"}, labels: labels, match: true},
+		{name: "several selectors one not matching", selectors: []string{"project=x", "env!=prod", "empty"}, labels: labels},
+		{name: "several selectors on the same key", selectors: []string{"env", "env!=test", "env!=staging"}, labels: labels, match: true},
+		{name: "several conflicting selectors", selectors: []string{"env=prod", "env=test"}, labels: labels},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sels []*labelSelector
+			for _, s := range tt.selectors {
+				sel, err := parseLabelSelector(s)
+				if err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				sels = append(sels, sel)
+			}
+			if match := matchLabelSelectors(sels, tt.labels); match != tt.match {
+				t.Fatalf("expected match: %t, got: %t", tt.match, match)
+			}
+		})
+	}
+}
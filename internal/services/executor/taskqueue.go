@@ -0,0 +1,274 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"container/heap"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"agola.io/agola/services/runservice/types"
+)
+
+// QueuedTask is a task waiting to be started
+type QueuedTask struct {
+	TaskID   string `json:"task_id"`
+	TaskName string `json:"task_name,omitempty"`
+	Priority int    `json:"priority"`
+	// ConcurrencyGroup, when defined, is the task concurrency group
+	ConcurrencyGroup string    `json:"concurrency_group,omitempty"`
+	QueuedTime       time.Time `json:"queued_time"`
+}
+
+type queuedTask struct {
+	et         *types.ExecutorTask
+	priority   int
+	queuedTime time.Time
+	// seq keeps the submission order of tasks with the same priority
+	seq   uint64
+	index int
+}
+
+type queuedTasks []*queuedTask
+
+func (q queuedTasks) Len() int { return len(q) }
+
+func (q queuedTasks) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q queuedTasks) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *queuedTasks) Push(x interface{}) {
+	qt := x.(*queuedTask)
+	qt.index = len(*q)
+	*q = append(*q, qt)
+}
+
+func (q *queuedTasks) Pop() interface{} {
+	old := *q
+	n := len(old)
+	qt := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return qt
+}
+
+// taskQueue keeps the tasks waiting to be started ordered by priority (higher
+// first) and then by submission order
+type taskQueue struct {
+	tasks queuedTasks
+	byID  map[string]*queuedTask
+	seq   uint64
+	// notify is signaled when a task is queued
+	notify chan struct{}
+	m      sync.Mutex
+}
+
+func newTaskQueue() *taskQueue {
+	return &taskQueue{
+		byID:   make(map[string]*queuedTask),
+		notify: make(chan struct{}, 1),
+	}
+}
+
+// push queues the task. If the task is already queued it's updated keeping its
+// position between the tasks with the same priority
+func (q *taskQueue) push(et *types.ExecutorTask) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	priority := 0
+	if et.Spec.ExecutorTaskSpecData != nil {
+		priority = et.Spec.Priority
+	}
+
+	if qt, ok := q.byID[et.ID]; ok {
+		qt.et = et
+		qt.priority = priority
+		heap.Fix(&q.tasks, qt.index)
+	} else {
+		q.seq++
+		qt := &queuedTask{et: et, priority: priority, queuedTime: time.Now(), seq: q.seq}
+		heap.Push(&q.tasks, qt)
+		q.byID[et.ID] = qt
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop removes and returns the task with the highest priority that can be
+// started or nil if there's none. The tasks of a busy concurrency group are
+// skipped.
+func (q *taskQueue) pop(busyGroups map[string]string) *types.ExecutorTask {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	if len(q.tasks) == 0 {
+		return nil
+	}
+	if len(busyGroups) == 0 {
+		qt := heap.Pop(&q.tasks).(*queuedTask)
+		delete(q.byID, qt.et.ID)
+		return qt.et
+	}
+
+	for _, qt := range q.sorted() {
+		if _, ok := busyGroups[taskConcurrencyGroup(qt.et)]; ok {
+			continue
+		}
+		heap.Remove(&q.tasks, qt.index)
+		delete(q.byID, qt.et.ID)
+		return qt.et
+	}
+	return nil
+}
+
+// sorted returns the queued tasks in the order they'll be started. It must be
+// called with the queue locked.
+func (q *taskQueue) sorted() queuedTasks {
+	tasks := make(queuedTasks, len(q.tasks))
+	copy(tasks, q.tasks)
+	sort.Slice(tasks, func(i, j int) bool { return tasks.Less(i, j) })
+	return tasks
+}
+
+func (q *taskQueue) remove(taskID string) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	qt, ok := q.byID[taskID]
+	if !ok {
+		return
+	}
+	heap.Remove(&q.tasks, qt.index)
+	delete(q.byID, taskID)
+}
+
+// removeMatching removes and returns the queued tasks matched by match
+func (q *taskQueue) removeMatching(match func(et *types.ExecutorTask, queuedTime time.Time) bool) []*types.ExecutorTask {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	var removed []*types.ExecutorTask
+	for _, qt := range q.sorted() {
+		if !match(qt.et, qt.queuedTime) {
+			continue
+		}
+		heap.Remove(&q.tasks, qt.index)
+		delete(q.byID, qt.et.ID)
+		removed = append(removed, qt.et)
+	}
+	return removed
+}
+
+// each calls fn with every queued task in start order
+func (q *taskQueue) each(fn func(et *types.ExecutorTask, queuedTime time.Time)) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for _, qt := range q.sorted() {
+		fn(qt.et, qt.queuedTime)
+	}
+}
+
+func (q *taskQueue) has(taskID string) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	_, ok := q.byID[taskID]
+	return ok
+}
+
+// get returns the queued task
+func (q *taskQueue) get(taskID string) (*types.ExecutorTask, bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	qt, ok := q.byID[taskID]
+	if !ok {
+		return nil, false
+	}
+	return qt.et, true
+}
+
+func (q *taskQueue) ids() []string {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	ids := make([]string, 0, len(q.byID))
+	for id := range q.byID {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// list returns the queued tasks in the order they'll be started
+func (q *taskQueue) list() []*QueuedTask {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	tasks := q.sorted()
+
+	list := make([]*QueuedTask, len(tasks))
+	for i, qt := range tasks {
+		list[i] = &QueuedTask{
+			TaskID:           qt.et.ID,
+			Priority:         qt.priority,
+			ConcurrencyGroup: taskConcurrencyGroup(qt.et),
+			QueuedTime:       qt.queuedTime,
+		}
+		if qt.et.Spec.ExecutorTaskSpecData != nil {
+			list[i].TaskName = qt.et.Spec.TaskName
+		}
+	}
+	return list
+}
+
+// taskQueueLoop starts the queued tasks, in priority order, when there's room
+// for new active tasks. Running tasks are never preempted. A task waits while
+// another task of its concurrency group is running.
+func (e *Executor) taskQueueLoop(ctx context.Context) {
+	for {
+		for e.runningTasks.len() <= e.c.ActiveTasksLimit {
+			et := e.taskQueue.pop(e.busyConcurrencyGroups())
+			if et == nil {
+				break
+			}
+			e.startTask(ctx, et)
+		}
+
+		// also check periodically since running tasks could have finished
+		sleepCh := time.NewTimer(1 * time.Second).C
+		select {
+		case <-ctx.Done():
+			return
+		case <-e.taskQueue.notify:
+		case <-sleepCh:
+		}
+	}
+}
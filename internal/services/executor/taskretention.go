@@ -0,0 +1,85 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+)
+
+const defaultFailedTaskDataTTL = 24 * time.Hour
+
+// taskFetchedPath is the file created in the dir of a task kept after the
+// runservice forgot it. Its modification time is when the runservice forgot
+// the task.
+func (e *Executor) taskFetchedPath(taskID string) string {
+	return filepath.Join(e.taskPath(taskID), "fetched")
+}
+
+// taskFetched reports if the runservice forgot the task, and so already
+// fetched its logs and archives, and the task dir has been kept by the task
+// data retention
+func (e *Executor) taskFetched(taskID string) bool {
+	_, err := os.Stat(e.taskFetchedPath(taskID))
+	return err == nil
+}
+
+// keepForgottenTaskData reports if the dir of a task forgotten by the
+// runservice must be kept. With the "failed" task data retention the data of
+// the not successful tasks is kept for the failed task data ttl since the
+// runservice forgot the task.
+func (e *Executor) keepForgottenTaskData(taskID string) (bool, error) {
+	if e.c.TaskDataRetention != config.TaskDataRetentionFailed {
+		return false, nil
+	}
+	// a task still running isn't kept
+	if _, ok := e.runningTasks.get(taskID); ok {
+		return false, nil
+	}
+
+	fi, err := os.Stat(e.taskFetchedPath(taskID))
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil {
+		ttl := e.c.FailedTaskDataTTL
+		if ttl == 0 {
+			ttl = defaultFailedTaskDataTTL
+		}
+		return time.Since(fi.ModTime()) < ttl, nil
+	}
+
+	// the runservice just forgot the task
+	m, err := e.getTaskManifest(taskID)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if m.Status.Phase == types.ExecutorTaskPhaseSuccess {
+		return false, nil
+	}
+	log.Infof("keeping data of not successful task %q", taskID)
+	if err := ioutil.WriteFile(e.taskFetchedPath(taskID), nil, 0660); err != nil {
+		return false, err
+	}
+	return true, nil
+}
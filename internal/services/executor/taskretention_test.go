@@ -0,0 +1,97 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"agola.io/agola/internal/services/config"
+	"agola.io/agola/services/runservice/types"
+)
+
+func TestKeepForgottenTaskData(t *testing.T) {
+	tests := []struct {
+		name      string
+		retention string
+		phase     types.ExecutorTaskPhase
+		fetched   time.Duration
+		running   bool
+		keep      bool
+	}{
+		{name: "all retention", retention: config.TaskDataRetentionAll, phase: types.ExecutorTaskPhaseFailed},
+		{name: "successful task", retention: config.TaskDataRetentionFailed, phase: types.ExecutorTaskPhaseSuccess},
+		{name: "failed task just forgotten", retention: config.TaskDataRetentionFailed, phase: types.ExecutorTaskPhaseFailed, keep: true},
+		{name: "failed task forgotten before the ttl", retention: config.TaskDataRetentionFailed, phase: types.ExecutorTaskPhaseFailed, fetched: time.Hour, keep: true},
+		{name: "failed task forgotten after the ttl", retention: config.TaskDataRetentionFailed, phase: types.ExecutorTaskPhaseFailed, fetched: 2 * time.Hour},
+		{name: "running task", retention: config.TaskDataRetentionFailed, phase: types.ExecutorTaskPhaseFailed, running: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			e := &Executor{
+				c: &config.Executor{DataDir: dir, TaskDataRetention: tt.retention, FailedTaskDataTTL: 90 * time.Minute},
+				runningTasks: &runningTasks{
+					tasks: make(map[string]*runningTask),
+				},
+			}
+			const taskID = "task01"
+			if tt.running {
+				e.runningTasks.addIfNotExists(taskID, &runningTask{et: &types.ExecutorTask{ID: taskID}})
+			}
+
+			if err := os.MkdirAll(e.taskPath(taskID), 0770); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			mj, err := json.Marshal(&TaskManifest{TaskID: taskID, Status: types.ExecutorTaskStatus{Phase: tt.phase}})
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(e.taskPath(taskID), "manifest.json"), mj, 0660); err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if tt.fetched != 0 {
+				if err := ioutil.WriteFile(e.taskFetchedPath(taskID), nil, 0660); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+				fetchedTime := time.Now().Add(-tt.fetched)
+				if err := os.Chtimes(e.taskFetchedPath(taskID), fetchedTime, fetchedTime); err != nil {
+					t.Fatalf("unexpected err: %v", err)
+				}
+			}
+
+			keep, err := e.keepForgottenTaskData(taskID)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if keep != tt.keep {
+				t.Fatalf("expected keep %t, got %t", tt.keep, keep)
+			}
+			if keep && !e.taskFetched(taskID) {
+				t.Fatalf("expected kept task marked as fetched")
+			}
+		})
+	}
+}
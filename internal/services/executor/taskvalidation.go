@@ -0,0 +1,135 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"context"
+	"fmt"
+
+	"agola.io/agola/internal/services/executor/registry"
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// TaskPolicy is an executor policy checked on the submitted tasks
+type TaskPolicy string
+
+const (
+	// TaskPolicyDefinition reports an invalid task definition
+	TaskPolicyDefinition  TaskPolicy = "definition"
+	TaskPolicyImage       TaskPolicy = "image"
+	TaskPolicyNetworkMode TaskPolicy = "network_mode"
+	TaskPolicyUlimits     TaskPolicy = "ulimits"
+	// TaskPolicyImageRegistry reports a container image not pulled from an
+	// allowed image registry
+	TaskPolicyImageRegistry TaskPolicy = "image_registry"
+	// TaskPolicyPrivileged and TaskPolicyArch aren't checked at submission,
+	// the task fails when started
+	TaskPolicyPrivileged TaskPolicy = "privileged"
+	TaskPolicyArch       TaskPolicy = "arch"
+)
+
+type TaskViolation struct {
+	Policy  TaskPolicy `json:"policy"`
+	Message string     `json:"message"`
+}
+
+type TaskValidation struct {
+	Valid      bool             `json:"valid"`
+	Violations []*TaskViolation `json:"violations"`
+}
+
+// admissionViolations checks the task against the policies applied when it's
+// submitted. The containers images are normalized in place.
+func (e *Executor) admissionViolations(et *types.ExecutorTask) []*TaskViolation {
+	var violations []*TaskViolation
+	add := func(policy TaskPolicy, errs ...error) {
+		for _, err := range errs {
+			violations = append(violations, &TaskViolation{Policy: policy, Message: err.Error()})
+		}
+	}
+
+	add(TaskPolicyDefinition, taskDefinitionErrors(et)...)
+	add(TaskPolicyImage, e.normalizeImages(et)...)
+	add(TaskPolicyImageRegistry, e.imageRegistryViolations(et)...)
+	if et != nil && et.Spec.ExecutorTaskSpecData != nil && !e.networkModeAllowed(et.Spec.NetworkMode) {
+		add(TaskPolicyNetworkMode, errors.Errorf("network mode %q not allowed", et.Spec.NetworkMode))
+	}
+	add(TaskPolicyUlimits, e.stepUlimitsViolations(et)...)
+	return violations
+}
+
+// validateTask statically checks the task against all the executor policies.
+// Nothing is started and the images registries aren't contacted
+func (e *Executor) validateTask(ctx context.Context, et *types.ExecutorTask) (*TaskValidation, error) {
+	violations := e.admissionViolations(et)
+
+	if et != nil && et.Spec.ExecutorTaskSpecData != nil {
+		for i, c := range et.Spec.Containers {
+			if c.Privileged && !e.c.AllowPrivilegedContainers {
+				violations = append(violations, &TaskViolation{Policy: TaskPolicyPrivileged, Message: fmt.Sprintf("container %d is privileged but the executor doesn't allow executing privileged containers", i)})
+			}
+		}
+		if et.Spec.Arch != "" {
+			archs, err := e.driver.Archs(ctx)
+			if err != nil {
+				return nil, err
+			}
+			supported := false
+			for _, arch := range archs {
+				if arch == et.Spec.Arch {
+					supported = true
+				}
+			}
+			if !supported {
+				violations = append(violations, &TaskViolation{Policy: TaskPolicyArch, Message: fmt.Sprintf("arch %q not supported by the executor", et.Spec.Arch)})
+			}
+		}
+	}
+
+	if violations == nil {
+		violations = []*TaskViolation{}
+	}
+	return &TaskValidation{
+		Valid:      len(violations) == 0,
+		Violations: violations,
+	}, nil
+}
+
+// normalizeImages replaces the task containers images with their fully
+// qualified reference so the task reports exactly what will be pulled
+func (e *Executor) normalizeImages(et *types.ExecutorTask) []error {
+	if et == nil || et.Spec.ExecutorTaskSpecData == nil {
+		return nil
+	}
+	var errs []error
+	for i, c := range et.Spec.Containers {
+		image, defaultTag, err := registry.NormalizeImage(c.Image)
+		if err != nil {
+			errs = append(errs, errors.Errorf("invalid container %d image %q: %w", i, c.Image, err))
+			continue
+		}
+		if defaultTag {
+			if e.c.RequireImageTag {
+				errs = append(errs, errors.Errorf("container %d image %q without a tag or digest", i, c.Image))
+				continue
+			}
+			log.Warnf("task %s container %d image %q without a tag or digest, using %q", et.ID, i, c.Image, image)
+		}
+		c.Image = image
+	}
+	return errs
+}
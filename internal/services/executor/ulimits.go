@@ -0,0 +1,117 @@
+// Copyright 2019 Sorint.lab
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package executor
+
+import (
+	"fmt"
+	"sort"
+
+	"agola.io/agola/services/runservice/types"
+
+	errors "golang.org/x/xerrors"
+)
+
+// stepUlimitNames are the ulimits supported by the toolbox ulimit command
+var stepUlimitNames = map[string]struct{}{
+	"cpu": {}, "fsize": {}, "data": {}, "stack": {}, "core": {}, "rss": {},
+	"nproc": {}, "nofile": {}, "memlock": {}, "as": {}, "locks": {},
+	"sigpending": {}, "msgqueue": {}, "nice": {}, "rtprio": {}, "rttime": {},
+}
+
+// ulimitExceeds reports if the limit v exceeds max, -1 is unlimited
+func ulimitExceeds(v, max int64) bool {
+	if max == -1 {
+		return false
+	}
+	return v == -1 || v > max
+}
+
+// validateMaxStepUlimits checks the names of the configured max step ulimits
+func validateMaxStepUlimits(maxUlimits map[string]int64) error {
+	for name := range maxUlimits {
+		if _, ok := stepUlimitNames[name]; !ok {
+			return errors.Errorf("unknown max step ulimit %q", name)
+		}
+	}
+	return nil
+}
+
+// validateStepUlimits checks the ulimits of a run step
+func validateStepUlimits(ulimits map[string]types.Ulimit) error {
+	for _, name := range sortedUlimitNames(ulimits) {
+		u := ulimits[name]
+		if _, ok := stepUlimitNames[name]; !ok {
+			return errors.Errorf("unknown ulimit %q", name)
+		}
+		if u.Soft < -1 || u.Hard < -1 {
+			return errors.Errorf("ulimit %q values must be positive or -1", name)
+		}
+		if ulimitExceeds(u.Soft, u.Hard) {
+			return errors.Errorf("ulimit %q soft limit is greater than its hard limit", name)
+		}
+	}
+	return nil
+}
+
+// stepUlimitsViolations returns the run steps ulimits exceeding the executor
+// max step ulimits or not allowed by the executor
+func (e *Executor) stepUlimitsViolations(et *types.ExecutorTask) []error {
+	if et == nil || et.Spec.ExecutorTaskSpecData == nil {
+		return nil
+	}
+	var errs []error
+	for i, step := range et.Spec.Steps {
+		rs, ok := step.(*types.RunStep)
+		if !ok {
+			continue
+		}
+		for _, name := range sortedUlimitNames(rs.Ulimits) {
+			u := rs.Ulimits[name]
+			max, ok := e.c.MaxStepUlimits[name]
+			if !ok {
+				errs = append(errs, errors.Errorf("step %d: ulimit %q not allowed by the executor", i, name))
+				continue
+			}
+			if ulimitExceeds(u.Hard, max) {
+				errs = append(errs, errors.Errorf("step %d: ulimit %q hard limit exceeds the executor max of %d", i, name, max))
+			}
+		}
+	}
+	return errs
+}
+
+func sortedUlimitNames(ulimits map[string]types.Ulimit) []string {
+	names := make([]string, 0, len(ulimits))
+	for name := range ulimits {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ulimitCmd returns the command executing cmd with the provided ulimits using
+// the toolbox
+func ulimitCmd(ulimits map[string]types.Ulimit, cmd []string) []string {
+	if len(ulimits) == 0 {
+		return cmd
+	}
+	ucmd := []string{toolboxContainerPath, "ulimit"}
+	for _, name := range sortedUlimitNames(ulimits) {
+		u := ulimits[name]
+		ucmd = append(ucmd, "--limit", fmt.Sprintf("%s=%d:%d", name, u.Soft, u.Hard))
+	}
+	ucmd = append(ucmd, "--")
+	return append(ucmd, cmd...)
+}
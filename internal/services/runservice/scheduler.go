@@ -19,6 +19,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"strconv"
 	"time"
@@ -367,15 +368,77 @@ func (s *Runservice) sendExecutorTask(ctx context.Context, et *types.ExecutorTas
 		return err
 	}
 
-	req, err := http.Post(executor.ListenURL+"/api/v1alpha/executor", "", bytes.NewReader(etj))
+	if err := postExecutorTask(executor.ListenURL, etj); err != nil {
+		var rerr *executorTaskRejectedError
+		if errors.As(err, &rerr) {
+			return s.failRejectedExecutorTask(ctx, et.ID, rerr.reason)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// executorTaskRejectedError is returned when the executor permanently rejected
+// an executor task, like when it's denied by the executor admission policies
+type executorTaskRejectedError struct {
+	reason string
+}
+
+func (e *executorTaskRejectedError) Error() string {
+	return fmt.Sprintf("executor task rejected: %s", e.reason)
+}
+
+// postExecutorTask posts the executor task to the executor. A bad request or
+// forbidden response is a permanent rejection of the task and an
+// executorTaskRejectedError with the reason returned by the executor is
+// returned. Any other failure is transient.
+func postExecutorTask(executorURL string, etj []byte) error {
+	resp, err := http.Post(executorURL+"/api/v1alpha/executor", "", bytes.NewReader(etj))
 	if err != nil {
 		return err
 	}
-	if req.StatusCode != http.StatusOK {
-		return errors.Errorf("received http status: %d", req.StatusCode)
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest, http.StatusForbidden:
+		reason := http.StatusText(resp.StatusCode)
+		var errResp struct {
+			Message string `json:"message"`
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&errResp); err == nil && errResp.Message != "" {
+			reason = errResp.Message
+		}
+		return &executorTaskRejectedError{reason: reason}
 	}
+	return errors.Errorf("received http status: %d", resp.StatusCode)
+}
 
-	return nil
+// failRejectedExecutorTask marks as failed the not started executor task
+// rejected by the executor, so it won't be sent again. The run task is then
+// updated by the run tasks updater.
+func (s *Runservice) failRejectedExecutorTask(ctx context.Context, etID, reason string) error {
+	et, err := store.GetExecutorTask(ctx, s.e, etID)
+	if err != nil {
+		return err
+	}
+	if et.Status.Phase != types.ExecutorTaskPhaseNotStarted {
+		return errors.Errorf("executor task %q in phase %q rejected: %s", et.ID, et.Status.Phase, reason)
+	}
+	log.Warnf("executor task %q rejected by executor %q: %s", et.ID, et.Spec.ExecutorID, reason)
+	markExecutorTaskRejected(et, reason)
+	_, err = store.AtomicPutExecutorTask(ctx, s.e, et)
+	return err
+}
+
+// markExecutorTaskRejected sets the executor task as failed with the reason
+// it was rejected by the executor
+func markExecutorTaskRejected(et *types.ExecutorTask, reason string) {
+	et.Status.Phase = types.ExecutorTaskPhaseFailed
+	et.Status.FailError = fmt.Sprintf("rejected by the executor: %s", reason)
+	et.Status.EndTime = util.TimeP(time.Now())
 }
 
 func (s *Runservice) compactChangeGroupsLoop(ctx context.Context) {
@@ -903,6 +966,10 @@ func (s *Runservice) fetchLog(ctx context.Context, rt *types.RunTask, setup bool
 		log.Warnf("executor with id %q doesn't exist. Skipping fetching", et.Spec.ExecutorID)
 		return nil
 	}
+	// the logs of a task not persisting them are gone when the task finishes
+	if et.Spec.ExecutorTaskSpecData != nil && et.Spec.NoLogPersist {
+		return nil
+	}
 
 	var logPath string
 	if setup {
@@ -924,14 +991,21 @@ func (s *Runservice) fetchLog(ctx context.Context, rt *types.RunTask, setup bool
 	} else {
 		u = fmt.Sprintf(executor.ListenURL+"/api/v1alpha/executor/logs?taskid=%s&step=%d", rt.ID, stepnum)
 	}
+	return s.fetchExecutorLog(u, logPath)
+}
+
+// fetchExecutorLog saves in the object storage at logPath the log fetched from
+// the executor at u. A log not found or gone, like the logs of a task not
+// persisting them, is considered fetched.
+func (s *Runservice) fetchExecutorLog(u, logPath string) error {
 	r, err := http.Get(u)
 	if err != nil {
 		return err
 	}
 	defer r.Body.Close()
 
-	// ignore if not found
-	if r.StatusCode == http.StatusNotFound {
+	// ignore if not found or gone
+	if r.StatusCode == http.StatusNotFound || r.StatusCode == http.StatusGone {
 		return nil
 	}
 	if r.StatusCode != http.StatusOK {
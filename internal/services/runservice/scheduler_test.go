@@ -16,10 +16,17 @@ package runservice
 
 import (
 	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"sort"
 	"testing"
 	"time"
 
+	"agola.io/agola/internal/objectstorage"
 	"agola.io/agola/services/runservice/types"
 	ctypes "agola.io/agola/services/types"
 	"github.com/google/go-cmp/cmp"
@@ -702,3 +709,200 @@ func TestChooseExecutor(t *testing.T) {
 		})
 	}
 }
+
+func TestFetchExecutorLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		fetched bool
+		err     bool
+	}{
+		{
+			name:    "test log fetched",
+			status:  http.StatusOK,
+			body:    "log content\n",
+			fetched: true,
+		},
+		{
+			name:   "test log not found",
+			status: http.StatusNotFound,
+		},
+		{
+			name:   "test log gone since the task doesn't persist its logs",
+			status: http.StatusGone,
+		},
+		{
+			name:   "test executor error",
+			status: http.StatusInternalServerError,
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "agola")
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			ost, err := objectstorage.NewPosix(dir)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			s := &Runservice{ost: objectstorage.NewObjStorage(ost, "/")}
+
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer ts.Close()
+
+			logPath := "logs/task01/steps/0.log"
+			err = s.fetchExecutorLog(ts.URL, logPath)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected err, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			exists, err := s.OSTFileExists(logPath)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if exists != tt.fetched {
+				t.Fatalf("expected log saved %t, got %t", tt.fetched, exists)
+			}
+			if !tt.fetched {
+				return
+			}
+			f, err := s.ost.ReadObject(logPath)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			defer f.Close()
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if string(data) != tt.body {
+				t.Fatalf("expected log %q, got %q", tt.body, data)
+			}
+		})
+	}
+}
+
+func TestPostExecutorTask(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		rejected bool
+		reason   string
+		err      bool
+	}{
+		{
+			name:   "test task accepted",
+			status: http.StatusOK,
+		},
+		{
+			name:     "test task denied by the executor admission",
+			status:   http.StatusForbidden,
+			body:     `{"code":"forbidden","message":"image registry not allowed","taskid":"task01"}`,
+			rejected: true,
+			reason:   "image registry not allowed",
+		},
+		{
+			name:     "test invalid task",
+			status:   http.StatusBadRequest,
+			body:     `{"code":"invalidtask","message":"invalid working dir","taskid":"task01"}`,
+			rejected: true,
+			reason:   "invalid working dir",
+		},
+		{
+			name:     "test invalid task without error message",
+			status:   http.StatusBadRequest,
+			rejected: true,
+			reason:   "Bad Request",
+		},
+		{
+			name:   "test executor not ready",
+			status: http.StatusServiceUnavailable,
+			body:   `{"code":"unavailable","message":"executor not ready"}`,
+			err:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer ts.Close()
+
+			err := postExecutorTask(ts.URL, []byte(`{"id":"task01"}`))
+			var rerr *executorTaskRejectedError
+			rejected := errors.As(err, &rerr)
+			if rejected != tt.rejected {
+				t.Fatalf("expected rejected %t, got err: %v", tt.rejected, err)
+			}
+			if rejected {
+				if rerr.reason != tt.reason {
+					t.Fatalf("expected reason %q, got %q", tt.reason, rerr.reason)
+				}
+				return
+			}
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected err, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+		})
+	}
+}
+
+func TestMarkExecutorTaskRejected(t *testing.T) {
+	et := &types.ExecutorTask{
+		ID: "task01",
+		Status: types.ExecutorTaskStatus{
+			Phase: types.ExecutorTaskPhaseNotStarted,
+			Steps: []*types.ExecutorTaskStepStatus{{Phase: types.ExecutorTaskPhaseNotStarted}},
+		},
+	}
+	markExecutorTaskRejected(et, "image registry not allowed")
+
+	if et.Status.Phase != types.ExecutorTaskPhaseFailed {
+		t.Fatalf("expected phase %q, got %q", types.ExecutorTaskPhaseFailed, et.Status.Phase)
+	}
+	if et.Status.FailError != "rejected by the executor: image registry not allowed" {
+		t.Fatalf("unexpected fail error %q", et.Status.FailError)
+	}
+	if et.Status.EndTime == nil {
+		t.Fatalf("expected end time")
+	}
+
+	// the run task fails
+	r := &types.Run{
+		ID: "run01",
+		Tasks: map[string]*types.RunTask{
+			"task01": {ID: "task01", Status: types.RunTaskStatusNotStarted, Steps: []*types.RunTaskStep{{}}},
+		},
+	}
+	s := &Runservice{}
+	if err := s.updateRunTaskStatus(context.Background(), et, r); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if r.Tasks["task01"].Status != types.RunTaskStatusFailed {
+		t.Fatalf("expected run task status %q, got %q", types.RunTaskStatusFailed, r.Tasks["task01"].Status)
+	}
+}
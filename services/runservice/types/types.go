@@ -407,15 +407,156 @@ type Steps []Step
 type BaseStep struct {
 	Type string `json:"type,omitempty"`
 	Name string `json:"name,omitempty"`
+
+	// When defines when the step should be executed based on the result of
+	// the previous steps. Defaults to StepWhenOnSuccess
+	When StepWhen `json:"when,omitempty"`
+
+	// Retry, when defined, re-executes the step when it fails
+	Retry *StepRetry `json:"retry,omitempty"`
+}
+
+// StepRetry defines how a failed step is retried
+type StepRetry struct {
+	// MaxAttempts is the max number of step executions, including the first one
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// Backoff is the wait before the first retry. It's doubled at every retry
+	Backoff time.Duration `json:"backoff,omitempty"`
+	// ExitCodes are the step exit codes causing a retry. When empty the step
+	// is retried on any non zero exit code
+	ExitCodes []int `json:"exit_codes,omitempty"`
+}
+
+// ShouldRetry reports if a step that exited with exitCode at the provided
+// attempt (starting from 1) should be retried
+func (r *StepRetry) ShouldRetry(attempt, exitCode int) bool {
+	if r == nil || exitCode == 0 || attempt >= r.MaxAttempts {
+		return false
+	}
+	if len(r.ExitCodes) == 0 {
+		return true
+	}
+	for _, c := range r.ExitCodes {
+		if c == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryBackoff returns the wait before the provided retry (starting from 1)
+func (r *StepRetry) RetryBackoff(retry int) time.Duration {
+	d := r.Backoff
+	for i := 1; i < retry && d < time.Hour; i++ {
+		d *= 2
+	}
+	return d
+}
+
+type StepWhen string
+
+const (
+	// StepWhenOnSuccess executes the step only if all the previous steps succeeded
+	StepWhenOnSuccess StepWhen = "on_success"
+	// StepWhenOnFailure executes the step only if a previous step failed
+	StepWhenOnFailure StepWhen = "on_failure"
+	// StepWhenAlways always executes the step
+	StepWhenAlways StepWhen = "always"
+)
+
+// ShouldRun reports if a step with this condition should be executed given
+// the accumulated task state
+func (w StepWhen) ShouldRun(failed bool) bool {
+	switch w {
+	case StepWhenAlways:
+		return true
+	case StepWhenOnFailure:
+		return failed
+	default:
+		return !failed
+	}
 }
 
 type RunStep struct {
 	BaseStep
 	Command     string            `json:"command,omitempty"`
 	Environment map[string]string `json:"environment,omitempty"`
-	WorkingDir  string            `json:"working_dir,omitempty"`
-	Shell       string            `json:"shell,omitempty"`
-	Tty         *bool             `json:"tty,omitempty"`
+	// WorkingDir overrides the task working dir. A relative path is resolved
+	// relative to the task working dir. It'll be created if it doesn't exist.
+	WorkingDir string `json:"working_dir,omitempty"`
+	// Shell is the shell, with its arguments separated by spaces, executing
+	// the command. It defaults to the task shell or to "/bin/sh -e". With -e
+	// the shell exits at the first failed command so a failure in the middle
+	// of a script isn't ignored, but the failures of the commands in a
+	// pipeline, except the last one, are still ignored: use a shell
+	// supporting "-o pipefail" to detect them
+	Shell string `json:"shell,omitempty"`
+	// ShellArgs, when defined, replace the arguments of the shell, e.g. a
+	// "/bin/bash" shell with ["-euo", "pipefail"]. Unlike the arguments in
+	// Shell they can contain spaces
+	ShellArgs []string `json:"shell_args,omitempty"`
+	Tty       *bool    `json:"tty,omitempty"`
+	// OutputEncoding is the encoding of the commands output, like
+	// "windows-1252", converted to UTF-8 in the step logs. Empty means that
+	// the output is already UTF-8
+	OutputEncoding string `json:"output_encoding,omitempty"`
+
+	// Ulimits are the resource limits, by name (like "nofile" or "nproc"), of
+	// the command, or sub steps commands, processes. They cannot exceed the
+	// executor max step ulimits
+	Ulimits map[string]Ulimit `json:"ulimits,omitempty"`
+
+	// CaptureCommands records in the step log where every command of Command
+	// starts and ends, with its exit code, so the log can be grouped by
+	// command. Command must be a POSIX shell script. It cannot be used with
+	// Parallel
+	CaptureCommands bool `json:"capture_commands,omitempty"`
+
+	// Interpolate enables, before executing them, the replacement in the
+	// command and sub steps commands of the $NAME and ${NAME} references with
+	// the step environment and the executor provided variables. $$ is replaced
+	// by a literal $. A $ not followed by a variable name is kept as is.
+	Interpolate bool `json:"interpolate,omitempty"`
+
+	// FailOnLogPatterns are regular expressions matched against every line of
+	// the command, or sub steps commands, output. If one of them matches the
+	// step fails also if the command exit code is 0
+	FailOnLogPatterns []string `json:"fail_on_log_patterns,omitempty"`
+
+	// Parallel, when defined, are sub steps executed concurrently in the main
+	// container instead of Command. The step fails if any of them fails
+	Parallel []*RunSubstep `json:"parallel,omitempty"`
+}
+
+// Ulimit is a resource limit. -1 means unlimited
+type Ulimit struct {
+	Soft int64 `json:"soft"`
+	Hard int64 `json:"hard"`
+}
+
+type RunSubstep struct {
+	Name    string `json:"name,omitempty"`
+	Command string `json:"command,omitempty"`
+	// Environment overrides the run step environment
+	Environment map[string]string `json:"environment,omitempty"`
+}
+
+// StepBase returns the BaseStep of the provided step or nil if the step type
+// is unknown
+func StepBase(step Step) *BaseStep {
+	switch s := step.(type) {
+	case *RunStep:
+		return &s.BaseStep
+	case *SaveToWorkspaceStep:
+		return &s.BaseStep
+	case *RestoreWorkspaceStep:
+		return &s.BaseStep
+	case *SaveCacheStep:
+		return &s.BaseStep
+	case *RestoreCacheStep:
+		return &s.BaseStep
+	}
+	return nil
 }
 
 type SaveContent struct {
@@ -427,6 +568,9 @@ type SaveContent struct {
 type SaveToWorkspaceStep struct {
 	BaseStep
 	Contents []SaveContent `json:"contents,omitempty"`
+	// Metadata are labels (like the commit sha or the build number) stored
+	// with the archive and returned by the executor archives api
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type RestoreWorkspaceStep struct {
@@ -438,6 +582,8 @@ type SaveCacheStep struct {
 	BaseStep
 	Key      string        `json:"key,omitempty"`
 	Contents []SaveContent `json:"contents,omitempty"`
+	// Metadata are labels stored with the cache archive
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 type RestoreCacheStep struct {
@@ -455,10 +601,20 @@ const (
 	ExecutorTaskPhaseStopped    ExecutorTaskPhase = "stopped"
 	ExecutorTaskPhaseSuccess    ExecutorTaskPhase = "success"
 	ExecutorTaskPhaseFailed     ExecutorTaskPhase = "failed"
+	// ExecutorTaskPhaseTimedOut is used only for steps interrupted or never
+	// started because the task timeout expired
+	ExecutorTaskPhaseTimedOut ExecutorTaskPhase = "timedout"
+	// ExecutorTaskPhaseSkipped is used only for steps not executed since their
+	// when condition wasn't satisfied or, with fail fast, since a previous
+	// step failed
+	ExecutorTaskPhaseSkipped ExecutorTaskPhase = "skipped"
+	// ExecutorTaskPhasePaused is used only for the step running when the task
+	// has been paused
+	ExecutorTaskPhasePaused ExecutorTaskPhase = "paused"
 )
 
 func (s ExecutorTaskPhase) IsFinished() bool {
-	return s == ExecutorTaskPhaseCancelled || s == ExecutorTaskPhaseStopped || s == ExecutorTaskPhaseSuccess || s == ExecutorTaskPhaseFailed
+	return s == ExecutorTaskPhaseCancelled || s == ExecutorTaskPhaseStopped || s == ExecutorTaskPhaseSuccess || s == ExecutorTaskPhaseFailed || s == ExecutorTaskPhaseTimedOut || s == ExecutorTaskPhaseSkipped
 }
 
 type ExecutorTask struct {
@@ -503,6 +659,64 @@ type ExecutorTaskSpecData struct {
 	User        string            `json:"user,omitempty"`
 	Privileged  bool              `json:"privileged"`
 
+	// Priority defines the start order of the tasks waiting for the executor
+	// to have room for new active tasks. Higher priority tasks start first
+	Priority int `json:"priority,omitempty"`
+
+	// ConcurrencyGroup, when defined, serializes on the executor the tasks with
+	// the same concurrency group, like the ones using an exclusive local
+	// resource. A task waits in the executor queue until the running task of
+	// its group finishes
+	ConcurrencyGroup string `json:"concurrency_group,omitempty"`
+
+	// Labels are arbitrary task labels used to select the tasks in the
+	// executor api, like when cancelling many tasks at once
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Timeout is the max duration of the whole task execution (setup and all
+	// the steps). When it expires the current step is stopped and all the
+	// remaining steps are marked as timed out. 0 means no timeout.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	// StopGracePeriod, when defined, overrides the executor stop grace period:
+	// the time the task processes have to exit, after the SIGTERM, when the
+	// task is stopped or timed out. 0 kills them immediately
+	StopGracePeriod *time.Duration `json:"stop_grace_period,omitempty"`
+
+	// DNSServers are custom dns servers used by the task pod instead of the
+	// default ones
+	DNSServers []string `json:"dns_servers,omitempty"`
+	// ExtraHosts are additional hostname to ip mappings added to the task pod
+	// hosts file
+	ExtraHosts []ExtraHost `json:"extra_hosts,omitempty"`
+	// NetworkMode is the task pod network mode: none, bridge, host or the name
+	// of a custom network. If empty the driver default is used
+	NetworkMode string `json:"network_mode,omitempty"`
+
+	// Proxy overrides the executor proxy configuration
+	Proxy *Proxy `json:"proxy,omitempty"`
+
+	// NoLogPersist, when true, keeps the step logs only in memory while the
+	// task is running. They're discarded when the task finishes
+	NoLogPersist bool `json:"no_log_persist,omitempty"`
+
+	// CABundle are additional PEM encoded CA certificates injected in the task
+	// containers together with the executor CA bundle
+	CABundle string `json:"ca_bundle,omitempty"`
+
+	// SecretFiles are files, like ssh keys or kubeconfigs, written in the main
+	// container only while every run step is executed
+	SecretFiles []SecretFile `json:"secret_files,omitempty"`
+
+	// RedactionRules are applied to the steps output before it's saved in the
+	// logs, after masking the secret files
+	RedactionRules []RedactionRule `json:"redaction_rules,omitempty"`
+
+	// FailFast, when true, stops the task at the first failed step: the
+	// running parallel sub steps of the step are cancelled and all the
+	// remaining steps, also the ones that should run on failure, are skipped
+	FailFast bool `json:"fail_fast,omitempty"`
+
 	WorkspaceOperations []WorkspaceOperation `json:"workspace_operations,omitempty"`
 
 	DockerRegistriesAuth map[string]DockerRegistryAuth `json:"docker_registries_auth"`
@@ -520,31 +734,106 @@ type ExecutorTaskStatus struct {
 
 	Phase ExecutorTaskPhase `json:"phase,omitempty"`
 
+	// Attempt is the executor attempt of this task execution. Logs of previous
+	// attempts are kept by the executor
+	Attempt int `json:"attempt,omitempty"`
+
+	// Paused is true when the task pod has been paused. The task phase stays
+	// running while paused
+	Paused bool `json:"paused,omitempty"`
+
 	FailError string `json:"fail_error,omitempty"`
 
+	// FailFastReason is the failure that, with fail fast, cancelled the
+	// remaining task steps
+	FailFastReason string `json:"fail_fast_reason,omitempty"`
+
 	SetupStep ExecutorTaskStepStatus    `json:"setup_step,omitempty"`
 	Steps     []*ExecutorTaskStepStatus `json:"steps,omitempty"`
 
 	StartTime *time.Time `json:"start_time,omitempty"`
 	EndTime   *time.Time `json:"end_time,omitempty"`
+
+	// Deadline is the time when the task timeout will expire
+	Deadline *time.Time `json:"deadline,omitempty"`
+	// RemainingTime is the remaining time before the task timeout expires. It's
+	// updated every time the status is sent
+	RemainingTime *time.Duration `json:"remaining_time,omitempty"`
+
+	// DNSServers and ExtraHosts are the effective dns servers and extra hosts
+	// configured in the task pod
+	DNSServers []string    `json:"dns_servers,omitempty"`
+	ExtraHosts []ExtraHost `json:"extra_hosts,omitempty"`
+	// NetworkMode is the effective task pod network mode
+	NetworkMode string `json:"network_mode,omitempty"`
+	// ContainerImages are the references of the pulled task containers images
+	ContainerImages []string `json:"container_images,omitempty"`
+}
+
+type Proxy struct {
+	HTTPProxy  string `json:"http_proxy,omitempty"`
+	HTTPSProxy string `json:"https_proxy,omitempty"`
+	NoProxy    string `json:"no_proxy,omitempty"`
+}
+
+type ExtraHost struct {
+	Hostname string `json:"hostname,omitempty"`
+	IP       string `json:"ip,omitempty"`
 }
 
 type ExecutorTaskStepStatus struct {
 	Phase ExecutorTaskPhase `json:"phase,omitempty"`
 
+	// WorkingDir is the effective (expanded) working dir used by a run step
+	WorkingDir string `json:"working_dir,omitempty"`
+
+	StartTime *time.Time `json:"start_time,omitempty"`
+	EndTime   *time.Time `json:"end_time,omitempty"`
+
+	ExitStatus *int `json:"exit_status,omitempty"`
+
+	// Attempts is the number of executions of a step with a retry defined
+	Attempts int `json:"attempts,omitempty"`
+
+	// FailedLogPattern is the fail on log pattern that matched the output of
+	// a run step
+	FailedLogPattern string `json:"failed_log_pattern,omitempty"`
+
+	// Ulimits are the resource limits applied to the run step processes
+	Ulimits map[string]Ulimit `json:"ulimits,omitempty"`
+
+	// Substeps are the statuses of the run step parallel sub steps
+	Substeps []*ExecutorTaskSubstepStatus `json:"substeps,omitempty"`
+}
+
+type ExecutorTaskSubstepStatus struct {
+	Name  string            `json:"name,omitempty"`
+	Phase ExecutorTaskPhase `json:"phase,omitempty"`
+
 	StartTime *time.Time `json:"start_time,omitempty"`
 	EndTime   *time.Time `json:"end_time,omitempty"`
 
 	ExitStatus *int `json:"exit_status,omitempty"`
+
+	// FailedLogPattern is the fail on log pattern that matched the sub step
+	// output
+	FailedLogPattern string `json:"failed_log_pattern,omitempty"`
 }
 
 type Container struct {
+	// Name is the name of a service container, all the containers except the
+	// first one, used to get its log. Defaults to "service<index>"
+	Name        string            `json:"name,omitempty"`
 	Image       string            `json:"image,omitempty"`
 	Environment map[string]string `json:"environment,omitempty"`
 	User        string            `json:"user,omitempty"`
 	Privileged  bool              `json:"privileged"`
 	Entrypoint  string            `json:"entrypoint"`
 	Volumes     []Volume          `json:"volumes"`
+	// ReadOnlyRootFS mounts the container root filesystem read-only, only
+	// its volumes are writable. For the main container, where the steps are
+	// executed, a tmpfs is also mounted on /tmp
+	ReadOnlyRootFS bool `json:"read_only_rootfs,omitempty"`
 }
 
 type Volume struct {
@@ -557,6 +846,24 @@ type VolumeTmpFS struct {
 	Size int64 `json:"size"`
 }
 
+// RedactionRule replaces in every step output line the matches of Regex
+type RedactionRule struct {
+	// Regex is a go regular expression not matching the empty string
+	Regex string `json:"regex,omitempty"`
+	// Replacement can reference the submatches using the go regexp Expand
+	// syntax (i.e. "$1" or "${name}")
+	Replacement string `json:"replacement,omitempty"`
+}
+
+type SecretFile struct {
+	// Path is the absolute path of the file in the main container
+	Path string `json:"path,omitempty"`
+	// Mode is the file permissions mode. Defaults to 0400
+	Mode uint32 `json:"mode,omitempty"`
+	// Content is the base64 encoded file content
+	Content string `json:"content,omitempty"`
+}
+
 type WorkspaceOperation struct {
 	TaskID    string `json:"task_id,omitempty"`
 	Step      int    `json:"step,omitempty"`
@@ -264,6 +264,7 @@ func setup(ctx context.Context, t *testing.T, dir string) (*testutil.TestEmbedde
 			},
 			Labels:           map[string]string{},
 			ActiveTasksLimit: 2,
+			FileMode:         "0660",
 		},
 		Configstore: config.Configstore{
 			Debug:   false,